@@ -37,17 +37,18 @@ for arg; do
 done
 
 
+# Search needs SQLite built with FTS5.
 pushd libzif
-go install $VERBOSE
+go install $VERBOSE -tags sqlite_fts5
 
 pushd data
-go install $VERBOSE
+go install $VERBOSE -tags sqlite_fts5
 
 popd
 popd
 
 pushd zifd
-go install $VERBOSE
+go install $VERBOSE -tags sqlite_fts5
 popd
 
 if [ $NONPMINS -eq 0 ]; then
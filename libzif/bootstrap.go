@@ -0,0 +1,281 @@
+// Joining the network needs at least one peer that is already on it. The
+// bootstrap list is a file of such peers, which is tried on startup and
+// whenever the routing table empties. Nodes we bootstrap from successfully, from
+// the list or because we were asked to, are added to it, so the list keeps
+// itself fresh. Peers found any other way are not.
+
+package libzif
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Used when a host is given without a port.
+	DefaultPort = 5050
+	// The most nodes the bootstrap list keeps, the least recently seen are
+	// dropped first.
+	BootstrapListMax = 64
+	// How often to check if the routing table has emptied.
+	BootstrapCheckInterval = time.Minute
+)
+
+type BootstrapNode struct {
+	// host:port, the port is optional.
+	Host string `json:"host"`
+	// Optional. If set, the peer at Host must have this Zif address or it is
+	// not trusted. Nodes we add ourselves are pinned to the address they had
+	// the first time we saw them.
+	Address  string `json:"address,omitempty"`
+	LastSeen int64  `json:"lastSeen,omitempty"`
+}
+
+type BootstrapList struct {
+	path string
+
+	mutex sync.Mutex
+	nodes []BootstrapNode
+	// Set when nodes has changed since it was last saved.
+	dirty bool
+}
+
+// Adds the default port to a host if it does not have one.
+func HostPort(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(DefaultPort))
+}
+
+// Load a bootstrap list from the given path. If the file does not exist then
+// an empty list is returned, along with the error.
+func LoadBootstrapList(path string) (*BootstrapList, error) {
+	bl := &BootstrapList{path: path, nodes: make([]BootstrapNode, 0)}
+
+	dat, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return bl, err
+	}
+
+	err = json.Unmarshal(dat, &bl.nodes)
+
+	return bl, err
+}
+
+func (bl *BootstrapList) save() error {
+	dat, err := json.MarshalIndent(bl.nodes, "", "\t")
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(bl.path, dat, 0644)
+}
+
+func (bl *BootstrapList) List() []BootstrapNode {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	ret := make([]BootstrapNode, len(bl.nodes))
+	copy(ret, bl.nodes)
+
+	return ret
+}
+
+// Record that we have successfully bootstrapped from the peer at host, with the
+// given Zif address. This is not saved until Save is called, so that many nodes
+// can be recorded at once.
+func (bl *BootstrapList) Seen(host, address string) {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	host = HostPort(host)
+	now := time.Now().Unix()
+	found := false
+
+	for n, i := range bl.nodes {
+		if HostPort(i.Host) == host {
+			if i.Address == "" {
+				bl.nodes[n].Address = address
+			}
+
+			bl.nodes[n].LastSeen = now
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		bl.nodes = append(bl.nodes, BootstrapNode{host, address, now})
+	}
+
+	if len(bl.nodes) > BootstrapListMax {
+		sort.Slice(bl.nodes, func(i, j int) bool {
+			return bl.nodes[i].LastSeen > bl.nodes[j].LastSeen
+		})
+
+		bl.nodes = bl.nodes[:BootstrapListMax]
+	}
+
+	bl.dirty = true
+}
+
+// Write the list out, if anything has been seen since it was last written.
+func (bl *BootstrapList) Save() error {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	if !bl.dirty {
+		return nil
+	}
+
+	bl.dirty = false
+
+	return bl.save()
+}
+
+// Connect to the peer at host, check it is who we expect if address is set,
+// then fill our routing table from it.
+func (lp *LocalPeer) BootstrapPeer(host, address string) error {
+	_, err := lp.bootstrapPeer(host, address)
+
+	return err
+}
+
+// Bootstrap from the peer at host, and add it to the bootstrap list.
+func (lp *LocalPeer) AddBootstrapPeer(host string) error {
+	address, err := lp.bootstrapPeer(host, "")
+
+	if err != nil || lp.BootstrapList == nil {
+		return err
+	}
+
+	lp.BootstrapList.Seen(host, address)
+
+	return lp.BootstrapList.Save()
+}
+
+// As BootstrapPeer, returning the Zif address of the peer at host.
+func (lp *LocalPeer) bootstrapPeer(host, address string) (string, error) {
+	host = HostPort(host)
+
+	var peer *Peer
+
+	if zif, ok := lp.PublicToZif.Get(host); ok {
+		peer = lp.GetPeer(zif.(string))
+	}
+
+	if peer == nil {
+		var err error
+		peer, err = lp.ConnectPeerDirect(host)
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if address != "" && peer.Address().String() != address {
+		peer.Terminate()
+		lp.Peers.Remove(peer.Address().String())
+		lp.PublicToZif.Remove(host)
+		return "", errors.New("Bootstrap peer at " + host + " is not " + address)
+	}
+
+	stream, err := peer.Bootstrap(lp.DHT)
+
+	if stream != nil {
+		stream.Close()
+	}
+
+	return peer.Address().String(), err
+}
+
+// Try every node in the bootstrap list at once. Returns the number that
+// succeeded, and an error if none did.
+func (lp *LocalPeer) BootstrapAll() (int, error) {
+	if lp.BootstrapList == nil {
+		return 0, errors.New("No bootstrap list loaded")
+	}
+
+	nodes := lp.BootstrapList.List()
+
+	if len(nodes) == 0 {
+		return 0, errors.New("Bootstrap list is empty")
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	succeeded := 0
+
+	for _, i := range nodes {
+		wg.Add(1)
+
+		go func(node BootstrapNode) {
+			defer wg.Done()
+
+			address, err := lp.bootstrapPeer(node.Host, node.Address)
+
+			if err != nil {
+				log.WithField("host", node.Host).Info("Bootstrap failed: ", err.Error())
+				return
+			}
+
+			lp.BootstrapList.Seen(node.Host, address)
+
+			mutex.Lock()
+			succeeded++
+			mutex.Unlock()
+		}(i)
+	}
+
+	wg.Wait()
+
+	if err := lp.BootstrapList.Save(); err != nil {
+		log.Error(err.Error())
+	}
+
+	log.WithFields(log.Fields{
+		"succeeded": succeeded,
+		"tried":     len(nodes),
+	}).Info("Bootstrap complete")
+
+	if succeeded == 0 {
+		return 0, errors.New("Failed to bootstrap from any node")
+	}
+
+	return succeeded, nil
+}
+
+// Bootstrap now, then again whenever the routing table is empty. This blocks,
+// so should be run in a goroutine.
+func (lp *LocalPeer) MaintainBootstrap() {
+	ticker := time.NewTicker(BootstrapCheckInterval)
+	defer ticker.Stop()
+
+	// Once there is a routing table, the peers closest to our old addresses
+	// can be told about them.
+	if _, err := lp.BootstrapAll(); err == nil {
+		lp.announceRetired()
+	}
+
+	for _ = range ticker.C {
+		if lp.DHT.TableLen() == 0 {
+			log.Info("Routing table is empty, bootstrapping")
+
+			if _, err := lp.BootstrapAll(); err == nil {
+				lp.announceRetired()
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package libzif
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestHostPort(t *testing.T) {
+	cases := map[string]string{
+		"example.com":      "example.com:5050",
+		"example.com:4000": "example.com:4000",
+		"127.0.0.1":        "127.0.0.1:5050",
+		"::1":              "[::1]:5050",
+		"[::1]:4000":       "[::1]:4000",
+	}
+
+	for in, want := range cases {
+		if got := HostPort(in); got != want {
+			t.Errorf("HostPort(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestBootstrapListSeen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zif-bootstrap")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "bootstrap.json")
+	bl, err := LoadBootstrapList(path)
+
+	if !os.IsNotExist(err) {
+		t.Fatal("Expected missing file error")
+	}
+
+	bl.Seen("example.com", "first")
+	bl.Seen("example.com:5050", "second")
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Bootstrap list saved before Save")
+	}
+
+	if err := bl.Save(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	nodes := bl.List()
+
+	if len(nodes) != 1 {
+		t.Fatal("Same host added twice")
+	}
+
+	if nodes[0].Address != "first" {
+		t.Error("Pinned address was replaced")
+	}
+
+	loaded, err := LoadBootstrapList(path)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(loaded.List()) != 1 {
+		t.Error("Bootstrap list not saved")
+	}
+
+	for i := 0; i < BootstrapListMax+10; i++ {
+		bl.Seen("10.0.0."+strconv.Itoa(i), "")
+	}
+
+	if len(bl.List()) != BootstrapListMax {
+		t.Error("Bootstrap list not trimmed")
+	}
+}
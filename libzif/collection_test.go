@@ -1,7 +1,106 @@
 package libzif
 
-import "testing"
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/wjh/zif/libzif/data"
+)
 
 func TestHash(t *testing.T) {
 
 }
+
+func TestCheckedPiecePosts(t *testing.T) {
+	lp, done := federatedPeer(t)
+	defer done()
+
+	mirror, _ := lp.Databases.Get("mirror-a")
+	db := mirror.(data.PostStore)
+
+	posts := make([]data.Post, 0, data.PieceSize+5)
+
+	for i := 0; i < data.PieceSize+5; i++ {
+		posts = append(posts, data.Post{InfoHash: fmt.Sprintf("a%039x", i), Title: fmt.Sprintf("Post %d", i)})
+	}
+
+	insertFederated(t, db, posts...)
+
+	col, err := data.CreateCollection(db, 0, data.PieceSize)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	count := func() int {
+		n := 0
+
+		for range checkedPiecePosts(db, col.PieceHashes(), 0, 2) {
+			n++
+		}
+
+		return n
+	}
+
+	if n := count(); n != data.PieceSize+5 {
+		t.Fatalf("%d posts served, want %d", n, data.PieceSize+5)
+	}
+
+	// Changing a post in the last piece stops it being served, but not the
+	// pieces before it.
+	last, _ := db.QueryPostId(data.PieceSize + 2)
+
+	if err := db.AddMeta(last.Id, "lang", "en"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if n := count(); n != data.PieceSize {
+		t.Errorf("%d posts served from a changed mirror, want %d", n, data.PieceSize)
+	}
+}
+
+func TestCheckCollection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zif-collection")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+	os.Mkdir("data", 0777)
+
+	lp, done := snapshotPeer(t)
+	defer done()
+
+	before := append([]byte{}, lp.Collection.HashList...)
+
+	if err := lp.CheckCollection(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !bytes.Equal(before, lp.Collection.HashList) {
+		t.Error("Collection changed when it matched the database")
+	}
+
+	// As if a migration had changed a post.
+	if err := lp.Database.AddMeta(1, "lang", "en"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := lp.CheckCollection(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	saved, _ := ioutil.ReadFile("./data/collection.dat")
+
+	if bytes.Equal(before, lp.Collection.HashList) || !bytes.Equal(saved, lp.Collection.HashList) {
+		t.Error("Collection not rebuilt")
+	}
+}
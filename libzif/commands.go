@@ -30,6 +30,10 @@ type CommandRSearch struct {
 	Page  int    `json:"page"`
 }
 type CommandPeerSearch CommandRSearch
+type CommandPostProof struct {
+	CommandPeer
+	InfoHash string `json:"infoHash"`
+}
 type CommandPeerRecent struct {
 	CommandPeer
 	Page int `json:"page"`
@@ -47,11 +51,64 @@ type CommandMeta struct {
 
 type CommandAddPost struct {
 	data.Post
-	Index bool
 }
+type CommandEditPost CommandAddPost
+type CommandDeletePost struct {
+	InfoHash string `json:"infoHash"`
+}
+
+// A .torrent file, base64 encoded in JSON. Tags are added to the post made
+// from it.
+type CommandAddTorrent struct {
+	Torrent []byte `json:"torrent"`
+	Tags    string `json:"tags"`
+}
+
+// Title is used when the link has no name.
+type CommandAddMagnet struct {
+	Magnet string `json:"magnet"`
+	Title  string `json:"title"`
+	Tags   string `json:"tags"`
+}
+type CommandMagnet struct {
+	InfoHash string `json:"infoHash"`
+}
+
+// Imports a dump of posts, see LocalPeer.ImportPosts.
+type CommandImport struct {
+	data.ImportOptions
+	Reader io.Reader `json:"-"`
+	// If set, progress is sent here as the import goes on.
+	Updates chan<- data.ImportProgress `json:"-"`
+}
+
+// Exports the posts of our database, or of a mirror, see data.ExportPosts.
+type CommandExport struct {
+	// Empty for our own database.
+	Address string `json:"address"`
+	data.ExportOptions
+	Writer io.Writer `json:"-"`
+}
+
+// Writes a snapshot of our posts, or of a mirror, see WriteSnapshot.
+type CommandSnapshot struct {
+	// Empty for our own posts.
+	Address string    `json:"address"`
+	Writer  io.Writer `json:"-"`
+}
+
+// A snapshot file to import or verify.
+type CommandImportSnapshot struct {
+	Path string `json:"path"`
+}
+type CommandVerifySnapshot CommandImportSnapshot
 type CommandSelfIndex struct {
 	Since int `json:"since"`
 }
+
+// An empty address is our own database.
+type CommandRebuildIndex CommandPeer
+type CommandCheckIndex struct{}
 type CommandResolve CommandPeer
 type CommandBootstrap CommandPeer
 
@@ -63,19 +120,77 @@ type CommandSelfSearch struct {
 	CommandSuggest
 	Page int `json:"page"`
 }
+type CommandFederatedSearch CommandSelfSearch
+type CommandFanOutSearch struct {
+	CommandSuggest
+	Page int `json:"page"`
+	// Addresses of the peers to search, every connected peer if empty.
+	Peers []string `json:"peers"`
+	// In seconds, FanOutTimeout if zero.
+	Timeout int `json:"timeout"`
+	// If set, progress is sent here as the search goes on, see FanOutSearch.
+	Updates chan<- FanOutUpdate `json:"-"`
+}
 type CommandSelfRecent struct {
 	Page int `json:"page"`
 }
 type CommandSelfPopular CommandSelfRecent
 type CommandAddMeta struct {
 	CommandMeta
+	Key   string `json:"key"`
 	Value string `json:"value"`
 }
+
+// If Value is empty then every value for Key is removed.
+type CommandRemoveMeta CommandAddMeta
 type CommandGetMeta CommandMeta
 type CommandSaveCollection interface{}
 type CommandRebuildCollection interface{}
+type CommandTombstones interface{}
 type CommandPeers interface{}
 type CommandSaveRoutingTable interface{}
+type CommandBans interface{}
+type CommandDhtInfo interface{}
+type CommandDhtLookups interface{}
+
+type CommandDhtClosest struct {
+	CommandPeer
+	Count int `json:"count"`
+}
+
+// Format is either "json" or "dot".
+type CommandDhtExport struct {
+	Format string `json:"format"`
+}
+
+type CommandBan struct {
+	CommandPeer
+	// In seconds, if zero then the default ban duration is used.
+	Duration int    `json:"duration"`
+	Reason   string `json:"reason"`
+}
+type CommandUnban CommandPeer
+
+type CommandIdentities interface{}
+type CommandSchemaVersion interface{}
+
+type CommandPublishers struct {
+	InfoHash string `json:"infohash"`
+}
+
+// Current is the passphrase our identity file uses, and must be given. The
+// exported identity is encrypted with Passphrase, which need not be the same.
+type CommandIdentityExport struct {
+	Current    string `json:"current"`
+	Passphrase string `json:"passphrase"`
+}
+
+// Passphrase decrypts Armour. The imported identity is stored with our own
+// passphrase.
+type CommandIdentityImport struct {
+	Armour     string `json:"armour"`
+	Passphrase string `json:"passphrase"`
+}
 
 // Used for setting values in the localpeer entry
 type CommandLocalSet struct {
@@ -89,6 +204,30 @@ type CommandLocalGet struct {
 
 // Command output types
 
+type DatabaseSchema struct {
+	// "self" for our own database, otherwise the address of the peer it is a
+	// mirror of.
+	Database string `json:"database"`
+	Path     string `json:"path"`
+	Version  int    `json:"version"`
+	Latest   int    `json:"latest"`
+	Error    string `json:"error,omitempty"`
+}
+
+type DatabaseIndex struct {
+	// As in DatabaseSchema.
+	Database string `json:"database"`
+	Ok       bool   `json:"ok"`
+	data.IndexCheck
+}
+
+type AddedTorrent struct {
+	Id     int64              `json:"id"`
+	Post   data.Post          `json:"post"`
+	Files  []data.TorrentFile `json:"files"`
+	Magnet string             `json:"magnet"`
+}
+
 type CommandResult struct {
 	IsOK   bool        `json:"status"`
 	Result interface{} `json:"value"`
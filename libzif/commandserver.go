@@ -1,14 +1,24 @@
 package libzif
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	data "github.com/wjh/zif/libzif/data"
+	"github.com/wjh/zif/libzif/dht"
+	"github.com/wjh/zif/libzif/proto"
+)
+
+// For commands that only some kinds of post store support.
+var (
+	errNoIndex  = errors.New("Database has no search index")
+	errNoSchema = errors.New("Database has no schema")
 )
 
 // Command server type
@@ -63,8 +73,9 @@ func (cs *CommandServer) RSearch(rs CommandRSearch) CommandResult {
 	peer := cs.LocalPeer.GetPeer(rs.CommandPeer.Address)
 
 	if peer == nil {
-		// Remote searching is not allowed to be done on seeds, it has no
-		// verification so can be falsified easily. Mirror people, mirror!
+		// Remote searching is not allowed to be done on seeds. Signed posts
+		// are verified, but unsigned ones can be falsified easily, and are
+		// only marked as unverified. Mirror people, mirror!
 		peer, err = cs.LocalPeer.ConnectPeer(rs.CommandPeer.Address)
 		if err != nil {
 			return CommandResult{false, nil, err}
@@ -79,6 +90,29 @@ func (cs *CommandServer) RSearch(rs CommandRSearch) CommandResult {
 
 	return CommandResult{err == nil, posts, err}
 }
+func (cs *CommandServer) PostProof(cpp CommandPostProof) CommandResult {
+	var err error
+
+	log.Info("Command: Post Proof request")
+
+	peer := cs.LocalPeer.GetPeer(cpp.CommandPeer.Address)
+
+	if peer == nil {
+		peer, err = cs.LocalPeer.ConnectPeer(cpp.CommandPeer.Address)
+
+		if err != nil {
+			return CommandResult{false, nil, err}
+		}
+	}
+
+	proof, stream, err := peer.PostProof(cpp.InfoHash)
+
+	if stream != nil {
+		defer stream.Close()
+	}
+
+	return CommandResult{err == nil, proof, err}
+}
 func (cs *CommandServer) PeerSearch(ps CommandPeerSearch) CommandResult {
 	var err error
 
@@ -90,7 +124,7 @@ func (cs *CommandServer) PeerSearch(ps CommandPeerSearch) CommandResult {
 
 	db, _ := cs.LocalPeer.Databases.Get(ps.CommandPeer.Address)
 
-	posts, err := cs.LocalPeer.SearchProvider.Search(ps.CommandPeer.Address, db.(*data.Database), ps.Query, ps.Page)
+	posts, err := cs.LocalPeer.SearchProvider.Search(ps.CommandPeer.Address, db.(data.PostStore), ps.Query, ps.Page)
 
 	return CommandResult{err == nil, posts, err}
 }
@@ -173,7 +207,7 @@ func (cs *CommandServer) Mirror(cm CommandMirror) CommandResult {
 
 	cs.LocalPeer.Databases.Set(peer.Address().String(), db)
 
-	_, err = peer.Mirror(db)
+	_, err = peer.Mirror(db, cs.LocalPeer)
 	if err != nil {
 		return CommandResult{false, nil, err}
 	}
@@ -193,7 +227,13 @@ func (cs *CommandServer) PeerIndex(ci CommandPeerIndex) CommandResult {
 	}
 
 	db, _ := cs.LocalPeer.Databases.Get(ci.CommandPeer.Address)
-	err = db.(*data.Database).GenerateFts(int64(ci.Since))
+	indexed, ok := db.(data.IndexedStore)
+
+	if !ok {
+		return CommandResult{false, nil, errNoIndex}
+	}
+
+	err = indexed.GenerateFts(int64(ci.Since))
 
 	return CommandResult{err == nil, nil, err}
 }
@@ -201,7 +241,27 @@ func (cs *CommandServer) PeerIndex(ci CommandPeerIndex) CommandResult {
 func (cs *CommandServer) AddPost(ap CommandAddPost) CommandResult {
 	log.Info("Command: Add Post request")
 
-	post := data.Post{ap.Id, ap.InfoHash, ap.Title, ap.Size, ap.FileCount, ap.Seeders, ap.Leechers, ap.UploadDate, ap.Tags, ap.Meta}
+	id, err := cs.LocalPeer.AddPost(ap.Post, false)
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	return CommandResult{true, id, nil}
+}
+
+// Post a torrent from its .torrent file.
+func (cs *CommandServer) AddTorrent(at CommandAddTorrent) CommandResult {
+	log.Info("Command: Add Torrent request")
+
+	t, err := data.ParseTorrent(at.Torrent)
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	post := t.Post()
+	post.Tags = at.Tags
 
 	id, err := cs.LocalPeer.AddPost(post, false)
 
@@ -209,16 +269,148 @@ func (cs *CommandServer) AddPost(ap CommandAddPost) CommandResult {
 		return CommandResult{false, nil, err}
 	}
 
-	if ap.Index {
-		cs.LocalPeer.Database.GenerateFts(id - 1)
+	return CommandResult{true, AddedTorrent{id, post, t.Files, t.Magnet().String()}, nil}
+}
+func (cs *CommandServer) AddMagnet(am CommandAddMagnet) CommandResult {
+	log.Info("Command: Add Magnet request")
+
+	m, err := data.ParseMagnet(am.Magnet)
+
+	if err != nil {
+		return CommandResult{false, nil, err}
 	}
 
-	return CommandResult{true, id, nil}
+	post := m.Post()
+	post.Tags = am.Tags
+
+	if post.Title == "" {
+		post.Title = am.Title
+	}
+
+	if post.Title == "" {
+		return CommandResult{false, nil, errors.New("Magnet link has no name, give a title")}
+	}
+
+	id, err := cs.LocalPeer.AddPost(post, false)
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	return CommandResult{true, AddedTorrent{id, post, []data.TorrentFile{}, m.String()}, nil}
+}
+
+// The magnet link for one of our posts.
+func (cs *CommandServer) Magnet(cm CommandMagnet) CommandResult {
+	log.Info("Command: Magnet request")
+
+	post, err := cs.LocalPeer.Database.QueryInfoHash(cm.InfoHash)
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	if post == nil {
+		return CommandResult{false, nil, errors.New("Post not found")}
+	}
+
+	return CommandResult{true, data.PostMagnet(post).String(), nil}
+}
+func (cs *CommandServer) Import(ci CommandImport) CommandResult {
+	log.Info("Command: Import request")
+
+	progress, err := cs.LocalPeer.ImportPosts(ci.Reader, ci.ImportOptions, ci.Updates)
+
+	return CommandResult{err == nil, progress, err}
+}
+
+// Our own database if address is empty or ours, otherwise a mirror's.
+func (cs *CommandServer) database(address string) (data.PostStore, error) {
+	if address == "" || address == cs.LocalPeer.Address().String() {
+		return cs.LocalPeer.Database, nil
+	}
+
+	db, ok := cs.LocalPeer.Databases.Get(address)
+
+	if !ok {
+		return nil, errors.New("Peer database not loaded.")
+	}
+
+	return db.(data.PostStore), nil
+}
+func (cs *CommandServer) Export(ce CommandExport) CommandResult {
+	log.Info("Command: Export request")
+
+	db, err := cs.database(ce.Address)
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	count, err := data.ExportPosts(db, ce.Writer, ce.ExportOptions)
+
+	return CommandResult{err == nil, count, err}
+}
+func (cs *CommandServer) Snapshot(csn CommandSnapshot) CommandResult {
+	log.Info("Command: Snapshot request")
+
+	info, err := cs.LocalPeer.WriteSnapshot(csn.Writer, csn.Address)
+
+	return CommandResult{err == nil, info, err}
+}
+func (cs *CommandServer) ImportSnapshot(cis CommandImportSnapshot) CommandResult {
+	log.Info("Command: Import Snapshot request")
+
+	info, err := cs.LocalPeer.ImportSnapshot(cis.Path)
+
+	return CommandResult{err == nil, info, err}
+}
+func (cs *CommandServer) VerifySnapshot(cvs CommandVerifySnapshot) CommandResult {
+	log.Info("Command: Verify Snapshot request")
+
+	file, err := os.Open(cvs.Path)
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	defer file.Close()
+
+	info, err := VerifySnapshot(file)
+
+	return CommandResult{err == nil, info, err}
+}
+func (cs *CommandServer) EditPost(ep CommandEditPost) CommandResult {
+	log.Info("Command: Edit Post request")
+
+	err := cs.LocalPeer.EditPost(ep.Post)
+
+	return CommandResult{err == nil, nil, err}
+}
+func (cs *CommandServer) DeletePost(dp CommandDeletePost) CommandResult {
+	log.Info("Command: Delete Post request")
+
+	err := cs.LocalPeer.DeletePost(dp.InfoHash)
+
+	return CommandResult{err == nil, nil, err}
+}
+func (cs *CommandServer) Tombstones(ct CommandTombstones) CommandResult {
+	log.Info("Command: Tombstones request")
+
+	tombstones, err := cs.LocalPeer.Database.QueryTombstones()
+
+	return CommandResult{err == nil, tombstones, err}
 }
 func (cs *CommandServer) SelfIndex(ci CommandSelfIndex) CommandResult {
 	log.Info("Command: FTS Index request")
 
-	err := cs.LocalPeer.Database.GenerateFts(int64(ci.Since))
+	indexed, ok := cs.LocalPeer.Database.(data.IndexedStore)
+
+	if !ok {
+		return CommandResult{false, nil, errNoIndex}
+	}
+
+	err := indexed.GenerateFts(int64(ci.Since))
 
 	return CommandResult{err == nil, nil, err}
 }
@@ -232,22 +424,7 @@ func (cs *CommandServer) Resolve(cr CommandResolve) CommandResult {
 func (cs *CommandServer) Bootstrap(cb CommandBootstrap) CommandResult {
 	log.Info("Command: Bootstrap request")
 
-	addrnport := strings.Split(cb.Address, ":")
-
-	host := addrnport[0]
-	var port string
-	if len(addrnport) == 1 {
-		port = "5050" // TODO: make this configurable
-	} else {
-		port = addrnport[1]
-	}
-
-	peer, err := cs.LocalPeer.ConnectPeerDirect(host + ":" + port)
-	if err != nil {
-		return CommandResult{false, nil, err}
-	}
-
-	_, err = peer.Bootstrap(cs.LocalPeer.DHT)
+	err := cs.LocalPeer.AddBootstrapPeer(cb.Address)
 
 	return CommandResult{err == nil, nil, err}
 }
@@ -265,6 +442,23 @@ func (cs *CommandServer) SelfSearch(css CommandSelfSearch) CommandResult {
 
 	return CommandResult{err == nil, posts, err}
 }
+// Search our own database and every mirror.
+func (cs *CommandServer) FederatedSearch(cfs CommandFederatedSearch) CommandResult {
+	log.Info("Command: Federated Search request")
+
+	res, err := cs.LocalPeer.FederatedSearch(cfs.Query, cfs.Page)
+
+	return CommandResult{err == nil, res, err}
+}
+// Search many remote peers at once.
+func (cs *CommandServer) FanOutSearch(cfs CommandFanOutSearch) CommandResult {
+	log.Info("Command: Fan Out Search request")
+
+	res, err := cs.LocalPeer.FanOutSearch(cfs.Query, cfs.Page, cfs.Peers,
+		time.Duration(cfs.Timeout)*time.Second, cfs.Updates)
+
+	return CommandResult{err == nil, res, err}
+}
 func (cs *CommandServer) SelfRecent(cr CommandSelfRecent) CommandResult {
 	log.Info("Command: Recent request")
 
@@ -282,10 +476,24 @@ func (cs *CommandServer) SelfPopular(cp CommandSelfPopular) CommandResult {
 func (cs *CommandServer) AddMeta(cam CommandAddMeta) CommandResult {
 	log.Info("Command: Add Meta request")
 
-	err := cs.LocalPeer.Database.AddMeta(cam.CommandMeta.PId, cam.Value)
+	err := cs.LocalPeer.AddMeta(cam.CommandMeta.PId, cam.Key, cam.Value)
+
+	return CommandResult{err == nil, nil, err}
+}
+func (cs *CommandServer) RemoveMeta(crm CommandRemoveMeta) CommandResult {
+	log.Info("Command: Remove Meta request")
+
+	err := cs.LocalPeer.RemoveMeta(crm.CommandMeta.PId, crm.Key, crm.Value)
 
 	return CommandResult{err == nil, nil, err}
 }
+func (cs *CommandServer) GetMeta(cgm CommandGetMeta) CommandResult {
+	log.Info("Command: Get Meta request")
+
+	meta, err := cs.LocalPeer.Database.QueryMeta(cgm.PId)
+
+	return CommandResult{err == nil, meta, err}
+}
 func (cs *CommandServer) SaveCollection(csc CommandSaveCollection) CommandResult {
 	log.Info("Command: Save Collection request")
 
@@ -299,7 +507,7 @@ func (cs *CommandServer) RebuildCollection(crc CommandRebuildCollection) Command
 
 	log.Info("Command: Rebuild Collection request")
 
-	cs.LocalPeer.Collection, err = data.CreateCollection(cs.LocalPeer.Database, 0, data.PieceSize)
+	err = cs.LocalPeer.RebuildCollection()
 	return CommandResult{err == nil, nil, err}
 }
 func (cs *CommandServer) Peers(cp CommandPeers) CommandResult {
@@ -327,11 +535,230 @@ func (cs *CommandServer) RequestAddPeer(crap CommandRequestAddPeer) CommandResul
 		return CommandResult{true, nil, err}
 	}
 
-	_, err = peer.RequestAddPeer(crap.Peer)
+	_, err = peer.RequestAddPeer(cs.LocalPeer, crap.Peer)
+
+	return CommandResult{err == nil, nil, err}
+}
+
+func (cs *CommandServer) Bans(cb CommandBans) CommandResult {
+	log.Info("Command: Bans request")
+
+	return CommandResult{true, cs.LocalPeer.Server.Bans.List(), nil}
+}
+
+func (cs *CommandServer) Ban(cb CommandBan) CommandResult {
+	log.Info("Command: Ban request")
+
+	duration := proto.BanDuration
+
+	if cb.Duration > 0 {
+		duration = time.Duration(cb.Duration) * time.Second
+	}
+
+	if cb.Reason == "" {
+		cb.Reason = "Manual ban"
+	}
+
+	err := cs.LocalPeer.Server.Bans.Ban(cb.Address, duration, cb.Reason)
+
+	if peer := cs.LocalPeer.GetPeer(cb.Address); peer != nil {
+		peer.Terminate()
+		cs.LocalPeer.Peers.Remove(cb.Address)
+	}
+
+	return CommandResult{err == nil, nil, err}
+}
+
+func (cs *CommandServer) Unban(cu CommandUnban) CommandResult {
+	log.Info("Command: Unban request")
+
+	err := cs.LocalPeer.Server.Bans.Unban(cu.Address)
 
 	return CommandResult{err == nil, nil, err}
 }
 
+func (cs *CommandServer) DhtInfo(cdi CommandDhtInfo) CommandResult {
+	log.Info("Command: DHT Info request")
+
+	return CommandResult{true, cs.LocalPeer.DHT.Info(), nil}
+}
+
+func (cs *CommandServer) DhtClosest(cdc CommandDhtClosest) CommandResult {
+	log.Info("Command: DHT Closest request")
+
+	address := dht.DecodeAddress(cdc.Address)
+
+	if len(address.Raw) != dht.AddressBinarySize {
+		return CommandResult{false, nil, errors.New("Invalid address")}
+	}
+
+	if cdc.Count <= 0 {
+		cdc.Count = dht.BucketSize
+	}
+
+	return CommandResult{true, cs.LocalPeer.DHT.Closest(address, cdc.Count), nil}
+}
+
+func (cs *CommandServer) DhtLookups(cdl CommandDhtLookups) CommandResult {
+	log.Info("Command: DHT Lookups request")
+
+	return CommandResult{true, cs.LocalPeer.DHT.Lookups(), nil}
+}
+
+// Export the routing table. JSON exports are the same as DhtInfo, DOT exports
+// are returned as a string.
+func (cs *CommandServer) DhtExport(cde CommandDhtExport) CommandResult {
+	log.Info("Command: DHT Export request")
+
+	switch strings.ToLower(cde.Format) {
+	case "json":
+		return cs.DhtInfo(nil)
+	case "dot":
+		buf := bytes.Buffer{}
+		err := cs.LocalPeer.DHT.WriteDot(&buf)
+
+		return CommandResult{err == nil, buf.String(), err}
+
+	default:
+		return CommandResult{false, nil, errors.New("Unknown export format")}
+	}
+}
+
+func (cs *CommandServer) Identities(ci CommandIdentities) CommandResult {
+	log.Info("Command: Identities request")
+
+	ids, err := cs.LocalPeer.Identities()
+
+	return CommandResult{err == nil, ids, err}
+}
+
+// Returns the armoured identity as a string.
+func (cs *CommandServer) IdentityExport(cie CommandIdentityExport) CommandResult {
+	log.Info("Command: Identity Export request")
+
+	armour, err := cs.LocalPeer.ExportIdentity(cie.Current, cie.Passphrase)
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	return CommandResult{true, string(armour), nil}
+}
+
+func (cs *CommandServer) IdentityImport(cii CommandIdentityImport) CommandResult {
+	log.Info("Command: Identity Import request")
+
+	info, err := cs.LocalPeer.ImportIdentity([]byte(cii.Armour), cii.Passphrase)
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	return CommandResult{true, info, nil}
+}
+
+// Reports the schema version of our database, and of every mirror.
+func (cs *CommandServer) SchemaVersion(csv CommandSchemaVersion) CommandResult {
+	log.Info("Command: Schema Version request")
+
+	schema := func(name string, db data.PostStore) DatabaseSchema {
+		ds := DatabaseSchema{Database: name, Latest: data.LatestSchemaVersion()}
+		versioned, ok := db.(data.VersionedStore)
+
+		if !ok {
+			ds.Error = errNoSchema.Error()
+			return ds
+		}
+
+		ds.Path = versioned.Path()
+		version, err := versioned.SchemaVersion()
+		ds.Version = version
+
+		if err != nil {
+			ds.Error = err.Error()
+		}
+
+		return ds
+	}
+
+	ret := []DatabaseSchema{schema("self", cs.LocalPeer.Database)}
+
+	for k, v := range cs.LocalPeer.Databases.Items() {
+		ret = append(ret, schema(k, v.(data.PostStore)))
+	}
+
+	return CommandResult{true, ret, nil}
+}
+
+// Checks the search index of our database, and of every mirror.
+func (cs *CommandServer) CheckIndex(cci CommandCheckIndex) CommandResult {
+	log.Info("Command: Check Index request")
+
+	check := func(name string, db data.PostStore) DatabaseIndex {
+		di := DatabaseIndex{Database: name}
+		indexed, ok := db.(data.IndexedStore)
+
+		if !ok {
+			di.Error = errNoIndex.Error()
+			return di
+		}
+
+		ic, err := indexed.CheckFts()
+
+		if err != nil {
+			di.Error = err.Error()
+		} else {
+			di.IndexCheck = *ic
+			di.Ok = ic.Ok()
+		}
+
+		return di
+	}
+
+	ret := []DatabaseIndex{check("self", cs.LocalPeer.Database)}
+
+	for k, v := range cs.LocalPeer.Databases.Items() {
+		ret = append(ret, check(k, v.(data.PostStore)))
+	}
+
+	return CommandResult{true, ret, nil}
+}
+
+func (cs *CommandServer) RebuildIndex(cri CommandRebuildIndex) CommandResult {
+	log.Info("Command: Rebuild Index request")
+
+	db := cs.LocalPeer.Database
+
+	if cri.Address != "" {
+		mirror, ok := cs.LocalPeer.Databases.Get(cri.Address)
+
+		if !ok {
+			return CommandResult{false, nil, errors.New("Peer database not loaded.")}
+		}
+
+		db = mirror.(data.PostStore)
+	}
+
+	indexed, ok := db.(data.IndexedStore)
+
+	if !ok {
+		return CommandResult{false, nil, errNoIndex}
+	}
+
+	err := indexed.RebuildFts()
+
+	return CommandResult{err == nil, nil, err}
+}
+
+// Lists every peer whose posts we hold that has published the given infohash.
+func (cs *CommandServer) Publishers(cp CommandPublishers) CommandResult {
+	log.Info("Command: Publishers request")
+
+	publishers, err := cs.LocalPeer.Publishers(cp.InfoHash)
+
+	return CommandResult{err == nil, publishers, err}
+}
+
 // Set a value in the localpeer entry
 func (cs *CommandServer) LocalSet(cls CommandLocalSet) CommandResult {
 
@@ -0,0 +1,153 @@
+// Bencode, the encoding .torrent files are written in. Only decoding is needed,
+// as we never write torrents. Integers decode to int64, strings to string,
+// lists to []interface{} and dictionaries to map[string]interface{}.
+
+package data
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Nothing real nests this deep, and it keeps malicious files from exhausting
+// the stack.
+const bencodeMaxDepth = 64
+
+var errInvalidBencode = errors.New("Invalid bencode")
+
+type bencodeDecoder struct {
+	data []byte
+	pos  int
+	// The raw bytes of the "info" dictionary at the top level, which is what
+	// infohashes are taken over.
+	info []byte
+}
+
+// Decodes a single bencoded value, which must take up all of data.
+func decodeBencode(data []byte) (interface{}, []byte, error) {
+	d := bencodeDecoder{data: data}
+	value, err := d.value(0)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if d.pos != len(d.data) {
+		return nil, nil, errors.New("Trailing data after bencode")
+	}
+
+	return value, d.info, nil
+}
+
+func (d *bencodeDecoder) value(depth int) (interface{}, error) {
+	if depth > bencodeMaxDepth {
+		return nil, errors.New("Bencode nested too deeply")
+	}
+
+	if d.pos >= len(d.data) {
+		return nil, errInvalidBencode
+	}
+
+	switch c := d.data[d.pos]; {
+	case c == 'i':
+		d.pos++
+		return d.integer('e')
+
+	case c == 'l':
+		d.pos++
+		list := make([]interface{}, 0)
+
+		for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+			v, err := d.value(depth + 1)
+
+			if err != nil {
+				return nil, err
+			}
+
+			list = append(list, v)
+		}
+
+		return list, d.end()
+
+	case c == 'd':
+		d.pos++
+		return d.dict(depth)
+
+	case c >= '0' && c <= '9':
+		return d.str()
+	}
+
+	return nil, errInvalidBencode
+}
+
+func (d *bencodeDecoder) dict(depth int) (interface{}, error) {
+	dict := make(map[string]interface{})
+
+	for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+		key, err := d.str()
+
+		if err != nil {
+			return nil, err
+		}
+
+		start := d.pos
+		v, err := d.value(depth + 1)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if depth == 0 && key == "info" {
+			d.info = d.data[start:d.pos]
+		}
+
+		dict[key] = v
+	}
+
+	return dict, d.end()
+}
+
+func (d *bencodeDecoder) end() error {
+	if d.pos >= len(d.data) {
+		return errInvalidBencode
+	}
+
+	d.pos++
+
+	return nil
+}
+
+// Reads digits up to the terminator.
+func (d *bencodeDecoder) integer(term byte) (int64, error) {
+	start := d.pos
+
+	for d.pos < len(d.data) && d.data[d.pos] != term {
+		d.pos++
+	}
+
+	if d.pos >= len(d.data) {
+		return 0, errInvalidBencode
+	}
+
+	n, err := strconv.ParseInt(string(d.data[start:d.pos]), 10, 64)
+	d.pos++
+
+	if err != nil {
+		return 0, errInvalidBencode
+	}
+
+	return n, nil
+}
+
+func (d *bencodeDecoder) str() (string, error) {
+	length, err := d.integer(':')
+
+	if err != nil || length < 0 || length > int64(len(d.data)-d.pos) {
+		return "", errInvalidBencode
+	}
+
+	s := string(d.data[d.pos : d.pos+int(length)])
+	d.pos += int(length)
+
+	return s, nil
+}
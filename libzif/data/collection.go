@@ -1,29 +1,43 @@
 package data
 
 import (
+	"bytes"
 	"errors"
-	"hash"
 	"io/ioutil"
 	"math"
 
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/crypto/sha3"
 )
 
 // A collection of pieces, by extension a structure containing all posts this
 // peer has. Whether or not the pieces are *actually* there is optional, if not
 // this is essentially a hash list.
+// The root hash is a Merkle tree over the piece hashes, which are themselves
+// Merkle trees over posts. So once the root is signed, a single post can be
+// proven to be in the collection with a few dozen hashes, see PostProof.
 type Collection struct {
 	Pieces   []*Piece
 	HashList []byte
-	RootHash hash.Hash
+}
+
+// Proves that Post is in a collection with the given Root. Post is the
+// Index'th leaf of the Piece'th piece's tree, which has PieceSize leaves, and
+// that piece is a leaf of the collection's tree of Pieces leaves.
+type PostProof struct {
+	Post      Post     `json:"post"`
+	Piece     int      `json:"piece"`
+	Index     int      `json:"index"`
+	PieceSize int      `json:"pieceSize"`
+	PostPath  [][]byte `json:"postPath"`
+	Pieces    int      `json:"pieces"`
+	PiecePath [][]byte `json:"piecePath"`
+	Root      []byte   `json:"root"`
 }
 
 // Create a new collection, set all it's members to the correct default values.
 func NewCollection() *Collection {
 	col := &Collection{}
 
-	col.RootHash = sha3.New256()
 	col.Pieces = make([]*Piece, 0, 2)
 	col.HashList = make([]byte, 0)
 
@@ -32,7 +46,7 @@ func NewCollection() *Collection {
 
 // Takes a database, starting id, and piece size. From this we create a
 // collection, except it does not contain any posts - consider making this optional.
-func CreateCollection(db *Database, start, pieceSize int) (*Collection, error) {
+func CreateCollection(db PostStore, start, pieceSize int) (*Collection, error) {
 	col := NewCollection()
 
 	postCount := db.PostCount()
@@ -71,7 +85,6 @@ func LoadCollection(path string) (col *Collection, err error) {
 	}
 
 	col.HashList = data
-	col.Rehash()
 
 	return
 }
@@ -86,20 +99,16 @@ func (c *Collection) Save(path string) {
 func (c *Collection) Add(piece *Piece) {
 	c.Pieces = append(c.Pieces, piece)
 	c.HashList = append(c.HashList, piece.Hash()...)
-
-	c.RootHash.Write(piece.Hash())
 }
 
 // Add a post to the collection. Automatically assigns to the correct piece,
 // allocates a new piece if needed! Optional whether or not the actual post is
 // stored, if not just it's hash is.
 func (c *Collection) AddPost(post Post, store bool) {
-	if len(c.Pieces) == 0 || len(c.Pieces[len(c.Pieces)-1].Posts) == PieceSize {
+	if len(c.Pieces) == 0 || c.Pieces[len(c.Pieces)-1].Len() == PieceSize {
 		piece := &Piece{}
 		piece.Setup()
 		c.Add(piece)
-
-		c.HashList = append(c.HashList, piece.Hash()...)
 	}
 
 	lastIndex := len(c.Pieces) - 1
@@ -109,22 +118,87 @@ func (c *Collection) AddPost(post Post, store bool) {
 	copy(c.HashList[lastIndex*32:lastIndex*32+32], last.Hash())
 }
 
-// Return the hash of the hash list, which can then go on to be signed by the
-// LocalPeer. This allows proper validation of an entire collection, but the
-// localpeer only needs to sign a single hash.
-func (c *Collection) Hash() []byte {
-	var ret []byte
+// The hash of each piece, split out of the hash list.
+func (c *Collection) PieceHashes() [][]byte {
+	ret := make([][]byte, 0, len(c.HashList)/32)
 
-	ret = c.RootHash.Sum(nil)
+	for i := 0; i+32 <= len(c.HashList); i += 32 {
+		ret = append(ret, c.HashList[i:i+32])
+	}
 
 	return ret
 }
 
-// Regenerates the root hash from the hash list we have.
-func (c *Collection) Rehash() {
-	c.RootHash = sha3.New256()
+// Return the Merkle root of the hash list, which can then go on to be signed
+// by the LocalPeer. This allows proper validation of an entire collection, but
+// the localpeer only needs to sign a single hash.
+func (c *Collection) Hash() []byte {
+	return MerkleRoot(c.PieceHashes())
+}
+
+// Builds the proof that the post with the given infohash, as it is stored in
+// db, is in this collection. Fails if the piece it is in no longer matches the
+// hash list, as the post cannot then be proven.
+func (c *Collection) Prove(db PostStore, infohash string) (*PostProof, error) {
+	post, err := db.QueryInfoHash(infohash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if post == nil {
+		return nil, errors.New("Post not found")
+	}
+
+	position, err := db.PostPosition(post.Id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := c.PieceHashes()
+	n := position / PieceSize
+
+	if n >= len(hashes) {
+		return nil, errors.New("Post is not in the collection")
+	}
+
+	piece, err := db.QueryPiece(n, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(piece.Hash(), hashes[n]) {
+		return nil, errors.New("Collection is out of date")
+	}
+
+	index := position % PieceSize
+
+	return &PostProof{
+		Post:      piece.Posts[index],
+		Piece:     n,
+		Index:     index,
+		PieceSize: piece.Len(),
+		PostPath:  piece.Proof(index),
+		Pieces:    len(hashes),
+		PiecePath: MerkleProof(hashes, n),
+		Root:      c.Hash(),
+	}, nil
+}
+
+// Checks that the proof leads from the post to Root. Whether Root is to be
+// trusted, usually by a signature, is up to the caller.
+func (pp *PostProof) Verify() error {
+	piece, err := MerkleProofRoot(pp.Post.Leaf(), pp.Index, pp.PieceSize, pp.PostPath)
 
-	for i := 0; i < len(c.HashList)/32; i++ {
-		c.RootHash.Write(c.HashList[i*32 : i*32+32])
+	if err != nil {
+		return err
+	}
+
+	if !VerifyMerkleProof(pp.Root, piece, pp.Piece, pp.Pieces, pp.PiecePath) {
+		return errInvalidProof
 	}
+
+	return nil
 }
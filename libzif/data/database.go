@@ -20,7 +20,7 @@ func NewDatabase(path string) *Database {
 }
 
 // Connect to a database. If it does not already exist it is created, and the
-// proper schema is also setup.
+// schema is brought up to date, see migrate.go.
 func (db *Database) Connect() error {
 	var err error
 
@@ -34,22 +34,11 @@ func (db *Database) Connect() error {
 
 	//db.conn.SetMaxOpenConns(1)
 
-	_, err = db.conn.Exec(sql_create_post_table)
-	if err != nil {
-		return err
-	}
-
-	_, err = db.conn.Exec(sql_create_fts_post)
-	if err != nil {
-		return err
-	}
-
-	_, err = db.conn.Exec(sql_create_upload_date_index)
-	if err != nil {
-		return err
-	}
+	return db.Migrate()
+}
 
-	return nil
+func (db *Database) Path() string {
+	return db.path
 }
 
 // Inserts a piece into the database. All the posts are iterated over and inserted
@@ -67,8 +56,7 @@ func (db *Database) InsertPiece(piece *Piece) (err error) {
 	}()
 
 	for _, i := range piece.Posts {
-		_, err = tx.Exec(sql_insert_post, i.InfoHash, i.Title, i.Size, i.FileCount,
-			i.Seeders, i.Leechers, i.UploadDate, i.Tags)
+		_, _, err = upsertPost(tx, i)
 
 		if err != nil {
 			return
@@ -79,24 +67,32 @@ func (db *Database) InsertPiece(piece *Piece) (err error) {
 }
 
 // Insert pieces from a channel, good for streaming them from a network or something.
-// The fts bool is whether or not a fts index will be generated on every transaction
-// commit. Transactions contain 100 pieces, or 100,000 posts.
-func (db *Database) InsertPieces(pieces chan *Piece, fts bool) (err error) {
+// Transactions contain 100 pieces, or 100,000 posts. Posts are indexed for
+// searching as they are inserted. Returns when the channel is closed, or on
+// the first error, in which case the transaction in progress is rolled back.
+func (db *Database) InsertPieces(pieces chan *Piece) (err error) {
 	tx, err := db.conn.Begin()
 
+	if err != nil {
+		return err
+	}
+
 	n := 0
 
 	defer func() {
-		err = tx.Commit()
-
 		if err != nil {
-			tx.Rollback()
+			// Begin gives no transaction if it fails.
+			if tx != nil {
+				tx.Rollback()
+			}
+
 			log.Error(err.Error())
 			return
 		}
+
+		err = tx.Commit()
 	}()
 
-	//lastId := 0
 	for piece := range pieces {
 		// Insert the transaction every 100,000 posts.
 		if n == 99 {
@@ -106,9 +102,6 @@ func (db *Database) InsertPieces(pieces chan *Piece, fts bool) (err error) {
 				return
 			}
 
-			//db.GenerateFts(lastId)
-			//lastId = piece.Posts[len(piece.Posts)-1].Id
-
 			tx, err = db.conn.Begin()
 
 			if err != nil {
@@ -119,8 +112,16 @@ func (db *Database) InsertPieces(pieces chan *Piece, fts bool) (err error) {
 		}
 
 		for _, i := range piece.Posts {
-			_, err = tx.Exec(sql_insert_post, i.InfoHash, i.Title, i.Size, i.FileCount,
-				i.Seeders, i.Leechers, i.UploadDate, i.Tags)
+			_, _, err = upsertPost(tx, i)
+
+			// Other peers may have posts we would not accept ourselves, or
+			// that a tombstone says are gone, skip them rather than giving up
+			// on the whole mirror.
+			if skipPost(err) {
+				log.WithField("infohash", i.InfoHash).Debug("Skipping post")
+				err = nil
+				continue
+			}
 
 			if err != nil {
 				return
@@ -133,39 +134,142 @@ func (db *Database) InsertPieces(pieces chan *Piece, fts bool) (err error) {
 	return
 }
 
-// Insert a single post into the database.
+// Insert a single post into the database. If there is already a post with the
+// same infohash the two are merged, and the id of the existing post returned.
 func (db *Database) InsertPost(post Post) (int64, error) {
-	// TODO: Is preparing all statements before hand worth doing for perf?
-	stmt, err := db.conn.Prepare(sql_insert_post)
+	id, _, err := db.UpsertPost(post)
+
+	return id, err
+}
+
+// Like InsertPost, but also returns whether the post was new.
+func (db *Database) UpsertPost(post Post) (id int64, inserted bool, err error) {
+	tx, err := db.conn.Begin()
+
 	if err != nil {
-		return -1, err
+		return -1, false, err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		err = tx.Commit()
+	}()
+
+	return upsertPost(tx, post)
+}
+
+func upsertPost(tx *sql.Tx, post Post) (int64, bool, error) {
+	if err := preparePost(&post); err != nil {
+		return -1, false, err
+	}
+
+	hash := post.InfoHash
+
+	var tombstone *Tombstone
+	var t Tombstone
+
+	err := scanTombstone(tx.QueryRow(sql_query_tombstone, hash), &t)
+
+	if err == nil {
+		tombstone = &t
+	} else if err != sql.ErrNoRows {
+		return -1, false, err
+	}
+
+	var existing Post
+	var stored *Post
+
+	err = scanPost(tx.QueryRow(sql_query_post_infohash, hash), &existing)
+
+	if err == nil {
+		stored = &existing
+	} else if err != sql.ErrNoRows {
+		return -1, false, err
 	}
 
-	res, err := stmt.Exec(post.InfoHash, post.Title, post.Size, post.FileCount, post.Seeders,
-		post.Leechers, post.UploadDate, post.Tags, post.Meta)
+	changed, err := mergeStored(&post, stored, tombstone)
 
 	if err != nil {
-		return -1, err
+		return -1, false, err
 	}
 
-	id, err := res.LastInsertId()
+	if stored == nil {
+		res, err := tx.Exec(sql_insert_signed_post, post.InfoHash, post.Title, post.Size,
+			post.FileCount, post.Seeders, post.Leechers, post.UploadDate, post.Tags,
+			post.Meta, post.Author, post.Signature)
+
+		if err != nil {
+			return -1, false, err
+		}
+
+		id, err := res.LastInsertId()
+
+		if err == nil && len(post.Meta) > 0 {
+			err = writeMeta(tx, id, post.Meta)
+		}
+
+		return id, true, err
+	}
 
-	return id, nil
+	if changed {
+		_, err = tx.Exec(sql_update_merged_signed_post, existing.Title, existing.Size,
+			existing.FileCount, existing.Seeders, existing.Leechers,
+			existing.UploadDate, existing.Tags, existing.Meta, existing.Author,
+			existing.Signature, existing.Id)
+
+		if err == nil {
+			err = writeMeta(tx, int64(existing.Id), existing.Meta)
+		}
+	}
+
+	return int64(existing.Id), false, err
 }
 
-// Generate a full text search index since the given id. This should ideally be
-// done only for new additions, otherwise on a large dataset it can take a bit of
-// time.
-func (db *Database) GenerateFts(since int64) error {
-	stmt, err := db.conn.Prepare(sql_generate_fts)
+// A *sql.Row or *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Reads a whole post row, as selected by SELECT *.
+func scanPost(row rowScanner, post *Post) error {
+	return row.Scan(&post.Id, &post.InfoHash, &post.Title, &post.Size,
+		&post.FileCount, &post.Seeders, &post.Leechers, &post.UploadDate,
+		&post.Tags, &post.Meta, &post.Author, &post.Signature)
+}
+
+// Returns the post with the given infohash, or nil if there is not one.
+func (db *Database) QueryInfoHash(infohash string) (*Post, error) {
+	hash, err := NormaliseInfoHash(infohash)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	stmt.Exec(since)
+	var post Post
+
+	err = scanPost(db.conn.QueryRow(sql_query_post_infohash, hash), &post)
 
-	return nil
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &post, nil
+}
+
+// Reindex posts since the given id. Posts are indexed as they are added, so
+// this is only needed to repair the index, see RebuildFts.
+func (db *Database) GenerateFts(since int64) error {
+	_, err := db.conn.Exec(sql_generate_fts, since)
+
+	return err
 }
 
 // Performs a query upon the database where the only arguments are the page range.
@@ -184,9 +288,7 @@ func (db *Database) PaginatedQuery(query string, page int) ([]*Post, error) {
 	for rows.Next() {
 		var post Post
 
-		err := rows.Scan(&post.Id, &post.InfoHash, &post.Title, &post.Size,
-			&post.FileCount, &post.Seeders, &post.Leechers, &post.UploadDate,
-			&post.Tags, &post.Meta)
+		err := scanPost(rows, &post)
 
 		if err != nil {
 			return nil, err
@@ -210,37 +312,106 @@ func (db *Database) QueryPopular(page int) ([]*Post, error) {
 	return db.PaginatedQuery(sql_query_popular_post, page)
 }
 
+// A search result, with the part of the post that matched highlighted.
+type SearchHit struct {
+	Post    *Post
+	Snippet string
+	// What the results were ordered by, see Query.Rank.
+	Rank float64
+}
+
 // Perform a query on the FTS table. The results returned are used to pull actual
 // results out of the post table, and these are returned.
+// Queries may filter and sort as well, see ParseQuery. A query of only filters
+// matches every post that passes them.
 func (db *Database) Search(query string, page, pageSize int) ([]*Post, error) {
-	posts := make([]*Post, 0, pageSize)
-	rows, err := db.conn.Query(sql_search_post, query, page*pageSize,
-		pageSize)
+	hits, err := db.SearchHits(query, page, pageSize)
 
 	if err != nil {
 		return nil, err
 	}
 
-	for rows.Next() {
+	posts := make([]*Post, 0, len(hits))
 
-		var result uint
+	for _, i := range hits {
+		posts = append(posts, i.Post)
+	}
 
-		err = rows.Scan(&result)
+	return posts, nil
+}
+
+// As Search, but with a snippet for each post. Results are ordered by
+// relevance, blended with swarm health, unless the query sorts them otherwise.
+// See ParseQuery for what a query can contain.
+func (db *Database) SearchHits(query string, page, pageSize int) ([]SearchHit, error) {
+	q, err := ParseQuery(query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return db.SearchQuery(q, page, pageSize)
+}
+
+// Whether any post has metadata under key.
+func (db *Database) hasMetaKey(key string) bool {
+	var one int
+
+	return db.conn.QueryRow(sql_query_meta_key, key).Scan(&one) == nil
+}
+
+// Run a parsed query, see SearchHits.
+func (db *Database) SearchQuery(q *Query, page, pageSize int) ([]SearchHit, error) {
+	hits := make([]SearchHit, 0, pageSize)
+	q = q.WithMetaKeys(db.hasMetaKey)
+
+	// Nothing searchable, such as a query of only punctuation.
+	if q.Match() == "" && q.Text != "" {
+		return hits, nil
+	}
+
+	stmt, args := q.SQL(page, pageSize)
+
+	rows, err := db.conn.Query(stmt, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		id      uint
+		snippet string
+		rank    float64
+	}
+
+	results := make([]result, 0, pageSize)
+
+	for rows.Next() {
+		var r result
+
+		err = rows.Scan(&r.id, &r.snippet, &r.rank)
 
 		if err != nil {
+			rows.Close()
 			return nil, err
 		}
 
-		post, err := db.QueryPostId(result)
+		results = append(results, r)
+	}
+
+	rows.Close()
+
+	for _, i := range results {
+		post, err := db.QueryPostId(i.id)
 
 		if err != nil {
 			return nil, err
 		}
 
-		posts = append(posts, &post)
+		hits = append(hits, SearchHit{&post, i.snippet, i.rank})
 	}
 
-	return posts, nil
+	return hits, nil
 }
 
 // Return a single post given it's id.
@@ -254,9 +425,7 @@ func (db *Database) QueryPostId(id uint) (Post, error) {
 
 	for rows.Next() {
 
-		err := rows.Scan(&post.Id, &post.InfoHash, &post.Title, &post.Size,
-			&post.FileCount, &post.Seeders, &post.Leechers, &post.UploadDate,
-			&post.Tags, &post.Meta)
+		err := scanPost(rows, &post)
 
 		if err != nil {
 			return post, err
@@ -284,9 +453,7 @@ func (db *Database) QueryPiece(id int, store bool) (*Piece, error) {
 
 		var post Post
 
-		err := rows.Scan(&post.Id, &post.InfoHash, &post.Title, &post.Size,
-			&post.FileCount, &post.Seeders, &post.Leechers, &post.UploadDate,
-			&post.Tags, &post.Meta)
+		err := scanPost(rows, &post)
 
 		if err != nil {
 			return nil, err
@@ -309,7 +476,7 @@ func (db *Database) QueryPiecePosts(start, length int, store bool) chan *Post {
 		defer close(ret)
 
 		rows, err := db.conn.Query(sql_query_paged_post, start*page_size,
-			start+page_size*length)
+			page_size*length)
 
 		if err != nil {
 			return
@@ -319,9 +486,7 @@ func (db *Database) QueryPiecePosts(start, length int, store bool) chan *Post {
 
 			var post Post
 
-			err := rows.Scan(&post.Id, &post.InfoHash, &post.Title, &post.Size,
-				&post.FileCount, &post.Seeders, &post.Leechers, &post.UploadDate,
-				&post.Tags, &post.Meta)
+			err := scanPost(rows, &post)
 
 			if err != nil {
 				log.Error(err)
@@ -336,6 +501,15 @@ func (db *Database) QueryPiecePosts(start, length int, store bool) chan *Post {
 	return ret
 }
 
+// Where a post comes in the database, counting from zero, which is where it
+// comes in the collection.
+func (db *Database) PostPosition(id int) (int, error) {
+	var res int
+	err := db.conn.QueryRow(sql_count_post_before, id).Scan(&res)
+
+	return res, err
+}
+
 // How many posts are in the database?
 func (db *Database) PostCount() uint {
 	var res uint
@@ -345,29 +519,11 @@ func (db *Database) PostCount() uint {
 	return res
 }
 
-// Add a metadata key/value.
-func (db *Database) AddMeta(pid int, value string) error {
-
-	stmt, err := db.conn.Prepare(sql_attach_meta)
-
-	if err != nil {
-		return err
-	}
-
-	_, err = stmt.Exec(value, pid)
-
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (db *Database) Suggest(query string) ([]string, error) {
+func (db *Database) Suggest(prefix string) ([]string, error) {
 	suggest_size := 5
 
 	ret := make([]string, 0, suggest_size)
-	rows, err := db.conn.Query(sql_suggest_posts, query, suggest_size)
+	rows, err := db.conn.Query(sql_suggest_posts, escapeLike(prefix)+"%", suggest_size)
 
 	if err != nil {
 		return nil, err
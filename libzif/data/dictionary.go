@@ -0,0 +1,211 @@
+// A dictionary of the terms in a database's titles and tags, with how many
+// posts each is in. Used to correct misspelt search terms, and to complete
+// partly typed ones. Terms come from the full text index, so are lowercase and
+// tokenised the same way searches are.
+
+package data
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Corrections and completions are only made for words at least this long.
+// Shorter words have too many terms within reach to be useful.
+const DictionaryMinWord = 3
+
+type Term struct {
+	Term string `json:"term"`
+	// The number of posts the term is in.
+	Count int `json:"count"`
+}
+
+type Dictionary struct {
+	counts map[string]int
+	// Sorted alphabetically, for completions.
+	terms []Term
+}
+
+// Load the dictionary for this database from its index.
+func (db *Database) LoadDictionary() (*Dictionary, error) {
+	terms := make([]Term, 0)
+
+	rows, err := db.conn.Query(sql_query_dictionary)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var t Term
+
+		if err := rows.Scan(&t.Term, &t.Count); err != nil {
+			return nil, err
+		}
+
+		terms = append(terms, t)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return NewDictionary(terms), nil
+}
+
+// Make a dictionary from terms, which must be sorted alphabetically.
+func NewDictionary(terms []Term) *Dictionary {
+	d := &Dictionary{
+		counts: make(map[string]int),
+		terms:  terms,
+	}
+
+	for _, i := range terms {
+		d.counts[i.Term] = i.Count
+	}
+
+	return d
+}
+
+func (d *Dictionary) Len() int {
+	return len(d.terms)
+}
+
+// The number of posts a term is in, zero if it is not in the dictionary.
+func (d *Dictionary) Count(term string) int {
+	return d.counts[strings.ToLower(term)]
+}
+
+// Terms within a small edit distance of word, closest first, then most common
+// first. Words of up to five letters may have one mistake, longer words two.
+// The word itself is not included.
+func (d *Dictionary) Correct(word string, max int) []Term {
+	word = strings.ToLower(word)
+	length := utf8.RuneCountInString(word)
+
+	if length < DictionaryMinWord {
+		return []Term{}
+	}
+
+	distance := 1
+
+	if length > 5 {
+		distance = 2
+	}
+
+	type candidate struct {
+		Term
+		distance int
+	}
+
+	candidates := make([]candidate, 0)
+
+	for _, i := range d.terms {
+		diff := utf8.RuneCountInString(i.Term) - length
+
+		if i.Term == word || diff > distance || diff < -distance {
+			continue
+		}
+
+		if n := EditDistance(word, i.Term); n <= distance {
+			candidates = append(candidates, candidate{i, n})
+		}
+	}
+
+	sort.SliceStable(candidates, func(a, b int) bool {
+		if candidates[a].distance != candidates[b].distance {
+			return candidates[a].distance < candidates[b].distance
+		}
+
+		return candidates[a].Count > candidates[b].Count
+	})
+
+	ret := make([]Term, 0, max)
+
+	for n := 0; n < len(candidates) && n < max; n++ {
+		ret = append(ret, candidates[n].Term)
+	}
+
+	return ret
+}
+
+// Terms starting with prefix, most common first.
+func (d *Dictionary) Complete(prefix string, max int) []Term {
+	prefix = strings.ToLower(prefix)
+
+	if utf8.RuneCountInString(prefix) < DictionaryMinWord {
+		return []Term{}
+	}
+
+	start := sort.Search(len(d.terms), func(i int) bool {
+		return d.terms[i].Term >= prefix
+	})
+
+	matches := make([]Term, 0)
+
+	for _, i := range d.terms[start:] {
+		if !strings.HasPrefix(i.Term, prefix) {
+			break
+		}
+
+		matches = append(matches, i)
+	}
+
+	sort.SliceStable(matches, func(a, b int) bool {
+		return matches[a].Count > matches[b].Count
+	})
+
+	if len(matches) > max {
+		matches = matches[:max]
+	}
+
+	return matches
+}
+
+// The number of single character insertions, deletions, substitutions or
+// swaps of adjacent characters needed to turn a into b.
+func EditDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	// Three rows are enough, swaps look two back.
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				cur[j] = minInt(cur[j], prev2[j-2]+1)
+			}
+		}
+
+		prev2, prev, cur = prev, cur, prev2
+	}
+
+	return prev[len(rb)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
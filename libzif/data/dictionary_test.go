@@ -0,0 +1,153 @@
+package data
+
+import (
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"ubuntu", "ubuntu", 0},
+		{"ubuntu", "ubunto", 1},
+		{"ubuntu", "ubnutu", 1},
+		{"ubuntu", "buntu", 1},
+		{"ubuntu", "ubuntus", 1},
+		{"debian", "ubuntu", 6},
+		{"", "abc", 3},
+		{"café", "cafe", 1},
+	}
+
+	for _, i := range cases {
+		if got := EditDistance(i.a, i.b); got != i.want {
+			t.Errorf("EditDistance(%q, %q) is %d, want %d", i.a, i.b, got, i.want)
+		}
+	}
+}
+
+func dictionaryDatabase(t *testing.T) (*Database, func()) {
+	db, done := tempDatabase(t)
+
+	insertPosts(t, db,
+		Post{Title: "Ubuntu Desktop", Tags: "linux"},
+		Post{Title: "Ubuntu Server", Tags: "linux"},
+		Post{Title: "Ubuntu Studio"},
+		Post{Title: "Kubuntu Desktop", Tags: "linux"},
+		Post{Title: "Debian Stable", Tags: "linux"},
+		Post{Title: "Ubiquity Installer"},
+	)
+
+	return db, done
+}
+
+func TestDictionary(t *testing.T) {
+	db, done := dictionaryDatabase(t)
+	defer done()
+
+	d, err := db.LoadDictionary()
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if d.Count("ubuntu") != 3 || d.Count("Linux") != 4 || d.Count("fedora") != 0 {
+		t.Errorf("Counts are %d, %d, %d", d.Count("ubuntu"), d.Count("linux"), d.Count("fedora"))
+	}
+
+	corrections := d.Correct("Ubunto", 3)
+
+	if len(corrections) != 2 || corrections[0].Term != "ubuntu" || corrections[1].Term != "kubuntu" {
+		t.Errorf("Corrections are %+v", corrections)
+	}
+
+	if len(d.Correct("ab", 3)) != 0 {
+		t.Error("Short word corrected")
+	}
+
+	completions := d.Complete("ub", 3)
+
+	if len(completions) != 0 {
+		t.Errorf("Short prefix completed: %+v", completions)
+	}
+
+	completions = d.Complete("ubi", 3)
+
+	if len(completions) != 1 || completions[0].Term != "ubiquity" {
+		t.Errorf("Completions are %+v", completions)
+	}
+
+	completions = d.Complete("des", 3)
+
+	if len(completions) != 1 || completions[0] != (Term{"desktop", 2}) {
+		t.Errorf("Completions are %+v", completions)
+	}
+}
+
+func TestSearchDidYouMean(t *testing.T) {
+	db, done := dictionaryDatabase(t)
+	defer done()
+
+	sp := NewSearchProvider()
+	res, err := sp.Search("", db, "ubunto desktp tag:linux", 0)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(res.Posts) != 0 {
+		t.Errorf("Typo found %d posts", len(res.Posts))
+	}
+
+	if c := res.Corrections["desktp"]; len(c) != 1 || c[0] != "desktop" {
+		t.Errorf("Corrections are %v", res.Corrections)
+	}
+
+	// kubuntu desktop also finds something, but is further from what was typed.
+	if len(res.DidYouMean) != 2 || res.DidYouMean[0] != "ubuntu desktop tag:linux" ||
+		res.DidYouMean[1] != "kubuntu desktop tag:linux" {
+		t.Errorf("Did you mean %v", res.DidYouMean)
+	}
+
+	if !sp.Loaded {
+		t.Error("Dictionary not loaded")
+	}
+
+	res, err = sp.Search("", db, "ubuntu", 0)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if res.Corrections != nil || res.DidYouMean != nil {
+		t.Errorf("Suggestions for a correct query: %v, %v", res.Corrections, res.DidYouMean)
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	db, done := dictionaryDatabase(t)
+	defer done()
+
+	sp := NewSearchProvider()
+	suggestions, err := sp.Suggest(db, "ubu")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// The dictionary's completion first, then titles.
+	if len(suggestions) != 4 || suggestions[0] != "ubuntu" {
+		t.Errorf("Suggestions are %q", suggestions)
+	}
+
+	suggestions, err = sp.Suggest(db, "Ubuntu des")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// The title is the same as the completion.
+	if len(suggestions) != 1 || suggestions[0] != "Ubuntu desktop" {
+		t.Errorf("Suggestions are %q", suggestions)
+	}
+}
@@ -0,0 +1,139 @@
+// Posts can be exported from any store as JSON lines or CSV, in the forms
+// ImportPosts reads, so an export can be imported elsewhere without a column
+// mapping. Exports may be filtered by a search query, see ParseQuery.
+
+package data
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+)
+
+const (
+	ExportJSONL = ImportJSONL
+	ExportCSV   = ImportCSV
+
+	// Posts are read this many at a time when exporting a text search.
+	exportPageSize = 1000
+)
+
+type ExportOptions struct {
+	// ExportJSONL or ExportCSV.
+	Format string `json:"format"`
+	// Only posts matching this are exported, every post if it is empty.
+	Query string `json:"query"`
+}
+
+// Calls fn for every post in the store, in the order they were stored, or in
+// search order if q has text to match.
+func EachPost(db PostStore, q *Query, fn func(*Post) error) error {
+	if q != nil && q.Text != "" {
+		for page := 0; ; page++ {
+			hits, err := db.SearchQuery(q, page, exportPageSize)
+
+			if err != nil {
+				return err
+			}
+
+			for _, i := range hits {
+				if err := fn(i.Post); err != nil {
+					return err
+				}
+			}
+
+			if len(hits) < exportPageSize {
+				return nil
+			}
+		}
+	}
+
+	pieces := (int(db.PostCount()) + PieceSize - 1) / PieceSize
+	posts := db.QueryPiecePosts(0, pieces, true)
+
+	// The channel is drained on failure, so the query does not leak.
+	defer func() {
+		for range posts {
+		}
+	}()
+
+	for post := range posts {
+		if q != nil && !q.Allows(post) {
+			continue
+		}
+
+		if err := fn(post); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Writes posts to w, returning how many were written.
+func ExportPosts(db PostStore, w io.Writer, opts ExportOptions) (int, error) {
+	var q *Query
+
+	if opts.Query != "" {
+		var err error
+		q, err = ParseQuery(opts.Query)
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	count := 0
+
+	switch opts.Format {
+	case ExportJSONL:
+		encoder := json.NewEncoder(w)
+
+		err := EachPost(db, q, func(p *Post) error {
+			count++
+			return encoder.Encode(p)
+		})
+
+		return count, err
+
+	case ExportCSV:
+		writer := csv.NewWriter(w)
+
+		header := append(append([]string{}, importFields...), "author", "signature")
+
+		if err := writer.Write(header); err != nil {
+			return 0, err
+		}
+
+		err := EachPost(db, q, func(p *Post) error {
+			count++
+
+			return writer.Write([]string{
+				p.InfoHash,
+				p.Title,
+				strconv.Itoa(p.Size),
+				strconv.Itoa(p.FileCount),
+				strconv.Itoa(p.Seeders),
+				strconv.Itoa(p.Leechers),
+				strconv.Itoa(p.UploadDate),
+				p.Tags,
+				p.Meta.Encode(),
+				hex.EncodeToString(p.Author),
+				hex.EncodeToString(p.Signature),
+			})
+		})
+
+		writer.Flush()
+
+		if err == nil {
+			err = writer.Error()
+		}
+
+		return count, err
+	}
+
+	return 0, errors.New("Unknown export format: " + opts.Format)
+}
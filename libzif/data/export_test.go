@@ -0,0 +1,58 @@
+package data
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExportRoundTrip(t *testing.T) {
+	eachStore(t, func(t *testing.T, db PostStore) {
+		storePosts(t, db,
+			Post{Title: "Ubuntu 16.04", Tags: "linux", Size: 1 << 30, Seeders: 10, UploadDate: 100,
+				Meta: Meta{"lang": {"en", "fr"}}},
+			Post{Title: "Debian, \"stable\"", Tags: "linux,debian", Size: 300 << 20},
+			Post{Title: "The Shawshank Redemption", Size: 2 << 30},
+		)
+
+		for _, format := range []string{ExportJSONL, ExportCSV} {
+			var buf bytes.Buffer
+
+			count, err := ExportPosts(db, &buf, ExportOptions{Format: format, Query: "tag:linux"})
+
+			if err != nil || count != 2 {
+				t.Fatalf("%s: exported %d, %v", format, count, err)
+			}
+
+			posts := make([]Post, 0)
+
+			_, err = ImportPosts(&buf, ImportOptions{Format: format}, func(p Post) error {
+				posts = append(posts, p)
+				return nil
+			}, nil)
+
+			if err != nil || len(posts) != 2 {
+				t.Fatalf("%s: imported %d, %v", format, len(posts), err)
+			}
+
+			if posts[0].Title != "Ubuntu 16.04" || posts[0].Seeders != 10 || posts[0].UploadDate != 100 ||
+				posts[0].Meta.Encode() != "lang=en&lang=fr" || posts[1].Title != "Debian, \"stable\"" {
+				t.Errorf("%s: posts are %+v", format, posts)
+			}
+		}
+
+		var buf bytes.Buffer
+
+		if count, err := ExportPosts(db, &buf, ExportOptions{Format: ExportJSONL, Query: "shawshank"}); err != nil || count != 1 {
+			t.Errorf("Text search exported %d, %v", count, err)
+		}
+
+		if !strings.Contains(buf.String(), "Shawshank") {
+			t.Errorf("Export is %s", buf.String())
+		}
+
+		if _, err := ExportPosts(db, &buf, ExportOptions{Format: "xml"}); err == nil {
+			t.Error("Exported an unknown format")
+		}
+	})
+}
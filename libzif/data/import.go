@@ -0,0 +1,361 @@
+// Posts can be read in bulk from dumps, either JSON lines or CSV with a header
+// row. Fields are found by name, ignoring case, or through a mapping from post
+// field to the name the dump uses, so "title=name" takes titles from the
+// "name" column. JSON lines written from posts, as exports are, need no
+// mapping. Each post is checked with Post.Valid, and those that fail are
+// skipped and reported rather than ending the import.
+
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ImportJSONL = "jsonl"
+	ImportCSV   = "csv"
+
+	// Progress is reported every this many records.
+	importReportEvery = 1000
+	// Only the first errors are kept, after that they are only counted.
+	importErrorsMax = 100
+	// The longest line a JSON lines dump may have.
+	importLineMax = 1024 * 1024
+)
+
+// The post fields a dump can fill in.
+var importFields = []string{"infohash", "title", "size", "filecount", "seeders",
+	"leechers", "uploaddate", "tags", "meta"}
+
+type ImportOptions struct {
+	// ImportJSONL or ImportCSV.
+	Format string `json:"format"`
+	// Post field to the column or key holding it in the dump. Fields not given
+	// are looked for under their own name.
+	Columns map[string]string `json:"columns"`
+}
+
+type ImportProgress struct {
+	// Records read from the dump, including ones that were skipped.
+	Read     int      `json:"read"`
+	Imported int      `json:"imported"`
+	Skipped  int      `json:"skipped"`
+	Errors   []string `json:"errors,omitempty"`
+	Done     bool     `json:"done"`
+}
+
+func (ip *ImportProgress) skip(record int, err error) {
+	ip.Skipped++
+
+	if len(ip.Errors) < importErrorsMax {
+		ip.Errors = append(ip.Errors, fmt.Sprintf("Record %d: %s", record, err.Error()))
+	}
+}
+
+// Parses a column mapping such as "title=name,infohash=hash".
+func ParseImportColumns(s string) (map[string]string, error) {
+	columns := make(map[string]string)
+
+	for _, i := range strings.Split(s, ",") {
+		if strings.TrimSpace(i) == "" {
+			continue
+		}
+
+		pair := strings.SplitN(i, "=", 2)
+
+		if len(pair) != 2 {
+			return nil, errors.New("Column mappings are field=column: " + i)
+		}
+
+		columns[strings.TrimSpace(pair[0])] = strings.TrimSpace(pair[1])
+	}
+
+	return columns, nil
+}
+
+func (opts *ImportOptions) columns() (map[string]string, error) {
+	columns := make(map[string]string)
+
+	for _, i := range importFields {
+		columns[i] = i
+	}
+
+	for k, v := range opts.Columns {
+		field := strings.ToLower(k)
+
+		if _, ok := columns[field]; !ok {
+			return nil, errors.New("Unknown post field: " + k)
+		}
+
+		columns[field] = strings.ToLower(v)
+	}
+
+	return columns, nil
+}
+
+// Reads posts from a dump, passing each valid one to add. An error from add
+// ends the import. report, if not nil, is called as the import goes on.
+func ImportPosts(r io.Reader, opts ImportOptions, add func(Post) error,
+	report func(ImportProgress)) (ImportProgress, error) {
+
+	var progress ImportProgress
+
+	columns, err := opts.columns()
+
+	if err != nil {
+		return progress, err
+	}
+
+	record := func(get func(key string) (string, bool)) error {
+		progress.Read++
+
+		post, err := importPost(columns, get)
+
+		if err == nil {
+			err = post.Valid()
+		}
+
+		if err != nil {
+			progress.skip(progress.Read, err)
+		} else if err := add(post); err != nil {
+			return err
+		} else {
+			progress.Imported++
+		}
+
+		if report != nil && progress.Read%importReportEvery == 0 {
+			report(progress)
+		}
+
+		return nil
+	}
+
+	switch opts.Format {
+	case ImportJSONL:
+		err = importJSONL(r, record, &progress)
+	case ImportCSV:
+		err = importCSV(r, record, &progress)
+	default:
+		err = errors.New("Unknown import format: " + opts.Format)
+	}
+
+	progress.Done = err == nil
+
+	if report != nil {
+		report(progress)
+	}
+
+	return progress, err
+}
+
+func importJSONL(r io.Reader, record func(func(string) (string, bool)) error,
+	progress *ImportProgress) error {
+
+	reader := bufio.NewReader(r)
+
+	for {
+		line, long, err := readImportLine(reader)
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if long {
+			progress.Read++
+			progress.skip(progress.Read, errors.New("Line too long"))
+			continue
+		}
+
+		line = bytes.TrimSpace(line)
+
+		if len(line) == 0 {
+			continue
+		}
+
+		var raw map[string]json.RawMessage
+
+		if err := json.Unmarshal(line, &raw); err != nil {
+			progress.Read++
+			progress.skip(progress.Read, err)
+			continue
+		}
+
+		values := make(map[string]json.RawMessage, len(raw))
+
+		for k, v := range raw {
+			values[strings.ToLower(k)] = v
+		}
+
+		get := func(key string) (string, bool) {
+			v, ok := values[key]
+
+			if !ok || string(v) == "null" {
+				return "", false
+			}
+
+			// Strings are unquoted, anything else, including objects of
+			// meta, is kept as JSON.
+			var s string
+
+			if json.Unmarshal(v, &s) == nil {
+				return s, true
+			}
+
+			return string(v), true
+		}
+
+		if err := record(get); err != nil {
+			return err
+		}
+	}
+}
+
+// Reads a line, newline and all. A line longer than importLineMax is read to
+// its end but not kept, and long is set instead. Returns io.EOF once there are
+// no lines left.
+func readImportLine(r *bufio.Reader) (line []byte, long bool, err error) {
+	for {
+		part, err := r.ReadSlice('\n')
+
+		if len(line)+len(part) > importLineMax {
+			line, long = nil, true
+		} else if !long {
+			line = append(line, part...)
+		}
+
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && (len(line) > 0 || long):
+			// The last line need not end in a newline.
+			return line, long, nil
+		}
+
+		return line, long, err
+	}
+}
+
+func importCSV(r io.Reader, record func(func(string) (string, bool)) error,
+	progress *ImportProgress) error {
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+
+	if err != nil {
+		return errors.New("CSV dump has no header row")
+	}
+
+	index := make(map[string]int, len(header))
+
+	for n, i := range header {
+		index[strings.ToLower(strings.TrimSpace(i))] = n
+	}
+
+	for {
+		row, err := reader.Read()
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if perr, ok := err.(*csv.ParseError); ok {
+			progress.Read++
+			progress.skip(progress.Read, perr)
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		get := func(key string) (string, bool) {
+			n, ok := index[key]
+
+			if !ok || n >= len(row) {
+				return "", false
+			}
+
+			return row[n], true
+		}
+
+		if err := record(get); err != nil {
+			return err
+		}
+	}
+}
+
+// Dates may be unix times, RFC 3339, or as in search queries.
+func parseImportDate(s string) (int, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return int(n), nil
+	}
+
+	for _, i := range []string{time.RFC3339, QueryDateFormat} {
+		if t, err := time.Parse(i, s); err == nil {
+			return int(t.Unix()), nil
+		}
+	}
+
+	return 0, errors.New("Invalid date: " + s)
+}
+
+func importPost(columns map[string]string, get func(string) (string, bool)) (Post, error) {
+	post := Post{Meta: make(Meta)}
+
+	for _, field := range importFields {
+		value, ok := get(columns[field])
+		value = strings.TrimSpace(value)
+
+		if !ok || value == "" {
+			continue
+		}
+
+		var err error
+
+		switch field {
+		case "infohash":
+			post.InfoHash = value
+		case "title":
+			post.Title = value
+		case "tags":
+			post.Tags = MergeTags(value, "")
+		case "meta":
+			post.Meta = ParseMeta(value)
+		case "size":
+			var size int64
+			size, err = ParseSize(value)
+			post.Size = int(size)
+		case "filecount":
+			post.FileCount, err = strconv.Atoi(value)
+		case "seeders":
+			post.Seeders, err = strconv.Atoi(value)
+		case "leechers":
+			post.Leechers, err = strconv.Atoi(value)
+		case "uploaddate":
+			post.UploadDate, err = parseImportDate(value)
+		}
+
+		if err != nil {
+			return post, errors.New("Invalid " + field + ": " + value)
+		}
+	}
+
+	if post.InfoHash == "" {
+		return post, errors.New("No infohash")
+	}
+
+	return post, nil
+}
@@ -0,0 +1,106 @@
+package data
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestImportJSONL(t *testing.T) {
+	dump := `{"InfoHash": "` + ubuntuInfoHash + `", "Title": "Ubuntu", "Size": 1024, "Meta": {"lang": "en"}}
+
+{"infohash": "nope", "title": "Invalid"}
+not json
+{"hash": "` + strings.Repeat("ab", 20) + `", "name": "Mapped", "size": "1.5KB", "uploaddate": "2016-01-02", "tags": "a, b,A"}
+`
+
+	posts := make([]Post, 0)
+	reports := 0
+
+	progress, err := ImportPosts(strings.NewReader(dump),
+		ImportOptions{ImportJSONL, map[string]string{"infohash": "hash", "Title": "name"}},
+		func(p Post) error {
+			posts = append(posts, p)
+			return nil
+		},
+		func(ImportProgress) { reports++ })
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// The first post's infohash is only under its own name, which is mapped
+	// away.
+	if progress.Read != 4 || progress.Imported != 1 || progress.Skipped != 3 || len(progress.Errors) != 3 {
+		t.Errorf("Progress is %+v", progress)
+	}
+
+	if !progress.Done || reports != 1 {
+		t.Errorf("Done %v after %d reports", progress.Done, reports)
+	}
+
+	if len(posts) != 1 || posts[0].Title != "Mapped" || posts[0].Size != 1536 ||
+		posts[0].Tags != "a,b" || posts[0].UploadDate != 1451692800 {
+		t.Errorf("Posts are %+v", posts)
+	}
+
+	posts = posts[:0]
+
+	progress, err = ImportPosts(strings.NewReader(dump), ImportOptions{Format: ImportJSONL},
+		func(p Post) error {
+			posts = append(posts, p)
+			return nil
+		}, nil)
+
+	if err != nil || progress.Imported != 1 || posts[0].Meta.Get("lang") != "en" {
+		t.Errorf("Unmapped import gave %+v, %v", posts, err)
+	}
+
+	// A line too long to read is skipped like any other bad record, and the
+	// last line need not end in a newline.
+	long := `{"title": "` + strings.Repeat("x", importLineMax) + `"}` + "\n" +
+		`{"infohash": "` + strings.Repeat("cd", 20) + `", "title": "After"}`
+	posts = posts[:0]
+
+	progress, err = ImportPosts(strings.NewReader(long), ImportOptions{Format: ImportJSONL},
+		func(p Post) error {
+			posts = append(posts, p)
+			return nil
+		}, nil)
+
+	if err != nil || progress.Skipped != 1 || len(posts) != 1 || posts[0].Title != "After" {
+		t.Errorf("Import with a long line gave %+v, %v", progress, err)
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	dump := "Hash,Name,Seeders,Meta\n" +
+		ubuntuInfoHash + ",\"Ubuntu, 16.04\",10,imdb=tt0111161\n" +
+		strings.Repeat("ab", 20) + ",Bad seeders,lots,\n" +
+		strings.Repeat("cd", 20) + ",Short row\n"
+
+	posts := make([]Post, 0)
+
+	progress, err := ImportPosts(strings.NewReader(dump),
+		ImportOptions{ImportCSV, map[string]string{"infohash": "hash", "title": "name"}},
+		func(p Post) error {
+			posts = append(posts, p)
+			return nil
+		}, nil)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if progress.Imported != 2 || progress.Skipped != 1 {
+		t.Errorf("Progress is %+v", progress)
+	}
+
+	if posts[0].Title != "Ubuntu, 16.04" || posts[0].Seeders != 10 || posts[0].Meta.Get("imdb") != "tt0111161" {
+		t.Errorf("First post is %+v", posts[0])
+	}
+
+	if _, err := ImportPosts(strings.NewReader(dump), ImportOptions{ImportCSV, map[string]string{"colour": "x"}},
+		func(Post) error { return nil }, nil); err == nil {
+		t.Error("Imported with an unknown field mapped")
+	}
+}
@@ -0,0 +1,69 @@
+// The full text index is kept up to date by triggers on the post table, so
+// posts are searchable as soon as they are inserted, however they got there.
+// These repair it should it ever get out of step.
+
+package data
+
+type IndexCheck struct {
+	Posts int `json:"posts"`
+	// Posts that are not indexed.
+	Missing int `json:"missing"`
+	// Index entries for posts that no longer exist.
+	Stale int `json:"stale"`
+	// Index entries that no longer match their post.
+	Outdated int `json:"outdated"`
+	// Set if the index itself is corrupt.
+	Error string `json:"error,omitempty"`
+}
+
+func (ic *IndexCheck) Ok() bool {
+	return ic.Missing == 0 && ic.Stale == 0 && ic.Outdated == 0 && ic.Error == ""
+}
+
+// Check the full text index is consistent, and matches the post table. An
+// error is only returned if the check could not be run.
+func (db *Database) CheckFts() (*IndexCheck, error) {
+	ic := &IndexCheck{}
+
+	if _, err := db.conn.Exec(sql_integrity_check_fts); err != nil {
+		ic.Error = err.Error()
+	}
+
+	counts := []struct {
+		query string
+		dest  *int
+	}{
+		{"SELECT COUNT(*) FROM post", &ic.Posts},
+		{sql_count_fts_missing, &ic.Missing},
+		{sql_count_fts_stale, &ic.Stale},
+		{sql_count_fts_outdated, &ic.Outdated},
+	}
+
+	for _, i := range counts {
+		if err := db.conn.QueryRow(i.query).Scan(i.dest); err != nil {
+			return nil, err
+		}
+	}
+
+	return ic, nil
+}
+
+// Throw away the full text index and index every post again.
+func (db *Database) RebuildFts() (err error) {
+	tx, err := db.conn.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		err = tx.Commit()
+	}()
+
+	return execAll(sql_clear_fts, sql_populate_fts5_post)(tx)
+}
@@ -0,0 +1,130 @@
+package data
+
+import (
+	"fmt"
+	"testing"
+)
+
+func searchCount(t *testing.T, db *Database, query string) int {
+	results, err := db.Search(query, 0, 25)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return len(results)
+}
+
+func TestIndexTriggers(t *testing.T) {
+	db, done := tempDatabase(t)
+	defer done()
+
+	id, _, err := db.UpsertPost(Post{InfoHash: ubuntuInfoHash, Title: "Ubuntu"})
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if searchCount(t, db, "ubuntu") != 1 {
+		t.Error("Inserted post not indexed")
+	}
+
+	// Merges update the post.
+	db.UpsertPost(Post{InfoHash: ubuntuInfoHash, Title: "Ubuntu", Tags: "linux"})
+
+	if searchCount(t, db, "linux") != 1 {
+		t.Error("Merged tags not indexed")
+	}
+
+	db.AddMeta(int(id), "release", "xenial")
+
+	if searchCount(t, db, "xenial") != 1 {
+		t.Error("Added meta not indexed")
+	}
+
+	if _, err := db.conn.Exec("DELETE FROM post WHERE id=?", id); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if searchCount(t, db, "ubuntu") != 0 {
+		t.Error("Deleted post still indexed")
+	}
+
+	check, err := db.CheckFts()
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !check.Ok() {
+		t.Errorf("Index check failed: %+v", check)
+	}
+}
+
+func TestIndexPieces(t *testing.T) {
+	db, done := tempDatabase(t)
+	defer done()
+
+	pieces := make(chan *Piece, 2)
+
+	for i := 0; i < 2; i++ {
+		piece := &Piece{}
+		piece.Setup()
+
+		for j := 0; j < 3; j++ {
+			piece.Add(Post{InfoHash: fmt.Sprintf("%040x", i*3+j+1), Title: "Mirrored"}, true)
+		}
+
+		pieces <- piece
+	}
+
+	close(pieces)
+
+	if err := db.InsertPieces(pieces); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if searchCount(t, db, "mirrored") != 6 {
+		t.Error("Mirrored posts not indexed")
+	}
+}
+
+func TestIndexRebuild(t *testing.T) {
+	db, done := tempDatabase(t)
+	defer done()
+
+	insertPosts(t, db, Post{Title: "Ubuntu"}, Post{Title: "Debian"})
+
+	// Break the index behind the triggers' backs.
+	db.conn.Exec("DELETE FROM fts_post WHERE rowid = 1")
+	db.conn.Exec("INSERT INTO fts_post(rowid, title) VALUES(99, 'Gone')")
+	db.conn.Exec("UPDATE fts_post SET title = 'Fedora' WHERE rowid = 2")
+
+	check, err := db.CheckFts()
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if check.Ok() || check.Posts != 2 || check.Missing != 1 || check.Stale != 1 || check.Outdated != 1 {
+		t.Errorf("Index check is %+v", check)
+	}
+
+	if err := db.RebuildFts(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	check, err = db.CheckFts()
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !check.Ok() {
+		t.Errorf("Index check after rebuild is %+v", check)
+	}
+
+	if searchCount(t, db, "ubuntu") != 1 || searchCount(t, db, "gone") != 0 {
+		t.Error("Rebuilt index searched wrongly")
+	}
+}
@@ -0,0 +1,145 @@
+// The same torrent is often published by many peers, with the infohash written
+// in different ways. Infohashes are normalised to lowercase hex before being
+// stored, and a post for an infohash we already have is merged into the
+// existing one rather than duplicating it.
+
+package data
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+var errInvalidInfoHash = errors.New("Invalid infohash")
+
+// Turns an infohash into lowercase hex. Accepts hex or base32 v1 infohashes,
+// hex v2 infohashes, and any of those with a "urn:btih:" prefix.
+func NormaliseInfoHash(hash string) (string, error) {
+	hash = strings.TrimSpace(hash)
+
+	if len(hash) > 9 && strings.EqualFold(hash[:9], "urn:btih:") {
+		hash = hash[9:]
+	}
+
+	switch len(hash) {
+	case 40, 64:
+		raw, err := hex.DecodeString(hash)
+
+		if err != nil {
+			return "", errInvalidInfoHash
+		}
+
+		return hex.EncodeToString(raw), nil
+
+	case 32:
+		raw, err := base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+
+		if err != nil {
+			return "", errInvalidInfoHash
+		}
+
+		return hex.EncodeToString(raw), nil
+	}
+
+	return "", errInvalidInfoHash
+}
+
+// Combines two comma separated tag lists, keeping the order tags are first
+// seen in and dropping duplicates regardless of case. Tags that would take the
+// list over TagsMax are dropped.
+func MergeTags(a, b string) string {
+	seen := make(map[string]bool)
+	ret := make([]string, 0)
+	length := 0
+
+	for _, i := range strings.Split(a+","+b, ",") {
+		tag := strings.TrimSpace(i)
+		key := strings.ToLower(tag)
+
+		if tag == "" || seen[key] {
+			continue
+		}
+
+		if length+len(tag)+len(ret) > TagsMax {
+			break
+		}
+
+		seen[key] = true
+		length += len(tag)
+		ret = append(ret, tag)
+	}
+
+	return strings.Join(ret, ",")
+}
+
+// Merges another post for the same infohash into this one. Peer counts are
+// each the highest seen, as different sources usually see the same swarm and
+// summing them would count peers twice. Tags are combined, the earliest upload
+// date is kept, and anything this post is missing is filled in, unless it is
+// signed. Metadata is combined too, unless other is signed by this post's
+// author, whose metadata replaces it so that removals carry over. Returns true
+// if anything changed.
+func (p *Post) Merge(other Post) bool {
+	changed := false
+	verified := other.Verify() == nil
+
+	// What a signature covers is never changed, so that it stays valid. An
+	// unsigned post takes the signed fields, and signature, of a signed one.
+	if !p.Signed() && verified {
+		p.Title = other.Title
+		p.Size = other.Size
+		p.FileCount = other.FileCount
+		p.Author = other.Author
+		p.Signature = other.Signature
+		changed = true
+	}
+
+	if other.Seeders > p.Seeders {
+		p.Seeders = other.Seeders
+		changed = true
+	}
+
+	if other.Leechers > p.Leechers {
+		p.Leechers = other.Leechers
+		changed = true
+	}
+
+	if tags := MergeTags(p.Tags, other.Tags); tags != p.Tags {
+		p.Tags = tags
+		changed = true
+	}
+
+	if !p.Signed() && p.Size == 0 && other.Size != 0 {
+		p.Size = other.Size
+		changed = true
+	}
+
+	if !p.Signed() && p.FileCount == 0 && other.FileCount != 0 {
+		p.FileCount = other.FileCount
+		changed = true
+	}
+
+	if other.UploadDate != 0 && (p.UploadDate == 0 || other.UploadDate < p.UploadDate) {
+		p.UploadDate = other.UploadDate
+		changed = true
+	}
+
+	if p.Meta == nil {
+		p.Meta = make(Meta)
+	}
+
+	if verified && bytes.Equal(p.Author, other.Author) {
+		if p.Meta.Encode() != other.Meta.Encode() {
+			p.Meta = make(Meta)
+			p.Meta.Merge(other.Meta)
+			changed = true
+		}
+	} else if p.Meta.Merge(other.Meta) {
+		changed = true
+	}
+
+	return changed
+}
@@ -0,0 +1,182 @@
+package data
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const ubuntuInfoHash = "9f9165d9a281a9b8e782cd5176bbcc8256fd1871"
+
+func TestNormaliseInfoHash(t *testing.T) {
+	cases := []string{
+		ubuntuInfoHash,
+		"9F9165D9A281A9B8E782CD5176BBCC8256FD1871",
+		" urn:btih:9f9165d9a281a9b8e782cd5176bbcc8256fd1871 ",
+		"T6IWLWNCQGU3RZ4CZVIXNO6MQJLP2GDR",
+		"t6iwlwncqgu3rz4czvixno6mqjlp2gdr",
+	}
+
+	for _, i := range cases {
+		hash, err := NormaliseInfoHash(i)
+
+		if err != nil {
+			t.Errorf("%q: %s", i, err.Error())
+			continue
+		}
+
+		if hash != ubuntuInfoHash {
+			t.Errorf("%q normalised to %q", i, hash)
+		}
+	}
+
+	for _, i := range []string{"", "foo", ubuntuInfoHash[:39] + "z"} {
+		if _, err := NormaliseInfoHash(i); err == nil {
+			t.Errorf("%q accepted", i)
+		}
+	}
+}
+
+func TestMergeTags(t *testing.T) {
+	if tags := MergeTags("linux, iso", "ISO,ubuntu,,"); tags != "linux,iso,ubuntu" {
+		t.Errorf("Merged tags are %q", tags)
+	}
+}
+
+func TestPostMerge(t *testing.T) {
+	post := Post{Seeders: 10, Leechers: 5, UploadDate: 200, Tags: "linux"}
+
+	changed := post.Merge(Post{Seeders: 3, Leechers: 8, UploadDate: 100, Size: 50,
+		Tags: "iso"})
+
+	if !changed {
+		t.Error("Merge reported no change")
+	}
+
+	if post.Seeders != 10 || post.Leechers != 8 || post.UploadDate != 100 ||
+		post.Size != 50 || post.Tags != "linux,iso" {
+		t.Errorf("Bad merge: %+v", post)
+	}
+
+	if post.Merge(post) {
+		t.Error("Merging a post with itself changed it")
+	}
+}
+
+func tempDatabase(t *testing.T) (*Database, func()) {
+	dir, err := ioutil.TempDir("", "zif-data")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	db := NewDatabase(filepath.Join(dir, "posts.db"))
+
+	if err := db.Connect(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err.Error())
+	}
+
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUpsertPost(t *testing.T) {
+	db, done := tempDatabase(t)
+	defer done()
+
+	post := Post{InfoHash: ubuntuInfoHash, Title: "Ubuntu", Seeders: 5, Tags: "linux"}
+
+	id, inserted, err := db.UpsertPost(post)
+
+	if err != nil || !inserted {
+		t.Fatal("Post not inserted")
+	}
+
+	post.InfoHash = "T6IWLWNCQGU3RZ4CZVIXNO6MQJLP2GDR"
+	post.Seeders = 9
+	post.Tags = "iso"
+
+	id2, inserted, err := db.UpsertPost(post)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if inserted || id2 != id {
+		t.Fatal("Duplicate post inserted")
+	}
+
+	merged, err := db.QueryInfoHash(ubuntuInfoHash)
+
+	if err != nil || merged == nil {
+		t.Fatal("Merged post not found")
+	}
+
+	if merged.Seeders != 9 || merged.Tags != "linux,iso" {
+		t.Errorf("Bad merge: %+v", merged)
+	}
+}
+
+func TestMigrateDuplicates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zif-data")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "posts.db")
+
+	// A database from before migrations, with the same infohash three times.
+	conn, err := sql.Open("sqlite3", path)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	conn.Exec(legacy_post_table)
+	conn.Exec(legacy_fts_post)
+
+	for _, i := range []string{ubuntuInfoHash, "9F9165D9A281A9B8E782CD5176BBCC8256FD1871",
+		"T6IWLWNCQGU3RZ4CZVIXNO6MQJLP2GDR"} {
+		_, err := conn.Exec(sql_insert_post, i, "Ubuntu", 0, 0, 1, 1, 0, "", "")
+
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	conn.Close()
+
+	db := NewDatabase(path)
+
+	if err := db.Connect(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer db.Close()
+
+	var rows int
+	db.conn.QueryRow("SELECT COUNT(*) FROM post").Scan(&rows)
+
+	if rows != 1 {
+		t.Errorf("%d posts after migration, want 1", rows)
+	}
+
+	// OR IGNORE, so a duplicate is silently dropped now there is an index.
+	if _, err := db.conn.Exec(sql_insert_post, ubuntuInfoHash, "Again", 0, 0, 0, 0, 0, "", ""); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	db.conn.QueryRow("SELECT COUNT(*) FROM post").Scan(&rows)
+
+	if rows != 1 {
+		t.Error("Unique index not created")
+	}
+}
@@ -0,0 +1,124 @@
+// Magnet links, as in BEP 9. v1 infohashes are given as "urn:btih:", and v2
+// ones as "urn:btmh:" followed by the SHA-256 multihash, as BEP 52 has it.
+
+package data
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The multihash prefix for a 32 byte SHA-256 digest.
+const multihashPrefix = "1220"
+
+type Magnet struct {
+	InfoHash   string   `json:"infoHash,omitempty"`
+	InfoHashV2 string   `json:"infoHashV2,omitempty"`
+	Name       string   `json:"name,omitempty"`
+	Size       int64    `json:"size,omitempty"`
+	Trackers   []string `json:"trackers,omitempty"`
+}
+
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(strings.TrimSpace(uri))
+
+	if err != nil || u.Scheme != "magnet" {
+		return nil, errors.New("Not a magnet link")
+	}
+
+	q, err := url.ParseQuery(u.RawQuery)
+
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Magnet{Name: q.Get("dn"), Trackers: q["tr"]}
+
+	for _, i := range q["xt"] {
+		lower := strings.ToLower(i)
+
+		switch {
+		case strings.HasPrefix(lower, "urn:btih:"):
+			m.InfoHash, err = NormaliseInfoHash(i[9:])
+
+			if err != nil || len(m.InfoHash) != 40 {
+				return nil, errInvalidInfoHash
+			}
+
+		case strings.HasPrefix(lower, "urn:btmh:"+multihashPrefix):
+			m.InfoHashV2, err = NormaliseInfoHash(i[13:])
+
+			if err != nil || len(m.InfoHashV2) != 64 {
+				return nil, errInvalidInfoHash
+			}
+		}
+	}
+
+	if m.InfoHash == "" && m.InfoHashV2 == "" {
+		return nil, errors.New("Magnet link has no infohash")
+	}
+
+	if xl := q.Get("xl"); xl != "" {
+		m.Size, err = strconv.ParseInt(xl, 10, 64)
+
+		if err != nil || m.Size < 0 {
+			return nil, errors.New("Invalid size in magnet link")
+		}
+	}
+
+	return m, nil
+}
+
+// The magnet link for a post. Posts only know one infohash, and no trackers.
+func PostMagnet(p *Post) *Magnet {
+	m := &Magnet{Name: p.Title, Size: int64(p.Size)}
+
+	if len(p.InfoHash) == 64 {
+		m.InfoHashV2 = p.InfoHash
+	} else {
+		m.InfoHash = p.InfoHash
+	}
+
+	if btmh := p.Meta.Get("btmh"); strings.HasPrefix(btmh, multihashPrefix) {
+		m.InfoHashV2 = btmh[len(multihashPrefix):]
+	}
+
+	return m
+}
+
+// Builds the link. Infohashes are left unescaped, as clients expect.
+func (m *Magnet) String() string {
+	parts := make([]string, 0)
+
+	if m.InfoHash != "" {
+		parts = append(parts, "xt=urn:btih:"+m.InfoHash)
+	}
+
+	if m.InfoHashV2 != "" {
+		parts = append(parts, "xt=urn:btmh:"+multihashPrefix+m.InfoHashV2)
+	}
+
+	if m.Name != "" {
+		parts = append(parts, "dn="+url.QueryEscape(m.Name))
+	}
+
+	if m.Size > 0 {
+		parts = append(parts, "xl="+strconv.FormatInt(m.Size, 10))
+	}
+
+	for _, i := range m.Trackers {
+		parts = append(parts, "tr="+url.QueryEscape(i))
+	}
+
+	return "magnet:?" + strings.Join(parts, "&")
+}
+
+// A post for the magnet link. It has no file count, as magnet links do not
+// carry one.
+func (m *Magnet) Post() Post {
+	t := Torrent{Name: m.Name, InfoHash: m.InfoHash, InfoHashV2: m.InfoHashV2, Size: m.Size}
+
+	return t.Post()
+}
@@ -0,0 +1,701 @@
+// A PostStore kept in memory. Nothing is kept once the process exits, so it
+// suits tests and nodes that only serve what they are given each run, as zifd
+// does with -memory. It searches the way the SQLite store does, matching words,
+// phrases and prefixes in titles, tags and meta, though relevance is a weighted
+// count of matches rather than BM25.
+
+package data
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type MemoryStore struct {
+	lock sync.RWMutex
+
+	// In the order they were stored, so by id.
+	posts      []*Post
+	byHash     map[string]*Post
+	nextId     int
+	tombstones map[string]*Tombstone
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		posts:      make([]*Post, 0),
+		byHash:     make(map[string]*Post),
+		tombstones: make(map[string]*Tombstone),
+	}
+}
+
+// Posts are copied in and out, so that nothing outside the store can change
+// what it holds.
+func copyPost(p *Post) *Post {
+	post := *p
+	post.Meta = make(Meta)
+	post.Meta.Merge(p.Meta)
+
+	return &post
+}
+
+func (ms *MemoryStore) UpsertPost(post Post) (int64, bool, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	return ms.upsertPost(post)
+}
+
+func (ms *MemoryStore) upsertPost(post Post) (int64, bool, error) {
+	if err := preparePost(&post); err != nil {
+		return -1, false, err
+	}
+
+	existing := ms.byHash[post.InfoHash]
+
+	if _, err := mergeStored(&post, existing, ms.tombstones[post.InfoHash]); err != nil {
+		return -1, false, err
+	}
+
+	if existing == nil {
+		ms.nextId++
+
+		stored := copyPost(&post)
+		stored.Id = ms.nextId
+
+		ms.posts = append(ms.posts, stored)
+		ms.byHash[stored.InfoHash] = stored
+
+		return int64(stored.Id), true, nil
+	}
+
+	return int64(existing.Id), false, nil
+}
+
+func (ms *MemoryStore) InsertPost(post Post) (int64, error) {
+	id, _, err := ms.UpsertPost(post)
+
+	return id, err
+}
+
+// Stores pieces until the channel is closed, skipping posts as
+// Database.InsertPieces does.
+func (ms *MemoryStore) InsertPieces(pieces chan *Piece) error {
+	for piece := range pieces {
+		ms.lock.Lock()
+
+		for _, i := range piece.Posts {
+			_, _, err := ms.upsertPost(i)
+
+			if skipPost(err) {
+				continue
+			}
+
+			if err != nil {
+				ms.lock.Unlock()
+				return err
+			}
+		}
+
+		ms.lock.Unlock()
+	}
+
+	return nil
+}
+
+func (ms *MemoryStore) QueryInfoHash(infohash string) (*Post, error) {
+	hash, err := NormaliseInfoHash(infohash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	if post, ok := ms.byHash[hash]; ok {
+		return copyPost(post), nil
+	}
+
+	return nil, nil
+}
+
+// The position of the first post with an id of at least id.
+func (ms *MemoryStore) position(id int) int {
+	return sort.Search(len(ms.posts), func(i int) bool {
+		return ms.posts[i].Id >= id
+	})
+}
+
+func (ms *MemoryStore) QueryPostId(id uint) (Post, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	if n := ms.position(int(id)); n < len(ms.posts) && ms.posts[n].Id == int(id) {
+		return *copyPost(ms.posts[n]), nil
+	}
+
+	return Post{}, nil
+}
+
+// A page of posts, sorted stably by less, from the most recent limit posts if
+// limit is above zero.
+func (ms *MemoryStore) sortedPage(page, limit int, less func(a, b *Post) bool) []*Post {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	page_size := 25
+
+	posts := append([]*Post(nil), ms.posts...)
+
+	sort.SliceStable(posts, func(a, b int) bool {
+		return posts[a].UploadDate > posts[b].UploadDate
+	})
+
+	if limit > 0 && len(posts) > limit {
+		posts = posts[:limit]
+	}
+
+	sort.SliceStable(posts, func(a, b int) bool {
+		return less(posts[a], posts[b])
+	})
+
+	ret := make([]*Post, 0, page_size)
+
+	for i := page * page_size; i >= 0 && i < len(posts) && len(ret) < page_size; i++ {
+		ret = append(ret, copyPost(posts[i]))
+	}
+
+	return ret
+}
+
+func (ms *MemoryStore) QueryRecent(page int) ([]*Post, error) {
+	return ms.sortedPage(page, 0, func(a, b *Post) bool {
+		return a.UploadDate > b.UploadDate
+	}), nil
+}
+
+func (ms *MemoryStore) QueryPopular(page int) ([]*Post, error) {
+	return ms.sortedPage(page, 10000, func(a, b *Post) bool {
+		return a.Seeders+a.Leechers > b.Seeders+b.Leechers
+	}), nil
+}
+
+// Posts from start up to, but not including, end.
+func (ms *MemoryStore) slice(start, end int) []*Post {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	if start < 0 {
+		start = 0
+	}
+
+	if end > len(ms.posts) {
+		end = len(ms.posts)
+	}
+
+	ret := make([]*Post, 0)
+
+	for i := start; i < end; i++ {
+		ret = append(ret, copyPost(ms.posts[i]))
+	}
+
+	return ret
+}
+
+func (ms *MemoryStore) QueryPiece(id int, store bool) (*Piece, error) {
+	var piece Piece
+	piece.Setup()
+
+	for _, i := range ms.slice(id*PieceSize, (id+1)*PieceSize) {
+		piece.Add(*i, store)
+	}
+
+	return &piece, nil
+}
+
+func (ms *MemoryStore) QueryPiecePosts(start, length int, store bool) chan *Post {
+	ret := make(chan *Post)
+	posts := ms.slice(start*PieceSize, (start+length)*PieceSize)
+
+	go func() {
+		defer close(ret)
+
+		for _, i := range posts {
+			ret <- i
+		}
+	}()
+
+	return ret
+}
+
+func (ms *MemoryStore) PostPosition(id int) (int, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	return ms.position(id), nil
+}
+
+func (ms *MemoryStore) PostCount() uint {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	return uint(len(ms.posts))
+}
+
+func (ms *MemoryStore) Search(query string, page, pageSize int) ([]*Post, error) {
+	q, err := ParseQuery(query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	hits, err := ms.SearchQuery(q, page, pageSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	posts := make([]*Post, 0, len(hits))
+
+	for _, i := range hits {
+		posts = append(posts, i.Post)
+	}
+
+	return posts, nil
+}
+
+// A word or phrase to match, as FtsQuery would make it.
+type memoryTerm struct {
+	words []string
+	// The last word matches as a prefix.
+	prefix bool
+}
+
+// Lowercase words, split the way the full text index splits them.
+func memoryTokens(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !isTokenRune(r)
+	})
+}
+
+func memoryTerms(text string) []memoryTerm {
+	terms := make([]memoryTerm, 0)
+
+	for n, part := range strings.Split(text, `"`) {
+		// Odd parts were between quotes.
+		if n%2 == 1 {
+			if words := memoryTokens(part); len(words) > 0 {
+				terms = append(terms, memoryTerm{words: words})
+			}
+
+			continue
+		}
+
+		for _, word := range strings.Fields(part) {
+			prefix := strings.HasSuffix(word, "*")
+
+			if words := memoryTokens(word); len(words) > 0 {
+				terms = append(terms, memoryTerm{words, prefix})
+			}
+		}
+	}
+
+	return terms
+}
+
+func (t memoryTerm) matchWord(n int, word string) bool {
+	if t.prefix && n == len(t.words)-1 {
+		return strings.HasPrefix(word, t.words[n])
+	}
+
+	return word == t.words[n]
+}
+
+// How many times the term is in a column's words.
+func (t memoryTerm) count(words []string) int {
+	count := 0
+
+	for i := 0; i+len(t.words) <= len(words); i++ {
+		match := true
+
+		for n := range t.words {
+			if !t.matchWord(n, words[i+n]) {
+				match = false
+				break
+			}
+		}
+
+		if match {
+			count++
+		}
+	}
+
+	return count
+}
+
+func memoryHealth(post *Post) float64 {
+	return float64(post.Seeders)*1.1 + float64(post.Leechers)
+}
+
+// Ranks a post as Query.Rank would.
+func memoryRank(q *Query, post *Post, relevance float64) float64 {
+	switch q.Sort {
+	case "relevance":
+		if relevance != 0 {
+			health := memoryHealth(post)
+			return relevance * (1.0 + 0.25*health/(health+100.0))
+		}
+
+		return memoryHealth(post)
+	case "health":
+		return memoryHealth(post)
+	case "seeders":
+		return float64(post.Seeders)
+	case "leechers":
+		return float64(post.Leechers)
+	case "size":
+		return float64(post.Size)
+	case "files":
+		return float64(post.FileCount)
+	case "date":
+		return float64(post.UploadDate)
+	}
+
+	return 0
+}
+
+// Highlights the words in a title that match any term.
+func memorySnippet(title string, terms []memoryTerm) string {
+	var buf bytes.Buffer
+	runes := []rune(title)
+
+	for i := 0; i < len(runes); {
+		if !isTokenRune(runes[i]) {
+			buf.WriteRune(runes[i])
+			i++
+			continue
+		}
+
+		end := i
+
+		for end < len(runes) && isTokenRune(runes[end]) {
+			end++
+		}
+
+		word := string(runes[i:end])
+		lower := strings.ToLower(word)
+		match := false
+
+		for _, t := range terms {
+			for n := range t.words {
+				if t.matchWord(n, lower) {
+					match = true
+				}
+			}
+		}
+
+		if match {
+			buf.WriteString(SnippetOpen + word + SnippetClose)
+		} else {
+			buf.WriteString(word)
+		}
+
+		i = end
+	}
+
+	return buf.String()
+}
+
+// Whether any post has metadata under key.
+func (ms *MemoryStore) hasMetaKey(key string) bool {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	for _, i := range ms.posts {
+		if len(i.Meta[key]) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ms *MemoryStore) SearchQuery(q *Query, page, pageSize int) ([]SearchHit, error) {
+	hits := make([]SearchHit, 0, pageSize)
+	q = q.WithMetaKeys(ms.hasMetaKey)
+	terms := memoryTerms(q.Text)
+
+	// Nothing searchable, such as a query of only punctuation.
+	if len(terms) == 0 && q.Text != "" {
+		return hits, nil
+	}
+
+	ms.lock.RLock()
+
+	for _, post := range ms.posts {
+		if !q.Allows(post) {
+			continue
+		}
+
+		relevance := 0.0
+		title := memoryTokens(post.Title)
+		tags := memoryTokens(post.Tags)
+		meta := memoryTokens(post.Meta.Encode())
+		match := true
+
+		for _, t := range terms {
+			// Weighted as BM25 is, see sql_search_rank_relevance.
+			score := 2.0*float64(t.count(title)) + float64(t.count(tags)) +
+				0.5*float64(t.count(meta))
+
+			if score == 0 {
+				match = false
+				break
+			}
+
+			relevance -= score
+		}
+
+		if !match {
+			continue
+		}
+
+		hit := SearchHit{Post: copyPost(post), Rank: memoryRank(q, post, relevance)}
+
+		if len(terms) > 0 {
+			hit.Snippet = memorySnippet(post.Title, terms)
+		}
+
+		hits = append(hits, hit)
+	}
+
+	ms.lock.RUnlock()
+
+	_, descending := q.Rank()
+
+	// Ties are broken by id, so that pages do not overlap.
+	sort.SliceStable(hits, func(a, b int) bool {
+		if hits[a].Rank == hits[b].Rank {
+			return hits[a].Post.Id < hits[b].Post.Id
+		}
+
+		if descending {
+			return hits[a].Rank > hits[b].Rank
+		}
+
+		return hits[a].Rank < hits[b].Rank
+	})
+
+	start := page * pageSize
+
+	if start < 0 || start >= len(hits) {
+		return hits[:0], nil
+	}
+
+	if start+pageSize < len(hits) {
+		return hits[start : start+pageSize], nil
+	}
+
+	return hits[start:], nil
+}
+
+// Titles starting with prefix, ignoring case, from the most recent posts.
+func (ms *MemoryStore) Suggest(prefix string) ([]string, error) {
+	suggest_size := 5
+
+	ms.lock.RLock()
+
+	posts := append([]*Post(nil), ms.posts...)
+
+	ms.lock.RUnlock()
+
+	sort.SliceStable(posts, func(a, b int) bool {
+		return posts[a].UploadDate > posts[b].UploadDate
+	})
+
+	if len(posts) > 100000 {
+		posts = posts[:100000]
+	}
+
+	sort.SliceStable(posts, func(a, b int) bool {
+		return memoryHealth(posts[a]) > memoryHealth(posts[b])
+	})
+
+	ret := make([]string, 0, suggest_size)
+	prefix = strings.ToLower(prefix)
+
+	for _, i := range posts {
+		if len(ret) == suggest_size {
+			break
+		}
+
+		if strings.HasPrefix(strings.ToLower(i.Title), prefix) {
+			ret = append(ret, i.Title)
+		}
+	}
+
+	return ret, nil
+}
+
+// Counts terms as the full text index would, by the posts whose title or tags
+// they are in.
+func (ms *MemoryStore) LoadDictionary() (*Dictionary, error) {
+	counts := make(map[string]int)
+
+	ms.lock.RLock()
+
+	for _, post := range ms.posts {
+		for _, column := range []string{post.Title, post.Tags} {
+			seen := make(map[string]bool)
+
+			for _, i := range memoryTokens(column) {
+				if !seen[i] {
+					seen[i] = true
+					counts[i]++
+				}
+			}
+		}
+	}
+
+	ms.lock.RUnlock()
+
+	terms := make([]Term, 0, len(counts))
+
+	for k, v := range counts {
+		terms = append(terms, Term{k, v})
+	}
+
+	sort.Slice(terms, func(a, b int) bool {
+		return terms[a].Term < terms[b].Term
+	})
+
+	return NewDictionary(terms), nil
+}
+
+func (ms *MemoryStore) updateMeta(pid int, update func(m Meta)) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	n := ms.position(pid)
+
+	if n >= len(ms.posts) || ms.posts[n].Id != pid {
+		return errors.New("Post not found")
+	}
+
+	m := make(Meta)
+	m.Merge(ms.posts[n].Meta)
+	update(m)
+
+	if err := m.Valid(); err != nil {
+		return err
+	}
+
+	ms.posts[n].Meta = m
+
+	return nil
+}
+
+func (ms *MemoryStore) AddMeta(pid int, key, value string) error {
+	return ms.updateMeta(pid, func(m Meta) {
+		m.Add(strings.ToLower(key), value)
+	})
+}
+
+func (ms *MemoryStore) RemoveMeta(pid int, key, value string) error {
+	return ms.updateMeta(pid, func(m Meta) {
+		m.Del(strings.ToLower(key), value)
+	})
+}
+
+func (ms *MemoryStore) QueryMeta(pid int) (Meta, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	n := ms.position(pid)
+
+	if n >= len(ms.posts) || ms.posts[n].Id != pid {
+		return nil, errors.New("Post not found")
+	}
+
+	return copyPost(ms.posts[n]).Meta, nil
+}
+
+func (ms *MemoryStore) QueryTombstone(infohash string) (*Tombstone, error) {
+	hash, err := NormaliseInfoHash(infohash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	if t, ok := ms.tombstones[hash]; ok {
+		ret := *t
+		return &ret, nil
+	}
+
+	return nil, nil
+}
+
+// Every tombstone, oldest first.
+func (ms *MemoryStore) QueryTombstones() ([]*Tombstone, error) {
+	ms.lock.RLock()
+
+	ret := make([]*Tombstone, 0, len(ms.tombstones))
+
+	for _, i := range ms.tombstones {
+		t := *i
+		ret = append(ret, &t)
+	}
+
+	ms.lock.RUnlock()
+
+	sort.SliceStable(ret, func(a, b int) bool {
+		if ret[a].Timestamp == ret[b].Timestamp {
+			return ret[a].InfoHash < ret[b].InfoHash
+		}
+
+		return ret[a].Timestamp < ret[b].Timestamp
+	})
+
+	return ret, nil
+}
+
+// See Database.ApplyTombstone.
+func (ms *MemoryStore) ApplyTombstone(t Tombstone, owner []byte) (bool, error) {
+	if err := t.CheckOwner(owner); err != nil {
+		return false, err
+	}
+
+	t.InfoHash, _ = NormaliseInfoHash(t.InfoHash)
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if last, ok := ms.tombstones[t.InfoHash]; ok && last.Timestamp >= t.Timestamp {
+		return false, nil
+	}
+
+	if post, ok := ms.byHash[t.InfoHash]; ok {
+		if post.Signed() && !bytes.Equal(post.Author, t.Author) {
+			return false, errTombstoneAuthor
+		}
+
+		if t.Deleted() {
+			n := ms.position(post.Id)
+			ms.posts = append(ms.posts[:n], ms.posts[n+1:]...)
+			delete(ms.byHash, t.InfoHash)
+		}
+	}
+
+	ms.tombstones[t.InfoHash] = &t
+
+	return true, nil
+}
+
+func (ms *MemoryStore) Close() {}
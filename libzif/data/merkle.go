@@ -0,0 +1,124 @@
+// Merkle trees, built as in RFC 6962. Leaves and nodes are hashed with
+// different prefixes, so that a node can never be passed off as a leaf. The
+// tree over n leaves splits at the largest power of two below n, so any
+// number of leaves can be used, and proofs are at most log2(n) hashes.
+
+package data
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+var errInvalidProof = errors.New("Invalid inclusion proof")
+
+func MerkleLeaf(data []byte) []byte {
+	h := sha3.New256()
+	h.Write([]byte{merkleLeafPrefix})
+	h.Write(data)
+
+	return h.Sum(nil)
+}
+
+func merkleNode(left, right []byte) []byte {
+	h := sha3.New256()
+	h.Write([]byte{merkleNodePrefix})
+	h.Write(left)
+	h.Write(right)
+
+	return h.Sum(nil)
+}
+
+// The largest power of two below n, where the tree over n leaves splits.
+func merkleSplit(n int) int {
+	k := 1
+
+	for k<<1 < n {
+		k <<= 1
+	}
+
+	return k
+}
+
+// The root of the tree over the given leaf hashes. The root of an empty tree
+// is the hash of nothing.
+func MerkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		h := sha3.New256()
+		return h.Sum(nil)
+	case 1:
+		return leaves[0]
+	}
+
+	k := merkleSplit(len(leaves))
+
+	return merkleNode(MerkleRoot(leaves[:k]), MerkleRoot(leaves[k:]))
+}
+
+// The hashes needed to get from the leaf at index to the root, nearest first.
+func MerkleProof(leaves [][]byte, index int) [][]byte {
+	if len(leaves) <= 1 || index < 0 || index >= len(leaves) {
+		return [][]byte{}
+	}
+
+	k := merkleSplit(len(leaves))
+
+	if index < k {
+		return append(MerkleProof(leaves[:k], index), MerkleRoot(leaves[k:]))
+	}
+
+	return append(MerkleProof(leaves[k:], index-k), MerkleRoot(leaves[:k]))
+}
+
+// Works out the root of a tree of size leaves from one leaf and its proof, see
+// RFC 9162 section 2.1.3.2. The result should be compared to a root that is
+// trusted.
+func MerkleProofRoot(leaf []byte, index, size int, proof [][]byte) ([]byte, error) {
+	if index < 0 || index >= size {
+		return nil, errInvalidProof
+	}
+
+	fn, sn := index, size-1
+	root := leaf
+
+	for _, i := range proof {
+		if sn == 0 {
+			return nil, errInvalidProof
+		}
+
+		if fn&1 == 1 || fn == sn {
+			root = merkleNode(i, root)
+
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			root = merkleNode(root, i)
+		}
+
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 {
+		return nil, errInvalidProof
+	}
+
+	return root, nil
+}
+
+// Whether leaf is at index in the tree of size leaves with the given root.
+func VerifyMerkleProof(root, leaf []byte, index, size int, proof [][]byte) bool {
+	computed, err := MerkleProofRoot(leaf, index, size, proof)
+
+	return err == nil && bytes.Equal(computed, root)
+}
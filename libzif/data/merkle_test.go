@@ -0,0 +1,98 @@
+package data
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestMerkleProof(t *testing.T) {
+	for size := 1; size <= 33; size++ {
+		leaves := make([][]byte, 0, size)
+
+		for i := 0; i < size; i++ {
+			leaves = append(leaves, MerkleLeaf([]byte{byte(i)}))
+		}
+
+		root := MerkleRoot(leaves)
+
+		for i := range leaves {
+			proof := MerkleProof(leaves, i)
+
+			if !VerifyMerkleProof(root, leaves[i], i, size, proof) {
+				t.Fatalf("Proof for leaf %d of %d not valid", i, size)
+			}
+
+			if VerifyMerkleProof(root, leaves[(i+1)%size], i, size, proof) && size > 1 {
+				t.Fatalf("Proof for leaf %d of %d valid for another leaf", i, size)
+			}
+		}
+	}
+
+	// A node can never pass as a leaf.
+	leaves := [][]byte{MerkleLeaf([]byte("a")), MerkleLeaf([]byte("b"))}
+
+	if bytes.Equal(MerkleRoot(leaves), MerkleLeaf(append(leaves[0], leaves[1]...))) {
+		t.Error("Node and leaf hashes collide")
+	}
+}
+
+func TestCollectionProve(t *testing.T) {
+	db, done := tempDatabase(t)
+	defer done()
+
+	// Not insertPosts, as some all digit infohashes are stored as numbers and
+	// collide.
+	hash := func(i int) string { return fmt.Sprintf("a%039x", i) }
+
+	for i := 1; i <= PieceSize+10; i++ {
+		if _, _, err := db.UpsertPost(Post{InfoHash: hash(i), Title: fmt.Sprintf("Post %d", i)}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	col, err := CreateCollection(db, 0, PieceSize)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(col.PieceHashes()) != 2 {
+		t.Fatalf("%d pieces, want 2", len(col.PieceHashes()))
+	}
+
+	for _, i := range []int{1, 500, PieceSize, PieceSize + 1, PieceSize + 10} {
+		proof, err := col.Prove(db, hash(i))
+
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if err := proof.Verify(); err != nil {
+			t.Errorf("Proof for post %d: %s", i, err.Error())
+		}
+
+		if proof.Post.Title != fmt.Sprintf("Post %d", i) || !bytes.Equal(proof.Root, col.Hash()) {
+			t.Errorf("Proof for post %d is for %+v", i, proof.Post)
+		}
+
+		proof.Post.Title = "Forged"
+
+		if proof.Verify() == nil {
+			t.Errorf("Forged post %d verified", i)
+		}
+	}
+
+	// The collection no longer matches once the post is changed.
+	if _, _, err := db.UpsertPost(Post{InfoHash: hash(1), Seeders: 10}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err := col.Prove(db, hash(1)); err == nil {
+		t.Error("Proved a post against an old collection")
+	}
+
+	if _, err := col.Prove(db, ubuntuInfoHash); err == nil {
+		t.Error("Proved a post that is not there")
+	}
+}
@@ -0,0 +1,373 @@
+// Posts carry metadata as key/value pairs, such as "imdb" = "tt0111161" or
+// "lang" = "en". A key may have more than one value. Pairs are kept in the
+// post_meta table so that they can be searched on, and a copy is kept in the
+// post table in encoded form so that posts can be read without a join.
+
+package data
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	MetaKeyMax   = 32
+	MetaValueMax = 256
+	// The most the encoded metadata for a post can take up.
+	MetaMax = 1024
+)
+
+var metaKeyRegexp = regexp.MustCompile("^[a-z0-9_.-]+$")
+
+type Meta map[string][]string
+
+// Keys must be short, lowercase, and made up of letters, numbers, "_", "-" or
+// "." only. This keeps them usable in search filters.
+func ValidMetaKey(key string) bool {
+	return len(key) <= MetaKeyMax && metaKeyRegexp.MatchString(key)
+}
+
+func (m Meta) Get(key string) string {
+	if len(m[key]) == 0 {
+		return ""
+	}
+
+	return m[key][0]
+}
+
+func (m Meta) Int(key string) (int, error) {
+	return strconv.Atoi(m.Get(key))
+}
+
+func (m Meta) Has(key, value string) bool {
+	for _, i := range m[key] {
+		if i == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Add a value for key, if it is not already there. Returns true if it was
+// added.
+func (m Meta) Add(key, value string) bool {
+	if m.Has(key, value) {
+		return false
+	}
+
+	m[key] = append(m[key], value)
+
+	return true
+}
+
+// Replace all values for key with the given one.
+func (m Meta) Set(key, value string) {
+	m[key] = []string{value}
+}
+
+// Remove a value for key, or every value if value is empty.
+func (m Meta) Del(key, value string) {
+	if value == "" {
+		delete(m, key)
+		return
+	}
+
+	kept := make([]string, 0, len(m[key]))
+
+	for _, i := range m[key] {
+		if i != value {
+			kept = append(kept, i)
+		}
+	}
+
+	if len(kept) == 0 {
+		delete(m, key)
+	} else {
+		m[key] = kept
+	}
+}
+
+// Add every pair in other, returning true if any were new.
+func (m Meta) Merge(other Meta) bool {
+	changed := false
+
+	for k, v := range other {
+		for _, i := range v {
+			if m.Add(k, i) {
+				changed = true
+			}
+		}
+	}
+
+	return changed
+}
+
+func (m Meta) Valid() error {
+	for k, v := range m {
+		if !ValidMetaKey(k) {
+			return errors.New("Invalid meta key: " + k)
+		}
+
+		for _, i := range v {
+			if len(i) > MetaValueMax {
+				return errors.New("Meta value too long for key " + k)
+			}
+		}
+	}
+
+	if len(m.Encode()) > MetaMax {
+		return errors.New("Too much meta")
+	}
+
+	return nil
+}
+
+// Encodes as a URL query string, with keys and values sorted. This is what
+// goes over the wire and into post hashes, so it must not change.
+func (m Meta) Encode() string {
+	keys := make([]string, 0, len(m))
+
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	buf := make([]string, 0, len(keys))
+
+	for _, k := range keys {
+		values := append([]string(nil), m[k]...)
+		sort.Strings(values)
+
+		for _, v := range values {
+			buf = append(buf, url.QueryEscape(k)+"="+url.QueryEscape(v))
+		}
+	}
+
+	return strings.Join(buf, "&")
+}
+
+// Parses metadata in any form we have seen it in: encoded pairs, a JSON object,
+// or a plain string from before metadata was structured, which is kept under
+// the key "meta".
+func ParseMeta(s string) Meta {
+	m := make(Meta)
+	s = strings.TrimSpace(s)
+
+	if s == "" {
+		return m
+	}
+
+	if strings.HasPrefix(s, "{") && json.Unmarshal([]byte(s), &m) == nil {
+		return m
+	}
+
+	parsed := make(Meta)
+
+	for _, i := range strings.Split(s, "&") {
+		pair := strings.SplitN(i, "=", 2)
+
+		if len(pair) != 2 {
+			parsed = nil
+			break
+		}
+
+		k, err := url.QueryUnescape(pair[0])
+		v, err2 := url.QueryUnescape(pair[1])
+
+		if err != nil || err2 != nil || !ValidMetaKey(k) {
+			parsed = nil
+			break
+		}
+
+		parsed.Add(k, v)
+	}
+
+	if parsed != nil {
+		return parsed
+	}
+
+	m.Add("meta", s)
+
+	return m
+}
+
+// Accepts an object whose values are strings or lists of strings, or a string
+// in any form ParseMeta understands.
+func (m *Meta) UnmarshalJSON(dat []byte) error {
+	var str string
+
+	if json.Unmarshal(dat, &str) == nil {
+		*m = ParseMeta(str)
+		return nil
+	}
+
+	var raw map[string]json.RawMessage
+
+	if err := json.Unmarshal(dat, &raw); err != nil {
+		return err
+	}
+
+	*m = make(Meta)
+
+	for k, v := range raw {
+		var values []string
+
+		if json.Unmarshal(v, &str) == nil {
+			values = []string{str}
+		} else if err := json.Unmarshal(v, &values); err != nil {
+			return err
+		}
+
+		for _, i := range values {
+			m.Add(strings.ToLower(k), i)
+		}
+	}
+
+	return nil
+}
+
+// Meta is stored encoded in the post table.
+func (m *Meta) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*m = make(Meta)
+	case string:
+		*m = ParseMeta(v)
+	case []byte:
+		*m = ParseMeta(string(v))
+	default:
+		// The column has numeric affinity, so old free-form meta may have
+		// been stored as a number.
+		*m = ParseMeta(fmt.Sprint(v))
+	}
+
+	return nil
+}
+
+func (m Meta) Value() (driver.Value, error) {
+	return m.Encode(), nil
+}
+
+// Makes the post_meta rows for a post match the given metadata, and stores the
+// encoded copy in the post table.
+func writeMeta(tx *sql.Tx, pid int64, m Meta) error {
+	if _, err := tx.Exec(sql_delete_post_meta, pid); err != nil {
+		return err
+	}
+
+	for k, v := range m {
+		for _, i := range v {
+			if _, err := tx.Exec(sql_insert_post_meta, pid, k, i); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := tx.Exec(sql_attach_meta, m, pid)
+
+	return err
+}
+
+// Read, change and write back the metadata for a post in one transaction.
+func (db *Database) updateMeta(pid int, update func(m Meta) error) (err error) {
+	tx, err := db.conn.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		err = tx.Commit()
+	}()
+
+	m := make(Meta)
+	err = tx.QueryRow(sql_query_meta, pid).Scan(&m)
+
+	if err == sql.ErrNoRows {
+		return errors.New("Post not found")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err = update(m); err != nil {
+		return err
+	}
+
+	if err = m.Valid(); err != nil {
+		return err
+	}
+
+	return writeMeta(tx, int64(pid), m)
+}
+
+// Add a metadata key/value to a post.
+func (db *Database) AddMeta(pid int, key, value string) error {
+	return db.updateMeta(pid, func(m Meta) error {
+		m.Add(strings.ToLower(key), value)
+		return nil
+	})
+}
+
+// Remove a metadata key/value from a post. If value is empty then every value
+// for key is removed.
+func (db *Database) RemoveMeta(pid int, key, value string) error {
+	return db.updateMeta(pid, func(m Meta) error {
+		m.Del(strings.ToLower(key), value)
+		return nil
+	})
+}
+
+func (db *Database) QueryMeta(pid int) (Meta, error) {
+	m := make(Meta)
+	err := db.conn.QueryRow(sql_query_meta, pid).Scan(&m)
+
+	if err == sql.ErrNoRows {
+		return nil, errors.New("Post not found")
+	}
+
+	return m, err
+}
+
+// A search filter requiring posts to have a metadata key/value.
+type MetaFilter struct {
+	Key   string
+	Value string
+}
+
+// Splits "key:value" terms out of a search query. Anything else is left in the
+// query. Keys must be valid meta keys, so "Star Wars: Episode IV" is left as it
+// is.
+func ParseMetaFilters(query string) (string, []MetaFilter) {
+	filters := make([]MetaFilter, 0)
+	rest := make([]string, 0)
+
+	for _, i := range strings.Fields(query) {
+		pair := strings.SplitN(i, ":", 2)
+
+		if len(pair) == 2 && pair[1] != "" && ValidMetaKey(pair[0]) {
+			filters = append(filters, MetaFilter{pair[0], pair[1]})
+			continue
+		}
+
+		rest = append(rest, i)
+	}
+
+	return strings.Join(rest, " "), filters
+}
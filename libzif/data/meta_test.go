@@ -0,0 +1,169 @@
+package data
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseMeta(t *testing.T) {
+	cases := map[string]string{
+		"imdb=tt0111161&lang=en": "imdb=tt0111161&lang=en",
+		"lang=fr&lang=en":        "lang=en&lang=fr",
+		`{"imdb": "tt0111161"}`:  "imdb=tt0111161",
+		`{"lang": ["en", "fr"]}`: "lang=en&lang=fr",
+		"just some text":         "meta=just+some+text",
+		"note=a%26b":             "note=a%26b",
+		"":                       "",
+	}
+
+	for in, want := range cases {
+		if got := ParseMeta(in).Encode(); got != want {
+			t.Errorf("ParseMeta(%q) encoded to %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestParseMetaFilters(t *testing.T) {
+	query, filters := ParseMetaFilters("Star Wars: Episode imdb:tt0076759 lang:en")
+
+	if query != "Star Wars: Episode" {
+		t.Errorf("Query is %q", query)
+	}
+
+	if len(filters) != 2 || filters[0] != (MetaFilter{"imdb", "tt0076759"}) ||
+		filters[1] != (MetaFilter{"lang", "en"}) {
+		t.Errorf("Filters are %+v", filters)
+	}
+}
+
+func TestDatabaseMeta(t *testing.T) {
+	db, done := tempDatabase(t)
+	defer done()
+
+	post := Post{InfoHash: ubuntuInfoHash, Title: "Ubuntu", Seeders: 5,
+		Meta: Meta{"lang": {"en"}}}
+
+	id, _, err := db.UpsertPost(post)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	pid := int(id)
+
+	if err := db.AddMeta(pid, "Release", "16.04"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := db.AddMeta(pid, "lang", "fr"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if db.AddMeta(pid, "not a key", "x") == nil {
+		t.Error("Invalid key accepted")
+	}
+
+	meta, err := db.QueryMeta(pid)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if meta.Encode() != "lang=en&lang=fr&release=16.04" {
+		t.Errorf("Meta is %q", meta.Encode())
+	}
+
+	if err := db.RemoveMeta(pid, "lang", "en"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	stored, _ := db.QueryPostId(uint(pid))
+
+	if stored.Meta.Encode() != "lang=fr&release=16.04" {
+		t.Errorf("Stored meta is %q", stored.Meta.Encode())
+	}
+
+	db.GenerateFts(0)
+
+	results, err := db.Search("ubuntu lang:fr", 0, 25)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(results) != 1 {
+		t.Error("Meta filter did not match")
+	}
+
+	results, err = db.Search("lang:en", 0, 25)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(results) != 0 {
+		t.Error("Removed meta still matched")
+	}
+
+	results, err = db.Search("release:16.04", 0, 25)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(results) != 1 {
+		t.Error("Filter only search did not match")
+	}
+}
+
+func TestPostWriteMeta(t *testing.T) {
+	post := Post{Id: 1, Title: "Ubuntu", Meta: Meta{"lang": {"en"}, "imdb": {"tt0111161"}}}
+
+	if s := post.String("|", ""); s != "1||Ubuntu|0|0|0|0|0||imdb=tt0111161&lang=en|||" {
+		t.Errorf("Post written as %q", s)
+	}
+}
+
+func TestMigrateMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zif-data")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "posts.db")
+	conn, err := sql.Open("sqlite3", path)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	conn.Exec(legacy_post_table)
+	conn.Exec(`INSERT INTO post(info_hash, title, size, file_count, seeders,
+		leechers, upload_date, tags, meta) VALUES(?, 'Ubuntu', 0, 0, 0, 0, 0, '', ?)`,
+		ubuntuInfoHash, `{"imdb": "tt0111161"}`)
+	conn.Close()
+
+	db := NewDatabase(path)
+
+	if err := db.Connect(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer db.Close()
+
+	results, err := db.Search("imdb:tt0111161", 0, 25)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(results) != 1 || results[0].Meta.Get("imdb") != "tt0111161" {
+		t.Error("Legacy meta not migrated")
+	}
+}
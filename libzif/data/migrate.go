@@ -0,0 +1,433 @@
+// Schema migrations. The version of the schema a database has is kept in the
+// SQLite user_version pragma, and every migration past that is run in order
+// when connecting. Each migration runs in its own transaction, so a failure
+// leaves the database at the last version that succeeded.
+// Migrations must never be changed once released, add a new one instead.
+
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Takes a database from Version-1 to Version.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(tx *sql.Tx) error
+}
+
+// Returns a migration step that runs each statement in turn.
+func execAll(statements ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, i := range statements {
+			if _, err := tx.Exec(i); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// Databases created before migrations existed are at version 0, but already
+// have the tables from the first migration. Those statements all use IF NOT
+// EXISTS, so this is fine.
+// The SQL here is written out rather than taken from sql.go, as the schema
+// those statements are for moves on.
+var migrations = []Migration{
+	{1, "Create post table and index", execAll(
+		`CREATE TABLE IF NOT EXISTS post(
+			id INTEGER PRIMARY KEY NOT NULL,
+			info_hash STRING,
+			title STRING NOT NULL,
+			size INTEGER NOT NULL,
+			file_count INTEGER NOT NULL,
+			seeders INTEGER NOT NULL,
+			leechers INTEGER NOT NULL,
+			upload_date INTEGER NOT NULL,
+			tags STRING,
+			meta STRING
+		)`,
+		`CREATE VIRTUAL TABLE IF NOT EXISTS fts_post USING fts4(
+			content="post",
+			title,
+			seeders,
+			leechers
+		)`,
+		`CREATE INDEX IF NOT EXISTS port_upload_date_index ON post(upload_date)`,
+	)},
+	{2, "Normalise and deduplicate infohashes", dedupeInfoHashes},
+	{3, "Add post_meta table", createPostMeta},
+	// FTS5 replaced FTS4 so that tags and meta could be searched and results
+	// ranked by relevance. The index keeps its own copy of the text, so that
+	// snippets can be made from it. Prefix indexes make short prefix queries
+	// fast.
+	{4, "Move full text search to FTS5", execAll(
+		"DROP TABLE IF EXISTS fts_post",
+		`CREATE VIRTUAL TABLE IF NOT EXISTS fts_post USING fts5(
+			title,
+			tags,
+			meta,
+			prefix='2 3'
+		)`,
+		`INSERT INTO fts_post(rowid, title, tags, meta)
+			SELECT id, title, tags, meta FROM post`,
+	)},
+	{5, "Add full text index vocabulary", execAll(
+		`CREATE VIRTUAL TABLE IF NOT EXISTS fts_post_vocab USING fts5vocab(fts_post, 'col')`,
+	)},
+	// Rebuilt, as mirrors were never indexed. Replacing rather than inserting
+	// or updating means a post that was somehow missed is indexed the next
+	// time it changes.
+	{6, "Index posts automatically", execAll(
+		`CREATE TRIGGER IF NOT EXISTS post_fts_insert AFTER INSERT ON post
+		BEGIN
+			INSERT OR REPLACE INTO fts_post(rowid, title, tags, meta)
+			VALUES(new.id, new.title, new.tags, new.meta);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS post_fts_update AFTER UPDATE OF title, tags, meta ON post
+		BEGIN
+			INSERT OR REPLACE INTO fts_post(rowid, title, tags, meta)
+			VALUES(new.id, new.title, new.tags, new.meta);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS post_fts_delete AFTER DELETE ON post
+		BEGIN
+			DELETE FROM fts_post WHERE rowid = old.id;
+		END`,
+		"DELETE FROM fts_post",
+		`INSERT INTO fts_post(rowid, title, tags, meta)
+			SELECT id, title, tags, meta FROM post`,
+	)},
+	{7, "Add post signatures", execAll(
+		"ALTER TABLE post ADD COLUMN author BLOB",
+		"ALTER TABLE post ADD COLUMN signature BLOB",
+	)},
+	{8, "Add tombstone table", execAll(
+		`CREATE TABLE IF NOT EXISTS tombstone(
+			info_hash TEXT PRIMARY KEY NOT NULL,
+			author BLOB,
+			timestamp INTEGER NOT NULL,
+			replacement BLOB,
+			signature BLOB
+		)`,
+	)},
+}
+
+// The version a database will be at once it is fully migrated.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+func (db *Database) SchemaVersion() (int, error) {
+	var version int
+
+	err := db.conn.QueryRow("PRAGMA user_version").Scan(&version)
+
+	return version, err
+}
+
+// Run all migrations the database has not yet had.
+func (db *Database) Migrate() error {
+	version, err := db.SchemaVersion()
+
+	if err != nil {
+		return err
+	}
+
+	if version > LatestSchemaVersion() {
+		return errors.New(fmt.Sprintf("Database schema version %d is newer than this version of Zif supports (%d)",
+			version, LatestSchemaVersion()))
+	}
+
+	for _, i := range migrations {
+		if i.Version <= version {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"database": db.path,
+			"version":  i.Version,
+		}).Info("Migrating database: ", i.Description)
+
+		err = db.migrate(i)
+
+		if err != nil {
+			return errors.New(fmt.Sprintf("Migration %d failed: %s", i.Version, err.Error()))
+		}
+	}
+
+	return nil
+}
+
+func (db *Database) migrate(m Migration) (err error) {
+	tx, err := db.conn.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		err = tx.Commit()
+	}()
+
+	err = m.Up(tx)
+
+	if err != nil {
+		return
+	}
+
+	// Pragmas do not take parameters.
+	_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", m.Version))
+
+	return
+}
+
+// Normalises every infohash, merges posts that share one, then adds a unique
+// index so it cannot happen again.
+func dedupeInfoHashes(tx *sql.Tx) error {
+	_, err := tx.Exec(`UPDATE post SET info_hash = lower(trim(info_hash))
+						WHERE length(trim(info_hash)) IN (40, 64)`)
+
+	if err != nil {
+		return err
+	}
+
+	// Anything else needs decoding, this should only be a few posts.
+	type rename struct {
+		id   int
+		hash string
+	}
+
+	renames := make([]rename, 0)
+	rows, err := tx.Query(`SELECT id, info_hash FROM post
+						WHERE length(info_hash) NOT IN (40, 64)`)
+
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var id int
+		var hash string
+
+		if err := rows.Scan(&id, &hash); err != nil {
+			rows.Close()
+			return err
+		}
+
+		if normal, err := NormaliseInfoHash(hash); err == nil {
+			renames = append(renames, rename{id, normal})
+		}
+	}
+
+	rows.Close()
+
+	for _, i := range renames {
+		if _, err := tx.Exec("UPDATE post SET info_hash=? WHERE id=?", i.hash, i.id); err != nil {
+			return err
+		}
+	}
+
+	duplicates := make([]string, 0)
+	rows, err = tx.Query(`SELECT info_hash FROM post
+						WHERE info_hash IS NOT NULL
+						GROUP BY info_hash
+						HAVING COUNT(*) > 1`)
+
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var hash string
+
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return err
+		}
+
+		duplicates = append(duplicates, hash)
+	}
+
+	rows.Close()
+
+	for _, i := range duplicates {
+		if err := mergeDuplicates(tx, i); err != nil {
+			return err
+		}
+	}
+
+	// The FTS4 index reads from the post table, so removed posts leave stale
+	// entries in it.
+	if len(duplicates) > 0 {
+		log.WithField("count", len(duplicates)).Info("Merged duplicate infohashes")
+
+		if _, err := tx.Exec("INSERT INTO fts_post(fts_post) VALUES('rebuild')"); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS post_info_hash_index ON post(info_hash)")
+
+	return err
+}
+
+// Merge every post with the given infohash into the oldest. Posts had no
+// signatures yet, so this is how Post.Merge worked then.
+func mergeDuplicates(tx *sql.Tx, hash string) error {
+	rows, err := tx.Query(`SELECT id, size, file_count, seeders, leechers,
+								upload_date, tags, meta
+							FROM post WHERE info_hash = ? ORDER BY id`, hash)
+
+	if err != nil {
+		return err
+	}
+
+	posts := make([]Post, 0, 2)
+
+	for rows.Next() {
+		var post Post
+		var tags sql.NullString
+
+		err := rows.Scan(&post.Id, &post.Size, &post.FileCount, &post.Seeders,
+			&post.Leechers, &post.UploadDate, &tags, &post.Meta)
+
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		post.Tags = tags.String
+		posts = append(posts, post)
+	}
+
+	rows.Close()
+
+	if len(posts) < 2 {
+		return nil
+	}
+
+	merged := posts[0]
+
+	if merged.Meta == nil {
+		merged.Meta = make(Meta)
+	}
+
+	for _, i := range posts[1:] {
+		if i.Seeders > merged.Seeders {
+			merged.Seeders = i.Seeders
+		}
+
+		if i.Leechers > merged.Leechers {
+			merged.Leechers = i.Leechers
+		}
+
+		merged.Tags = MergeTags(merged.Tags, i.Tags)
+
+		if merged.Size == 0 {
+			merged.Size = i.Size
+		}
+
+		if merged.FileCount == 0 {
+			merged.FileCount = i.FileCount
+		}
+
+		if i.UploadDate != 0 && (merged.UploadDate == 0 || i.UploadDate < merged.UploadDate) {
+			merged.UploadDate = i.UploadDate
+		}
+
+		merged.Meta.Merge(i.Meta)
+
+		if _, err := tx.Exec("DELETE FROM post WHERE id=?", i.Id); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE post
+						SET size=?,
+							file_count=?,
+							seeders=?,
+							leechers=?,
+							upload_date=?,
+							tags=?,
+							meta=?
+						WHERE id=?`, merged.Size, merged.FileCount,
+		merged.Seeders, merged.Leechers, merged.UploadDate, merged.Tags,
+		merged.Meta, merged.Id)
+
+	return err
+}
+
+// Creates the post_meta table, and fills it from the meta column. Meta that is
+// not key/value pairs is kept under the key "meta", see ParseMeta.
+func createPostMeta(tx *sql.Tx) error {
+	// TEXT rather than STRING, which would have numeric affinity and turn
+	// values such as "0111" into numbers.
+	err := execAll(
+		`CREATE TABLE IF NOT EXISTS post_meta(
+			post_id INTEGER NOT NULL,
+			key TEXT NOT NULL,
+			value TEXT NOT NULL,
+			PRIMARY KEY(post_id, key, value)
+		)`,
+		`CREATE INDEX IF NOT EXISTS post_meta_key_value_index ON post_meta(key, value)`,
+	)(tx)
+
+	if err != nil {
+		return err
+	}
+
+	type postMeta struct {
+		id   int64
+		meta Meta
+	}
+
+	metas := make([]postMeta, 0)
+	rows, err := tx.Query("SELECT id, meta FROM post WHERE meta IS NOT NULL AND meta != ''")
+
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var pm postMeta
+
+		if err := rows.Scan(&pm.id, &pm.meta); err != nil {
+			rows.Close()
+			return err
+		}
+
+		metas = append(metas, pm)
+	}
+
+	rows.Close()
+
+	for _, i := range metas {
+		for k, v := range i.meta {
+			for _, j := range v {
+				_, err := tx.Exec("INSERT OR IGNORE INTO post_meta(post_id, key, value) VALUES(?, ?, ?)",
+					i.id, k, j)
+
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if _, err := tx.Exec("UPDATE post SET meta=? WHERE id=?", i.meta, i.id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
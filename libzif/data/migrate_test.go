@@ -0,0 +1,130 @@
+package data
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The tables databases had before migrations, for testing migrating them.
+const legacy_post_table = `CREATE TABLE post(
+								id INTEGER PRIMARY KEY NOT NULL,
+								info_hash STRING,
+								title STRING NOT NULL,
+								size INTEGER NOT NULL,
+								file_count INTEGER NOT NULL,
+								seeders INTEGER NOT NULL,
+								leechers INTEGER NOT NULL,
+								upload_date INTEGER NOT NULL,
+								tags STRING,
+								meta STRING
+							)`
+
+const legacy_fts_post = `CREATE VIRTUAL TABLE fts_post USING fts4(
+							content="post",
+							title,
+							seeders,
+							leechers
+						)`
+
+func TestMigrateFresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zif-migrate")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+
+	db := NewDatabase(filepath.Join(dir, "posts.db"))
+
+	if err := db.Connect(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer db.Close()
+
+	version, err := db.SchemaVersion()
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if version != LatestSchemaVersion() {
+		t.Errorf("Database at version %d, want %d", version, LatestSchemaVersion())
+	}
+
+	// Connecting again must not fail, or rerun anything.
+	db.Close()
+
+	if err := db.Connect(); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestMigrateTooNew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zif-migrate")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "posts.db")
+	conn, err := sql.Open("sqlite3", path)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	conn.Exec("PRAGMA user_version = 1000")
+	conn.Close()
+
+	db := NewDatabase(path)
+	defer db.Close()
+
+	if db.Connect() == nil {
+		t.Error("Connected to a database with a newer schema")
+	}
+}
+
+func TestMigrateRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zif-migrate")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+
+	db := NewDatabase(filepath.Join(dir, "posts.db"))
+
+	if err := db.Connect(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer db.Close()
+
+	before, _ := db.SchemaVersion()
+	bad := Migration{before + 1, "Broken", execAll(
+		"CREATE TABLE broken(id INTEGER)",
+		"NOT SQL",
+	)}
+
+	if db.migrate(bad) == nil {
+		t.Fatal("Broken migration succeeded")
+	}
+
+	after, _ := db.SchemaVersion()
+
+	if after != before {
+		t.Error("Version changed by a failed migration")
+	}
+
+	if _, err := db.conn.Exec("SELECT * FROM broken"); err == nil {
+		t.Error("Failed migration was not rolled back")
+	}
+}
@@ -2,25 +2,25 @@ package data
 
 import (
 	"errors"
-	"hash"
 
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/crypto/sha3"
 )
 
 const PieceSize = 1000
 
+// A piece is the root of a Merkle tree over the posts in it, so that a post
+// can be proven to be in a piece without the rest of the piece.
 type Piece struct {
-	Posts []Post
-	hash  hash.Hash
+	Posts  []Post
+	leaves [][]byte
 }
 
 func (p *Piece) Setup() {
-	p.hash = sha3.New256()
+	p.leaves = make([][]byte, 0)
 }
 
 func (p *Piece) Add(post Post, store bool) error {
-	if len(p.Posts) > PieceSize {
+	if len(p.leaves) >= PieceSize {
 		return errors.New("Piece full")
 	}
 
@@ -28,29 +28,33 @@ func (p *Piece) Add(post Post, store bool) error {
 		p.Posts = append(p.Posts, post)
 	}
 
-	data := post.String("|", "")
-	p.hash.Write([]byte(data))
+	p.leaves = append(p.leaves, post.Leaf())
 
 	return nil
 }
 
-func (p *Piece) Hash() []byte {
-	var ret []byte
+// How many posts have been added, whether or not they were stored.
+func (p *Piece) Len() int {
+	return len(p.leaves)
+}
 
-	ret = p.hash.Sum(nil)
+func (p *Piece) Hash() []byte {
+	return MerkleRoot(p.leaves)
+}
 
-	return ret
+// The inclusion proof for the post at index, against Hash.
+func (p *Piece) Proof(index int) [][]byte {
+	return MerkleProof(p.leaves, index)
 }
 
 func (p *Piece) Rehash() ([]byte, error) {
-	p.hash = sha3.New256()
+	p.Setup()
 
 	for _, i := range p.Posts {
-		data := i.Bytes([]byte("|"), []byte(""))
-		p.hash.Write([]byte(data))
+		p.leaves = append(p.leaves, i.Leaf())
 	}
 
 	log.Info("Piece rehashed")
 
-	return p.hash.Sum(nil), nil
+	return p.Hash(), nil
 }
@@ -2,6 +2,7 @@ package data
 
 import (
 	"bytes"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"io"
@@ -10,9 +11,12 @@ import (
 )
 
 const (
-	TitleMax    = 144
-	TagsMax     = 256
-	MaxPostSize = TitleMax + TagsMax + 1024
+	// The longest title Post.Valid accepts.
+	TitleMax = 140
+	TagsMax  = 256
+	// Hex encoded public key and signature, see Post.Sign.
+	SignatureMax = 64 + 128
+	MaxPostSize  = TitleMax + TagsMax + MetaMax + SignatureMax
 )
 
 type Post struct {
@@ -25,7 +29,11 @@ type Post struct {
 	Leechers   int
 	UploadDate int
 	Tags       string
-	Meta       string
+	Meta       Meta
+	// The public key of the peer that published the post, and its signature.
+	// Both are empty if the post is not signed.
+	Author    []byte `json:",omitempty"`
+	Signature []byte `json:",omitempty"`
 }
 
 func (p Post) Json() ([]byte, error) {
@@ -46,6 +54,15 @@ func (p *Post) Bytes(sep, term []byte) []byte {
 	return buf.Bytes()
 }
 
+// The hash of a post as a leaf of its piece. The id is left out, as it
+// differs between a peer's database and those of its mirrors.
+func (p *Post) Leaf() []byte {
+	post := *p
+	post.Id = 0
+
+	return MerkleLeaf(post.Bytes([]byte("|"), []byte("")))
+}
+
 func (p *Post) String(sep, term string) string {
 	return string(p.Bytes([]byte(sep), []byte(term)))
 }
@@ -69,6 +86,12 @@ func (p *Post) Write(sep, term string, w io.Writer) {
 	w.Write([]byte(sep))
 	w.Write([]byte(p.Tags))
 	w.Write([]byte(sep))
+	w.Write([]byte(p.Meta.Encode()))
+	w.Write([]byte(sep))
+	w.Write([]byte(hex.EncodeToString(p.Author)))
+	w.Write([]byte(sep))
+	w.Write([]byte(hex.EncodeToString(p.Signature)))
+	w.Write([]byte(sep))
 	w.Write([]byte(term))
 
 	/*
@@ -98,10 +121,24 @@ func (p *Post) Write(sep, term string, w io.Writer) {
 }
 
 func (p *Post) Valid() error {
-	if len(p.Title) > 140 {
+	if len(p.Title) > TitleMax {
 		return errors.New("Title too long")
 	}
 
+	if _, err := NormaliseInfoHash(p.InfoHash); err != nil {
+		return err
+	}
+
+	if err := p.Meta.Valid(); err != nil {
+		return err
+	}
+
+	if p.Signed() {
+		if err := p.Verify(); err != nil {
+			return err
+		}
+	}
+
 	if p.UploadDate > int(time.Now().Unix()) {
 		return errors.New("Upload data cannot be in the future")
 	}
@@ -0,0 +1,407 @@
+// Search queries can filter and sort posts as well as match text, for example
+//
+//	ubuntu size:>1GB after:2016-01-01 tag:linux sort:seeders
+//
+// Filters are "field:value" terms. size, seeders, leechers and files take a
+// number with an optional comparison (>, >=, <, <=, =), sizes may have a unit.
+// after and before take a date. tag may be given more than once, and every tag
+// must be present. sort takes a field and an optional direction, as in
+// "sort:size:asc". Any other "key:value" is a metadata filter if some post in
+// the store being searched has that key, see Query.WithMetaKeys, so that
+// "re:zero" is still text. Everything else is text to match, see FtsQuery.
+// Queries are compiled to SQL with every value as a parameter, so nothing a
+// user types ends up in the SQL itself.
+
+package data
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const QueryDateFormat = "2006-01-02"
+
+// Columns that can be compared against, by the name used in queries.
+var queryColumns = map[string]string{
+	"size":     "post.size",
+	"seeders":  "post.seeders",
+	"leechers": "post.leechers",
+	"files":    "post.file_count",
+}
+
+// Orders that can be sorted by. Relevance is the default, and only means
+// anything when there is text to match.
+var querySorts = map[string]string{
+	"seeders":  "post.seeders",
+	"leechers": "post.leechers",
+	"size":     "post.size",
+	"files":    "post.file_count",
+	"date":     "post.upload_date",
+	"health":   "((post.seeders * 1.1) + post.leechers)",
+}
+
+var queryOperators = []string{">=", "<=", ">", "<", "="}
+
+var sizeUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kb":  1 << 10,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mb":  1 << 20,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gb":  1 << 30,
+	"gib": 1 << 30,
+	"t":   1 << 40,
+	"tb":  1 << 40,
+	"tib": 1 << 40,
+}
+
+// Requires a post column to compare to a value.
+type Comparison struct {
+	Column   string
+	Operator string
+	Value    int64
+}
+
+type Query struct {
+	// Text to match, in words and "quoted phrases".
+	Text        string
+	Comparisons []Comparison
+	Tags        []string
+	Meta        []MetaFilter
+	// One of the keys of querySorts, or "relevance".
+	Sort      string
+	Ascending bool
+}
+
+// Parse a search query. Returns an error describing the problem if the query is
+// not valid.
+func ParseQuery(query string) (*Query, error) {
+	terms, err := splitQuery(query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Query{Sort: "relevance"}
+	text := make([]string, 0)
+	sorted := false
+
+	for _, i := range terms {
+		pair := strings.SplitN(i, ":", 2)
+
+		if strings.HasPrefix(i, `"`) || len(pair) != 2 || pair[1] == "" ||
+			!ValidMetaKey(pair[0]) {
+			text = append(text, i)
+			continue
+		}
+
+		key, value := pair[0], pair[1]
+
+		switch key {
+		case "size", "seeders", "leechers", "files":
+			c, err := parseComparison(key, value)
+
+			if err != nil {
+				return nil, err
+			}
+
+			q.Comparisons = append(q.Comparisons, c)
+
+		case "after", "before":
+			date, err := time.Parse(QueryDateFormat, value)
+
+			if err != nil {
+				return nil, errors.New("Invalid date for " + key + ", use YYYY-MM-DD: " + value)
+			}
+
+			c := Comparison{"post.upload_date", ">=", date.Unix()}
+
+			if key == "before" {
+				c.Operator = "<"
+			}
+
+			q.Comparisons = append(q.Comparisons, c)
+
+		case "tag":
+			q.Tags = append(q.Tags, strings.ToLower(value))
+
+		case "sort":
+			if sorted {
+				return nil, errors.New("Only one sort order may be given")
+			}
+
+			sorted = true
+
+			if err := q.parseSort(value); err != nil {
+				return nil, err
+			}
+
+		default:
+			q.Meta = append(q.Meta, MetaFilter{key, value})
+		}
+	}
+
+	q.Text = strings.Join(text, " ")
+
+	return q, nil
+}
+
+// A copy of the query keeping only the metadata filters on keys that has
+// reports exist. The rest go back to being text, as they were written. Stores call this before running a
+// query, as ParseQuery cannot know which keys they hold.
+func (q *Query) WithMetaKeys(has func(key string) bool) *Query {
+	ret := *q
+	ret.Meta = make([]MetaFilter, 0, len(q.Meta))
+	text := make([]string, 0, len(q.Meta)+1)
+
+	if q.Text != "" {
+		text = append(text, q.Text)
+	}
+
+	for _, i := range q.Meta {
+		if has(i.Key) {
+			ret.Meta = append(ret.Meta, i)
+		} else {
+			text = append(text, i.Key+":"+i.Value)
+		}
+	}
+
+	ret.Text = strings.Join(text, " ")
+
+	return &ret
+}
+
+// Split a query into terms on whitespace, keeping "quoted phrases" whole.
+func splitQuery(query string) ([]string, error) {
+	if strings.Count(query, `"`)%2 != 0 {
+		return nil, errors.New("Unclosed quote in query")
+	}
+
+	terms := make([]string, 0)
+
+	for n, part := range strings.Split(query, `"`) {
+		// Odd parts were between quotes.
+		if n%2 == 1 {
+			if phrase := strings.Join(strings.Fields(part), " "); phrase != "" {
+				terms = append(terms, `"`+phrase+`"`)
+			}
+
+			continue
+		}
+
+		terms = append(terms, strings.Fields(part)...)
+	}
+
+	return terms, nil
+}
+
+func parseComparison(key, value string) (Comparison, error) {
+	c := Comparison{Column: queryColumns[key], Operator: "="}
+
+	for _, i := range queryOperators {
+		if strings.HasPrefix(value, i) {
+			c.Operator = i
+			value = value[len(i):]
+			break
+		}
+	}
+
+	var err error
+
+	if key == "size" {
+		c.Value, err = ParseSize(value)
+	} else {
+		c.Value, err = strconv.ParseInt(value, 10, 64)
+	}
+
+	if err != nil || c.Value < 0 {
+		return c, errors.New("Invalid number for " + key + ": " + value)
+	}
+
+	return c, nil
+}
+
+func (q *Query) parseSort(value string) error {
+	pair := strings.SplitN(value, ":", 2)
+
+	if _, ok := querySorts[pair[0]]; !ok && pair[0] != "relevance" {
+		return errors.New("Cannot sort by " + pair[0])
+	}
+
+	q.Sort = pair[0]
+
+	if len(pair) == 2 {
+		switch pair[1] {
+		case "asc":
+			q.Ascending = true
+		case "desc":
+		default:
+			return errors.New("Sort direction must be asc or desc: " + pair[1])
+		}
+	}
+
+	return nil
+}
+
+// Parse a size such as "700MB" or "1.5GB" into bytes. Units are powers of 1024,
+// and bytes are assumed if there is no unit.
+func ParseSize(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	end := strings.LastIndexAny(s, "0123456789.") + 1
+
+	unit, ok := sizeUnits[s[end:]]
+
+	if !ok {
+		return 0, errors.New("Unknown size unit: " + s[end:])
+	}
+
+	n, err := strconv.ParseFloat(s[:end], 64)
+
+	if err != nil {
+		return 0, err
+	}
+
+	size := n * float64(unit)
+
+	if math.IsNaN(size) || size > math.MaxInt64 {
+		return 0, errors.New("Size too large")
+	}
+
+	return int64(size), nil
+}
+
+// The FTS5 query for the text in this query, empty if there is none.
+func (q *Query) Match() string {
+	return FtsQuery(q.Text)
+}
+
+// The expression results are ranked by, and whether higher ranks come first.
+func (q *Query) Rank() (string, bool) {
+	switch {
+	case q.Sort == "relevance" && q.Match() != "":
+		return sql_search_rank_relevance, false
+	case q.Sort == "relevance":
+		return querySorts["health"], true
+	}
+
+	return querySorts[q.Sort], !q.Ascending
+}
+
+// Builds the SQL for a page of this query. It selects post ids, snippets and
+// ranks.
+func (q *Query) SQL(page, pageSize int) (string, []interface{}) {
+	match := q.Match()
+	rank, descending := q.Rank()
+
+	stmt := fmt.Sprintf(sql_search_post_head, rank)
+	args := []interface{}{SnippetOpen, SnippetClose, match}
+
+	if match == "" {
+		stmt = fmt.Sprintf(sql_search_post_all_head, rank)
+		args = []interface{}{}
+	}
+
+	// Column names and operators only ever come from the tables above.
+	for _, i := range q.Comparisons {
+		stmt += fmt.Sprintf(" AND %s %s ?", i.Column, i.Operator)
+		args = append(args, i.Value)
+	}
+
+	for _, i := range q.Tags {
+		stmt += sql_search_tag_filter
+		args = append(args, "%,"+escapeLike(i)+",%")
+	}
+
+	for _, i := range q.Meta {
+		stmt += sql_search_meta_filter
+		args = append(args, i.Key, i.Value)
+	}
+
+	// Ties are broken by id, so that pages do not overlap.
+	if descending {
+		stmt += " ORDER BY rank DESC, post.id"
+	} else {
+		stmt += " ORDER BY rank ASC, post.id"
+	}
+
+	stmt += " LIMIT ?,?"
+	args = append(args, page*pageSize, pageSize)
+
+	return stmt, args
+}
+
+// Whether a post passes the query's filters, without the SQL. The text is not
+// matched.
+func (q *Query) Allows(post *Post) bool {
+	for _, i := range q.Comparisons {
+		var value int64
+
+		switch i.Column {
+		case "post.size":
+			value = int64(post.Size)
+		case "post.seeders":
+			value = int64(post.Seeders)
+		case "post.leechers":
+			value = int64(post.Leechers)
+		case "post.file_count":
+			value = int64(post.FileCount)
+		case "post.upload_date":
+			value = int64(post.UploadDate)
+		}
+
+		var ok bool
+
+		switch i.Operator {
+		case ">=":
+			ok = value >= i.Value
+		case "<=":
+			ok = value <= i.Value
+		case ">":
+			ok = value > i.Value
+		case "<":
+			ok = value < i.Value
+		default:
+			ok = value == i.Value
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	tags := make(map[string]bool)
+
+	for _, i := range strings.Split(strings.ToLower(post.Tags), ",") {
+		tags[strings.TrimSpace(i)] = true
+	}
+
+	for _, i := range q.Tags {
+		if !tags[i] {
+			return false
+		}
+	}
+
+	for _, i := range q.Meta {
+		if !post.Meta.Has(i.Key, i.Value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Escape the wildcards in a LIKE pattern, see sql_search_tag_filter.
+func escapeLike(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "%", `\%`, -1)
+
+	return strings.Replace(s, "_", `\_`, -1)
+}
@@ -0,0 +1,137 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseQuery(t *testing.T) {
+	q, err := ParseQuery(`ubuntu "desktop amd64" size:>1GB after:2016-01-01 tag:Linux sort:seeders lang:en`)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if q.Text != `ubuntu "desktop amd64"` {
+		t.Errorf("Text is %q", q.Text)
+	}
+
+	date, _ := time.Parse(QueryDateFormat, "2016-01-01")
+	want := []Comparison{
+		{"post.size", ">", 1 << 30},
+		{"post.upload_date", ">=", date.Unix()},
+	}
+
+	if len(q.Comparisons) != len(want) {
+		t.Fatalf("Comparisons are %+v", q.Comparisons)
+	}
+
+	for n, i := range want {
+		if q.Comparisons[n] != i {
+			t.Errorf("Comparison %d is %+v, want %+v", n, q.Comparisons[n], i)
+		}
+	}
+
+	if len(q.Tags) != 1 || q.Tags[0] != "linux" {
+		t.Errorf("Tags are %v", q.Tags)
+	}
+
+	if len(q.Meta) != 1 || q.Meta[0] != (MetaFilter{"lang", "en"}) {
+		t.Errorf("Meta filters are %v", q.Meta)
+	}
+
+	if q.Sort != "seeders" || q.Ascending {
+		t.Errorf("Sort is %q, ascending %v", q.Sort, q.Ascending)
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	invalid := []string{
+		`"unclosed`,
+		"size:>lots",
+		"size:1XB",
+		"seeders:-1",
+		"files:>=",
+		"after:yesterday",
+		"sort:colour",
+		"sort:size:sideways",
+		"sort:size sort:date",
+	}
+
+	for _, i := range invalid {
+		if _, err := ParseQuery(i); err == nil {
+			t.Errorf("Query %q parsed", i)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]int64{
+		"100":   100,
+		"1k":    1024,
+		"700MB": 700 << 20,
+		"1.5GB": 3 << 29,
+		"2TiB":  2 << 40,
+	}
+
+	for in, want := range cases {
+		if got, err := ParseSize(in); err != nil || got != want {
+			t.Errorf("ParseSize(%q) is %d, %v, want %d", in, got, err, want)
+		}
+	}
+}
+
+func TestSearchFilters(t *testing.T) {
+	db, done := tempDatabase(t)
+	defer done()
+
+	jan, _ := time.Parse(QueryDateFormat, "2016-01-15")
+	jun, _ := time.Parse(QueryDateFormat, "2016-06-15")
+
+	insertPosts(t, db,
+		Post{Title: "Ubuntu Desktop", Size: 2 << 30, FileCount: 1, Seeders: 10,
+			UploadDate: int(jan.Unix()), Tags: "linux, iso"},
+		Post{Title: "Ubuntu Server", Size: 700 << 20, FileCount: 3, Seeders: 50,
+			UploadDate: int(jun.Unix()), Tags: "linux,server"},
+		Post{Title: "Ubuntu Wallpapers", Size: 100 << 20, FileCount: 200, Seeders: 5,
+			UploadDate: int(jun.Unix()), Tags: "linux_art"},
+	)
+
+	cases := map[string][]int{
+		"ubuntu size:>1GB":              {1},
+		"ubuntu size:<=700MB sort:size": {2, 3},
+		"ubuntu after:2016-02-01":       {2, 3},
+		"before:2016-02-01":             {1},
+		"tag:linux sort:seeders":        {2, 1},
+		"tag:linux tag:iso":             {1},
+		"tag:linux%":                    {},
+		"files:>2 sort:files:asc":       {2, 3},
+		"sort:date:asc seeders:>1":      {1, 2, 3},
+		"ubuntu tag:linux_art":          {3},
+		"ubuntu seeders:>=10 sort:size": {1, 2},
+	}
+
+	for query, want := range cases {
+		results, err := db.Search(query, 0, 25)
+
+		if err != nil {
+			t.Errorf("Search %q failed: %s", query, err.Error())
+			continue
+		}
+
+		if len(results) != len(want) {
+			t.Errorf("Search %q has %d results, want %d", query, len(results), len(want))
+			continue
+		}
+
+		for n, i := range want {
+			if results[n].Id != i {
+				t.Errorf("Search %q result %d is post %d, want %d", query, n, results[n].Id, i)
+			}
+		}
+	}
+
+	if _, err := db.Search("size:>big", 0, 25); err == nil {
+		t.Error("Invalid query searched")
+	}
+}
@@ -3,9 +3,20 @@ package data
 import (
 	"bufio"
 	"bytes"
-	"fmt"
 	"strings"
+	"sync"
+	"time"
 	"unicode"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// First pages with fewer results than this get spelling suggestions.
+	SuggestThreshold = 5
+	SuggestMax       = 5
+	// Dictionaries are reloaded after this long, to pick up new posts.
+	DictionaryMaxAge = time.Minute * 10
 )
 
 // This provides searching, as it is a little more comlex than just a db query.
@@ -15,19 +26,98 @@ import (
 type SearchProvider struct {
 	Loaded bool
 	// if the model has been loaded, otherwise no autocomplete/spell suggestions
+
+	// By the store they were loaded from.
+	dictionaries map[PostStore]*loadedDictionary
+	lock         sync.Mutex
 }
 
+type loadedDictionary struct {
+	*Dictionary
+	loaded time.Time
+}
+
+// Wrapped around the matching terms in snippets.
+const (
+	SnippetOpen  = "**"
+	SnippetClose = "**"
+)
+
 type SearchResult struct {
 	Posts  []*Post `json:"posts"`
 	Source string  `json:"source"`
+	// One for each post, in the same order. Only local searches have them.
+	Snippets []string `json:"snippets,omitempty"`
+	// Set when a search finds few results. Corrections are the likely words
+	// meant for each word that is not in the database, and DidYouMean are
+	// whole queries using them that do find something.
+	Corrections map[string][]string `json:"corrections,omitempty"`
+	DidYouMean  []string            `json:"didYouMean,omitempty"`
+	// One for each post, whether it is signed by Source. See Post.Provenance.
+	Provenance []string `json:"provenance,omitempty"`
+	// One for each post, the address of whoever signed it, if anyone did.
+	Authors []string `json:"authors,omitempty"`
+}
+
+// Drops posts with forged signatures, and their snippets, then sets the
+// provenance and author of those left.
+func (sr *SearchResult) Verify() {
+	posts := make([]*Post, 0, len(sr.Posts))
+	snippets := make([]string, 0, len(sr.Snippets))
+	sr.Provenance = make([]string, 0, len(sr.Posts))
+	sr.Authors = make([]string, 0, len(sr.Posts))
+
+	for n, i := range sr.Posts {
+		if i.Signed() && i.Verify() != nil {
+			continue
+		}
+
+		posts = append(posts, i)
+		sr.Provenance = append(sr.Provenance, i.Provenance(sr.Source))
+		sr.Authors = append(sr.Authors, i.AuthorAddress())
+
+		if n < len(sr.Snippets) {
+			snippets = append(snippets, sr.Snippets[n])
+		}
+	}
+
+	sr.Posts = posts
+
+	if sr.Snippets != nil {
+		sr.Snippets = snippets
+	}
 }
 
 func NewSearchProvider() *SearchProvider {
-	sp := &SearchProvider{true}
+	sp := &SearchProvider{
+		dictionaries: make(map[PostStore]*loadedDictionary),
+	}
 
 	return sp
 }
 
+// Returns the dictionary for a database, loading it if it has not been loaded
+// recently.
+func (sp *SearchProvider) Dictionary(db PostStore) (*Dictionary, error) {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+
+	if d, ok := sp.dictionaries[db]; ok && time.Since(d.loaded) < DictionaryMaxAge {
+		return d.Dictionary, nil
+	}
+
+	d, err := db.LoadDictionary()
+
+	if err != nil {
+		return nil, err
+	}
+
+	sp.dictionaries[db] = &loadedDictionary{d, time.Now()}
+	sp.Loaded = true
+
+	return d, nil
+}
+
 func IsAlnumWord(word string) bool {
 	for _, i := range word {
 		if !unicode.IsLetter(i) && !unicode.IsNumber(i) {
@@ -55,26 +145,229 @@ func SanitiseForAuto(in string) string {
 	return buffer.String()
 }
 
-func (sp *SearchProvider) Suggest(db *Database, query string) ([]string, error) {
-	checked, err := db.Suggest(fmt.Sprintf("%s%%", query))
+// Completions for a partly typed query. The last word is completed from the
+// dictionary first, most common terms first, then titles starting with the
+// query are added.
+func (sp *SearchProvider) Suggest(db PostStore, query string) ([]string, error) {
+	ret := make([]string, 0, SuggestMax)
+	seen := make(map[string]bool)
+
+	add := func(s string) {
+		s = strings.TrimSpace(s)
+		key := strings.ToLower(s)
+
+		if s != "" && !seen[key] && len(ret) < SuggestMax {
+			seen[key] = true
+			ret = append(ret, s)
+		}
+	}
+
+	words := strings.Fields(query)
+
+	// A trailing space means the last word is finished.
+	if len(words) > 0 && !strings.HasSuffix(query, " ") {
+		d, err := sp.Dictionary(db)
+
+		if err != nil {
+			return nil, err
+		}
+
+		head := strings.Join(words[:len(words)-1], " ")
+
+		for _, i := range d.Complete(words[len(words)-1], SuggestMax) {
+			add(head + " " + i.Term)
+		}
+	}
+
+	checked, err := db.Suggest(query)
 
 	if err != nil {
 		return nil, err
 	}
 
-	ret := make([]string, len(checked))
-
 	for _, i := range checked {
-		ret = append(ret, SanitiseForAuto(i))
+		add(SanitiseForAuto(i))
 	}
 
 	return ret, nil
 }
 
-func (sp *SearchProvider) Search(source string, db *Database, query string, page int) (SearchResult, error) {
-	// TODO: Instead of searching for spell-corrected versions, suggest an
-	// alternate search.
-	results, err := db.Search(query, page, 25)
+// Fills in corrections for any misspelt words in the query, and alternative
+// queries that find something. Only plain words are corrected, not phrases,
+// filters, prefixes or numbers.
+func (sp *SearchProvider) didYouMean(db PostStore, query string, res *SearchResult) error {
+	d, err := sp.Dictionary(db)
+
+	if err != nil {
+		return err
+	}
+
+	terms, err := splitQuery(query)
+
+	if err != nil {
+		return err
+	}
+
+	// The replacements for each term, best first. Terms that are fine have
+	// none.
+	fixes := make([][]string, len(terms))
+	corrected := false
+
+	for n, i := range terms {
+		if !IsAlnumWord(i) || strings.IndexFunc(i, unicode.IsNumber) >= 0 || d.Count(i) > 0 {
+			continue
+		}
+
+		for _, j := range d.Correct(i, 3) {
+			fixes[n] = append(fixes[n], j.Term)
+		}
+
+		if len(fixes[n]) > 0 {
+			if res.Corrections == nil {
+				res.Corrections = make(map[string][]string)
+			}
+
+			res.Corrections[i] = fixes[n]
+			corrected = true
+		}
+	}
+
+	if !corrected {
+		return nil
+	}
+
+	// The best correction for every word, then the same with each word's
+	// other corrections in turn.
+	alternative := func(at, choice int) string {
+		alt := make([]string, len(terms))
+
+		for n, i := range terms {
+			alt[n] = i
+
+			if n == at {
+				alt[n] = fixes[n][choice]
+			} else if len(fixes[n]) > 0 {
+				alt[n] = fixes[n][0]
+			}
+		}
+
+		return strings.Join(alt, " ")
+	}
+
+	candidates := []string{alternative(-1, 0)}
+
+	for n, i := range fixes {
+		for choice := 1; choice < len(i); choice++ {
+			candidates = append(candidates, alternative(n, choice))
+		}
+	}
+
+	for _, i := range candidates {
+		if len(res.DidYouMean) >= SuggestMax {
+			break
+		}
+
+		q, err := ParseQuery(i)
+
+		if err != nil {
+			return err
+		}
+
+		hits, err := db.SearchQuery(q, 0, 1)
+
+		if err != nil {
+			return err
+		}
+
+		if len(hits) > 0 {
+			res.DidYouMean = append(res.DidYouMean, i)
+		}
+	}
+
+	return nil
+}
+
+// Search a database. A first page with few results comes with suggestions of
+// what might have been meant, see didYouMean.
+func (sp *SearchProvider) Search(source string, db PostStore, query string, page int) (SearchResult, error) {
+	q, err := ParseQuery(query)
+
+	if err != nil {
+		return SearchResult{Source: source}, err
+	}
+
+	hits, err := db.SearchQuery(q, page, 25)
+
+	if err != nil {
+		return SearchResult{Source: source}, err
+	}
+
+	res := SearchResult{
+		Posts:    make([]*Post, 0, len(hits)),
+		Source:   source,
+		Snippets: make([]string, 0, len(hits)),
+	}
+
+	for _, i := range hits {
+		res.Posts = append(res.Posts, i.Post)
+		res.Snippets = append(res.Snippets, i.Snippet)
+	}
+
+	res.Verify()
+
+	// Suggestions are only a nicety, the results are still good without them.
+	if page == 0 && len(hits) < SuggestThreshold && q.Text != "" {
+		if err := sp.didYouMean(db, query, &res); err != nil {
+			log.Error("Failed to make search suggestions: ", err.Error())
+		}
+	}
+
+	return res, nil
+}
+
+// Turns a user's query into an FTS5 one. Every word must match, "quoted
+// phrases" must match as a phrase, and a word ending in * matches as a prefix.
+// Everything is quoted, so punctuation in a query is never taken as FTS5
+// syntax. Returns an empty string if there is nothing to search for.
+func FtsQuery(query string) string {
+	terms := make([]string, 0)
+
+	// Parts are split on quotes, so never contain one.
+	quote := func(s string) string {
+		return `"` + s + `"`
+	}
+
+	for n, part := range strings.Split(query, `"`) {
+		// Odd parts were between quotes.
+		if n%2 == 1 {
+			if phrase := strings.Join(strings.Fields(part), " "); phrase != "" {
+				terms = append(terms, quote(phrase))
+			}
+
+			continue
+		}
+
+		for _, word := range strings.Fields(part) {
+			prefix := strings.HasSuffix(word, "*")
+			word = strings.TrimRight(word, "*")
+
+			if strings.IndexFunc(word, isTokenRune) < 0 {
+				continue
+			}
+
+			term := quote(word)
+
+			if prefix {
+				term += "*"
+			}
+
+			terms = append(terms, term)
+		}
+	}
+
+	return strings.Join(terms, " ")
+}
 
-	return SearchResult{results, source}, err
+func isTokenRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r)
 }
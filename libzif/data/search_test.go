@@ -0,0 +1,191 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFtsQuery(t *testing.T) {
+	cases := map[string]string{
+		"ubuntu desktop":        `"ubuntu" "desktop"`,
+		"ubu*":                  `"ubu"*`,
+		`"star wars" episode`:   `"star wars" "episode"`,
+		"Star Wars: Episode IV": `"Star" "Wars:" "Episode" "IV"`,
+		"AND OR NOT - ( ) ^ :":  `"AND" "OR" "NOT"`,
+		`unclosed "quote here`:  `"unclosed" "quote here"`,
+		"":                      "",
+		"*":                     "",
+	}
+
+	for in, want := range cases {
+		if got := FtsQuery(in); got != want {
+			t.Errorf("FtsQuery(%q) is %q, want %q", in, got, want)
+		}
+	}
+}
+
+func insertPosts(t *testing.T, db *Database, posts ...Post) {
+	for n, i := range posts {
+		i.InfoHash = fmt.Sprintf("%040x", n+1)
+
+		if _, _, err := db.UpsertPost(i); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	if err := db.GenerateFts(0); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestSearchRanking(t *testing.T) {
+	db, done := tempDatabase(t)
+	defer done()
+
+	posts := []Post{
+		{Title: "Ubuntu Server Complete Collection with Desktop Extras and Tools", Seeders: 50000, Leechers: 1000},
+		{Title: "Ubuntu Desktop", Seeders: 20},
+		{Title: "Debian", Tags: "ubuntu,desktop", Seeders: 100},
+		{Title: "Ubuntu Desktop", Seeders: 300, Meta: Meta{"lang": {"en"}}},
+	}
+
+	// Relevance means little with only a few posts, every term is in most of
+	// them.
+	for i := 0; i < 20; i++ {
+		posts = append(posts, Post{Title: fmt.Sprintf("Some Other Linux Distribution Release %d", i)})
+	}
+
+	insertPosts(t, db, posts...)
+
+	hits, err := db.SearchHits("ubuntu desktop", 0, 25)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(hits) != 4 {
+		t.Fatalf("%d results, want 4", len(hits))
+	}
+
+	// Exact titles first, the healthier one ahead, however popular the others
+	// are.
+	order := []int{4, 2}
+
+	for n, i := range order {
+		if hits[n].Post.Id != i {
+			t.Errorf("Result %d is post %d, want %d", n, hits[n].Post.Id, i)
+		}
+	}
+
+	if hits[0].Snippet != "**Ubuntu** **Desktop**" {
+		t.Errorf("Snippet is %q", hits[0].Snippet)
+	}
+
+	if hits[3].Snippet != "**ubuntu**,**desktop**" {
+		t.Errorf("Tag snippet is %q", hits[3].Snippet)
+	}
+}
+
+func TestSearchQueries(t *testing.T) {
+	db, done := tempDatabase(t)
+	defer done()
+
+	insertPosts(t, db,
+		Post{Title: "Star Wars Episode IV"},
+		Post{Title: "Episode of Star Trek: Wars"},
+		Post{Title: "Something else", Meta: Meta{"director": {"Lucas"}}},
+	)
+
+	cases := map[string]int{
+		"star wars":          2,
+		`"star wars"`:        1,
+		"episo*":             2,
+		"Star Trek: Wars":    1,
+		"lucas":              1,
+		"lucas director:x":   0,
+		"?!":                 0,
+		`"star wars" NOT iv`: 0,
+	}
+
+	for query, want := range cases {
+		results, err := db.Search(query, 0, 25)
+
+		if err != nil {
+			t.Errorf("Search %q failed: %s", query, err.Error())
+			continue
+		}
+
+		if len(results) != want {
+			t.Errorf("Search %q has %d results, want %d", query, len(results), want)
+		}
+	}
+}
+
+func TestSearchGenerateFtsTwice(t *testing.T) {
+	db, done := tempDatabase(t)
+	defer done()
+
+	insertPosts(t, db, Post{Title: "Ubuntu"})
+
+	if err := db.GenerateFts(0); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	results, err := db.Search("ubuntu", 0, 25)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(results) != 1 {
+		t.Errorf("%d results, want 1", len(results))
+	}
+}
+
+func TestMigrateFts4(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zif-data")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "posts.db")
+	conn, err := sql.Open("sqlite3", path)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	conn.Exec(legacy_post_table)
+	conn.Exec(legacy_fts_post)
+	conn.Exec(`INSERT INTO post(info_hash, title, size, file_count, seeders,
+		leechers, upload_date, tags, meta) VALUES(?, 'Ubuntu', 0, 0, 0, 0, 0, 'linux', '')`,
+		ubuntuInfoHash)
+	conn.Exec(`INSERT INTO fts_post(docid, title, seeders, leechers)
+		SELECT id, title, seeders, leechers FROM post`)
+	conn.Close()
+
+	db := NewDatabase(path)
+
+	if err := db.Connect(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer db.Close()
+
+	results, err := db.Search("linux", 0, 25)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(results) != 1 || results[0].Title != "Ubuntu" {
+		t.Error("Existing posts not in the new index")
+	}
+}
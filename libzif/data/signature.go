@@ -0,0 +1,130 @@
+// Posts may be signed by the peer that published them, so that a post can be
+// trusted however it reached us. The signature covers what identifies the
+// torrent: its infohash, title, size and file count. Seeders, leechers, tags
+// and metadata are not covered, they change as posts from different sources
+// are merged. Anyone can sign a post, so a signature only means something
+// once the author is known to be the peer the post came from.
+
+package data
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+
+	"github.com/wjh/zif/libzif/dht"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	// Signed by the peer it came from.
+	ProvenanceVerified = "verified"
+	// Validly signed, but by someone else. See AuthorAddress.
+	ProvenanceSigned     = "signed"
+	ProvenanceUnverified = "unverified"
+)
+
+var (
+	ErrPostUnsigned         = errors.New("Post is not signed")
+	errInvalidPostSignature = errors.New("Invalid post signature")
+)
+
+// The bytes a post's author signs. Strings are length prefixed, so that one
+// field cannot run into the next.
+func (p *Post) SignedBytes() []byte {
+	buf := bytes.Buffer{}
+
+	hash, err := NormaliseInfoHash(p.InfoHash)
+
+	if err != nil {
+		hash = p.InfoHash
+	}
+
+	writeString := func(s string) {
+		buf.WriteString(strconv.Itoa(len(s)))
+		buf.WriteString(":")
+		buf.WriteString(s)
+	}
+
+	buf.WriteString("post")
+	buf.Write(p.Author)
+	writeString(hash)
+	writeString(p.Title)
+	writeString(strconv.Itoa(p.Size))
+	writeString(strconv.Itoa(p.FileCount))
+
+	return buf.Bytes()
+}
+
+func (p *Post) Sign(s Signer) {
+	p.Author = s.PublicKey()
+	p.Signature = s.Sign(p.SignedBytes())
+}
+
+func (p *Post) Signed() bool {
+	return len(p.Author) > 0 || len(p.Signature) > 0
+}
+
+// Returns nil if the post is signed by its author, ErrPostUnsigned if it is
+// not signed at all, or an error if the signature is not valid.
+func (p *Post) Verify() error {
+	if !p.Signed() {
+		return ErrPostUnsigned
+	}
+
+	if len(p.Author) != ed25519.PublicKeySize {
+		return errors.New("Invalid post author")
+	}
+
+	if !ed25519.Verify(p.Author, p.SignedBytes(), p.Signature) {
+		return errInvalidPostSignature
+	}
+
+	return nil
+}
+
+// The address of the post's author, or an empty string if it is not signed.
+func (p *Post) AuthorAddress() string {
+	if len(p.Author) != ed25519.PublicKeySize {
+		return ""
+	}
+
+	address := dht.NewAddress(p.Author)
+
+	return address.String()
+}
+
+// ProvenanceVerified if the post has a valid signature by one of the peers at
+// sources, ProvenanceSigned if it is validly signed by anyone else, otherwise
+// ProvenanceUnverified.
+func (p *Post) Provenance(sources ...string) string {
+	if p.Verify() != nil {
+		return ProvenanceUnverified
+	}
+
+	author := p.AuthorAddress()
+
+	for _, i := range sources {
+		if i == author {
+			return ProvenanceVerified
+		}
+	}
+
+	return ProvenanceSigned
+}
+
+// Removes posts that are signed, but whose signatures are not valid. These
+// have been tampered with. Unsigned posts are kept.
+func FilterForged(posts []*Post) []*Post {
+	ret := make([]*Post, 0, len(posts))
+
+	for _, i := range posts {
+		if i.Signed() && i.Verify() != nil {
+			continue
+		}
+
+		ret = append(ret, i)
+	}
+
+	return ret
+}
@@ -0,0 +1,199 @@
+package data
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/wjh/zif/libzif/dht"
+	"golang.org/x/crypto/ed25519"
+)
+
+type testSigner struct {
+	public  ed25519.PublicKey
+	private ed25519.PrivateKey
+}
+
+func newTestSigner(t *testing.T) *testSigner {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return &testSigner{public, private}
+}
+
+func (s *testSigner) Sign(msg []byte) []byte {
+	return ed25519.Sign(s.private, msg)
+}
+
+func (s *testSigner) PublicKey() []byte {
+	return s.public
+}
+
+func TestPostSignature(t *testing.T) {
+	post := Post{InfoHash: ubuntuInfoHash, Title: "Ubuntu", Size: 1024, FileCount: 1}
+
+	if post.Verify() != ErrPostUnsigned || post.Provenance() != ProvenanceUnverified {
+		t.Error("Unsigned post verified")
+	}
+
+	author := newTestSigner(t)
+	post.Sign(author)
+
+	if err := post.Verify(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	source := dht.NewAddress(author.PublicKey())
+
+	if post.Provenance("other", source.String()) != ProvenanceVerified || post.AuthorAddress() != source.String() {
+		t.Error("Post signed by its source not verified")
+	}
+
+	// Anyone can sign a post, it is only verified if it came from its author.
+	resigned := post
+	resigned.Title = "Ubuntu (totally not malware)"
+	resigned.Sign(newTestSigner(t))
+
+	if resigned.Verify() != nil || resigned.Provenance(source.String()) != ProvenanceSigned {
+		t.Error("Post signed by someone else verified")
+	}
+
+	// Not covered by the signature.
+	post.Seeders = 100
+	post.Tags = "linux"
+
+	if post.Verify() != nil {
+		t.Error("Changing seeders broke the signature")
+	}
+
+	// Only case is changed, the infohash is the same.
+	post.InfoHash = "9F9165D9A281A9B8E782CD5176BBCC8256FD1871"
+
+	if post.Verify() != nil {
+		t.Error("Changing infohash encoding broke the signature")
+	}
+
+	forged := post
+	forged.Title = "Ubuntu (totally not malware)"
+
+	if forged.Verify() == nil {
+		t.Error("Forged title verified")
+	}
+
+	if posts := FilterForged([]*Post{&post, &forged, {Title: "Unsigned"}}); len(posts) != 2 ||
+		posts[0] != &post || posts[1].Title != "Unsigned" {
+		t.Errorf("Filtered posts are %v", posts)
+	}
+}
+
+func TestMergeSignature(t *testing.T) {
+	signed := Post{InfoHash: ubuntuInfoHash, Title: "Ubuntu", Size: 1024}
+	signed.Sign(newTestSigner(t))
+
+	unsigned := Post{InfoHash: ubuntuInfoHash, Title: "ubuntu iso", Size: 9, Seeders: 5}
+
+	if !unsigned.Merge(signed) || unsigned.Title != "Ubuntu" || unsigned.Verify() != nil {
+		t.Errorf("Unsigned post did not take the signature: %+v", unsigned)
+	}
+
+	if unsigned.Seeders != 5 {
+		t.Error("Seeders lost in merge")
+	}
+
+	// A signed post is never changed by an unsigned one.
+	original := signed
+	signed.Merge(Post{InfoHash: ubuntuInfoHash, Title: "Other", Size: 1, FileCount: 3})
+
+	if signed.Title != original.Title || signed.FileCount != 0 || signed.Verify() != nil {
+		t.Errorf("Signed post changed: %+v", signed)
+	}
+
+	// Nor does a forged signature spread.
+	forged := Post{InfoHash: ubuntuInfoHash, Title: "Forged", Author: signed.Author,
+		Signature: signed.Signature}
+	plain := Post{InfoHash: ubuntuInfoHash, Title: "Plain"}
+	plain.Merge(forged)
+
+	if plain.Signed() || plain.Title != "Plain" {
+		t.Errorf("Forged signature merged: %+v", plain)
+	}
+}
+
+func TestMergeAuthorMeta(t *testing.T) {
+	eachStore(t, func(t *testing.T, db PostStore) {
+		author := newTestSigner(t)
+		post := signedPost(author, "Ubuntu")
+		post.Meta = Meta{"lang": {"en"}, "release": {"16.04"}}
+
+		if _, _, err := db.UpsertPost(post); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		// The author removing a key is carried over to copies of the post.
+		post.Meta = Meta{"lang": {"en"}}
+
+		if _, _, err := db.UpsertPost(post); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		stored, _ := db.QueryInfoHash(ubuntuInfoHash)
+
+		if stored.Meta.Encode() != "lang=en" {
+			t.Errorf("Meta is %q after the author removed a key", stored.Meta.Encode())
+		}
+
+		// Anyone else can only add to it.
+		other := signedPost(newTestSigner(t), "Ubuntu")
+		other.Meta = Meta{"source": {"elsewhere"}}
+
+		if _, _, err := db.UpsertPost(other); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		stored, _ = db.QueryInfoHash(ubuntuInfoHash)
+
+		if stored.Meta.Encode() != "lang=en&source=elsewhere" {
+			t.Errorf("Meta is %q after merging someone else's post", stored.Meta.Encode())
+		}
+	})
+}
+
+func TestSignedPostDatabase(t *testing.T) {
+	db, done := tempDatabase(t)
+	defer done()
+
+	post := Post{InfoHash: ubuntuInfoHash, Title: "Ubuntu", Size: 1024}
+	post.Sign(newTestSigner(t))
+
+	if _, _, err := db.UpsertPost(Post{InfoHash: ubuntuInfoHash, Title: "ubuntu", Seeders: 3}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Merged into the unsigned post, which becomes signed.
+	if _, _, err := db.UpsertPost(post); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	stored, err := db.QueryInfoHash(ubuntuInfoHash)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if stored.Verify() != nil || stored.Title != "Ubuntu" || stored.Seeders != 3 {
+		t.Errorf("Stored post is %+v", stored)
+	}
+
+	forged := post
+	forged.InfoHash = "a" + ubuntuInfoHash[1:]
+
+	if _, _, err := db.UpsertPost(forged); err != errInvalidPostSignature {
+		t.Errorf("Forged post stored, error %v", err)
+	}
+
+	if err := forged.Valid(); err == nil {
+		t.Error("Forged post valid")
+	}
+}
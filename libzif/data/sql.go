@@ -1,31 +1,5 @@
 package data
 
-const sql_create_post_table string = `CREATE TABLE IF NOT EXISTS 
-										post(
-											id INTEGER PRIMARY KEY NOT NULL,
-											info_hash STRING,
-											title STRING NOT NULL,
-											size INTEGER NOT NULL,
-											file_count INTEGER NOT NULL,
-											seeders INTEGER NOT NULL,
-											leechers INTEGER NOT NULL,
-											upload_date INTEGER NOT NULL,
-											tags STRING,
-											meta STRING
-										)`
-
-const sql_create_fts_post string = `CREATE VIRTUAL TABLE IF NOT EXISTS
-									fts_post using fts4(
-										content="post",
-										title,
-										seeders,
-										leechers
-									)`
-
-const sql_create_upload_date_index string = `CREATE INDEX IF NOT EXISTS
-											port_upload_date_index
-											ON post(upload_date)`
-
 const sql_insert_post string = `INSERT OR IGNORE INTO post(
 									info_hash,
 									title,
@@ -38,16 +12,70 @@ const sql_insert_post string = `INSERT OR IGNORE INTO post(
 									meta
 								) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
+// Posts gained an author and signature after sql_insert_post was written, it
+// is kept for databases from before then.
+const sql_insert_signed_post string = `INSERT OR IGNORE INTO post(
+									info_hash,
+									title,
+									size,
+									file_count,
+									seeders,
+									leechers,
+									upload_date,
+									tags,
+									meta,
+									author,
+									signature
+								) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+const sql_query_post_infohash string = `SELECT * FROM post
+										WHERE info_hash = ?`
+
+// A merge may also give an unsigned post a signature.
+const sql_update_merged_signed_post string = `UPDATE post
+										SET title=?,
+											size=?,
+											file_count=?,
+											seeders=?,
+											leechers=?,
+											upload_date=?,
+											tags=?,
+											meta=?,
+											author=?,
+											signature=?
+										WHERE id=?`
+
+const sql_populate_fts5_post string = `INSERT INTO fts_post(rowid, title, tags, meta)
+										SELECT id, title, tags, meta FROM post`
+
+const sql_insert_post_meta string = `INSERT OR IGNORE INTO post_meta(
+										post_id,
+										key,
+										value
+									) VALUES(?, ?, ?)`
+
+const sql_delete_post_meta string = `DELETE FROM post_meta WHERE post_id = ?`
+
+const sql_query_meta string = `SELECT meta FROM post WHERE id = ?`
+
+const sql_query_meta_key string = `SELECT 1 FROM post_meta WHERE key = ? LIMIT 1`
+
+// Appended to a search once per filter.
+const sql_search_meta_filter string = ` AND post.id IN (
+											SELECT post_id FROM post_meta
+											WHERE key = ? AND value = ?
+										)`
+
 const sql_attach_meta string = `UPDATE POST
 								SET meta=?
 								WHERE id=?`
 
-const sql_generate_fts string = `INSERT OR IGNORE INTO fts_post(
-								docid,
+const sql_generate_fts string = `INSERT OR REPLACE INTO fts_post(
+								rowid,
 								title,
-								seeders,
-								leechers)
-							SELECT id, title, seeders, leechers FROM post 
+								tags,
+								meta)
+							SELECT id, title, tags, meta FROM post
 							WHERE id >= ?`
 
 const sql_query_recent_post string = `SELECT 	 * FROM post
@@ -65,25 +93,91 @@ const sql_query_popular_post string = ` SELECT * FROM(
 const sql_query_post_id string = `SELECT 	 * FROM post
 												 WHERE id = ?`
 
+// Paged by offset rather than id, as deleting posts leaves gaps in ids.
 const sql_query_paged_post string = `SELECT 	 * FROM post
-												 WHERE id > ?
-												 LIMIT 0,?`
+												 ORDER BY id
+												 LIMIT ?, ?`
+
+// Searches are built from a head, any filters, and an order, see Query.SQL.
+// The snippet is taken from whichever column matched best, with the markers
+// passed in. The head is given the expression posts are ranked by, so that the
+// rank can be returned too.
+const sql_search_post_head string = `SELECT post.id,
+										snippet(fts_post, -1, ?, ?, '...', 16),
+										%s AS rank
+									FROM fts_post
+									JOIN post ON post.id = fts_post.rowid
+									WHERE fts_post MATCH ?`
 
+// Used when there are filters but no query. The post table is read directly,
+// and there is nothing to make a snippet from.
+const sql_search_post_all_head string = `SELECT post.id, '', %s AS rank FROM post
+									WHERE 1`
+
+// BM25 weights title matches above tags, and tags above meta. Larger weights
+// saturate the term frequency, so that short exact titles no longer stand out.
+// BM25 is negative, lower is better, and is scaled by up to a quarter more for
+// healthy swarms. Relevance comes first, swarm health decides between posts
+// that are about as relevant.
 // Seeders are weighted, things with more seeders are better than things with
 // more leechers, though both are important.
 // (for one, seeders DO still upload, and are indicative of popularity)
-const sql_search_post string = `SELECT docid FROM fts_post
-									WHERE title MATCH ?
-									ORDER BY ((seeders * 1.1) + leechers) DESC
-									LIMIT ?,?`
+const sql_search_rank_relevance string = `bm25(fts_post, 2.0, 1.0, 0.5) *
+										(1.0 + 0.25 * (post.seeders * 1.1 + post.leechers) /
+											(post.seeders * 1.1 + post.leechers + 100.0))`
+
+// Tags are comma separated, so are matched with a comma either side. The
+// pattern has LIKE wildcards escaped, see escapeLike.
+const sql_search_tag_filter string = ` AND (',' || replace(lower(post.tags), ', ', ',') || ',')
+											LIKE ? ESCAPE '\'`
 
 const sql_suggest_posts string = `SELECT title FROM (
 										SELECT * FROM post
 										ORDER BY upload_date DESC
 										LIMIT 100000
 									)
-									WHERE title LIKE ?
+									WHERE title LIKE ? ESCAPE '\'
 									ORDER BY (seeders * 1.1) + leechers DESC
 									LIMIT 0,?`
 
-const sql_count_post = `SELECT MAX(id) FROM post`
+const sql_clear_fts string = `DELETE FROM fts_post`
+
+// Checks the index against itself, an error is returned if it is corrupt.
+const sql_integrity_check_fts string = `INSERT INTO fts_post(fts_post) VALUES('integrity-check')`
+
+const sql_count_fts_missing string = `SELECT COUNT(*) FROM post
+										WHERE id NOT IN (SELECT rowid FROM fts_post)`
+
+const sql_count_fts_stale string = `SELECT COUNT(*) FROM fts_post
+										WHERE rowid NOT IN (SELECT id FROM post)`
+
+const sql_count_fts_outdated string = `SELECT COUNT(*) FROM post
+										JOIN fts_post ON fts_post.rowid = post.id
+										WHERE fts_post.title IS NOT post.title
+											OR fts_post.tags IS NOT post.tags
+											OR fts_post.meta IS NOT post.meta`
+
+// Sorted so that completions can be found with a binary search. A post with a
+// term in both its title and tags counts twice.
+const sql_query_dictionary string = `SELECT term, SUM(doc) FROM fts_post_vocab
+										WHERE col IN ('title', 'tags')
+										GROUP BY term
+										ORDER BY term`
+
+const sql_count_post = `SELECT COUNT(*) FROM post`
+
+const sql_count_post_before = `SELECT COUNT(*) FROM post WHERE id < ?`
+
+const sql_insert_tombstone string = `INSERT OR REPLACE INTO tombstone(
+										info_hash,
+										author,
+										timestamp,
+										replacement,
+										signature
+									) VALUES(?, ?, ?, ?, ?)`
+
+const sql_query_tombstone string = `SELECT * FROM tombstone WHERE info_hash = ?`
+
+const sql_query_tombstones string = `SELECT * FROM tombstone ORDER BY timestamp`
+
+const sql_delete_post string = `DELETE FROM post WHERE id = ?`
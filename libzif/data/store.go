@@ -0,0 +1,115 @@
+// Posts can be kept anywhere that can do what a PostStore does. Database keeps
+// them in SQLite, and MemoryStore keeps them in memory for tests and nodes that
+// do not need to keep posts between runs. Nothing outside this package should
+// need to know which it has.
+
+package data
+
+// Everything a peer needs to store, search and serve posts.
+type PostStore interface {
+	// Stores a post, merging it into any post with the same infohash. See
+	// Post.Merge and Tombstone.Allows.
+	UpsertPost(post Post) (id int64, inserted bool, err error)
+	InsertPost(post Post) (int64, error)
+	// Stores every post in pieces read from the channel, skipping any that
+	// would not be accepted, until it is closed.
+	InsertPieces(pieces chan *Piece) error
+
+	QueryInfoHash(infohash string) (*Post, error)
+	QueryPostId(id uint) (Post, error)
+	QueryRecent(page int) ([]*Post, error)
+	QueryPopular(page int) ([]*Post, error)
+
+	// Pieces are made of posts in the order they were stored.
+	QueryPiece(id int, store bool) (*Piece, error)
+	QueryPiecePosts(start, length int, store bool) chan *Post
+	PostPosition(id int) (int, error)
+	PostCount() uint
+
+	Search(query string, page, pageSize int) ([]*Post, error)
+	SearchQuery(q *Query, page, pageSize int) ([]SearchHit, error)
+	// Titles starting with prefix, most popular first.
+	Suggest(prefix string) ([]string, error)
+	LoadDictionary() (*Dictionary, error)
+
+	AddMeta(pid int, key, value string) error
+	RemoveMeta(pid int, key, value string) error
+	QueryMeta(pid int) (Meta, error)
+
+	QueryTombstone(infohash string) (*Tombstone, error)
+	QueryTombstones() ([]*Tombstone, error)
+	ApplyTombstone(t Tombstone, owner []byte) (bool, error)
+
+	Close()
+}
+
+// A store with a full text index that is kept separately from posts, and so
+// may need checking and rebuilding.
+type IndexedStore interface {
+	GenerateFts(since int64) error
+	CheckFts() (*IndexCheck, error)
+	RebuildFts() error
+}
+
+// A store kept in a file with a versioned schema.
+type VersionedStore interface {
+	Path() string
+	SchemaVersion() (int, error)
+}
+
+var (
+	_ PostStore      = (*Database)(nil)
+	_ IndexedStore   = (*Database)(nil)
+	_ VersionedStore = (*Database)(nil)
+	_ PostStore      = (*MemoryStore)(nil)
+)
+
+// Errors for posts that a store will not take, but that should not stop the
+// rest of a mirror from being stored.
+func skipPost(err error) bool {
+	return err == errInvalidInfoHash || err == errInvalidPostSignature ||
+		err == ErrPostDeleted || err == errPostSuperseded
+}
+
+// Normalises a post's infohash and checks any signature, before it is stored.
+func preparePost(post *Post) error {
+	hash, err := NormaliseInfoHash(post.InfoHash)
+
+	if err != nil {
+		return errInvalidInfoHash
+	}
+
+	post.InfoHash = hash
+
+	if post.Signed() && post.Verify() != nil {
+		return errInvalidPostSignature
+	}
+
+	return nil
+}
+
+// Decides how a prepared post is stored, given the tombstone for its infohash
+// and the post already stored for it, either of which may be nil. Every store
+// upserts through this. Returns an error if the post may not be stored.
+// Otherwise, if existing is nil the post should be inserted as it is, if not
+// the post is merged into existing, and changed is true if it needs writing.
+func mergeStored(post *Post, existing *Post, tombstone *Tombstone) (changed bool, err error) {
+	if tombstone != nil {
+		// Stored tombstones were checked against their owner when applied,
+		// so here only the post's own author can block it.
+		if err := tombstone.Allows(post, post.Author); err != nil {
+			return false, err
+		}
+	}
+
+	if existing == nil {
+		return true, nil
+	}
+
+	// The edit a tombstone points to replaces what the old version signed.
+	if tombstone != nil && tombstone.Replaces(existing, post) {
+		existing.Author, existing.Signature = nil, nil
+	}
+
+	return existing.Merge(*post), nil
+}
@@ -0,0 +1,215 @@
+package data
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Runs a test against every kind of PostStore, so they all behave the same.
+func eachStore(t *testing.T, test func(t *testing.T, db PostStore)) {
+	t.Run("sqlite", func(t *testing.T) {
+		db, done := tempDatabase(t)
+		defer done()
+
+		test(t, db)
+	})
+
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryStore())
+	})
+}
+
+func storePosts(t *testing.T, db PostStore, posts ...Post) {
+	for n, i := range posts {
+		i.InfoHash = fmt.Sprintf("a%039x", n+1)
+
+		if _, _, err := db.UpsertPost(i); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
+
+func TestStoreUpsert(t *testing.T) {
+	eachStore(t, func(t *testing.T, db PostStore) {
+		id, inserted, err := db.UpsertPost(Post{InfoHash: ubuntuInfoHash, Title: "Ubuntu", Tags: "linux"})
+
+		if err != nil || !inserted {
+			t.Fatalf("Insert: %v %v", inserted, err)
+		}
+
+		again, inserted, err := db.UpsertPost(Post{InfoHash: ubuntuInfoHash, Seeders: 5, Tags: "iso"})
+
+		if err != nil || inserted || again != id {
+			t.Fatalf("Merge: %d %v %v", again, inserted, err)
+		}
+
+		post, err := db.QueryInfoHash(ubuntuInfoHash)
+
+		if err != nil || post == nil {
+			t.Fatalf("Query: %v %v", post, err)
+		}
+
+		if post.Title != "Ubuntu" || post.Seeders != 5 || post.Tags != "linux,iso" {
+			t.Errorf("Merged post is %+v", post)
+		}
+
+		if db.PostCount() != 1 {
+			t.Errorf("%d posts, want 1", db.PostCount())
+		}
+
+		if _, err := db.InsertPost(Post{InfoHash: "nope"}); err == nil {
+			t.Error("Stored a post with an invalid infohash")
+		}
+
+		if err := db.AddMeta(int(id), "Lang", "en"); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if m, err := db.QueryMeta(int(id)); err != nil || !m.Has("lang", "en") {
+			t.Errorf("Meta is %v, %v", m, err)
+		}
+
+		if db.AddMeta(int(id)+100, "lang", "en") == nil {
+			t.Error("Added meta to a post that is not there")
+		}
+	})
+}
+
+func TestStoreSearch(t *testing.T) {
+	eachStore(t, func(t *testing.T, db PostStore) {
+		storePosts(t, db,
+			Post{Title: "Ubuntu 16.04 Desktop", Tags: "linux", Size: 1 << 30, Seeders: 10},
+			Post{Title: "Debian Netinstall", Tags: "linux,ubuntu-like", Size: 300 << 20, Seeders: 50},
+			Post{Title: "The Shawshank Redemption", Size: 2 << 30, Seeders: 100,
+				Meta: Meta{"imdb": {"tt0111161"}}},
+			Post{Title: "Re:Zero Season 1"},
+		)
+
+		if index, ok := db.(IndexedStore); ok {
+			if err := index.GenerateFts(0); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+
+		cases := []struct {
+			query  string
+			titles []string
+		}{
+			// Title matches rank above tag matches.
+			{"ubuntu", []string{"Ubuntu 16.04 Desktop", "Debian Netinstall"}},
+			{"ubun*", []string{"Ubuntu 16.04 Desktop", "Debian Netinstall"}},
+			{`"shawshank redemption"`, []string{"The Shawshank Redemption"}},
+			{`"redemption shawshank"`, []string{}},
+			{"size:>500MB", []string{"The Shawshank Redemption", "Ubuntu 16.04 Desktop"}},
+			{"tag:linux sort:seeders:asc", []string{"Ubuntu 16.04 Desktop", "Debian Netinstall"}},
+			{"imdb:tt0111161", []string{"The Shawshank Redemption"}},
+			// No post has "re" metadata, so this is text.
+			{"re:zero", []string{"Re:Zero Season 1"}},
+			{"!!!", []string{}},
+		}
+
+		for _, c := range cases {
+			posts, err := db.Search(c.query, 0, 25)
+
+			if err != nil {
+				t.Fatalf("%s: %s", c.query, err.Error())
+			}
+
+			titles := make([]string, 0)
+
+			for _, i := range posts {
+				titles = append(titles, i.Title)
+			}
+
+			if fmt.Sprint(titles) != fmt.Sprint(c.titles) {
+				t.Errorf("%s: got %v, want %v", c.query, titles, c.titles)
+			}
+		}
+
+		suggestions, err := db.Suggest("ubu")
+
+		if err != nil || fmt.Sprint(suggestions) != "[Ubuntu 16.04 Desktop]" {
+			t.Errorf("Suggestions %v, %v", suggestions, err)
+		}
+
+		dict, err := db.LoadDictionary()
+
+		if err != nil || dict.Count("linux") != 2 {
+			t.Errorf("Dictionary has linux %d times, %v", dict.Count("linux"), err)
+		}
+	})
+}
+
+func TestStorePieces(t *testing.T) {
+	hashes := make([][]byte, 0)
+
+	eachStore(t, func(t *testing.T, db PostStore) {
+		posts := make([]Post, 0)
+
+		for i := 1; i <= 11; i++ {
+			posts = append(posts, Post{Title: fmt.Sprintf("Post %d", i), UploadDate: i})
+		}
+
+		storePosts(t, db, posts...)
+
+		piece, err := db.QueryPiece(0, true)
+
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		hashes = append(hashes, piece.Hash())
+
+		recent, err := db.QueryRecent(0)
+
+		if err != nil || len(recent) != 11 || recent[0].Title != "Post 11" {
+			t.Errorf("Recent posts %v, %v", recent, err)
+		}
+
+		if n, err := db.PostPosition(recent[0].Id); err != nil || n != 10 {
+			t.Errorf("Last post is at %d, %v", n, err)
+		}
+	})
+
+	// The same posts make the same collection wherever they are kept.
+	if len(hashes) != 2 || !bytes.Equal(hashes[0], hashes[1]) {
+		t.Error("Piece hashes differ between stores")
+	}
+}
+
+func TestStoreTombstone(t *testing.T) {
+	eachStore(t, func(t *testing.T, db PostStore) {
+		author := newTestSigner(t)
+
+		if _, _, err := db.UpsertPost(signedPost(author, "Ubuntu")); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		tombstone := Tombstone{InfoHash: ubuntuInfoHash, Timestamp: time.Now().Unix()}
+		tombstone.Sign(author)
+
+		if applied, err := db.ApplyTombstone(tombstone, author.PublicKey()); err != nil || !applied {
+			t.Fatalf("Apply: %v %v", applied, err)
+		}
+
+		if applied, err := db.ApplyTombstone(tombstone, author.PublicKey()); err != nil || applied {
+			t.Errorf("Applied the same tombstone twice: %v %v", applied, err)
+		}
+
+		if post, err := db.QueryInfoHash(ubuntuInfoHash); err != nil || post != nil {
+			t.Errorf("Deleted post is %v, %v", post, err)
+		}
+
+		if _, _, err := db.UpsertPost(signedPost(author, "Ubuntu")); err != ErrPostDeleted {
+			t.Errorf("Stored a deleted post: %v", err)
+		}
+
+		tombstones, err := db.QueryTombstones()
+
+		if err != nil || len(tombstones) != 1 || !tombstones[0].Deleted() {
+			t.Errorf("Tombstones %v, %v", tombstones, err)
+		}
+	})
+}
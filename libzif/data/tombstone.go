@@ -0,0 +1,249 @@
+// Posts cannot be taken back once other peers have mirrored them, so deleting
+// or editing one leaves a tombstone: a record, signed by the post's author, of
+// what happened to it. Mirrors fetch tombstones when they next sync, and they
+// stop a deleted post, or the version an edit replaced, from coming back.
+
+package data
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"strconv"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+var (
+	ErrPostDeleted      = errors.New("Post has been deleted")
+	errPostSuperseded   = errors.New("Post has been edited since")
+	errTombstoneAuthor  = errors.New("Tombstone is not by the author of the post")
+	errTombstoneOwner   = errors.New("Tombstone is not by the owner of the posts")
+	errInvalidTombstone = errors.New("Invalid tombstone signature")
+)
+
+type Tombstone struct {
+	InfoHash string `json:"infoHash"`
+	Author   []byte `json:"author"`
+	// Unix time of the change. Only the latest tombstone for a post is kept.
+	Timestamp int64 `json:"timestamp"`
+	// For an edit, the signature of the post as it now is. Empty if the post
+	// was deleted.
+	Replacement []byte `json:"replacement,omitempty"`
+	Signature   []byte `json:"signature"`
+}
+
+func (t *Tombstone) Deleted() bool {
+	return len(t.Replacement) == 0
+}
+
+// The bytes a tombstone's author signs, in the same form as a post's.
+func (t *Tombstone) SignedBytes() []byte {
+	buf := bytes.Buffer{}
+
+	hash, err := NormaliseInfoHash(t.InfoHash)
+
+	if err != nil {
+		hash = t.InfoHash
+	}
+
+	writeBytes := func(b []byte) {
+		buf.WriteString(strconv.Itoa(len(b)))
+		buf.WriteString(":")
+		buf.Write(b)
+	}
+
+	buf.WriteString("tombstone")
+	buf.Write(t.Author)
+	writeBytes([]byte(hash))
+	writeBytes([]byte(strconv.FormatInt(t.Timestamp, 10)))
+	writeBytes(t.Replacement)
+
+	return buf.Bytes()
+}
+
+func (t *Tombstone) Sign(s Signer) {
+	t.Author = s.PublicKey()
+	t.Signature = s.Sign(t.SignedBytes())
+}
+
+func (t *Tombstone) Verify() error {
+	if _, err := NormaliseInfoHash(t.InfoHash); err != nil {
+		return err
+	}
+
+	if len(t.Author) != ed25519.PublicKeySize {
+		return errors.New("Invalid tombstone author")
+	}
+
+	if !ed25519.Verify(t.Author, t.SignedBytes(), t.Signature) {
+		return errInvalidTombstone
+	}
+
+	return nil
+}
+
+// Returns an error if the tombstone means a post should not be stored. Nothing
+// is stored for a deleted post, nor any version its author has replaced, but
+// only if owner signed the tombstone. Posts by anyone else are merged as usual,
+// they cannot change what the author signed.
+func (t *Tombstone) Allows(post *Post, owner []byte) error {
+	if len(owner) == 0 || !bytes.Equal(t.Author, owner) {
+		return nil
+	}
+
+	if !bytes.Equal(post.Author, t.Author) {
+		return nil
+	}
+
+	if t.Deleted() {
+		return ErrPostDeleted
+	}
+
+	if !bytes.Equal(post.Signature, t.Replacement) {
+		return errPostSuperseded
+	}
+
+	return nil
+}
+
+// Whether post is the edit this tombstone points to, and should replace the
+// signed fields of existing.
+func (t *Tombstone) Replaces(existing, post *Post) bool {
+	if t.Deleted() || !bytes.Equal(post.Signature, t.Replacement) {
+		return false
+	}
+
+	if bytes.Equal(existing.Signature, post.Signature) {
+		return false
+	}
+
+	return !existing.Signed() || bytes.Equal(existing.Author, t.Author)
+}
+
+// Checks the tombstone is valid and signed by owner.
+func (t *Tombstone) CheckOwner(owner []byte) error {
+	if err := t.Verify(); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(t.Author, owner) {
+		return errTombstoneOwner
+	}
+
+	return nil
+}
+
+func scanTombstone(row rowScanner, t *Tombstone) error {
+	return row.Scan(&t.InfoHash, &t.Author, &t.Timestamp, &t.Replacement, &t.Signature)
+}
+
+// Returns the tombstone for an infohash, or nil if there is not one.
+func (db *Database) QueryTombstone(infohash string) (*Tombstone, error) {
+	hash, err := NormaliseInfoHash(infohash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var t Tombstone
+
+	err = scanTombstone(db.conn.QueryRow(sql_query_tombstone, hash), &t)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// Every tombstone, oldest first.
+func (db *Database) QueryTombstones() ([]*Tombstone, error) {
+	rows, err := db.conn.Query(sql_query_tombstones)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ret := make([]*Tombstone, 0)
+
+	for rows.Next() {
+		var t Tombstone
+
+		if err := scanTombstone(rows, &t); err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, &t)
+	}
+
+	return ret, rows.Err()
+}
+
+// Stores a tombstone and, if the post was deleted, removes it. Only tombstones
+// signed by owner, whose posts these are, are accepted. A tombstone older than
+// the one already stored for the post changes nothing, and false is returned.
+func (db *Database) ApplyTombstone(t Tombstone, owner []byte) (applied bool, err error) {
+	if err := t.CheckOwner(owner); err != nil {
+		return false, err
+	}
+
+	t.InfoHash, _ = NormaliseInfoHash(t.InfoHash)
+
+	tx, err := db.conn.Begin()
+
+	if err != nil {
+		return false, err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		err = tx.Commit()
+	}()
+
+	var last Tombstone
+
+	err = scanTombstone(tx.QueryRow(sql_query_tombstone, t.InfoHash), &last)
+
+	if err == nil && last.Timestamp >= t.Timestamp {
+		return false, nil
+	} else if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+
+	var post Post
+
+	err = scanPost(tx.QueryRow(sql_query_post_infohash, t.InfoHash), &post)
+
+	if err == sql.ErrNoRows {
+		// The post may well arrive later, the tombstone will still apply.
+		err = nil
+	} else if err != nil {
+		return false, err
+	} else if post.Signed() && !bytes.Equal(post.Author, t.Author) {
+		return false, errTombstoneAuthor
+	} else if t.Deleted() {
+		if _, err = tx.Exec(sql_delete_post_meta, post.Id); err != nil {
+			return false, err
+		}
+
+		if _, err = tx.Exec(sql_delete_post, post.Id); err != nil {
+			return false, err
+		}
+	}
+
+	_, err = tx.Exec(sql_insert_tombstone, t.InfoHash, t.Author, t.Timestamp,
+		t.Replacement, t.Signature)
+
+	return err == nil, err
+}
@@ -0,0 +1,211 @@
+package data
+
+import (
+	"fmt"
+	"testing"
+)
+
+func signedPost(s Signer, title string) Post {
+	post := Post{InfoHash: ubuntuInfoHash, Title: title, Size: 1024}
+	post.Sign(s)
+
+	return post
+}
+
+func TestTombstoneDelete(t *testing.T) {
+	db, done := tempDatabase(t)
+	defer done()
+
+	author := newTestSigner(t)
+	post := signedPost(author, "Ubuntu")
+
+	if _, _, err := db.UpsertPost(post); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	stranger := Tombstone{InfoHash: ubuntuInfoHash, Timestamp: 5}
+	stranger.Sign(newTestSigner(t))
+
+	if _, err := db.ApplyTombstone(stranger, author.PublicKey()); err != errTombstoneOwner {
+		t.Errorf("Tombstone by someone else applied, error %v", err)
+	}
+
+	if _, err := db.ApplyTombstone(stranger, stranger.Author); err != errTombstoneAuthor {
+		t.Errorf("Tombstone for a post by someone else applied, error %v", err)
+	}
+
+	tombstone := Tombstone{InfoHash: ubuntuInfoHash, Timestamp: 10}
+	tombstone.Sign(author)
+
+	forged := tombstone
+	forged.Timestamp = 20
+
+	if _, err := db.ApplyTombstone(forged, author.PublicKey()); err != errInvalidTombstone {
+		t.Errorf("Forged tombstone applied, error %v", err)
+	}
+
+	if applied, err := db.ApplyTombstone(tombstone, author.PublicKey()); err != nil || !applied {
+		t.Fatalf("Tombstone not applied, error %v", err)
+	}
+
+	if stored, _ := db.QueryInfoHash(ubuntuInfoHash); stored != nil {
+		t.Error("Deleted post still stored")
+	}
+
+	if searchCount(t, db, "ubuntu") != 0 {
+		t.Error("Deleted post still searchable")
+	}
+
+	if _, _, err := db.UpsertPost(post); err != ErrPostDeleted {
+		t.Errorf("Deleted post stored again, error %v", err)
+	}
+
+	// Mirrors skip it rather than failing.
+	piece := Piece{Posts: []Post{post}}
+	piece.Setup()
+	pieces := make(chan *Piece, 1)
+	pieces <- &piece
+	close(pieces)
+
+	if err := db.InsertPieces(pieces); err != nil {
+		t.Error(err.Error())
+	}
+
+	if db.PostCount() != 0 {
+		t.Error("Deleted post inserted from a piece")
+	}
+
+	older := Tombstone{InfoHash: ubuntuInfoHash, Timestamp: 5, Replacement: post.Signature}
+	older.Sign(author)
+
+	if applied, err := db.ApplyTombstone(older, author.PublicKey()); err != nil || applied {
+		t.Errorf("Older tombstone applied, error %v", err)
+	}
+
+	tombstones, err := db.QueryTombstones()
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(tombstones) != 1 || !tombstones[0].Deleted() || tombstones[0].Verify() != nil {
+		t.Errorf("Tombstones are %+v", tombstones)
+	}
+}
+
+func TestTombstoneStranger(t *testing.T) {
+	eachStore(t, func(t *testing.T, db PostStore) {
+		author := newTestSigner(t)
+		stranger := newTestSigner(t)
+
+		// Stored before the post, as a mirror may see it, but by someone who
+		// does not own the posts.
+		tombstone := Tombstone{InfoHash: ubuntuInfoHash, Timestamp: 10}
+		tombstone.Sign(stranger)
+
+		if _, err := db.ApplyTombstone(tombstone, author.PublicKey()); err != errTombstoneOwner {
+			t.Errorf("Stranger's tombstone applied, error %v", err)
+		}
+
+		if _, _, err := db.UpsertPost(signedPost(author, "Ubuntu")); err != nil {
+			t.Fatalf("Post blocked by a stranger's tombstone: %v", err)
+		}
+
+		// Even a tombstone stored for the owner only blocks its own posts.
+		if err := tombstone.Allows(&Post{Author: author.PublicKey()}, stranger.PublicKey()); err != nil {
+			t.Errorf("Post by someone else blocked: %v", err)
+		}
+
+		if err := tombstone.Allows(&Post{Author: stranger.PublicKey()}, author.PublicKey()); err != nil {
+			t.Errorf("Tombstone not by the owner blocked a post: %v", err)
+		}
+	})
+}
+
+func TestTombstoneEdit(t *testing.T) {
+	db, done := tempDatabase(t)
+	defer done()
+
+	author := newTestSigner(t)
+	original := signedPost(author, "Ubunut")
+	original.Seeders = 7
+	edited := signedPost(author, "Ubuntu")
+
+	if _, _, err := db.UpsertPost(original); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tombstone := Tombstone{InfoHash: ubuntuInfoHash, Timestamp: 10, Replacement: edited.Signature}
+	tombstone.Sign(author)
+
+	if _, err := db.ApplyTombstone(tombstone, author.PublicKey()); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, _, err := db.UpsertPost(edited); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	stored, err := db.QueryInfoHash(ubuntuInfoHash)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if stored.Title != "Ubuntu" || stored.Seeders != 7 || stored.Verify() != nil {
+		t.Errorf("Edited post is %+v", stored)
+	}
+
+	if _, _, err := db.UpsertPost(original); err != errPostSuperseded {
+		t.Errorf("Replaced version stored again, error %v", err)
+	}
+
+	// Anyone else's post is merged as usual, without changing the title.
+	other := signedPost(newTestSigner(t), "Something else")
+	other.Seeders = 20
+
+	if _, _, err := db.UpsertPost(other); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	stored, _ = db.QueryInfoHash(ubuntuInfoHash)
+
+	if stored.Title != "Ubuntu" || stored.Seeders != 20 {
+		t.Errorf("Merged post is %+v", stored)
+	}
+}
+
+func TestQueryPieceGaps(t *testing.T) {
+	db, done := tempDatabase(t)
+	defer done()
+
+	insertPosts(t, db, Post{Title: "One"}, Post{Title: "Two"}, Post{Title: "Three"})
+
+	owner := newTestSigner(t)
+	tombstone := Tombstone{InfoHash: fmt.Sprintf("%040x", 2), Timestamp: 1}
+	tombstone.Sign(owner)
+
+	if _, err := db.ApplyTombstone(tombstone, owner.PublicKey()); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	piece, err := db.QueryPiece(0, true)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(piece.Posts) != 2 || piece.Posts[1].Title != "Three" || db.PostCount() != 2 {
+		t.Errorf("Piece is %+v", piece.Posts)
+	}
+
+	streamed := 0
+
+	for range db.QueryPiecePosts(0, 1, true) {
+		streamed++
+	}
+
+	if streamed != 2 {
+		t.Errorf("%d posts streamed, want 2", streamed)
+	}
+}
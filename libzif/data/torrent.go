@@ -0,0 +1,289 @@
+// Posts can be made from .torrent files, rather than by filling in the
+// infohash, size and file count by hand. Both v1 and v2 (BEP 52) torrents are
+// understood. A hybrid torrent is posted under its v1 infohash, with the v2 one
+// kept in the "btmh" meta key, as magnet links carry it.
+
+package data
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The largest .torrent file we will read.
+const TorrentMax = 10 * 1024 * 1024
+
+type TorrentFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+type Torrent struct {
+	Name string `json:"name"`
+	// Hex encoded. InfoHash is empty for a v2 only torrent, and InfoHashV2 for
+	// a v1 only one.
+	InfoHash   string        `json:"infoHash,omitempty"`
+	InfoHashV2 string        `json:"infoHashV2,omitempty"`
+	Size       int64         `json:"size"`
+	Files      []TorrentFile `json:"files"`
+	Trackers   []string      `json:"trackers,omitempty"`
+}
+
+// Reads a .torrent file, of at most TorrentMax bytes.
+func ReadTorrent(r io.Reader) (*Torrent, error) {
+	dat, err := ioutil.ReadAll(io.LimitReader(r, TorrentMax+1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseTorrent(dat)
+}
+
+func ParseTorrent(dat []byte) (*Torrent, error) {
+	if len(dat) > TorrentMax {
+		return nil, errors.New("Torrent file too large")
+	}
+
+	value, raw, err := decodeBencode(dat)
+
+	if err != nil {
+		return nil, err
+	}
+
+	root, ok := value.(map[string]interface{})
+
+	if !ok || raw == nil {
+		return nil, errors.New("Torrent has no info dictionary")
+	}
+
+	info, ok := root["info"].(map[string]interface{})
+
+	if !ok {
+		return nil, errors.New("Torrent has no info dictionary")
+	}
+
+	t := &Torrent{Files: make([]TorrentFile, 0)}
+	t.Name, _ = info["name"].(string)
+
+	version, _ := info["meta version"].(int64)
+	_, v1 := info["pieces"]
+
+	if v1 {
+		sum := sha1.Sum(raw)
+		t.InfoHash = hex.EncodeToString(sum[:])
+	}
+
+	if version == 2 {
+		sum := sha256.Sum256(raw)
+		t.InfoHashV2 = hex.EncodeToString(sum[:])
+	}
+
+	if t.InfoHash == "" && t.InfoHashV2 == "" {
+		return nil, errors.New("Torrent is neither v1 nor v2")
+	}
+
+	// v1 file lists are simpler, and a hybrid has both.
+	if v1 {
+		err = t.readFiles(info)
+	} else {
+		tree, ok := info["file tree"].(map[string]interface{})
+
+		if !ok {
+			return nil, errors.New("Torrent has no file tree")
+		}
+
+		err = t.readFileTree(tree, "", 0)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	t.readTrackers(root)
+
+	return t, nil
+}
+
+func (t *Torrent) addFile(path string, size int64) error {
+	if size < 0 {
+		return errors.New("Torrent file has a negative size")
+	}
+
+	if size > math.MaxInt64-t.Size {
+		return errors.New("Torrent is too large")
+	}
+
+	t.Files = append(t.Files, TorrentFile{path, size})
+	t.Size += size
+
+	return nil
+}
+
+func (t *Torrent) readFiles(info map[string]interface{}) error {
+	files, ok := info["files"].([]interface{})
+
+	// A single file torrent.
+	if !ok {
+		length, ok := info["length"].(int64)
+
+		if !ok {
+			return errors.New("Torrent has no length")
+		}
+
+		return t.addFile(t.Name, length)
+	}
+
+	for _, i := range files {
+		file, ok := i.(map[string]interface{})
+
+		if !ok {
+			return errors.New("Invalid torrent file list")
+		}
+
+		// Hybrid torrents pad files to piece boundaries, they are not part of
+		// the content.
+		if attr, _ := file["attr"].(string); strings.Contains(attr, "p") {
+			continue
+		}
+
+		length, _ := file["length"].(int64)
+		parts, _ := file["path"].([]interface{})
+		path := make([]string, 0, len(parts))
+
+		for _, p := range parts {
+			if s, ok := p.(string); ok {
+				path = append(path, s)
+			}
+		}
+
+		if err := t.addFile(strings.Join(path, "/"), length); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// v2 file trees are nested dictionaries of path parts, where a file is a
+// dictionary under the empty key.
+func (t *Torrent) readFileTree(tree map[string]interface{}, prefix string, depth int) error {
+	if depth > bencodeMaxDepth {
+		return errors.New("Torrent file tree too deep")
+	}
+
+	keys := make([]string, 0, len(tree))
+
+	for k := range tree {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		node, ok := tree[k].(map[string]interface{})
+
+		if !ok {
+			return errors.New("Invalid torrent file tree")
+		}
+
+		if k == "" {
+			length, _ := node["length"].(int64)
+
+			if err := t.addFile(prefix, length); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		path := k
+
+		if prefix != "" {
+			path = prefix + "/" + k
+		}
+
+		if err := t.readFileTree(node, path, depth+1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *Torrent) readTrackers(root map[string]interface{}) {
+	seen := make(map[string]bool)
+
+	add := func(v interface{}) {
+		if s, ok := v.(string); ok && s != "" && !seen[s] {
+			seen[s] = true
+			t.Trackers = append(t.Trackers, s)
+		}
+	}
+
+	add(root["announce"])
+
+	tiers, _ := root["announce-list"].([]interface{})
+
+	for _, i := range tiers {
+		tier, _ := i.([]interface{})
+
+		for _, j := range tier {
+			add(j)
+		}
+	}
+}
+
+// Cuts a string to at most max bytes, without splitting a character.
+func truncateString(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+
+	// Cut at the start of a rune, so that none is split. Names are not always
+	// valid UTF-8, so anything invalid before the cut is left as it is.
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+
+	return s[:max]
+}
+
+// A post for this torrent, uploaded now.
+func (t *Torrent) Post() Post {
+	post := Post{
+		InfoHash:   t.InfoHash,
+		Title:      truncateString(t.Name, TitleMax),
+		Size:       int(t.Size),
+		FileCount:  len(t.Files),
+		UploadDate: int(time.Now().Unix()),
+		Meta:       make(Meta),
+	}
+
+	if post.InfoHash == "" {
+		post.InfoHash = t.InfoHashV2
+	} else if t.InfoHashV2 != "" {
+		post.Meta.Set("btmh", multihashPrefix+t.InfoHashV2)
+	}
+
+	return post
+}
+
+func (t *Torrent) Magnet() *Magnet {
+	return &Magnet{
+		InfoHash:   t.InfoHash,
+		InfoHashV2: t.InfoHashV2,
+		Name:       t.Name,
+		Size:       t.Size,
+		Trackers:   t.Trackers,
+	}
+}
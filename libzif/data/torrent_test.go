@@ -0,0 +1,148 @@
+package data
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestParseTorrent(t *testing.T) {
+	single := "d6:lengthi1024e4:name10:ubuntu.iso12:piece lengthi16384e6:pieces0:e"
+	multi := "d5:filesld6:lengthi100e4:pathl3:dir5:a.txteed4:attr1:p6:lengthi28e4:pathl4:.pad2:28eed6:lengthi50e4:pathl5:b.txteee" +
+		"4:name4:test12:piece lengthi16384e6:pieces0:e"
+	v2 := "d9:file treed5:a.txtd0:d6:lengthi7e11:pieces root0:ee3:dird5:b.txtd0:d6:lengthi3eeeee" +
+		"12:meta versioni2e4:name2:v212:piece lengthi16384ee"
+
+	sha1Hex := func(s string) string {
+		sum := sha1.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+
+	sha256Hex := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+
+	torrent, err := ParseTorrent([]byte("d8:announce9:udp://one13:announce-listll9:udp://one9:udp://twoee4:info" + single + "e"))
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if torrent.InfoHash != sha1Hex(single) || torrent.InfoHashV2 != "" {
+		t.Errorf("Infohash %s, want %s", torrent.InfoHash, sha1Hex(single))
+	}
+
+	if torrent.Name != "ubuntu.iso" || torrent.Size != 1024 || len(torrent.Files) != 1 {
+		t.Errorf("Single file torrent is %+v", torrent)
+	}
+
+	if strings.Join(torrent.Trackers, " ") != "udp://one udp://two" {
+		t.Errorf("Trackers %v", torrent.Trackers)
+	}
+
+	post := torrent.Post()
+
+	if post.Valid() != nil || post.InfoHash != torrent.InfoHash || post.FileCount != 1 {
+		t.Errorf("Post is %+v", post)
+	}
+
+	torrent, err = ParseTorrent([]byte("d4:info" + multi + "e"))
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// The padding file is left out.
+	if torrent.Size != 150 || len(torrent.Files) != 2 || torrent.Files[0].Path != "dir/a.txt" {
+		t.Errorf("Multi file torrent is %+v", torrent)
+	}
+
+	torrent, err = ParseTorrent([]byte("d4:info" + v2 + "e"))
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if torrent.InfoHash != "" || torrent.InfoHashV2 != sha256Hex(v2) {
+		t.Errorf("v2 infohash %s, want %s", torrent.InfoHashV2, sha256Hex(v2))
+	}
+
+	if torrent.Size != 10 || len(torrent.Files) != 2 || torrent.Files[1].Path != "dir/b.txt" {
+		t.Errorf("v2 torrent is %+v", torrent)
+	}
+
+	if post := torrent.Post(); post.InfoHash != torrent.InfoHashV2 || post.Valid() != nil {
+		t.Errorf("v2 post is %+v", post)
+	}
+
+	invalid := []string{
+		"",
+		"d4:info",
+		"d4:infod4:name1:xee",
+		"d4:info" + single + "eextra",
+		"d4:info" + single[:len(single)-1] + "9999999:x" + "e",
+		strings.Repeat("l", 100) + strings.Repeat("e", 100),
+		// File lengths that add up past what an int64 holds.
+		"d4:infod5:filesld6:lengthi9223372036854775807e4:pathl1:aeed6:lengthi1e4:pathl1:beee" +
+			"4:name1:x12:piece lengthi16384e6:pieces0:ee",
+	}
+
+	for _, i := range invalid {
+		if _, err := ParseTorrent([]byte(i)); err == nil {
+			t.Errorf("Parsed invalid torrent %q", i)
+		}
+	}
+}
+
+func TestTruncateString(t *testing.T) {
+	// A GBK name, not valid UTF-8, is cut like any other.
+	gbk := "\xc4\xe3\xba\xc3" + strings.Repeat("a", TitleMax)
+
+	if got := truncateString(gbk, TitleMax); got != gbk[:TitleMax] {
+		t.Errorf("Invalid UTF-8 truncated to %q", got)
+	}
+
+	// Runes are never split.
+	name := strings.Repeat("é", TitleMax)
+
+	if got := truncateString(name, TitleMax+1); len(got) != TitleMax || !utf8.ValidString(got) {
+		t.Errorf("Truncated to %q", got)
+	}
+}
+
+func TestMagnet(t *testing.T) {
+	m, err := ParseMagnet("magnet:?xt=urn:btih:" + strings.ToUpper(ubuntuInfoHash) +
+		"&dn=Ubuntu+16.04&xl=1024&tr=udp%3A%2F%2Fone&tr=udp%3A%2F%2Ftwo")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if m.InfoHash != ubuntuInfoHash || m.Name != "Ubuntu 16.04" || m.Size != 1024 || len(m.Trackers) != 2 {
+		t.Errorf("Magnet is %+v", m)
+	}
+
+	again, err := ParseMagnet(m.String())
+
+	if err != nil || again.String() != m.String() {
+		t.Errorf("Round trip gave %v, %v", again, err)
+	}
+
+	v2 := strings.Repeat("ab", 32)
+	post := Post{InfoHash: ubuntuInfoHash, Title: "Ubuntu", Meta: Meta{"btmh": {multihashPrefix + v2}}}
+	link := PostMagnet(&post).String()
+
+	if link != "magnet:?xt=urn:btih:"+ubuntuInfoHash+"&xt=urn:btmh:1220"+v2+"&dn=Ubuntu" {
+		t.Errorf("Post magnet is %s", link)
+	}
+
+	for _, i := range []string{"http://example.com", "magnet:?dn=nothing", "magnet:?xt=urn:btih:1234"} {
+		if _, err := ParseMagnet(i); err == nil {
+			t.Errorf("Parsed invalid magnet %s", i)
+		}
+	}
+}
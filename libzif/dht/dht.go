@@ -1,7 +1,10 @@
 package dht
 
+import "io"
+
 type DHT struct {
-	db *NetDB
+	db      *NetDB
+	history LookupHistory
 }
 
 func NewDHT(addr Address, path string) *DHT {
@@ -16,11 +19,20 @@ func (dht *DHT) Address() Address {
 	return dht.db.addr
 }
 
+func (dht *DHT) TableLen() int {
+	return dht.db.TableLen()
+}
+
 func (dht *DHT) Insert(kv *KeyValue) error {
 	// TODO: Announces
 	return dht.db.Insert(kv)
 }
 
+// See NetDB.InsertFrom.
+func (dht *DHT) InsertFrom(kv *KeyValue, observed string) error {
+	return dht.db.InsertFrom(kv, observed)
+}
+
 func (dht *DHT) Query(addr Address) (*KeyValue, error) {
 	return dht.db.Query(addr)
 }
@@ -28,3 +40,36 @@ func (dht *DHT) Query(addr Address) (*KeyValue, error) {
 func (dht *DHT) FindClosest(addr Address) (Pairs, error) {
 	return dht.db.FindClosest(addr)
 }
+
+func (dht *DHT) SetAdmission(admit AdmissionFunc) {
+	dht.db.SetAdmission(admit)
+}
+
+// Mark an address as recently seen, moving it to the front of its bucket.
+func (dht *DHT) Touch(addr Address) bool {
+	return dht.db.Touch(addr)
+}
+
+func (dht *DHT) Remove(addr Address) {
+	dht.db.Remove(addr)
+}
+
+func (dht *DHT) Info() TableInfo {
+	return dht.db.Info()
+}
+
+func (dht *DHT) Closest(addr Address, count int) []Contact {
+	return dht.db.Closest(addr, count)
+}
+
+func (dht *DHT) WriteDot(w io.Writer) error {
+	return dht.db.WriteDot(w)
+}
+
+func (dht *DHT) RecordLookup(l Lookup) {
+	dht.history.Add(l)
+}
+
+func (dht *DHT) Lookups() []Lookup {
+	return dht.history.List()
+}
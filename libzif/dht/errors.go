@@ -17,3 +17,12 @@ type NoCapacity struct {
 func (nc *NoCapacity) Error() string {
 	return fmt.Sprintf("Out of capacity, max: %d", nc.Max)
 }
+
+type NoDiversity struct {
+	Subnet string
+	Max    int
+}
+
+func (nd *NoDiversity) Error() string {
+	return fmt.Sprintf("Too many contacts from %s, max: %d", nd.Subnet, nd.Max)
+}
@@ -0,0 +1,157 @@
+// Lets us see what the routing table looks like, which is the only way to work
+// out why resolving an address is failing.
+
+package dht
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+type Contact struct {
+	Address string `json:"address"`
+	Host    string `json:"host"`
+	Bucket  int    `json:"bucket"`
+	// XOR distance, hex encoded. For buckets this is the distance from us, for
+	// Closest it is the distance from the target.
+	Distance string    `json:"distance"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+type Bucket struct {
+	Index    int       `json:"index"`
+	Contacts []Contact `json:"contacts"`
+}
+
+type TableInfo struct {
+	Address  string   `json:"address"`
+	Contacts int      `json:"contacts"`
+	Values   int      `json:"values"`
+	Buckets  []Bucket `json:"buckets"`
+}
+
+// Callers must hold at least a read lock.
+func (ndb *NetDB) contact(addr Address, from *Address) Contact {
+	return Contact{
+		Address:  addr.String(),
+		Host:     ndb.hosts[addr.String()],
+		Bucket:   addr.Xor(&ndb.addr).LeadingZeroes(),
+		Distance: hex.EncodeToString(addr.Xor(from).Raw),
+		LastSeen: ndb.seen[addr.String()],
+	}
+}
+
+// Returns all non-empty buckets, in order, with the contacts in each. Contacts
+// are ordered as they are in the bucket, most recently seen first.
+func (ndb *NetDB) Buckets() []Bucket {
+	ndb.mutex.RLock()
+	defer ndb.mutex.RUnlock()
+
+	ret := make([]Bucket, 0)
+
+	for n, i := range ndb.table {
+		if len(i) == 0 {
+			continue
+		}
+
+		bucket := Bucket{n, make([]Contact, 0, len(i))}
+
+		for _, j := range i {
+			bucket.Contacts = append(bucket.Contacts, ndb.contact(j, &ndb.addr))
+		}
+
+		ret = append(ret, bucket)
+	}
+
+	return ret
+}
+
+// The number of values stored on disk. This includes values for addresses that
+// are no longer in the routing table.
+func (ndb *NetDB) ValueCount() int {
+	count := 0
+
+	for _ = range ndb.database.Keys(nil) {
+		count++
+	}
+
+	return count
+}
+
+// Returns up to count contacts from the routing table, closest to the given
+// address first. Unlike FindClosest this looks at every bucket, and does not
+// touch the stored values.
+func (ndb *NetDB) Closest(addr Address, count int) []Contact {
+	ndb.mutex.RLock()
+	defer ndb.mutex.RUnlock()
+
+	all := make(Pairs, 0, BucketSize)
+
+	for _, i := range ndb.table {
+		for _, j := range i {
+			all = append(all, &KeyValue{Key: j, distance: *j.Xor(&addr)})
+		}
+	}
+
+	sort.Sort(all)
+
+	if len(all) > count {
+		all = all[:count]
+	}
+
+	ret := make([]Contact, 0, len(all))
+
+	for _, i := range all {
+		ret = append(ret, ndb.contact(i.Key, &addr))
+	}
+
+	return ret
+}
+
+func (ndb *NetDB) Info() TableInfo {
+	buckets := ndb.Buckets()
+	contacts := 0
+
+	for _, i := range buckets {
+		contacts += len(i.Contacts)
+	}
+
+	return TableInfo{ndb.addr.String(), contacts, ndb.ValueCount(), buckets}
+}
+
+// Write the routing table as a Graphviz digraph. Each bucket is a cluster, with
+// an edge from us to every contact labelled with the bucket index.
+func (ndb *NetDB) WriteDot(w io.Writer) error {
+	self := ndb.addr.String()
+
+	_, err := fmt.Fprintf(w, "digraph dht {\n\t%q [shape=doublecircle];\n", self)
+
+	if err != nil {
+		return err
+	}
+
+	buckets := ndb.Buckets()
+
+	for _, i := range buckets {
+		fmt.Fprintf(w, "\tsubgraph cluster_%d {\n\t\tlabel=\"bucket %d\";\n", i.Index, i.Index)
+
+		for _, j := range i.Contacts {
+			fmt.Fprintf(w, "\t\t%q [label=%q];\n", j.Address, j.Address+"\n"+j.Host)
+		}
+
+		fmt.Fprintf(w, "\t}\n")
+	}
+
+	for _, i := range buckets {
+		for _, j := range i.Contacts {
+			fmt.Fprintf(w, "\t%q -> %q [label=\"%d\"];\n", self, j.Address, i.Index)
+		}
+	}
+
+	_, err = fmt.Fprintf(w, "}\n")
+
+	return err
+}
@@ -0,0 +1,62 @@
+package dht_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/wjh/zif/libzif/dht"
+)
+
+func TestNetDBInfo(t *testing.T) {
+	db, cl := newDB()
+	defer cl()
+
+	insert(t, db, addr, 1)
+	insert(t, db, addr2, 2)
+
+	info := db.Info()
+
+	if info.Contacts != 2 || info.Values != 2 {
+		t.Errorf("Incorrect counts: %d contacts, %d values", info.Contacts, info.Values)
+	}
+
+	for _, i := range info.Buckets {
+		for _, j := range i.Contacts {
+			if j.Bucket != i.Index || j.LastSeen.IsZero() {
+				t.Error("Contact not filled in correctly")
+			}
+		}
+	}
+
+	closest := db.Closest(addr2, 1)
+
+	if len(closest) != 1 || closest[0].Address != addr2.String() {
+		t.Error("Closest did not return the address itself first")
+	}
+
+	buf := bytes.Buffer{}
+	err := db.WriteDot(&buf)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !strings.HasPrefix(buf.String(), "digraph") || !strings.Contains(buf.String(), addr2.String()) {
+		t.Error("Invalid DOT output")
+	}
+}
+
+func TestLookupHistory(t *testing.T) {
+	lh := dht.LookupHistory{}
+
+	for i := 0; i < dht.LookupHistorySize+10; i++ {
+		lh.Add(dht.Lookup{Hops: i})
+	}
+
+	lookups := lh.List()
+
+	if len(lookups) != dht.LookupHistorySize || lookups[0].Hops != 10 {
+		t.Error("Lookup history not trimmed to the most recent")
+	}
+}
@@ -0,0 +1,49 @@
+package dht
+
+import (
+	"sync"
+	"time"
+)
+
+// How many lookups are remembered.
+const LookupHistorySize = 100
+
+// A record of an attempt to resolve an address.
+type Lookup struct {
+	Target   string        `json:"target"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	// How many rounds of peers were asked before the lookup finished. Zero
+	// means that it was answered from our own table.
+	Hops    int    `json:"hops"`
+	Queried int    `json:"queried"`
+	Found   bool   `json:"found"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Keeps the most recent lookups, oldest first.
+type LookupHistory struct {
+	mutex   sync.Mutex
+	lookups []Lookup
+}
+
+func (lh *LookupHistory) Add(l Lookup) {
+	lh.mutex.Lock()
+	defer lh.mutex.Unlock()
+
+	lh.lookups = append(lh.lookups, l)
+
+	if len(lh.lookups) > LookupHistorySize {
+		lh.lookups = lh.lookups[len(lh.lookups)-LookupHistorySize:]
+	}
+}
+
+func (lh *LookupHistory) List() []Lookup {
+	lh.mutex.Lock()
+	defer lh.mutex.Unlock()
+
+	ret := make([]Lookup, len(lh.lookups))
+	copy(ret, lh.lookups)
+
+	return ret
+}
@@ -2,23 +2,60 @@ package dht
 
 import (
 	"errors"
+	"net"
+	"sync"
+	"time"
 
 	"github.com/peterbourgon/diskv"
 )
 
 const (
 	BucketSize = 20
+
+	// The most contacts a single bucket may hold from one IP, and from one /24
+	// (or /48 for IPv6). Without these a single network could fill a bucket and
+	// eclipse the addresses it covers.
+	BucketIPLimit     = 2
+	BucketSubnetLimit = 4
+
+	// The host for values whose IP is not known. They all count as one subnet,
+	// so they cannot get round the limits by not saying where they are.
+	UnknownHost = "unknown"
 )
 
+// Given a value about to be inserted, and the IP it was observed coming from if
+// any, returns the IP it can be reached at, or an error if it should not be
+// admitted into the routing table at all.
+type AdmissionFunc func(kv *KeyValue, observed string) (string, error)
+
+// The routing table and the values stored for it. This is used from many
+// goroutines at once, so the table is guarded by a read/write lock. Reads never
+// modify the table, only Insert, Touch and Remove do. Diskv does its own
+// locking, so values are read and written outside of the lock.
 type NetDB struct {
+	mutex    sync.RWMutex
 	table    [][]Address
 	addr     Address
 	database *diskv.Diskv
+
+	// The host of every address in the table, used for the diversity limits.
+	hosts map[string]string
+	// When each address in the table was last inserted or touched.
+	seen  map[string]time.Time
+	admit AdmissionFunc
+
+	// Set either to zero to disable that limit.
+	IPLimit     int
+	SubnetLimit int
 }
 
 func NewNetDB(addr Address, path string) *NetDB {
 	ret := &NetDB{}
 	ret.addr = addr
+	ret.hosts = make(map[string]string)
+	ret.seen = make(map[string]time.Time)
+	ret.IPLimit = BucketIPLimit
+	ret.SubnetLimit = BucketSubnetLimit
 
 	// One bucket of addresses per bit in an address
 	// At the time of writing, uses roughly 64KB of memory
@@ -44,6 +81,9 @@ func NewNetDB(addr Address, path string) *NetDB {
 }
 
 func (ndb *NetDB) TableLen() int {
+	ndb.mutex.RLock()
+	defer ndb.mutex.RUnlock()
+
 	size := 0
 
 	for _, i := range ndb.table {
@@ -53,11 +93,51 @@ func (ndb *NetDB) TableLen() int {
 	return size
 }
 
+// Set the function used to vet values before they are inserted. If this is not
+// set then any valid KeyValue is accepted, and no diversity limits apply.
+func (ndb *NetDB) SetAdmission(admit AdmissionFunc) {
+	ndb.mutex.Lock()
+	defer ndb.mutex.Unlock()
+
+	ndb.admit = admit
+}
+
 func (ndb *NetDB) Insert(kv *KeyValue) error {
+	return ndb.InsertFrom(kv, "")
+}
+
+// Inserts a value that its own peer announced from the IP observed, which is
+// used for the diversity limits in place of whatever host the value claims.
+// An empty observed IP means the value was passed on by someone else.
+func (ndb *NetDB) InsertFrom(kv *KeyValue, observed string) error {
 	if !kv.Valid() {
 		return &InvalidValue{kv.Key.String()}
 	}
 
+	host := ""
+
+	ndb.mutex.RLock()
+	admit := ndb.admit
+	ndb.mutex.RUnlock()
+
+	// Admission may well be slow (signature checks and the like), so is done
+	// before taking the lock.
+	if admit != nil {
+		var err error
+		host, err = admit(kv, observed)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if observed != "" {
+		host = observed
+	}
+
+	ndb.mutex.Lock()
+	defer ndb.mutex.Unlock()
+
 	// Find the distance between the kv address and our own address, this is the
 	// index in the table
 	index := kv.Key.Xor(&ndb.addr).LeadingZeroes()
@@ -75,17 +155,30 @@ func (ndb *NetDB) Insert(kv *KeyValue) error {
 		}
 	}
 
+	others := make([]Address, 0, BucketSize)
+	others = append(others, bucket...)
+
 	// if it already exists, it first needs to be removed from it's old position
 	if found != -1 {
-		bucket = append(bucket[:found], bucket[found+1:]...)
+		others = append(others[:found], others[found+1:]...)
 	} else if len(bucket) == BucketSize {
 		// TODO: Ping all peers, remove any inactive
 		return &NoCapacity{BucketSize}
 	}
 
-	bucket = append([]Address{kv.Key}, bucket...)
+	// A value already in the table is checked again if it has moved, or it
+	// could move into a subnet that is already full.
+	if found == -1 || ndb.hosts[kv.Key.String()] != host {
+		if err := ndb.checkDiversity(others, host); err != nil {
+			return err
+		}
+	}
+
+	bucket = append([]Address{kv.Key}, others...)
 
 	ndb.table[index] = bucket
+	ndb.hosts[kv.Key.String()] = host
+	ndb.seen[kv.Key.String()] = time.Now()
 
 	// key has been added to the routing table, now store the entry!
 	ndb.database.Write(kv.Key.String(), kv.Value)
@@ -93,7 +186,133 @@ func (ndb *NetDB) Insert(kv *KeyValue) error {
 	return nil
 }
 
+// Move an address that is already in the table to the front of its bucket, as
+// it has just been seen. Addresses that are not in the table are ignored.
+// Returns true if the address was found.
+func (ndb *NetDB) Touch(addr Address) bool {
+	ndb.mutex.Lock()
+	defer ndb.mutex.Unlock()
+
+	index := addr.Xor(&ndb.addr).LeadingZeroes()
+	bucket := ndb.table[index]
+
+	for n, i := range bucket {
+		if i.Equals(&addr) {
+			moved := make([]Address, 0, BucketSize)
+			moved = append(moved, i)
+			moved = append(moved, bucket[:n]...)
+			moved = append(moved, bucket[n+1:]...)
+
+			ndb.table[index] = moved
+			ndb.seen[addr.String()] = time.Now()
+			return true
+		}
+	}
+
+	return false
+}
+
+// Remove an address from the routing table. The stored value is kept, so it
+// can still be queried.
+func (ndb *NetDB) Remove(addr Address) {
+	ndb.mutex.Lock()
+	defer ndb.mutex.Unlock()
+
+	index := addr.Xor(&ndb.addr).LeadingZeroes()
+	bucket := ndb.table[index]
+
+	for n, i := range bucket {
+		if i.Equals(&addr) {
+			kept := make([]Address, 0, BucketSize)
+			kept = append(kept, bucket[:n]...)
+			kept = append(kept, bucket[n+1:]...)
+
+			ndb.table[index] = kept
+			delete(ndb.hosts, addr.String())
+			delete(ndb.seen, addr.String())
+			return
+		}
+	}
+}
+
+// Returns a copy of a bucket, safe to use once the lock is released.
+func (ndb *NetDB) bucket(index int) []Address {
+	ndb.mutex.RLock()
+	defer ndb.mutex.RUnlock()
+
+	ret := make([]Address, len(ndb.table[index]))
+	copy(ret, ndb.table[index])
+
+	return ret
+}
+
+// Makes sure that adding a contact at the given host would not leave the bucket
+// with too many contacts from the same IP or subnet.
+func (ndb *NetDB) checkDiversity(bucket []Address, host string) error {
+	ip, subnet := subnetOf(host)
+
+	if subnet == "" {
+		return nil
+	}
+
+	ipCount, subnetCount := 0, 0
+
+	for _, i := range bucket {
+		otherIp, otherSubnet := subnetOf(ndb.hosts[i.String()])
+
+		if ip != "" && otherIp == ip {
+			ipCount++
+		}
+
+		if otherSubnet == subnet {
+			subnetCount++
+		}
+	}
+
+	if ndb.IPLimit > 0 && ipCount >= ndb.IPLimit {
+		return &NoDiversity{ip, ndb.IPLimit}
+	}
+
+	if ndb.SubnetLimit > 0 && subnetCount >= ndb.SubnetLimit {
+		return &NoDiversity{subnet, ndb.SubnetLimit}
+	}
+
+	return nil
+}
+
+// Returns the IP and subnet of a host, for the purpose of bucket diversity.
+// Names should be resolved before they get here, see AdmissionFunc, so hosts
+// that are not IPs are onions and are treated as their own subnet. UnknownHost
+// has a subnet but no IP. Empty hosts return nothing, and are not limited at
+// all, as only values inserted without admission have them.
+func subnetOf(host string) (string, string) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if host == "" {
+		return "", ""
+	}
+
+	if host == UnknownHost {
+		return "", UnknownHost
+	}
+
+	ip := net.ParseIP(host)
+
+	if ip == nil {
+		return host, host
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String(), v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+
+	return ip.String(), ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
 // Returns the KeyValue if this node has the address, nil and err otherwise.
+// This does not change the routing table, use Touch for that.
 func (ndb *NetDB) Query(addr Address) (*KeyValue, error) {
 	if !ndb.database.Has(addr.String()) {
 		return nil, errors.New("Not found")
@@ -105,10 +324,7 @@ func (ndb *NetDB) Query(addr Address) (*KeyValue, error) {
 		return nil, err
 	}
 
-	kv := NewKeyValue(addr, value)
-
-	// reinsert the kv, popular things will stay near the top
-	return kv, ndb.Insert(kv)
+	return NewKeyValue(addr, value), nil
 }
 
 func (ndb *NetDB) queryAddresses(as []Address) Pairs {
@@ -131,7 +347,7 @@ func (ndb *NetDB) FindClosest(addr Address) (Pairs, error) {
 	// Find the distance between the kv address and our own address, this is the
 	// index in the table
 	index := addr.Xor(&ndb.addr).LeadingZeroes()
-	bucket := ndb.table[index]
+	bucket := ndb.bucket(index)
 
 	if len(bucket) == BucketSize {
 		return ndb.queryAddresses(bucket), nil
@@ -145,37 +361,21 @@ func (ndb *NetDB) FindClosest(addr Address) (Pairs, error) {
 		len(ret) < BucketSize; i++ {
 
 		if index-i >= 0 {
-			bucket = ndb.table[index-i]
-
-			for _, i := range bucket {
-				if len(bucket) >= BucketSize {
+			for _, kv := range ndb.queryAddresses(ndb.bucket(index - i)) {
+				if len(ret) >= BucketSize {
 					break
 				}
 
-				kv, err := ndb.Query(i)
-
-				if err != nil {
-					continue
-				}
-
 				ret = append(ret, kv)
 			}
 		}
 
 		if index+i < len(addr.Raw)*8 {
-			bucket = ndb.table[index+i]
-
-			for _, i := range bucket {
-				if len(bucket) >= BucketSize {
+			for _, kv := range ndb.queryAddresses(ndb.bucket(index + i)) {
+				if len(ret) >= BucketSize {
 					break
 				}
 
-				kv, err := ndb.Query(i)
-
-				if err != nil {
-					continue
-				}
-
 				ret = append(ret, kv)
 			}
 		}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"sync"
 	"testing"
 
 	"github.com/wjh/zif/libzif/dht"
@@ -143,3 +145,160 @@ func BenchmarkNetDBFindClosest(b *testing.B) {
 		db.FindClosest(addr)
 	}
 }
+
+func TestNetDBDiversity(t *testing.T) {
+	db, cl := newDB()
+	defer cl()
+
+	// every value claims to live on the same /24
+	host := "203.0.113."
+	n := 0
+	db.SetAdmission(func(kv *dht.KeyValue, observed string) (string, error) {
+		n++
+		return host + strconv.Itoa(n), nil
+	})
+
+	inserted := 0
+	for i := 0; i < dht.BucketSize*4; i++ {
+		dat, _ := util.CryptoRandBytes(20)
+
+		// keep everything in the furthest bucket
+		dat[0] = ^addr.Raw[0]
+		a := dht.Address{dat}
+
+		err := db.Insert(dht.NewKeyValue(a, a.Raw))
+
+		if err == nil {
+			inserted++
+		} else if _, ok := err.(*dht.NoDiversity); !ok {
+			t.Fatal(err.Error())
+		}
+	}
+
+	if inserted != dht.BucketSubnetLimit {
+		t.Errorf("Inserted %d from one subnet, expected: %d", inserted, dht.BucketSubnetLimit)
+	}
+
+	// Loopback is limited like anything else.
+	db.SetAdmission(func(kv *dht.KeyValue, observed string) (string, error) {
+		return "127.0.0.1", nil
+	})
+
+	inserted = 0
+	for i := 0; i < dht.BucketIPLimit+1; i++ {
+		dat, _ := util.CryptoRandBytes(20)
+		dat[0] = ^addr.Raw[0]
+		a := dht.Address{Raw: dat}
+
+		if db.Insert(dht.NewKeyValue(a, a.Raw)) == nil {
+			inserted++
+		}
+	}
+
+	if inserted != dht.BucketIPLimit {
+		t.Errorf("Inserted %d from loopback, expected: %d", inserted, dht.BucketIPLimit)
+	}
+
+	// What a peer claims gives way to where its announcement came from.
+	dat, _ := util.CryptoRandBytes(20)
+	dat[0] = ^addr.Raw[0]
+	a := dht.Address{Raw: dat}
+
+	if err := db.InsertFrom(dht.NewKeyValue(a, a.Raw), "198.51.100.1"); err != nil {
+		t.Error(err.Error())
+	}
+
+	// Nor can it then move into a subnet that is already full.
+	if _, ok := db.InsertFrom(dht.NewKeyValue(a, a.Raw), "203.0.113.200").(*dht.NoDiversity); !ok {
+		t.Error("Moved into a full subnet")
+	}
+
+	// Hosts that are not known all share one subnet.
+	db.SetAdmission(func(kv *dht.KeyValue, observed string) (string, error) {
+		return dht.UnknownHost, nil
+	})
+
+	inserted = 0
+	for i := 0; i < dht.BucketSubnetLimit+1; i++ {
+		dat, _ := util.CryptoRandBytes(20)
+		dat[0] = ^addr.Raw[0]
+		a := dht.Address{Raw: dat}
+
+		if db.Insert(dht.NewKeyValue(a, a.Raw)) == nil {
+			inserted++
+		}
+	}
+
+	if inserted != dht.BucketSubnetLimit {
+		t.Errorf("Inserted %d unknown hosts, expected: %d", inserted, dht.BucketSubnetLimit)
+	}
+}
+
+func TestNetDBTouch(t *testing.T) {
+	db, cl := newDB()
+	defer cl()
+
+	insert(t, db, addr, 1)
+
+	if !db.Touch(addr) {
+		t.Error("Touch did not find inserted address")
+	}
+
+	dat, _ := util.CryptoRandBytes(20)
+	if db.Touch(dht.Address{dat}) {
+		t.Error("Touch found an address that was never inserted")
+	}
+
+	db.Remove(addr)
+
+	if db.TableLen() != 0 {
+		t.Error("Remove did not remove address from table")
+	}
+
+	if _, err := db.Query(addr); err != nil {
+		t.Error("Removed address should still be queryable")
+	}
+}
+
+// Should be run with -race.
+func TestNetDBConcurrent(t *testing.T) {
+	db, cl := newDB()
+	defer cl()
+
+	addrs := make([]dht.Address, 200)
+	for n := range addrs {
+		dat, _ := util.CryptoRandBytes(20)
+		addrs[n] = dht.Address{dat}
+	}
+
+	var wg sync.WaitGroup
+
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+
+		go func(w int) {
+			defer wg.Done()
+
+			for n, a := range addrs {
+				switch (n + w) % 5 {
+				case 0, 1:
+					db.Insert(dht.NewKeyValue(a, a.Raw))
+				case 2:
+					db.Query(a)
+				case 3:
+					db.FindClosest(a)
+				case 4:
+					db.Touch(a)
+					db.TableLen()
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+
+	// each address should appear in the table at most once
+	if db.TableLen() > len(addrs) {
+		t.Errorf("Table has %d entries, more than were inserted", db.TableLen())
+	}
+}
@@ -0,0 +1,59 @@
+// Proof of work bound to a public key.
+// Addresses are just a hash of a public key, so anyone can generate as many as
+// they like until some land close to a target address, then surround it. To make
+// that costly a peer may be asked to find a nonce such that
+// SHA3-256(key || nonce) starts with a number of zero bits. The work is tied to
+// the key, so it cannot be reused for a different address.
+
+package dht
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// Roughly a million hashes, a second or so on a modern machine. This is only
+// ever done once per identity.
+const DefaultWorkDifficulty = 20
+
+// Returns the number of leading zero bits in the work hash of a key and nonce.
+func WorkBits(key []byte, nonce uint64) int {
+	buf := make([]byte, len(key)+8)
+	copy(buf, key)
+	binary.BigEndian.PutUint64(buf[len(key):], nonce)
+
+	hash := sha3.Sum256(buf)
+
+	for i := 0; i < len(hash); i++ {
+		for j := 0; j < 8; j++ {
+			if (hash[i]>>uint8(7-j))&0x1 != 0 {
+				return i*8 + j
+			}
+		}
+	}
+
+	return len(hash) * 8
+}
+
+// Finds a nonce for the given key that meets the difficulty. This is brute
+// force, expect it to take around 2^difficulty hashes.
+func GenerateWork(key []byte, difficulty int) uint64 {
+	var nonce uint64
+
+	for WorkBits(key, nonce) < difficulty {
+		nonce++
+	}
+
+	return nonce
+}
+
+// Checks that the nonce is valid work for the key. A difficulty of zero or less
+// means that no work is required.
+func CheckWork(key []byte, nonce uint64, difficulty int) bool {
+	if difficulty <= 0 {
+		return true
+	}
+
+	return WorkBits(key, nonce) >= difficulty
+}
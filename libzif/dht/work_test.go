@@ -0,0 +1,31 @@
+package dht_test
+
+import (
+	"testing"
+
+	"github.com/wjh/zif/libzif/dht"
+)
+
+func TestWork(t *testing.T) {
+	key := addr.Raw
+
+	nonce := dht.GenerateWork(key, 8)
+
+	if !dht.CheckWork(key, nonce, 8) {
+		t.Error("Generated work did not verify")
+	}
+
+	if dht.WorkBits(key, nonce) < 8 {
+		t.Error("Generated work does not meet difficulty")
+	}
+
+	if !dht.CheckWork(key, 0, 0) {
+		t.Error("Zero difficulty should not require work")
+	}
+}
+
+func BenchmarkGenerateWork(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		dht.GenerateWork(addr.Raw, 12)
+	}
+}
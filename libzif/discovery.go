@@ -0,0 +1,194 @@
+// Finds other peers on the local network, so that they do not have to be
+// bootstrapped by hand. Every peer taking part multicasts a small signed beacon
+// with its address and port, and bootstraps off any new peer it hears from.
+
+package libzif
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/wjh/zif/libzif/dht"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	DiscoveryGroup    = "239.255.90.70:5051"
+	DiscoveryInterval = time.Second * 30
+	// Beacons older than this, or this far in the future, are ignored. Stops
+	// old beacons being replayed.
+	BeaconMaxAge = DiscoveryInterval * 2
+	// Large enough for any beacon.
+	beaconMaxSize = 1024
+)
+
+type Beacon struct {
+	PublicKey []byte `json:"publicKey"`
+	Port      int    `json:"port"`
+	// Unix time the beacon was sent.
+	Timestamp int64  `json:"timestamp"`
+	Signature []byte `json:"signature"`
+}
+
+// The bytes a beacon signs.
+func (b *Beacon) Bytes() []byte {
+	buf := bytes.Buffer{}
+
+	buf.WriteString("beacon")
+	buf.Write(b.PublicKey)
+	buf.WriteString(strconv.Itoa(b.Port))
+	buf.WriteString(strconv.FormatInt(b.Timestamp, 10))
+
+	return buf.Bytes()
+}
+
+func (b *Beacon) Address() dht.Address {
+	return dht.NewAddress(b.PublicKey)
+}
+
+// Check the beacon is signed and was sent recently.
+func (b *Beacon) Verify(now time.Time) error {
+	if len(b.PublicKey) != ed25519.PublicKeySize {
+		return errors.New("Beacon public key invalid")
+	}
+
+	if b.Port <= 0 || b.Port > 65535 {
+		return errors.New("Beacon port invalid")
+	}
+
+	age := now.Sub(time.Unix(b.Timestamp, 0))
+
+	if age > BeaconMaxAge || age < -BeaconMaxAge {
+		return errors.New("Beacon expired")
+	}
+
+	if !ed25519.Verify(b.PublicKey, b.Bytes(), b.Signature) {
+		return errors.New("Failed to verify beacon signature")
+	}
+
+	return nil
+}
+
+func (lp *LocalPeer) SignBeacon() Beacon {
+	b := Beacon{
+		PublicKey: lp.PublicKey(),
+		Port:      lp.Entry.Port,
+		Timestamp: time.Now().Unix(),
+	}
+
+	b.Signature = lp.Sign(b.Bytes())
+
+	return b
+}
+
+// Send beacons to, and listen for beacons on, the given multicast group. This
+// blocks, so should be run in a goroutine.
+func (lp *LocalPeer) Discover(group string) error {
+	addr, err := net.ResolveUDPAddr("udp4", group)
+
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.ListenMulticastUDP("udp4", nil, addr)
+
+	if err != nil {
+		return err
+	}
+
+	defer listener.Close()
+
+	sender, err := net.DialUDP("udp4", nil, addr)
+
+	if err != nil {
+		return err
+	}
+
+	defer sender.Close()
+
+	log.WithField("group", group).Info("Discovering peers on the local network")
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go lp.sendBeacons(sender, done)
+
+	// When we last tried each address, so that a peer we fail to connect to is
+	// not retried on every beacon.
+	tried := make(map[string]time.Time)
+	buf := make([]byte, beaconMaxSize)
+
+	for {
+		n, from, err := listener.ReadFromUDP(buf)
+
+		if err != nil {
+			return err
+		}
+
+		beacon := Beacon{}
+
+		if err := json.Unmarshal(buf[:n], &beacon); err != nil {
+			continue
+		}
+
+		if err := beacon.Verify(time.Now()); err != nil {
+			log.WithField("from", from.String()).Debug("Ignoring beacon: ", err.Error())
+			continue
+		}
+
+		address := beacon.Address()
+		zif := address.String()
+
+		if address.Equals(lp.Address()) || lp.Peers.Has(zif) || lp.Server.Bans.IsBanned(zif) {
+			continue
+		}
+
+		if last, ok := tried[zif]; ok && time.Since(last) < DiscoveryInterval {
+			continue
+		}
+
+		tried[zif] = time.Now()
+		host := net.JoinHostPort(from.IP.String(), strconv.Itoa(beacon.Port))
+
+		log.WithFields(log.Fields{
+			"peer": zif,
+			"host": host,
+		}).Info("Discovered local peer")
+
+		// Pinned to the beaconed address, so a beacon cannot send us to a
+		// different peer.
+		go func() {
+			if err := lp.BootstrapPeer(host, zif); err != nil {
+				log.WithField("host", host).Info("Failed to bootstrap from local peer: ", err.Error())
+			}
+		}()
+	}
+}
+
+func (lp *LocalPeer) sendBeacons(conn *net.UDPConn, done <-chan struct{}) {
+	ticker := time.NewTicker(DiscoveryInterval)
+	defer ticker.Stop()
+
+	for {
+		dat, err := json.Marshal(lp.SignBeacon())
+
+		if err == nil {
+			_, err = conn.Write(dat)
+		}
+
+		if err != nil {
+			log.Error("Failed to send beacon: ", err.Error())
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package libzif
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBeaconVerify(t *testing.T) {
+	var lp LocalPeer
+	lp.GenerateKey()
+	lp.Address().Generate(lp.PublicKey())
+	lp.Entry = &Entry{Port: 5050}
+
+	beacon := lp.SignBeacon()
+	now := time.Now()
+
+	if err := beacon.Verify(now); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	address := beacon.Address()
+
+	if !address.Equals(lp.Address()) {
+		t.Error("Beacon address does not match key")
+	}
+
+	if beacon.Verify(now.Add(BeaconMaxAge*2)) == nil {
+		t.Error("Expired beacon verified")
+	}
+
+	beacon.Port = 5051
+
+	if beacon.Verify(now) == nil {
+		t.Error("Tampered beacon verified")
+	}
+}
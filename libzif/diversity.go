@@ -0,0 +1,100 @@
+// The DHT limits how many contacts a bucket holds from one IP and subnet, so
+// entries need an IP. The one a peer was seen connecting from is best, failing
+// that the name in its entry is resolved. Any peer can put any name in its
+// entry, so lookups are cached and given a short time to finish, and an entry
+// whose IP cannot be found counts towards a single shared "unknown" subnet.
+
+package libzif
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wjh/zif/libzif/dht"
+)
+
+const (
+	HostCacheTime      = time.Minute * 10
+	HostResolveTimeout = time.Second * 2
+
+	// Past this many names, expired ones are dropped, and if that is not enough
+	// the whole cache is.
+	hostCacheMax = 4096
+)
+
+type cachedHost struct {
+	ip      string
+	expires time.Time
+}
+
+// Safe to use from many goroutines. The zero value is ready to use.
+type hostCache struct {
+	mutex sync.Mutex
+	hosts map[string]cachedHost
+}
+
+// The host an entry's public address counts as for bucket diversity. Names are
+// resolved so that they cannot each count as a subnet of their own, except over
+// Tor, where resolving them would leak who we talk to. Onions cannot be
+// resolved, only proof of work limits them.
+func (lp *LocalPeer) diversityHost(host string) string {
+	if net.ParseIP(host) != nil || strings.HasSuffix(host, ".onion") {
+		return host
+	}
+
+	if host == "" || lp.Tor {
+		return dht.UnknownHost
+	}
+
+	return lp.hosts.lookup(host)
+}
+
+// Resolve a name, or return dht.UnknownHost if it does not resolve in time.
+// Failures are cached as well, so a name that hangs only costs us once.
+func (hc *hostCache) lookup(host string) string {
+	now := time.Now()
+
+	hc.mutex.Lock()
+	cached, ok := hc.hosts[host]
+	hc.mutex.Unlock()
+
+	if ok && now.Before(cached.expires) {
+		return cached.ip
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), HostResolveTimeout)
+	defer cancel()
+
+	ip := dht.UnknownHost
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+
+	if err == nil && len(ips) > 0 {
+		ip = ips[0].IP.String()
+	}
+
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	if hc.hosts == nil || len(hc.hosts) >= hostCacheMax {
+		hc.evict(now)
+	}
+
+	hc.hosts[host] = cachedHost{ip, now.Add(HostCacheTime)}
+
+	return ip
+}
+
+func (hc *hostCache) evict(now time.Time) {
+	for k, v := range hc.hosts {
+		if !now.Before(v.expires) {
+			delete(hc.hosts, k)
+		}
+	}
+
+	if hc.hosts == nil || len(hc.hosts) >= hostCacheMax {
+		hc.hosts = make(map[string]cachedHost)
+	}
+}
@@ -0,0 +1,36 @@
+package libzif
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wjh/zif/libzif/dht"
+)
+
+func TestDiversityHost(t *testing.T) {
+	var lp LocalPeer
+
+	lp.hosts.hosts = map[string]cachedHost{
+		"zif.example": {"192.0.2.1", time.Now().Add(time.Minute)},
+	}
+
+	want := map[string]string{
+		"":               dht.UnknownHost,
+		"198.51.100.7":   "198.51.100.7",
+		"abcdefgh.onion": "abcdefgh.onion",
+		"zif.example":    "192.0.2.1",
+	}
+
+	for host, ip := range want {
+		if got := lp.diversityHost(host); got != ip {
+			t.Errorf("%q counts as %q, want %q", host, got, ip)
+		}
+	}
+
+	// Names are never looked up over Tor.
+	lp.Tor = true
+
+	if got := lp.diversityHost("zif.example"); got != dht.UnknownHost {
+		t.Errorf("Resolved a name over Tor to %q", got)
+	}
+}
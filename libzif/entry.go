@@ -29,20 +29,22 @@ type Entry struct {
 	CollectionSig []byte `json:"collectionSig"`
 	Port          int    `json:"port"`
 
-	// Essentially just a list of other peers who have this entry in their table.
-	// They may or may not actually have pieces, so mirror/piece requests may go
-	// awry.
-	// This is... weird. It is not signed. It is not verified.
-	// While the idea of doing the above irks me somewhat, as potentially bad
-	// actors can make themselves become seeds - they will fail with piece
-	// requests. Hashes of pieces will not match.
-	// Removing the requirement for this to be both signed and verified means
-	// that any peer can become a seed without that much work at all. Again,
-	// seed lists can then be updated *without* the requirement that the origin
-	// peer actually be online in the first place.
-	// TODO: Switch this to be a struct containing the last time this peer was
-	// announced as a peer, then the list can be periodically culled.
-	Seeds [][]byte `json:"seeds"`
+	// Proof of work for PublicKey, see dht.GenerateWork. As it is bound to the
+	// key it does not need to be signed, it is useless for any other entry.
+	Work uint64 `json:"work"`
+
+	// Other peers who have mirrored this entry, and so can serve its pieces.
+	// This is not signed by the owner of the entry, and does not need to be:
+	// a seed that is lying will fail piece requests, as the hashes will not
+	// match. This means any peer can become a seed, and seed lists can be
+	// updated without the origin peer being online.
+	// Each seed carries the time it last registered, and may carry its own
+	// signature over that. Seeds that stop registering are culled, see seed.go.
+	Seeds []Seed `json:"seeds"`
+
+	// Set once the owner has moved to a new key, see succession.go. This is
+	// signed by the key itself, so is not part of the entry signature.
+	Successor *Succession `json:"successor,omitempty"`
 
 	// Used in the FindClosest function, for sorting.
 	distance dht.Address
@@ -103,6 +105,11 @@ func (e *Entry) SetLocalPeer(lp *LocalPeer) {
 	e.PublicKey = lp.PublicKey()
 }
 
+// Returns true if the entry carries enough proof of work for its public key.
+func (e *Entry) CheckWork(difficulty int) bool {
+	return dht.CheckWork(e.PublicKey, e.Work, difficulty)
+}
+
 type Entries []*Entry
 
 func (e Entries) Len() int {
@@ -0,0 +1,266 @@
+// Searches many remote peers at once. The search is sent to every peer in
+// parallel, and results are passed on as each peer answers, until they all have
+// or time runs out. Remote peers do not tell us how they ranked posts, only
+// the order, so results are merged by reciprocal rank: a post high up in many
+// peers' results comes first.
+
+package libzif
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/wjh/zif/libzif/data"
+)
+
+const (
+	FanOutTimeout    = time.Second * 10
+	FanOutMaxTimeout = time.Minute
+	// Dampens the difference between the first few places, the usual value
+	// for reciprocal rank fusion.
+	fanOutRankConstant = 60.0
+)
+
+// The state of a peer's part in a search.
+const (
+	FanOutAnswered = "answered"
+	FanOutTimedOut = "timeout"
+	FanOutError    = "error"
+	// Sent last, with the merged results.
+	FanOutDone = "done"
+)
+
+// Sent as a search progresses.
+type FanOutUpdate struct {
+	Peer   string `json:"peer,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Posts from this peer that no peer before it had.
+	Posts  []*data.Post  `json:"posts,omitempty"`
+	Result *FanOutResult `json:"result,omitempty"`
+}
+
+type FanOutResult struct {
+	Hits     []*FederatedHit   `json:"hits"`
+	Answered []string          `json:"answered"`
+	TimedOut []string          `json:"timedOut"`
+	Errors   map[string]string `json:"errors"`
+}
+
+// Searches the given peers, or every connected peer if there are none, for up
+// to timeout. If updates is not nil then an update is sent for each peer as it
+// answers, fails or runs out of time, then a final one with the result. It is
+// closed once the search is over.
+func (lp *LocalPeer) FanOutSearch(query string, page int, peers []string,
+	timeout time.Duration, updates chan<- FanOutUpdate) (*FanOutResult, error) {
+
+	if updates != nil {
+		defer close(updates)
+	}
+
+	// No point asking everyone a question that cannot be answered.
+	if _, err := data.ParseQuery(query); err != nil {
+		return nil, err
+	}
+
+	if timeout <= 0 || timeout > FanOutMaxTimeout {
+		timeout = FanOutTimeout
+	}
+
+	if len(peers) == 0 {
+		peers = lp.Peers.Keys()
+	}
+
+	if len(peers) == 0 {
+		return nil, errors.New("No peers to search")
+	}
+
+	log.WithFields(log.Fields{
+		"query": query,
+		"peers": len(peers),
+	}).Info("Searching peers")
+
+	// Forged posts are dropped as results are merged, so the stream is
+	// searched directly rather than through Peer.Search.
+	search := func(addr string, cancel <-chan struct{}) ([]*data.Post, error) {
+		peer := lp.GetPeer(addr)
+
+		if peer == nil {
+			var err error
+			peer, err = lp.ConnectPeer(addr)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		stream, err := peer.OpenStream()
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer stream.Close()
+
+		// A search still going when time runs out is given up on, rather than
+		// holding the stream open for a peer that may never answer.
+		finished := make(chan struct{})
+		defer close(finished)
+
+		go func() {
+			select {
+			case <-cancel:
+				stream.Close()
+			case <-finished:
+			}
+		}()
+
+		return stream.Search(query, page)
+	}
+
+	res := fanOut(peers, search, timeout, updates)
+
+	if updates != nil {
+		updates <- FanOutUpdate{Status: FanOutDone, Result: res}
+	}
+
+	return res, nil
+}
+
+// Runs search for every peer at once, and merges what comes back. Each peer is
+// searched once however many times it is given. cancel is closed once the
+// search is over, searches still running by then should give up.
+func fanOut(peers []string, search func(peer string, cancel <-chan struct{}) ([]*data.Post, error),
+	timeout time.Duration, updates chan<- FanOutUpdate) *FanOutResult {
+
+	type answer struct {
+		peer  string
+		posts []*data.Post
+		err   error
+	}
+
+	seen := make(map[string]bool)
+	unique := make([]string, 0, len(peers))
+
+	for _, i := range peers {
+		if !seen[i] {
+			seen[i] = true
+			unique = append(unique, i)
+		}
+	}
+
+	peers = unique
+
+	// Buffered so that peers answering after the timeout do not block.
+	answers := make(chan answer, len(peers))
+	cancel := make(chan struct{})
+	defer close(cancel)
+
+	for _, i := range peers {
+		go func(peer string) {
+			posts, err := search(peer, cancel)
+			answers <- answer{peer, posts, err}
+		}(i)
+	}
+
+	res := &FanOutResult{
+		Hits:     make([]*FederatedHit, 0),
+		Answered: make([]string, 0),
+		TimedOut: make([]string, 0),
+		Errors:   make(map[string]string),
+	}
+
+	hits := make(map[string]*FederatedHit)
+	scores := make(map[*FederatedHit]float64)
+	pending := make(map[string]bool)
+
+	for _, i := range peers {
+		pending[i] = true
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for len(pending) > 0 {
+		var a answer
+
+		select {
+		case a = <-answers:
+		case <-deadline.C:
+			for peer := range pending {
+				res.TimedOut = append(res.TimedOut, peer)
+
+				if updates != nil {
+					updates <- FanOutUpdate{Peer: peer, Status: FanOutTimedOut}
+				}
+			}
+
+			pending = nil
+			continue
+		}
+
+		delete(pending, a.peer)
+
+		if a.err != nil {
+			res.Errors[a.peer] = a.err.Error()
+
+			if updates != nil {
+				updates <- FanOutUpdate{Peer: a.peer, Status: FanOutError, Error: a.err.Error()}
+			}
+
+			continue
+		}
+
+		res.Answered = append(res.Answered, a.peer)
+		fresh := make([]*data.Post, 0)
+
+		for n, i := range a.posts {
+			hash, err := data.NormaliseInfoHash(i.InfoHash)
+
+			// A forged post is dropped, rather than being merged into a
+			// genuine one.
+			if err != nil || (i.Signed() && i.Verify() != nil) {
+				continue
+			}
+
+			i.InfoHash = hash
+			hit, ok := hits[hash]
+
+			if !ok {
+				// A copy is merged into, as the original goes out in the
+				// update.
+				post := *i
+				post.Meta = make(data.Meta)
+				post.Meta.Merge(i.Meta)
+
+				hit = &FederatedHit{Post: &post, Sources: []string{}}
+				hits[hash] = hit
+				res.Hits = append(res.Hits, hit)
+				fresh = append(fresh, i)
+			} else {
+				hit.Post.Merge(*i)
+			}
+
+			hit.Sources = append(hit.Sources, a.peer)
+			scores[hit] += 1.0 / (fanOutRankConstant + float64(n+1))
+		}
+
+		if updates != nil {
+			updates <- FanOutUpdate{Peer: a.peer, Status: FanOutAnswered, Posts: fresh}
+		}
+	}
+
+	sort.SliceStable(res.Hits, func(a, b int) bool {
+		return scores[res.Hits[a]] > scores[res.Hits[b]]
+	})
+
+	for _, i := range res.Hits {
+		i.setProvenance()
+	}
+
+	sort.Strings(res.TimedOut)
+
+	return res
+}
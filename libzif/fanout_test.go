@@ -0,0 +1,119 @@
+package libzif
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wjh/zif/libzif/data"
+)
+
+func TestFanOut(t *testing.T) {
+	hash := func(i int) string { return fmt.Sprintf("a%039x", i) }
+	cancelled := make(chan string, 1)
+	answered := make(map[string]int)
+	var mutex sync.Mutex
+
+	search := func(peer string, cancel <-chan struct{}) ([]*data.Post, error) {
+		mutex.Lock()
+		answered[peer]++
+		mutex.Unlock()
+
+		switch peer {
+		case "a":
+			return []*data.Post{
+				{InfoHash: hash(1), Title: "One", Seeders: 5},
+				{InfoHash: hash(2), Title: "Two"},
+			}, nil
+		case "b":
+			return []*data.Post{
+				{InfoHash: hash(2), Title: "Two", Seeders: 9},
+				{InfoHash: hash(3), Title: "Three"},
+				{InfoHash: "not a hash", Title: "Bad"},
+			}, nil
+		case "c":
+			return nil, errors.New("Connection refused")
+		}
+
+		<-cancel
+		cancelled <- peer
+		return nil, errors.New("Cancelled")
+	}
+
+	updates := make(chan FanOutUpdate, 10)
+	start := time.Now()
+	res := fanOut([]string{"a", "b", "a", "c", "d"}, search, time.Millisecond*200, updates)
+	close(updates)
+
+	if time.Since(start) > time.Second {
+		t.Error("Timeout not kept to")
+	}
+
+	select {
+	case peer := <-cancelled:
+		if peer != "d" {
+			t.Errorf("Cancelled %s", peer)
+		}
+	case <-time.After(time.Second):
+		t.Error("Timed out search not cancelled")
+	}
+
+	mutex.Lock()
+	if answered["a"] != 1 {
+		t.Errorf("Searched a %d times", answered["a"])
+	}
+	mutex.Unlock()
+
+	if len(res.Answered) != 2 || len(res.TimedOut) != 1 || res.TimedOut[0] != "d" ||
+		res.Errors["c"] != "Connection refused" {
+		t.Errorf("Answered %v, timed out %v, errors %v", res.Answered, res.TimedOut, res.Errors)
+	}
+
+	// Two is in both peers' results, so comes first.
+	if len(res.Hits) != 3 || res.Hits[0].Post.InfoHash != hash(2) {
+		t.Fatalf("Hits are %+v", res.Hits)
+	}
+
+	if len(res.Hits[0].Sources) != 2 || res.Hits[0].Post.Seeders != 9 {
+		t.Errorf("Merged hit is %+v, %+v", res.Hits[0], res.Hits[0].Post)
+	}
+
+	// Each post is only streamed once, by the first peer to have it.
+	streamed := make(map[string]int)
+	statuses := make(map[string]string)
+
+	for i := range updates {
+		statuses[i.Peer] = i.Status
+
+		for _, j := range i.Posts {
+			streamed[j.InfoHash]++
+		}
+	}
+
+	if len(streamed) != 3 || streamed[hash(2)] != 1 {
+		t.Errorf("Streamed %v", streamed)
+	}
+
+	want := map[string]string{"a": FanOutAnswered, "b": FanOutAnswered, "c": FanOutError, "d": FanOutTimedOut}
+
+	for k, v := range want {
+		if statuses[k] != v {
+			t.Errorf("Peer %s is %q, want %q", k, statuses[k], v)
+		}
+	}
+}
+
+func TestFanOutSearchInvalid(t *testing.T) {
+	var lp LocalPeer
+	updates := make(chan FanOutUpdate, 1)
+
+	if _, err := lp.FanOutSearch(`"unclosed`, 0, []string{"a"}, 0, updates); err == nil {
+		t.Error("Invalid query sent")
+	}
+
+	if _, ok := <-updates; ok {
+		t.Error("Updates not closed")
+	}
+}
@@ -0,0 +1,171 @@
+// Searches our own database and every mirror at once, as if they were one.
+// Each database is searched concurrently, and the results merged by rank. A
+// post for the same infohash may be in many databases, it is returned once
+// with every database it was found in.
+
+package libzif
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/wjh/zif/libzif/data"
+)
+
+const (
+	FederatedPageSize = 25
+	// To get a page of merged results, that many pages have to be read from
+	// every database, so pages stop here.
+	FederatedMaxResults = 1000
+)
+
+type FederatedHit struct {
+	Post    *data.Post `json:"post"`
+	Snippet string     `json:"snippet"`
+	// The address of every peer whose database has the post, the one the post
+	// and snippet came from first. Our own database is our own address.
+	Sources []string `json:"sources"`
+	// Whether the merged post is signed by one of Sources. See
+	// data.Post.Provenance.
+	Provenance string `json:"provenance"`
+	// The address of whoever signed the merged post, if anyone did.
+	Author string `json:"author,omitempty"`
+
+	rank float64
+}
+
+type FederatedResult struct {
+	Hits []*FederatedHit `json:"hits"`
+	// Databases that could not be searched, and why.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// Search every database we have. Ranks are compared directly, as every
+// database ranks in the same way, though relevance is only approximate as
+// each database weighs terms by how common they are in it.
+func (lp *LocalPeer) FederatedSearch(query string, page int) (*FederatedResult, error) {
+	q, err := data.ParseQuery(query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if page < 0 {
+		return nil, errors.New("Invalid page")
+	}
+
+	// Every post in the top n of the merged results is in the top n of the
+	// database it ranks best in, as databases hold an infohash at most once.
+	limit := (page + 1) * FederatedPageSize
+
+	if limit > FederatedMaxResults {
+		return nil, errors.New("Page too far, narrow the search instead")
+	}
+
+	databases := map[string]data.PostStore{lp.Address().String(): lp.Database}
+
+	for k, v := range lp.Databases.Items() {
+		databases[k] = v.(data.PostStore)
+	}
+
+	type searched struct {
+		source string
+		hits   []data.SearchHit
+		err    error
+	}
+
+	results := make(chan searched, len(databases))
+	var wg sync.WaitGroup
+
+	for k, v := range databases {
+		wg.Add(1)
+
+		go func(source string, db data.PostStore) {
+			defer wg.Done()
+
+			hits, err := db.SearchQuery(q, 0, limit)
+			results <- searched{source, hits, err}
+		}(k, v)
+	}
+
+	wg.Wait()
+	close(results)
+
+	res := &FederatedResult{
+		Hits:   make([]*FederatedHit, 0, FederatedPageSize),
+		Errors: make(map[string]string),
+	}
+
+	all := make([]*FederatedHit, 0)
+
+	for i := range results {
+		if i.err != nil {
+			log.WithField("database", i.source).Error("Federated search failed: ", i.err.Error())
+			res.Errors[i.source] = i.err.Error()
+			continue
+		}
+
+		for _, j := range i.hits {
+			all = append(all, &FederatedHit{Post: j.Post, Snippet: j.Snippet,
+				Sources: []string{i.source}, rank: j.Rank})
+		}
+	}
+
+	_, descending := q.Rank()
+
+	// Ties go the same way every time, so that pages do not overlap.
+	sort.SliceStable(all, func(a, b int) bool {
+		if all[a].rank != all[b].rank {
+			return (all[a].rank > all[b].rank) == descending
+		}
+
+		if all[a].Sources[0] != all[b].Sources[0] {
+			return all[a].Sources[0] < all[b].Sources[0]
+		}
+
+		return all[a].Post.Id < all[b].Post.Id
+	})
+
+	merged := mergeHits(all)
+
+	for n := page * FederatedPageSize; n < len(merged) && n < limit; n++ {
+		merged[n].setProvenance()
+		res.Hits = append(res.Hits, merged[n])
+	}
+
+	return res, nil
+}
+
+// Sets the provenance and author of the merged post.
+func (fh *FederatedHit) setProvenance() {
+	fh.Provenance = fh.Post.Provenance(fh.Sources...)
+	fh.Author = fh.Post.AuthorAddress()
+}
+
+// Combines hits with the same infohash into the first of them, keeping the
+// order of first appearance.
+func mergeHits(hits []*FederatedHit) []*FederatedHit {
+	first := make(map[string]*FederatedHit)
+	ret := make([]*FederatedHit, 0, len(hits))
+
+	for _, i := range hits {
+		existing, ok := first[i.Post.InfoHash]
+
+		if !ok {
+			// Copied, as merging changes it.
+			post := *i.Post
+			i.Post = &post
+
+			first[i.Post.InfoHash] = i
+			ret = append(ret, i)
+			continue
+		}
+
+		existing.Post.Merge(*i.Post)
+		existing.Sources = append(existing.Sources, i.Sources...)
+	}
+
+	return ret
+}
@@ -0,0 +1,170 @@
+package libzif
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/streamrail/concurrent-map"
+	"github.com/wjh/zif/libzif/data"
+)
+
+func federatedPeer(t *testing.T) (*LocalPeer, func()) {
+	dir, err := ioutil.TempDir("", "zif-federated")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	lp := &LocalPeer{Databases: cmap.New()}
+	lp.GenerateKey()
+
+	open := func(name string) *data.Database {
+		db := data.NewDatabase(filepath.Join(dir, name+".db"))
+
+		if err := db.Connect(); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		return db
+	}
+
+	lp.Database = open("self")
+	lp.Databases.Set("mirror-a", open("mirror-a"))
+	lp.Databases.Set("mirror-b", open("mirror-b"))
+
+	return lp, func() {
+		lp.Database.Close()
+
+		for _, i := range lp.Databases.Items() {
+			i.(*data.Database).Close()
+		}
+
+		os.RemoveAll(dir)
+	}
+}
+
+func insertFederated(t *testing.T, db data.PostStore, posts ...data.Post) {
+	for _, i := range posts {
+		if _, _, err := db.UpsertPost(i); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
+
+func TestFederatedSearch(t *testing.T) {
+	lp, done := federatedPeer(t)
+	defer done()
+
+	mirrorA, _ := lp.Databases.Get("mirror-a")
+	mirrorB, _ := lp.Databases.Get("mirror-b")
+	hash := func(i int) string { return fmt.Sprintf("a%039x", i) }
+
+	insertFederated(t, lp.Database,
+		data.Post{InfoHash: hash(1), Title: "Ubuntu Desktop", Seeders: 10})
+	insertFederated(t, mirrorA.(*data.Database),
+		data.Post{InfoHash: hash(1), Title: "Ubuntu Desktop", Seeders: 40, Tags: "linux"},
+		data.Post{InfoHash: hash(2), Title: "Ubuntu Server", Seeders: 30})
+	insertFederated(t, mirrorB.(*data.Database),
+		data.Post{InfoHash: hash(3), Title: "Debian", Seeders: 5})
+
+	res, err := lp.FederatedSearch("sort:seeders", 0)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(res.Errors) != 0 {
+		t.Errorf("Errors: %v", res.Errors)
+	}
+
+	if len(res.Hits) != 3 {
+		t.Fatalf("%d hits, want 3", len(res.Hits))
+	}
+
+	want := []string{hash(1), hash(2), hash(3)}
+
+	for n, i := range want {
+		if res.Hits[n].Post.InfoHash != i {
+			t.Errorf("Hit %d is %s, want %s", n, res.Hits[n].Post.InfoHash, i)
+		}
+	}
+
+	first := res.Hits[0]
+
+	if len(first.Sources) != 2 || first.Sources[0] != "mirror-a" ||
+		first.Sources[1] != lp.Address().String() {
+		t.Errorf("Sources are %v", first.Sources)
+	}
+
+	if first.Post.Seeders != 40 || first.Post.Tags != "linux" {
+		t.Errorf("Merged post is %+v", first.Post)
+	}
+
+	res, err = lp.FederatedSearch("ubuntu", 0)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(res.Hits) != 2 || res.Hits[0].Snippet == "" {
+		t.Errorf("Text search hits are %+v", res.Hits)
+	}
+
+	if _, err := lp.FederatedSearch("size:>lots", 0); err == nil {
+		t.Error("Invalid query searched")
+	}
+}
+
+func TestFederatedSearchPages(t *testing.T) {
+	lp, done := federatedPeer(t)
+	defer done()
+
+	mirror, _ := lp.Databases.Get("mirror-a")
+
+	// Every post is in both databases, so the pages must be made after
+	// deduplicating.
+	for i := 0; i < FederatedPageSize*2; i++ {
+		post := data.Post{InfoHash: fmt.Sprintf("a%039x", i+1), Title: "Post", Seeders: i}
+		insertFederated(t, lp.Database, post)
+		insertFederated(t, mirror.(*data.Database), post)
+	}
+
+	seen := make(map[string]bool)
+
+	for page := 0; page < 3; page++ {
+		res, err := lp.FederatedSearch("post sort:seeders", page)
+
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		want := FederatedPageSize
+
+		if page == 2 {
+			want = 0
+		}
+
+		if len(res.Hits) != want {
+			t.Fatalf("Page %d has %d hits, want %d", page, len(res.Hits), want)
+		}
+
+		for n, i := range res.Hits {
+			if seen[i.Post.InfoHash] {
+				t.Errorf("%s on more than one page", i.Post.InfoHash)
+			}
+
+			seen[i.Post.InfoHash] = true
+
+			if wantSeeders := FederatedPageSize*2 - 1 - page*FederatedPageSize - n; i.Post.Seeders != wantSeeders {
+				t.Errorf("Page %d hit %d has %d seeders, want %d", page, n, i.Post.Seeders, wantSeeders)
+			}
+		}
+	}
+
+	if _, err := lp.FederatedSearch("post", FederatedMaxResults/FederatedPageSize); err == nil {
+		t.Error("Searched past the last page")
+	}
+}
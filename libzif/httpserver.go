@@ -4,12 +4,17 @@ package libzif
 
 import (
 	"encoding/json"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 
 	log "github.com/sirupsen/logrus"
+	data "github.com/wjh/zif/libzif/data"
 )
 
 type HttpServer struct {
@@ -30,23 +35,56 @@ func (hs *HttpServer) ListenHttp(addr string) {
 	router.HandleFunc("/peer/{address}/recent/{page}/", hs.Recent)
 	router.HandleFunc("/peer/{address}/popular/{page}/", hs.Popular)
 	router.HandleFunc("/peer/{address}/mirror/", hs.Mirror)
+	router.HandleFunc("/peer/{address}/proof/{infohash}/", hs.PostProof)
+	router.HandleFunc("/peer/{address}/index/rebuild/", hs.PeerRebuildIndex).Methods("POST")
+	router.HandleFunc("/peer/{address}/export/{format}/", hs.Export)
+	router.HandleFunc("/peer/{address}/snapshot/", hs.Snapshot)
 	router.HandleFunc("/peer/{address}/index/{since}/", hs.PeerFtsIndex)
 
 	router.HandleFunc("/self/addpost/", hs.AddPost).Methods("POST")
+	router.HandleFunc("/self/addtorrent/", hs.AddTorrent).Methods("POST")
+	router.HandleFunc("/self/addmagnet/", hs.AddMagnet).Methods("POST")
+	router.HandleFunc("/self/magnet/{infohash}/", hs.Magnet)
+	router.HandleFunc("/self/import/", hs.Import).Methods("POST")
+	router.HandleFunc("/self/export/{format}/", hs.Export)
+	router.HandleFunc("/self/snapshot/", hs.Snapshot)
+	router.HandleFunc("/self/snapshot/import/", hs.ImportSnapshot).Methods("POST")
+	router.HandleFunc("/self/snapshot/verify/", hs.VerifySnapshot).Methods("POST")
+	router.HandleFunc("/self/editpost/", hs.EditPost).Methods("POST")
+	router.HandleFunc("/self/deletepost/{infohash}/", hs.DeletePost).Methods("POST")
+	router.HandleFunc("/self/tombstones/", hs.Tombstones)
+	router.HandleFunc("/self/index/check/", hs.CheckIndex)
+	router.HandleFunc("/self/index/rebuild/", hs.RebuildIndex).Methods("POST")
 	router.HandleFunc("/self/index/{since}/", hs.FtsIndex)
 	router.HandleFunc("/self/resolve/{address}/", hs.Resolve)
 	router.HandleFunc("/self/bootstrap/{address}/", hs.Bootstrap)
 	router.HandleFunc("/self/search/", hs.SelfSearch).Methods("POST")
 	router.HandleFunc("/self/suggest/", hs.SelfSuggest).Methods("POST")
+	router.HandleFunc("/self/federatedsearch/", hs.FederatedSearch).Methods("POST")
+	router.HandleFunc("/self/fanoutsearch/", hs.FanOutSearch).Methods("POST")
 	router.HandleFunc("/self/recent/{page}/", hs.SelfRecent)
 	router.HandleFunc("/self/popular/{page}/", hs.SelfPopular)
 	router.HandleFunc("/self/addmeta/{pid}/", hs.AddMeta).Methods("POST")
+	router.HandleFunc("/self/removemeta/{pid}/", hs.RemoveMeta).Methods("POST")
+	router.HandleFunc("/self/meta/{pid}/", hs.GetMeta)
 	router.HandleFunc("/self/savecollection/", hs.SaveCollection)
 	router.HandleFunc("/self/rebuildcollection/", hs.RebuildCollection)
 	router.HandleFunc("/self/peers/", hs.Peers)
 	router.HandleFunc("/self/requestaddpeer/{remote}/{peer}/", hs.RequestAddPeer)
 	router.HandleFunc("/self/set/{key}/", hs.SelfSet).Methods("POST")
 	router.HandleFunc("/self/get/{key}/", hs.SelfGet)
+	router.HandleFunc("/self/bans/", hs.Bans)
+	router.HandleFunc("/self/ban/{address}/", hs.Ban).Methods("POST")
+	router.HandleFunc("/self/unban/{address}/", hs.Unban)
+	router.HandleFunc("/self/dht/", hs.DhtInfo)
+	router.HandleFunc("/self/dht/closest/{address}/", hs.DhtClosest)
+	router.HandleFunc("/self/dht/lookups/", hs.DhtLookups)
+	router.HandleFunc("/self/dht/export/{format}/", hs.DhtExport)
+	router.HandleFunc("/self/schema/", hs.SchemaVersion)
+	router.HandleFunc("/self/publishers/{infohash}/", hs.Publishers)
+	router.HandleFunc("/self/identities/", hs.Identities)
+	router.HandleFunc("/self/identity/export/", hs.IdentityExport).Methods("POST")
+	router.HandleFunc("/self/identity/import/", hs.IdentityImport).Methods("POST")
 
 	log.Info("Starting HTTP server on ", addr)
 
@@ -99,6 +137,12 @@ func (hs *HttpServer) PeerRSearch(w http.ResponseWriter, r *http.Request) {
 	write_http_response(w, hs.CommandServer.RSearch(
 		CommandRSearch{CommandPeer{addr}, query, pagei}))
 }
+func (hs *HttpServer) PostProof(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	write_http_response(w, hs.CommandServer.PostProof(
+		CommandPostProof{CommandPeer{vars["address"]}, vars["infohash"]}))
+}
 func (hs *HttpServer) PeerSearch(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
@@ -169,7 +213,6 @@ func (hs *HttpServer) PeerFtsIndex(w http.ResponseWriter, r *http.Request) {
 
 func (hs *HttpServer) AddPost(w http.ResponseWriter, r *http.Request) {
 	pj := r.FormValue("data")
-	index := r.FormValue("index") == "true"
 
 	var post CommandAddPost
 	err := json.Unmarshal([]byte(pj), &post)
@@ -179,10 +222,238 @@ func (hs *HttpServer) AddPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	post.Index = index
-
 	write_http_response(w, hs.CommandServer.AddPost(post))
 }
+
+// Takes the .torrent file as a multipart upload, under "torrent".
+func (hs *HttpServer) AddTorrent(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, data.TorrentMax+1024*1024)
+
+	file, _, err := r.FormFile("torrent")
+
+	if err != nil {
+		write_http_response(w, CommandResult{false, nil, err})
+		return
+	}
+
+	defer file.Close()
+
+	dat, err := ioutil.ReadAll(file)
+
+	if err != nil {
+		write_http_response(w, CommandResult{false, nil, err})
+		return
+	}
+
+	write_http_response(w, hs.CommandServer.AddTorrent(
+		CommandAddTorrent{dat, r.FormValue("tags")}))
+}
+func (hs *HttpServer) AddMagnet(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.AddMagnet(CommandAddMagnet{
+		r.FormValue("magnet"), r.FormValue("title"), r.FormValue("tags")}))
+}
+func (hs *HttpServer) Magnet(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	write_http_response(w, hs.CommandServer.Magnet(CommandMagnet{vars["infohash"]}))
+}
+
+// Takes the dump as a multipart upload, under "dump". format is jsonl or csv,
+// and is guessed from the file name if not given. columns is a mapping such as
+// "title=name,infohash=hash". Progress is streamed as it goes, one JSON
+// ImportProgress per line.
+func (hs *HttpServer) Import(w http.ResponseWriter, r *http.Request) {
+	file, header, err := r.FormFile("dump")
+
+	if err != nil {
+		write_http_response(w, CommandResult{false, nil, err})
+		return
+	}
+
+	defer file.Close()
+
+	ci := CommandImport{Reader: file}
+	ci.Format = r.FormValue("format")
+
+	if ci.Format == "" {
+		ci.Format = DumpFormat(header.Filename)
+	}
+
+	ci.Columns, err = data.ParseImportColumns(r.FormValue("columns"))
+
+	if err != nil {
+		write_http_response(w, CommandResult{false, nil, err})
+		return
+	}
+
+	updates := make(chan data.ImportProgress)
+	ci.Updates = updates
+	result := make(chan CommandResult, 1)
+
+	go func() {
+		result <- hs.CommandServer.Import(ci)
+	}()
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	streamed := false
+
+	for i := range updates {
+		if !streamed {
+			w.Header().Set("Content-Type", "application/x-ndjson; charset=UTF-8")
+			streamed = true
+		}
+
+		encoder.Encode(i)
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	// Failed before reading anything, or part way through, in which case the
+	// error follows the last progress.
+	if cr := <-result; !streamed {
+		write_http_response(w, cr)
+	} else if !cr.IsOK {
+		cr.WriteJSON(w)
+	}
+}
+
+// Counts what is written, so that handlers writing raw output know whether
+// they can still write an error instead.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+
+	return n, err
+}
+
+// Like DhtExport this writes the export as is. An error part way through can
+// only be logged, as the status has been sent by then. query filters the
+// posts, as a search query would.
+func (hs *HttpServer) Export(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	cw := &countingWriter{w: w}
+
+	if vars["format"] == data.ExportCSV {
+		w.Header().Set("Content-Type", "text/csv; charset=UTF-8")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson; charset=UTF-8")
+	}
+
+	cr := hs.CommandServer.Export(CommandExport{vars["address"],
+		data.ExportOptions{Format: vars["format"], Query: r.FormValue("query")}, cw})
+
+	if !cr.IsOK && cw.n == 0 {
+		write_http_response(w, cr)
+	} else if !cr.IsOK {
+		log.Error("Export failed: ", cr.Error.Error())
+	}
+}
+
+func (hs *HttpServer) Snapshot(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	cw := &countingWriter{w: w}
+
+	name := vars["address"]
+
+	if name == "" {
+		name = hs.CommandServer.LocalPeer.Address().String()
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+name+".tar.gz\"")
+
+	cr := hs.CommandServer.Snapshot(CommandSnapshot{vars["address"], cw})
+
+	if !cr.IsOK && cw.n == 0 {
+		w.Header().Del("Content-Disposition")
+		write_http_response(w, cr)
+	} else if !cr.IsOK {
+		log.Error("Snapshot failed: ", cr.Error.Error())
+	}
+}
+
+// Saves a multipart upload to a temporary file, returning its path. The file
+// should be removed once it is done with.
+func saveUpload(r *http.Request, field string) (string, error) {
+	file, _, err := r.FormFile(field)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close()
+
+	tmp, err := ioutil.TempFile("", "zif-upload")
+
+	if err != nil {
+		return "", err
+	}
+
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, file); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return tmp.Name(), nil
+}
+
+// Takes the snapshot as a multipart upload, under "snapshot".
+func (hs *HttpServer) ImportSnapshot(w http.ResponseWriter, r *http.Request) {
+	path, err := saveUpload(r, "snapshot")
+
+	if err != nil {
+		write_http_response(w, CommandResult{false, nil, err})
+		return
+	}
+
+	defer os.Remove(path)
+
+	write_http_response(w, hs.CommandServer.ImportSnapshot(CommandImportSnapshot{path}))
+}
+
+func (hs *HttpServer) VerifySnapshot(w http.ResponseWriter, r *http.Request) {
+	path, err := saveUpload(r, "snapshot")
+
+	if err != nil {
+		write_http_response(w, CommandResult{false, nil, err})
+		return
+	}
+
+	defer os.Remove(path)
+
+	write_http_response(w, hs.CommandServer.VerifySnapshot(CommandVerifySnapshot{path}))
+}
+func (hs *HttpServer) EditPost(w http.ResponseWriter, r *http.Request) {
+	pj := r.FormValue("data")
+
+	var post CommandEditPost
+	err := json.Unmarshal([]byte(pj), &post)
+
+	if err != nil {
+		write_http_response(w, CommandResult{false, nil, err})
+		return
+	}
+
+	write_http_response(w, hs.CommandServer.EditPost(post))
+}
+func (hs *HttpServer) DeletePost(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	write_http_response(w, hs.CommandServer.DeletePost(CommandDeletePost{vars["infohash"]}))
+}
+func (hs *HttpServer) Tombstones(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.Tombstones(nil))
+}
 func (hs *HttpServer) FtsIndex(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
@@ -195,6 +466,17 @@ func (hs *HttpServer) FtsIndex(w http.ResponseWriter, r *http.Request) {
 	write_http_response(w, hs.CommandServer.SelfIndex(
 		CommandSelfIndex{since}))
 }
+func (hs *HttpServer) CheckIndex(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.CheckIndex(CommandCheckIndex{}))
+}
+func (hs *HttpServer) RebuildIndex(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.RebuildIndex(CommandRebuildIndex{}))
+}
+func (hs *HttpServer) PeerRebuildIndex(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	write_http_response(w, hs.CommandServer.RebuildIndex(CommandRebuildIndex{vars["address"]}))
+}
 func (hs *HttpServer) Resolve(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
@@ -218,6 +500,75 @@ func (hs *HttpServer) SelfSearch(w http.ResponseWriter, r *http.Request) {
 	write_http_response(w, hs.CommandServer.SelfSearch(CommandSelfSearch{CommandSuggest{query}, pagei}))
 }
 
+func (hs *HttpServer) FederatedSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.FormValue("query")
+	page := r.FormValue("page")
+
+	pagei, err := strconv.Atoi(page)
+	if err != nil {
+		write_http_response(w, CommandResult{false, nil, err})
+		return
+	}
+
+	write_http_response(w, hs.CommandServer.FederatedSearch(
+		CommandFederatedSearch{CommandSuggest{query}, pagei}))
+}
+
+// Streams the search as it goes, one JSON FanOutUpdate per line. peers is a
+// comma separated list of addresses, timeout is in seconds. Both are optional.
+func (hs *HttpServer) FanOutSearch(w http.ResponseWriter, r *http.Request) {
+	cfs := CommandFanOutSearch{CommandSuggest: CommandSuggest{r.FormValue("query")}}
+
+	var err error
+	cfs.Page, err = strconv.Atoi(r.FormValue("page"))
+	if err != nil {
+		write_http_response(w, CommandResult{false, nil, err})
+		return
+	}
+
+	if timeout := r.FormValue("timeout"); timeout != "" {
+		cfs.Timeout, err = strconv.Atoi(timeout)
+		if err != nil {
+			write_http_response(w, CommandResult{false, nil, err})
+			return
+		}
+	}
+
+	if peers := r.FormValue("peers"); peers != "" {
+		cfs.Peers = strings.Split(peers, ",")
+	}
+
+	updates := make(chan FanOutUpdate)
+	cfs.Updates = updates
+	result := make(chan CommandResult, 1)
+
+	go func() {
+		result <- hs.CommandServer.FanOutSearch(cfs)
+	}()
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	streamed := false
+
+	for i := range updates {
+		if !streamed {
+			w.Header().Set("Content-Type", "application/x-ndjson; charset=UTF-8")
+			streamed = true
+		}
+
+		encoder.Encode(i)
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	// Failed before searching anyone.
+	if cr := <-result; !streamed {
+		write_http_response(w, cr)
+	}
+}
+
 func (hs *HttpServer) SelfSuggest(w http.ResponseWriter, r *http.Request) {
 	log.Info("HTTP: Self Suggest request")
 
@@ -253,7 +604,8 @@ func (hs *HttpServer) AddMeta(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	pid, err := strconv.Atoi(vars["pid"])
-	meta := r.FormValue("meta")
+	key := r.FormValue("key")
+	value := r.FormValue("value")
 
 	if err != nil {
 		write_http_response(w, CommandResult{false, nil, err})
@@ -261,7 +613,34 @@ func (hs *HttpServer) AddMeta(w http.ResponseWriter, r *http.Request) {
 	}
 
 	write_http_response(w, hs.CommandServer.AddMeta(
-		CommandAddMeta{CommandMeta{pid}, meta}))
+		CommandAddMeta{CommandMeta{pid}, key, value}))
+}
+func (hs *HttpServer) RemoveMeta(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	pid, err := strconv.Atoi(vars["pid"])
+	key := r.FormValue("key")
+	value := r.FormValue("value")
+
+	if err != nil {
+		write_http_response(w, CommandResult{false, nil, err})
+		return
+	}
+
+	write_http_response(w, hs.CommandServer.RemoveMeta(
+		CommandRemoveMeta{CommandMeta{pid}, key, value}))
+}
+func (hs *HttpServer) GetMeta(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	pid, err := strconv.Atoi(vars["pid"])
+
+	if err != nil {
+		write_http_response(w, CommandResult{false, nil, err})
+		return
+	}
+
+	write_http_response(w, hs.CommandServer.GetMeta(CommandGetMeta{pid}))
 }
 func (hs *HttpServer) SaveCollection(w http.ResponseWriter, r *http.Request) {
 	write_http_response(w, hs.CommandServer.SaveCollection(nil))
@@ -298,6 +677,117 @@ func (hs *HttpServer) SelfGet(w http.ResponseWriter, r *http.Request) {
 	write_http_response(w, hs.CommandServer.LocalGet(CommandLocalGet{key}))
 }
 
+func (hs *HttpServer) Bans(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.Bans(nil))
+}
+
+func (hs *HttpServer) Ban(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	duration := 0
+
+	if d := r.FormValue("duration"); d != "" {
+		var err error
+		duration, err = strconv.Atoi(d)
+
+		if err != nil {
+			write_http_response(w, CommandResult{false, nil, err})
+			return
+		}
+	}
+
+	write_http_response(w, hs.CommandServer.Ban(CommandBan{
+		CommandPeer{vars["address"]}, duration, r.FormValue("reason"),
+	}))
+}
+
+func (hs *HttpServer) Unban(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	write_http_response(w, hs.CommandServer.Unban(CommandUnban{vars["address"]}))
+}
+
+func (hs *HttpServer) DhtInfo(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.DhtInfo(nil))
+}
+
+func (hs *HttpServer) DhtClosest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	count := 0
+
+	if c := r.FormValue("count"); c != "" {
+		var err error
+		count, err = strconv.Atoi(c)
+
+		if err != nil {
+			write_http_response(w, CommandResult{false, nil, err})
+			return
+		}
+	}
+
+	write_http_response(w, hs.CommandServer.DhtClosest(
+		CommandDhtClosest{CommandPeer{vars["address"]}, count}))
+}
+
+func (hs *HttpServer) DhtLookups(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.DhtLookups(nil))
+}
+
+// Unlike other handlers this writes the export as is, rather than wrapping it
+// in a status object, so it can be fed straight into other tools.
+func (hs *HttpServer) DhtExport(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	cr := hs.CommandServer.DhtExport(CommandDhtExport{vars["format"]})
+
+	if !cr.IsOK {
+		write_http_response(w, cr)
+		return
+	}
+
+	if dot, ok := cr.Result.(string); ok {
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(dot))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(cr.Result)
+}
+
+func (hs *HttpServer) SchemaVersion(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.SchemaVersion(nil))
+}
+
+func (hs *HttpServer) Publishers(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	write_http_response(w, hs.CommandServer.Publishers(CommandPublishers{vars["infohash"]}))
+}
+
+func (hs *HttpServer) Identities(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.Identities(nil))
+}
+
+func (hs *HttpServer) IdentityExport(w http.ResponseWriter, r *http.Request) {
+	current := r.FormValue("current")
+	passphrase := r.FormValue("passphrase")
+
+	write_http_response(w, hs.CommandServer.IdentityExport(
+		CommandIdentityExport{current, passphrase}))
+}
+
+func (hs *HttpServer) IdentityImport(w http.ResponseWriter, r *http.Request) {
+	armour := r.FormValue("armour")
+	passphrase := r.FormValue("passphrase")
+
+	write_http_response(w, hs.CommandServer.IdentityImport(
+		CommandIdentityImport{armour, passphrase}))
+}
+
 func (hs *HttpServer) IndexHandler(w http.ResponseWriter, r *http.Request) {
 	// TODO
 	w.WriteHeader(http.StatusOK)
@@ -0,0 +1,347 @@
+// Identity files hold our private key. With a passphrase set the key is
+// encrypted, using a key derived from the passphrase with argon2id and
+// XChaCha20-Poly1305. The file is armoured, so the same format is used to move
+// identities between machines.
+// Files holding just the raw key, as written by older versions, can still be
+// read.
+
+package libzif
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/wjh/zif/libzif/dht"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	DefaultIdentityPath = "identity.dat"
+	IdentityArmourType  = "ZIF IDENTITY"
+	IdentityVersion     = 1
+
+	// argon2id parameters for new files. Those for existing files are read
+	// from the file itself.
+	identityTime    = 3
+	identityMemory  = 64 * 1024
+	identityThreads = 4
+	identitySalt    = 16
+)
+
+var ErrBadPassphrase = errors.New("Wrong passphrase, or the identity is corrupt")
+
+type EncryptedIdentity struct {
+	Version int    `json:"version"`
+	Address string `json:"address"`
+
+	Salt    []byte `json:"salt"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// Describes an identity file, without decrypting it.
+type IdentityInfo struct {
+	Path      string `json:"path"`
+	Address   string `json:"address"`
+	Encrypted bool   `json:"encrypted"`
+	Current   bool   `json:"current"`
+}
+
+func (ei *EncryptedIdentity) key(passphrase string) []byte {
+	return argon2.IDKey([]byte(passphrase), ei.Salt, ei.Time, ei.Memory, ei.Threads,
+		chacha20poly1305.KeySize)
+}
+
+// Encrypt a private key with the given passphrase.
+func EncryptIdentity(pk ed25519.PrivateKey, passphrase string) (*EncryptedIdentity, error) {
+	if len(pk) != ed25519.PrivateKeySize {
+		return nil, errors.New("Private key invalid")
+	}
+
+	address := dht.NewAddress(pk.Public().(ed25519.PublicKey))
+
+	ei := &EncryptedIdentity{
+		Version: IdentityVersion,
+		Address: address.String(),
+		Salt:    make([]byte, identitySalt),
+		Time:    identityTime,
+		Memory:  identityMemory,
+		Threads: identityThreads,
+		Nonce:   make([]byte, chacha20poly1305.NonceSizeX),
+	}
+
+	if _, err := rand.Read(ei.Salt); err != nil {
+		return nil, err
+	}
+
+	if _, err := rand.Read(ei.Nonce); err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.NewX(ei.key(passphrase))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The address is authenticated too, so it cannot be swapped for another.
+	ei.Ciphertext = aead.Seal(nil, ei.Nonce, pk, []byte(ei.Address))
+
+	return ei, nil
+}
+
+func (ei *EncryptedIdentity) Decrypt(passphrase string) (ed25519.PrivateKey, error) {
+	if ei.Version != IdentityVersion {
+		return nil, errors.New("Unknown identity version")
+	}
+
+	if len(ei.Nonce) != chacha20poly1305.NonceSizeX {
+		return nil, errors.New("Identity nonce invalid")
+	}
+
+	aead, err := chacha20poly1305.NewX(ei.key(passphrase))
+
+	if err != nil {
+		return nil, err
+	}
+
+	pk, err := aead.Open(nil, ei.Nonce, ei.Ciphertext, []byte(ei.Address))
+
+	if err != nil || len(pk) != ed25519.PrivateKeySize {
+		return nil, ErrBadPassphrase
+	}
+
+	return ed25519.PrivateKey(pk), nil
+}
+
+// Armoured form, for writing to disk or moving between machines.
+func (ei *EncryptedIdentity) Armour() ([]byte, error) {
+	dat, err := json.Marshal(ei)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:    IdentityArmourType,
+		Headers: map[string]string{"Address": ei.Address},
+		Bytes:   dat,
+	}), nil
+}
+
+func DearmourIdentity(armour []byte) (*EncryptedIdentity, error) {
+	block, _ := pem.Decode(armour)
+
+	if block == nil || block.Type != IdentityArmourType {
+		return nil, errors.New("Not an armoured identity")
+	}
+
+	ei := &EncryptedIdentity{}
+	err := json.Unmarshal(block.Bytes, ei)
+
+	return ei, err
+}
+
+// Read a private key from an identity file. If the file is encrypted the
+// passphrase is used to decrypt it, otherwise it is ignored.
+func ReadIdentity(path, passphrase string) (ed25519.PrivateKey, error) {
+	dat, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(dat) == ed25519.PrivateKeySize {
+		return ed25519.PrivateKey(dat), nil
+	}
+
+	ei, err := DearmourIdentity(dat)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ei.Decrypt(passphrase)
+}
+
+// Write a private key to an identity file, encrypted if passphrase is not
+// empty. Any existing file is replaced, but only once the new one is written.
+func WriteIdentity(path string, pk ed25519.PrivateKey, passphrase string) error {
+	dat := []byte(pk)
+
+	if passphrase != "" {
+		ei, err := EncryptIdentity(pk, passphrase)
+
+		if err != nil {
+			return err
+		}
+
+		dat, err = ei.Armour()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	tmp := path + ".new"
+	os.Remove(tmp)
+
+	err := ioutil.WriteFile(tmp, dat, 0400)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Look at an identity file without decrypting it.
+func StatIdentity(path string) (IdentityInfo, error) {
+	info := IdentityInfo{Path: path}
+
+	dat, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return info, err
+	}
+
+	if len(dat) == ed25519.PrivateKeySize {
+		pk := ed25519.PrivateKey(dat)
+		address := dht.NewAddress(pk.Public().(ed25519.PublicKey))
+		info.Address = address.String()
+
+		return info, nil
+	}
+
+	ei, err := DearmourIdentity(dat)
+
+	if err != nil {
+		return info, err
+	}
+
+	info.Address = ei.Address
+	info.Encrypted = true
+
+	return info, nil
+}
+
+// Where our identity is stored.
+func (lp *LocalPeer) identityPath() string {
+	if lp.IdentityPath == "" {
+		return DefaultIdentityPath
+	}
+
+	return lp.IdentityPath
+}
+
+// Lists the identity files alongside ours. Imported identities are written
+// there, and any of them can be used by pointing IdentityPath at it.
+func (lp *LocalPeer) Identities() ([]IdentityInfo, error) {
+	current, _ := filepath.Abs(lp.identityPath())
+	dir := filepath.Dir(lp.identityPath())
+
+	files, err := ioutil.ReadDir(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]IdentityInfo, 0)
+
+	for _, i := range files {
+		if i.IsDir() {
+			continue
+		}
+
+		info, err := StatIdentity(filepath.Join(dir, i.Name()))
+
+		if err != nil || info.Address == "" {
+			continue
+		}
+
+		abs, _ := filepath.Abs(info.Path)
+		info.Current = abs == current
+
+		ret = append(ret, info)
+	}
+
+	return ret, nil
+}
+
+// Export our identity in armoured form, encrypted with the given passphrase.
+// Anything that can ask us to export must also know current, the passphrase
+// our identity file is encrypted with, so an identity without one cannot be
+// exported at all.
+func (lp *LocalPeer) ExportIdentity(current, passphrase string) ([]byte, error) {
+	if lp.Passphrase == "" {
+		return nil, errors.New("Set a passphrase for the identity before exporting it")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(current), []byte(lp.Passphrase)) != 1 {
+		return nil, ErrBadPassphrase
+	}
+
+	if passphrase == "" {
+		return nil, errors.New("A passphrase is needed to export an identity")
+	}
+
+	if len(lp.privateKey) == 0 {
+		return nil, errors.New("LocalPeer does not have a private key, please generate")
+	}
+
+	ei, err := EncryptIdentity(lp.privateKey, passphrase)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ei.Armour()
+}
+
+// Import an armoured identity, writing it alongside ours as <address>.dat and
+// encrypted with our passphrase. Returns the new file.
+func (lp *LocalPeer) ImportIdentity(armour []byte, passphrase string) (IdentityInfo, error) {
+	ei, err := DearmourIdentity(armour)
+
+	if err != nil {
+		return IdentityInfo{}, err
+	}
+
+	pk, err := ei.Decrypt(passphrase)
+
+	if err != nil {
+		return IdentityInfo{}, err
+	}
+
+	address := dht.NewAddress(pk.Public().(ed25519.PublicKey))
+
+	if address.String() != ei.Address {
+		return IdentityInfo{}, errors.New("Identity address does not match key")
+	}
+
+	path := filepath.Join(filepath.Dir(lp.identityPath()), ei.Address+".dat")
+
+	if _, err := os.Stat(path); err == nil {
+		return IdentityInfo{}, errors.New("Identity already exists")
+	}
+
+	err = WriteIdentity(path, pk, lp.Passphrase)
+
+	if err != nil {
+		return IdentityInfo{}, err
+	}
+
+	return StatIdentity(path)
+}
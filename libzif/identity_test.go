@@ -0,0 +1,152 @@
+package libzif
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestIdentityRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zif-identity")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+
+	_, pk, _ := ed25519.GenerateKey(nil)
+	path := filepath.Join(dir, "identity.dat")
+
+	err = WriteIdentity(path, pk, "hunter2")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Writing again must replace the read only file.
+	err = WriteIdentity(path, pk, "hunter2")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	dat, _ := ioutil.ReadFile(path)
+
+	if len(dat) == ed25519.PrivateKeySize {
+		t.Fatal("Identity not encrypted")
+	}
+
+	if _, err := ReadIdentity(path, "wrong"); err != ErrBadPassphrase {
+		t.Error("Identity decrypted with the wrong passphrase")
+	}
+
+	read, err := ReadIdentity(path, "hunter2")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !bytes.Equal(pk, read) {
+		t.Error("Identity changed on round trip")
+	}
+
+	info, err := StatIdentity(path)
+
+	if err != nil || !info.Encrypted {
+		t.Error("Encrypted identity not recognised")
+	}
+}
+
+func TestIdentityLegacy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zif-identity")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+
+	_, pk, _ := ed25519.GenerateKey(nil)
+	path := filepath.Join(dir, "identity.dat")
+	ioutil.WriteFile(path, pk, 0400)
+
+	read, err := ReadIdentity(path, "ignored")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !bytes.Equal(pk, read) {
+		t.Error("Legacy identity not read")
+	}
+}
+
+func TestIdentityImportExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zif-identity")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+
+	var from, to LocalPeer
+	from.GenerateKey()
+	to.IdentityPath = filepath.Join(dir, "identity.dat")
+	to.Passphrase = "local"
+
+	if _, err := from.ExportIdentity("", "transfer"); err == nil {
+		t.Error("Exported an identity without a passphrase")
+	}
+
+	from.Passphrase = "secret"
+
+	if _, err := from.ExportIdentity("guess", "transfer"); err != ErrBadPassphrase {
+		t.Errorf("Exported with the wrong passphrase, error %v", err)
+	}
+
+	armour, err := from.ExportIdentity("secret", "transfer")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err := to.ImportIdentity(armour, "wrong"); err == nil {
+		t.Error("Imported with the wrong passphrase")
+	}
+
+	info, err := to.ImportIdentity(armour, "transfer")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !info.Encrypted {
+		t.Error("Imported identity not encrypted")
+	}
+
+	read, err := ReadIdentity(info.Path, "local")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !bytes.Equal(from.privateKey, read) {
+		t.Error("Imported identity does not match")
+	}
+
+	ids, err := to.Identities()
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(ids) != 1 || ids[0].Address != info.Address {
+		t.Error("Imported identity not listed")
+	}
+}
@@ -0,0 +1,128 @@
+package libzif
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	data "github.com/wjh/zif/libzif/data"
+)
+
+// The format of a dump file, going by its extension.
+func DumpFormat(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".csv":
+		return data.ImportCSV
+	}
+
+	return data.ImportJSONL
+}
+
+// Imports posts from a dump as our own, see data.ImportPosts. Unlike AddPost,
+// posts are stored a piece at a time through InsertPieces, and the collection
+// and entry are only brought up to date once, at the end. The search index
+// keeps itself up to date as posts are stored, see data/index.go. Posts
+// we have deleted stay deleted. If updates is not nil then progress is sent
+// there, and it is closed once the import is over.
+func (lp *LocalPeer) ImportPosts(r io.Reader, opts data.ImportOptions,
+	updates chan<- data.ImportProgress) (*data.ImportProgress, error) {
+
+	if updates != nil {
+		defer close(updates)
+	}
+
+	pieces := make(chan *data.Piece, 2)
+	inserted := make(chan error, 1)
+
+	go func() {
+		inserted <- lp.Database.InsertPieces(pieces)
+	}()
+
+	var insertErr error
+	finished := false
+
+	// False if the store gave up, in which case nothing more will be read.
+	send := func(piece *data.Piece) bool {
+		select {
+		case pieces <- piece:
+			return true
+		case insertErr = <-inserted:
+			finished = true
+			return false
+		}
+	}
+
+	piece := &data.Piece{}
+	piece.Setup()
+
+	add := func(p data.Post) error {
+		// Posts we import are ours, and are signed as such.
+		p.Author, p.Signature = nil, nil
+		p.InfoHash, _ = data.NormaliseInfoHash(p.InfoHash)
+		p.Sign(lp)
+
+		piece.Add(p, true)
+
+		if piece.Len() < data.PieceSize {
+			return nil
+		}
+
+		if !send(piece) {
+			return insertErr
+		}
+
+		piece = &data.Piece{}
+		piece.Setup()
+
+		return nil
+	}
+
+	var report func(data.ImportProgress)
+
+	if updates != nil {
+		report = func(ip data.ImportProgress) {
+			// Not done until the store has everything.
+			ip.Done = false
+			updates <- ip
+		}
+	}
+
+	progress, err := data.ImportPosts(r, opts, add, report)
+
+	if err == nil && piece.Len() > 0 {
+		send(piece)
+	}
+
+	close(pieces)
+
+	if !finished {
+		insertErr = <-inserted
+	}
+
+	if err == nil {
+		err = insertErr
+	}
+
+	// Pieces stored before a failure are kept, so the collection must still
+	// be brought up to date.
+	if progress.Imported > 0 {
+		if ferr := lp.RebuildCollection(); err == nil {
+			err = ferr
+		}
+	}
+
+	if err != nil {
+		return &progress, err
+	}
+
+	log.WithField("posts", progress.Imported).Info("Imported posts")
+
+	progress.Done = true
+
+	if updates != nil {
+		updates <- progress
+	}
+
+	return &progress, nil
+}
@@ -4,13 +4,15 @@
 package libzif
 
 import (
+	"bytes"
 	"errors"
-	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/streamrail/concurrent-map"
@@ -28,7 +30,7 @@ type LocalPeer struct {
 	DHT           *dht.DHT
 	Server        proto.Server
 	Collection    *data.Collection
-	Database      *data.Database
+	Database      data.PostStore
 	PublicAddress string
 	// These are the databases of all of the peers that we have mirrored.
 	Databases   cmap.ConcurrentMap
@@ -43,8 +45,25 @@ type LocalPeer struct {
 	PublicToZif cmap.ConcurrentMap
 
 	privateKey ed25519.PrivateKey
+	// Where the private key is stored, "identity.dat" if empty.
+	IdentityPath string
+	// Used to encrypt the private key. If empty it is stored unencrypted.
+	Passphrase string
+
+	// Guards Entry.Seeds, which is updated by handlers and MaintainSeeds.
+	seedMutex sync.Mutex
 
 	Tor bool
+
+	// Peers to join the network through. May be nil.
+	BootstrapList *BootstrapList
+
+	// The proof of work difficulty entries need to meet before they are let
+	// into our routing table. Zero accepts entries without any work.
+	MinWork int
+
+	// The IPs entries' public addresses resolved to, see diversity.go.
+	hosts hostCache
 }
 
 func (lp *LocalPeer) Setup() {
@@ -61,9 +80,13 @@ func (lp *LocalPeer) Setup() {
 	lp.Address().Generate(lp.PublicKey())
 
 	lp.DHT = dht.NewDHT(lp.address, "./data/dht")
+	lp.DHT.SetAdmission(lp.admitEntry)
+	lp.publishRetired()
 
-	if err != nil {
-		panic(err)
+	lp.Server.Bans, err = proto.LoadBanList("./data/bans.json")
+
+	if err != nil && !os.IsNotExist(err) {
+		log.Error(err.Error())
 	}
 
 	lp.Collection, err = data.LoadCollection("./data/collection.dat")
@@ -114,6 +137,46 @@ func (lp *LocalPeer) Setup() {
 	lp.SearchProvider = data.NewSearchProvider()
 }
 
+// Decides whether a value may enter the routing table. It must be a valid,
+// signed entry for the address it is stored under, with enough proof of work.
+// The IP it was observed at, or failing that the one its public address
+// resolves to, is returned so the DHT can keep its buckets diverse.
+func (lp *LocalPeer) admitEntry(kv *dht.KeyValue, observed string) (string, error) {
+	entry, err := JsonToEntry(kv.Value)
+
+	if err != nil {
+		return "", err
+	}
+
+	err = entry.Validate()
+
+	if err != nil {
+		return "", err
+	}
+
+	address := dht.NewAddress(entry.PublicKey)
+
+	if !address.Equals(&kv.Key) || !entry.Address.Equals(&kv.Key) {
+		return "", errors.New("Entry address does not match public key")
+	}
+
+	if !entry.CheckWork(lp.MinWork) {
+		return "", errors.New("Entry has insufficient proof of work")
+	}
+
+	err = entry.CheckSuccessor()
+
+	if err != nil {
+		return "", err
+	}
+
+	if observed != "" {
+		return observed, nil
+	}
+
+	return lp.diversityHost(entry.PublicAddress), nil
+}
+
 // Given a direct address, for instance an IP or domain, connect to the peer there.
 // This can be used for something like bootstrapping, or for something like
 // connecting to a peer whose Zif address we have just resolved.
@@ -141,10 +204,16 @@ func (lp *LocalPeer) ConnectPeerDirect(addr string) (*Peer, error) {
 		return nil, err
 	}
 
+	if lp.Server.Bans.IsBanned(peer.Address().String()) {
+		peer.Terminate()
+		return nil, errors.New("Peer is banned")
+	}
+
 	peer.ConnectClient(lp)
 
 	lp.Peers.Set(peer.Address().String(), peer)
 	lp.PublicToZif.Set(addr, peer.Address().String())
+	lp.DHT.Touch(*peer.Address())
 
 	return peer, nil
 }
@@ -175,6 +244,11 @@ func (lp *LocalPeer) ConnectPeer(addr string) (*Peer, error) {
 		return nil, data.AddressResolutionError{addr}
 	}
 
+	// The address may have been succeeded by one we are already connected to.
+	if peer = lp.GetPeer(entry.Address.String()); peer != nil {
+		return peer, nil
+	}
+
 	// now should have an entry for the peer, connect to it!
 	log.Debug("Connecting to ", entry.Address.String())
 
@@ -192,7 +266,7 @@ func (lp *LocalPeer) ConnectPeer(addr string) (*Peer, error) {
 }
 
 func (lp *LocalPeer) SignEntry() {
-	data, _ := lp.Entry.Bytes()
+	data, _ := lp.copyEntry().Bytes()
 	copy(lp.Entry.Signature, ed25519.Sign(lp.privateKey, data))
 }
 
@@ -217,24 +291,39 @@ func (lp *LocalPeer) GenerateKey() {
 	}
 }
 
+// Make sure our entry carries proof of work of at least the given difficulty,
+// generating new work if it does not. This only needs doing once per identity.
+func (lp *LocalPeer) GenerateWork(difficulty int) {
+	if lp.Entry.CheckWork(difficulty) {
+		return
+	}
+
+	log.WithField("difficulty", difficulty).Info("Generating proof of work")
+	lp.Entry.Work = dht.GenerateWork(lp.PublicKey(), difficulty)
+}
+
 // Writes the private key to a file, in this way persisting your identity -
 // all the other addresses can be generated from this, no need to save them.
-// By default this file is "identity.dat"
+// By default this file is "identity.dat", and it is encrypted if Passphrase is
+// set. See identity.go.
 func (lp *LocalPeer) WriteKey() error {
 	if len(lp.privateKey) == 0 {
 		return errors.
 			New("LocalPeer does not have a private key, please generate")
 	}
 
-	err := ioutil.WriteFile("identity.dat", lp.privateKey, 0400)
+	if lp.Passphrase == "" {
+		log.Warn("No passphrase set, identity will be stored unencrypted")
+	}
 
-	return err
+	return WriteIdentity(lp.identityPath(), lp.privateKey, lp.Passphrase)
 }
 
-// Read the private key from file. This is the "identity.dat" file. The public
-// key is also then generated from the private key.
+// Read the private key from file. This is the "identity.dat" file unless
+// IdentityPath is set. The public key is also then generated from the private
+// key.
 func (lp *LocalPeer) ReadKey() error {
-	pk, err := ioutil.ReadFile("identity.dat")
+	pk, err := ReadIdentity(lp.identityPath(), lp.Passphrase)
 
 	if err != nil {
 		return err
@@ -246,13 +335,61 @@ func (lp *LocalPeer) ReadKey() error {
 	return nil
 }
 
+// Resolve a Zif address into an entry. If the owner of the address has moved
+// to a new key, the entry for the new address is returned instead.
 func (lp *LocalPeer) Resolve(addr string) (*Entry, error) {
+	seen := make(map[string]bool)
+
+	for i := 0; i < MaxSuccessionDepth; i++ {
+		entry, err := lp.resolveAddress(addr)
+
+		if err != nil || entry.Successor == nil {
+			return entry, err
+		}
+
+		// An invalid succession is ignored, the old entry is still usable.
+		if err = entry.CheckSuccessor(); err != nil {
+			log.WithField("address", addr).Warn(err.Error())
+			return entry, nil
+		}
+
+		seen[addr] = true
+		addr = entry.Successor.New.String()
+
+		if seen[addr] {
+			return nil, errors.New("Succession loop")
+		}
+
+		log.WithField("address", addr).Info("Following succession")
+	}
+
+	return nil, errors.New("Succession chain too long")
+}
+
+func (lp *LocalPeer) resolveAddress(addr string) (*Entry, error) {
 	log.Debug("Resolving ", addr)
 
 	if addr == lp.Address().String() {
 		return lp.Entry, nil
 	}
 
+	lookup := dht.Lookup{Target: addr, Started: time.Now()}
+
+	entry, err := lp.resolve(addr, &lookup)
+
+	lookup.Duration = time.Since(lookup.Started)
+	lookup.Found = err == nil
+
+	if err != nil {
+		lookup.Error = err.Error()
+	}
+
+	lp.DHT.RecordLookup(lookup)
+
+	return entry, err
+}
+
+func (lp *LocalPeer) resolve(addr string, lookup *dht.Lookup) (*Entry, error) {
 	address := dht.DecodeAddress(addr)
 
 	// If we have the entry stored, then just return it!
@@ -273,11 +410,13 @@ func (lp *LocalPeer) Resolve(addr string) (*Entry, error) {
 	}
 
 	current := make(map[string]bool)
+	queue := make([]workItem, 0, len(closest))
 
 	for _, i := range closest {
 		entry, err := JsonToEntry(i.Value)
 
 		if err != nil {
+			log.Error(err.Error())
 			continue
 		}
 
@@ -286,45 +425,62 @@ func (lp *LocalPeer) Resolve(addr string) (*Entry, error) {
 		}
 
 		current[i.Key.String()] = true
+		queue = append(queue, workItem{entry.PublicAddress + ":" + strconv.Itoa(entry.Port), 1})
 	}
 
 	// Create a worker pool of goroutines working on resolving an address, then
 	// proceed to block on a result.
 
 	workers := 3
-	addresses := make(chan string, dht.BucketSize)
-	results := make(chan workResult, dht.BucketSize*workers)
+	addresses := make(chan workItem)
+	results := make(chan workResult)
+	done := make(chan struct{})
 
-	defer close(results)
+	// Only this function sends on addresses, so it is safe to close. Workers
+	// may still be sending results once we return, done lets them give up.
+	defer close(done)
 	defer close(addresses)
 
 	// Setup the workers
 	for i := 0; i < workers; i++ {
-		go lp.worker(i, addr, addresses, results)
+		go lp.worker(i, addr, addresses, results, done)
 	}
 
-	// Feed in the initial addresses
-	for _, i := range closest {
-		entry, err := JsonToEntry(i.Value)
+	// Hand out addresses to query, and listen for results from workers, feeding
+	// addresses we have not seen before back into the queue. Terminates when we
+	// have found what we are looking for, or when the queue is empty and no
+	// workers are busy.
+	pending := 0
 
-		if err != nil {
-			log.Error(err.Error())
-			log.Info(string(i.Value))
-			continue
+	for len(queue) > 0 || pending > 0 {
+		var next chan<- workItem
+		var item workItem
+
+		if len(queue) > 0 {
+			next = addresses
+			item = queue[0]
 		}
 
-		log.Info("Working on ", entry.Address.String())
-		addresses <- fmt.Sprintf("%s:%s", entry.PublicAddress, entry.Port)
-	}
+		select {
+		case next <- item:
+			log.Info("Working on ", item.address)
+			queue = queue[1:]
+			pending++
+			lookup.Queried++
+
+		case i := <-results:
+			pending--
+
+			if i.hops > lookup.Hops {
+				lookup.Hops = i.hops
+			}
+
+			for _, j := range i.pairs {
+				// If this is a new address we have not yet seen
+				if _, ok := current[j.Key.String()]; ok {
+					continue
+				}
 
-	// Listen for results from workers, feeding addresses we have not seen before
-	// back into the system to be queried. Terminates when we have found what we
-	// are looking for. If all workers return no new results then the search
-	// is terminated.
-	for i := range results {
-		for _, j := range i.pairs {
-			// If this is a new address we have not yet seen
-			if _, ok := current[j.Key.String()]; !ok {
 				entry, err := JsonToEntry(j.Value)
 
 				if err != nil {
@@ -335,11 +491,9 @@ func (lp *LocalPeer) Resolve(addr string) (*Entry, error) {
 					return entry, nil
 				}
 
-				log.Info("Working on ", entry.Address.String())
-				addresses <- fmt.Sprintf("%s:%s", entry.PublicAddress, entry.Port)
-
-				closest = append(closest, j)
 				current[j.Key.String()] = true
+				queue = append(queue, workItem{
+					entry.PublicAddress + ":" + strconv.Itoa(entry.Port), i.hops + 1})
 			}
 		}
 	}
@@ -347,8 +501,15 @@ func (lp *LocalPeer) Resolve(addr string) (*Entry, error) {
 	return nil, errors.New("Failed to resolve entry")
 }
 
+type workItem struct {
+	address string
+	// How many rounds of queries it took to learn of this address.
+	hops int
+}
+
 type workResult struct {
 	id    int
+	hops  int
 	pairs dht.Pairs
 }
 
@@ -357,46 +518,63 @@ type workResult struct {
 // results on. Note that the addresses being passed in via channel are those
 // of public internet addresses and not Zif addresses. They should have
 // already been resolved :)
-func (lp *LocalPeer) worker(id int, address string, addresses <-chan string, results chan<- workResult) {
+// Every address recieved gets exactly one result, even if it is empty.
+func (lp *LocalPeer) worker(id int, address string, addresses <-chan workItem, results chan<- workResult, done <-chan struct{}) {
 
 	// If any errors occur, just skip that peer and attempt to work with the
 	// next. No point terminating if we meet one dodgy peer.
-	seen := make(map[string]bool)
-
 	for i := range addresses {
-		if seen[i] == true {
-			continue
-		}
+		res := workResult{id, i.hops, nil}
 
-		p := lp.GetPeer(i)
-		seen[i] = true
+		var p *Peer
 
-		if p == nil {
-			p = &Peer{}
-
-			err := p.Connect(i, lp)
+		if zif, ok := lp.PublicToZif.Get(i.address); ok {
+			p = lp.GetPeer(zif.(string))
+		}
 
-			if err != nil {
-				continue
-			}
+		if p == nil {
+			p, _ = lp.ConnectPeerDirect(i.address)
+		}
 
+		if p != nil {
 			client, kv, err := p.Query(address)
+			client.Close()
 
 			if err == nil {
-				results <- workResult{id, dht.Pairs{kv}}
+				res.pairs = dht.Pairs{kv}
+			} else {
+				client, pairs, err := p.FindClosest(address)
 				client.Close()
-				return
-			}
 
-			client, res, err := p.FindClosest(address)
+				if err == nil {
+					res.pairs = pairs
+				}
+			}
+		}
 
-			results <- workResult{id, res}
+		select {
+		case results <- res:
+		case <-done:
+			return
 		}
 	}
 }
 
+// A copy of our entry. Handlers add seeds to it as peers register, so anything
+// reading it while we are running should read this instead.
+func (lp *LocalPeer) copyEntry() *Entry {
+	lp.seedMutex.Lock()
+	defer lp.seedMutex.Unlock()
+
+	entry := *lp.Entry
+	entry.Seeds = make([]Seed, len(lp.Entry.Seeds))
+	copy(entry.Seeds, lp.Entry.Seeds)
+
+	return &entry
+}
+
 func (lp *LocalPeer) SaveEntry() error {
-	dat, err := lp.Entry.Json()
+	dat, err := lp.copyEntry().Json()
 
 	if err != nil {
 		return err
@@ -433,23 +611,206 @@ func (lp *LocalPeer) Close() {
 func (lp *LocalPeer) AddPost(p data.Post, store bool) (int64, error) {
 	log.Info("Adding post with title ", p.Title)
 
+	// Posts we add are ours, and are signed as such.
+	p.Author, p.Signature = nil, nil
+
 	valid := p.Valid()
 
 	if valid != nil {
 		return -1, valid
 	}
 
-	lp.Entry.PostCount += 1
+	p.InfoHash, _ = data.NormaliseInfoHash(p.InfoHash)
+	p.Sign(lp)
 
-	lp.Collection.AddPost(p, store)
-	id, err := lp.Database.InsertPost(p)
+	// Publishing a post we deleted brings it back, for mirrors too.
+	tombstone, err := lp.Database.QueryTombstone(p.InfoHash)
+
+	if err != nil {
+		return -1, err
+	}
+
+	if tombstone != nil && tombstone.Deleted() {
+		if err := lp.leaveTombstone(p.InfoHash, p.Signature); err != nil {
+			return -1, err
+		}
+	}
+
+	id, inserted, err := lp.Database.UpsertPost(p)
 
 	if err != nil {
 		return id, err
 	}
 
+	// Merged into a post we already had, so there is nothing new to publish.
+	if !inserted {
+		return id, nil
+	}
+
+	lp.Entry.PostCount += 1
+	lp.Collection.AddPost(p, store)
+
 	lp.SignEntry()
 	err = lp.SaveEntry()
 
 	return id, err
 }
+
+// Replaces the title, size and file count of one of our posts, and adds any
+// tags and metadata given. The post is signed again, and a tombstone left for
+// the version it replaces.
+func (lp *LocalPeer) EditPost(p data.Post) error {
+	log.Info("Editing post with infohash ", p.InfoHash)
+
+	p.Author, p.Signature = nil, nil
+
+	if err := p.Valid(); err != nil {
+		return err
+	}
+
+	p.InfoHash, _ = data.NormaliseInfoHash(p.InfoHash)
+
+	existing, err := lp.Database.QueryInfoHash(p.InfoHash)
+
+	if err != nil {
+		return err
+	}
+
+	if existing == nil {
+		return errors.New("Post not found")
+	}
+
+	// Metadata from a post's own author replaces what is stored, so what is
+	// given is added to what the post has.
+	meta := make(data.Meta)
+	meta.Merge(existing.Meta)
+	meta.Merge(p.Meta)
+	p.Meta = meta
+
+	p.Sign(lp)
+
+	if err := lp.leaveTombstone(p.InfoHash, p.Signature); err != nil {
+		return err
+	}
+
+	if _, _, err := lp.Database.UpsertPost(p); err != nil {
+		return err
+	}
+
+	return lp.RebuildCollection()
+}
+
+// Add a metadata key/value to one of our posts.
+func (lp *LocalPeer) AddMeta(pid int, key, value string) error {
+	return lp.changeMeta(func() error {
+		return lp.Database.AddMeta(pid, key, value)
+	})
+}
+
+// Remove a metadata key/value from one of our posts, or every value for key if
+// value is empty.
+func (lp *LocalPeer) RemoveMeta(pid int, key, value string) error {
+	return lp.changeMeta(func() error {
+		return lp.Database.RemoveMeta(pid, key, value)
+	})
+}
+
+// Meta is part of every post's hash, so the collection changes with it.
+func (lp *LocalPeer) changeMeta(change func() error) error {
+	if err := change(); err != nil {
+		return err
+	}
+
+	return lp.RebuildCollection()
+}
+
+// Removes one of our posts, leaving a tombstone so that mirrors remove it too.
+func (lp *LocalPeer) DeletePost(infohash string) error {
+	log.Info("Deleting post with infohash ", infohash)
+
+	existing, err := lp.Database.QueryInfoHash(infohash)
+
+	if err != nil {
+		return err
+	}
+
+	if existing == nil {
+		return errors.New("Post not found")
+	}
+
+	if err := lp.leaveTombstone(existing.InfoHash, nil); err != nil {
+		return err
+	}
+
+	return lp.RebuildCollection()
+}
+
+// Signs and applies a tombstone for a change to one of our posts. Timestamps
+// only ever go forward for a post, even if changes are made within a second.
+func (lp *LocalPeer) leaveTombstone(infohash string, replacement []byte) error {
+	t := data.Tombstone{
+		InfoHash:    infohash,
+		Timestamp:   time.Now().Unix(),
+		Replacement: replacement,
+	}
+
+	last, err := lp.Database.QueryTombstone(infohash)
+
+	if err != nil {
+		return err
+	}
+
+	if last != nil && last.Timestamp >= t.Timestamp {
+		t.Timestamp = last.Timestamp + 1
+	}
+
+	t.Sign(lp)
+
+	_, err = lp.Database.ApplyTombstone(t, lp.PublicKey())
+
+	return err
+}
+
+// Recreates the collection from the database, as it cannot be changed in
+// place once posts are edited or deleted, then saves it and the entry.
+func (lp *LocalPeer) RebuildCollection() error {
+	col, err := data.CreateCollection(lp.Database, 0, data.PieceSize)
+
+	if err != nil {
+		return err
+	}
+
+	return lp.setCollection(col)
+}
+
+// Builds the collection from the database and, if it does not match the one
+// saved, saves it and signs the entry again. Migrations can merge or drop
+// posts, which leaves the saved collection out of date. Every post is read, so
+// this is only done on startup.
+func (lp *LocalPeer) CheckCollection() error {
+	col, err := data.CreateCollection(lp.Database, 0, data.PieceSize)
+
+	if err != nil {
+		return err
+	}
+
+	if lp.Collection != nil && bytes.Equal(col.HashList, lp.Collection.HashList) {
+		// Kept all the same, as it has the pieces posts are added to.
+		lp.Collection = col
+		return nil
+	}
+
+	log.Info("Collection does not match the database, rebuilding")
+
+	return lp.setCollection(col)
+}
+
+func (lp *LocalPeer) setCollection(col *data.Collection) error {
+	lp.Collection = col
+	lp.Collection.Save("./data/collection.dat")
+
+	lp.Entry.PostCount = int(lp.Database.PostCount())
+	lp.SignEntry()
+
+	return lp.SaveEntry()
+}
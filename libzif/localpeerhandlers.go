@@ -2,10 +2,15 @@ package libzif
 
 import (
 	"bufio"
+	"bytes"
 	"compress/gzip"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"strconv"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	data "github.com/wjh/zif/libzif/data"
@@ -27,43 +32,42 @@ func (lp *LocalPeer) HandleQuery(msg *proto.Message) error {
 	log.Info("Handling query")
 	cl := msg.Client
 
-	//msg.From.limiter.queryLimiter.Wait()
-
 	address := dht.DecodeAddress(string(msg.Content))
 	log.WithField("target", address.String()).Info("Recieved query")
 
-	ok := &proto.Message{Header: proto.ProtoOk}
-	err := cl.WriteMessage(ok)
-
-	if err != nil {
-		return err
-	}
+	var kv *dht.KeyValue
 
 	if address.Equals(lp.Address()) {
 		log.WithField("name", lp.Entry.Name).Debug("Query for local peer")
 
-		var json []byte
-		json, err = lp.Entry.Json()
+		json, err := lp.copyEntry().Json()
 
 		if err != nil {
+			cl.WriteMessage(&proto.Message{Header: proto.ProtoNo})
 			return err
 		}
-		kv := dht.NewKeyValue(lp.Entry.Address, json)
 
-		err = cl.WriteMessage(kv)
+		kv = dht.NewKeyValue(lp.Entry.Address, json)
 
 	} else {
-		kv := &dht.KeyValue{}
+		var err error
 		kv, err = lp.DHT.Query(address)
 
+		// The client is waiting on an answer either way, so tell it we do not
+		// have the address rather than leave it hanging.
 		if err != nil {
+			cl.WriteMessage(&proto.Message{Header: proto.ProtoNo})
 			return err
 		}
+	}
 
-		err = cl.WriteMessage(kv)
+	err := cl.WriteMessage(&proto.Message{Header: proto.ProtoOk})
+
+	if err != nil {
+		return err
 	}
 
-	return err
+	return cl.WriteMessage(kv)
 }
 
 func (lp *LocalPeer) HandleFindClosest(msg *proto.Message) error {
@@ -88,7 +92,7 @@ func (lp *LocalPeer) HandleFindClosest(msg *proto.Message) error {
 	if address.Equals(lp.Address()) {
 		log.WithField("name", lp.Entry.Name).Debug("Query for local peer")
 
-		json, err := lp.Entry.Json()
+		json, err := lp.copyEntry().Json()
 
 		if err != nil {
 			return err
@@ -129,6 +133,23 @@ func (lp *LocalPeer) HandleFindClosest(msg *proto.Message) error {
 	return err
 }
 
+// The IP a peer announcing its own entry connected from, or nothing if the
+// entry was passed on from someone else. Over Tor every connection comes from
+// the local proxy, so nothing is observed.
+func (lp *LocalPeer) observedHost(msg *proto.Message, entry *Entry) string {
+	if lp.Tor || msg.From == nil || !msg.From.Equals(&entry.Address) || msg.Stream == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(msg.Stream.RemoteAddr().String())
+
+	if err != nil {
+		return ""
+	}
+
+	return host
+}
+
 func (lp *LocalPeer) HandleAnnounce(msg *proto.Message) error {
 	cl := proto.NewClient(msg.Stream)
 
@@ -144,7 +165,7 @@ func (lp *LocalPeer) HandleAnnounce(msg *proto.Message) error {
 	}
 
 	json, _ := entry.Json()
-	err = lp.DHT.Insert(dht.NewKeyValue(entry.Address, json))
+	err = lp.DHT.InsertFrom(dht.NewKeyValue(entry.Address, json), lp.observedHost(msg, &entry))
 
 	if err == nil {
 		cl.WriteMessage(&proto.Message{Header: proto.ProtoOk})
@@ -228,7 +249,9 @@ func (lp *LocalPeer) HandleSearch(msg *proto.Message) error {
 
 	posts, err := lp.Database.Search(sq.Query, sq.Page, 25)
 
+	// Most likely a query that does not parse, tell the searcher why.
 	if err != nil {
+		msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoNo, Content: []byte(err.Error())})
 		return err
 	}
 	log.Info("Posts loaded")
@@ -319,7 +342,7 @@ func (lp *LocalPeer) HandleHashList(msg *proto.Message) error {
 	var sig []byte
 
 	if address.Equals(lp.Address()) {
-		sig = lp.Sign(lp.Collection.HashList)
+		sig = lp.Sign(lp.Collection.Hash())
 	} else {
 		// this means that the hash list wanted does not belong to this peer
 		// TODO: sort out getting a hash list for a peer that has been mirrored
@@ -363,7 +386,13 @@ func (lp *LocalPeer) HandlePiece(msg *proto.Message) error {
 
 	} else if lp.Databases.Has(mrp.Address) {
 		db, _ := lp.Databases.Get(mrp.Address)
-		posts = db.(*data.Database).QueryPiecePosts(mrp.Id, mrp.Length, true)
+		col, err := data.LoadCollection(fmt.Sprintf("./data/%s/collection.dat", mrp.Address))
+
+		if err != nil {
+			return err
+		}
+
+		posts = checkedPiecePosts(db.(data.PostStore), col.PieceHashes(), mrp.Id, mrp.Length)
 
 	} else {
 		return errors.New("Piece not found")
@@ -392,35 +421,215 @@ func (lp *LocalPeer) HandlePiece(msg *proto.Message) error {
 	return nil
 }
 
+// Reads posts from a mirror a piece at a time, stopping at the first piece that
+// does not match the collection we mirrored. A mirror can differ from its
+// origin, if the origin has posts we would not store, and those pieces would
+// only fail the requester's hash checks.
+func checkedPiecePosts(db data.PostStore, hashes [][]byte, id, length int) chan *data.Post {
+	ret := make(chan *data.Post, data.PieceSize)
+
+	go func() {
+		defer close(ret)
+
+		posts := db.QueryPiecePosts(id, length, true)
+
+		// Drained if we stop early, so the query does not leak.
+		defer func() {
+			for range posts {
+			}
+		}()
+
+		piece := make([]*data.Post, 0, data.PieceSize)
+		n := id
+
+		send := func() bool {
+			check := data.Piece{}
+			check.Setup()
+
+			for _, i := range piece {
+				check.Add(*i, false)
+			}
+
+			if n >= len(hashes) || !bytes.Equal(hashes[n], check.Hash()) {
+				log.WithField("piece", n).Error("Mirror does not match its collection, not serving")
+				return false
+			}
+
+			for _, i := range piece {
+				ret <- i
+			}
+
+			piece = piece[:0]
+			n++
+
+			return true
+		}
+
+		for post := range posts {
+			piece = append(piece, post)
+
+			if len(piece) == data.PieceSize && !send() {
+				return
+			}
+		}
+
+		if len(piece) > 0 {
+			send()
+		}
+	}()
+
+	return ret
+}
+
+// Sends the tombstones for our own posts, or for a peer we have mirrored.
+func (lp *LocalPeer) HandleTombstones(msg *proto.Message) error {
+	address := dht.Address{Raw: msg.Content}
+
+	log.WithField("address", address.String()).Info("Tombstone request recieved")
+
+	db := lp.Database
+
+	if !address.Equals(lp.Address()) {
+		mirror, ok := lp.Databases.Get(address.String())
+
+		if !ok {
+			msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoNo, Content: []byte("Not mirrored")})
+			return errors.New("Tombstones not found")
+		}
+
+		db = mirror.(data.PostStore)
+	}
+
+	tombstones, err := db.QueryTombstones()
+
+	if err != nil {
+		return err
+	}
+
+	dat, err := json.Marshal(tombstones)
+
+	if err != nil {
+		return err
+	}
+
+	msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoTombstones, Content: dat})
+
+	return nil
+}
+
+// Sends a post and its inclusion proof, for our own collection or one we have
+// mirrored. The root of a mirrored collection was signed by its owner, and
+// that signature was kept when it was mirrored.
+func (lp *LocalPeer) HandlePostProof(msg *proto.Message) error {
+	mrpp := proto.MessageRequestPostProof{}
+
+	if err := msg.Decode(&mrpp); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"address":  mrpp.Address,
+		"infohash": mrpp.InfoHash,
+	}).Info("Post proof request recieved")
+
+	refuse := func(err error) error {
+		msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoNo, Content: []byte(err.Error())})
+		return err
+	}
+
+	var db data.PostStore
+	var col *data.Collection
+	var sig []byte
+
+	if mrpp.Address == lp.Entry.Address.String() {
+		db = lp.Database
+		col = lp.Collection
+		sig = lp.Sign(col.Hash())
+
+	} else if mirror, ok := lp.Databases.Get(mrpp.Address); ok {
+		var err error
+		db = mirror.(data.PostStore)
+		col, err = data.LoadCollection(fmt.Sprintf("./data/%s/collection.dat", mrpp.Address))
+
+		if err != nil {
+			return refuse(err)
+		}
+
+		sig, err = ioutil.ReadFile(fmt.Sprintf("./data/%s/collection.sig", mrpp.Address))
+
+		if err != nil {
+			return refuse(err)
+		}
+
+	} else {
+		return refuse(errors.New("Collection not found"))
+	}
+
+	proof, err := col.Prove(db, mrpp.InfoHash)
+
+	if err != nil {
+		return refuse(err)
+	}
+
+	dat, err := json.Marshal(proto.MessagePostProof{PostProof: *proof, Signature: sig})
+
+	if err != nil {
+		return err
+	}
+
+	msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoPostProof, Content: dat})
+
+	return nil
+}
+
 func (lp *LocalPeer) HandleAddPeer(msg *proto.Message) error {
 	// The AddPeer message contains the address of the peer that the client
-	// wishes to be registered for.
+	// wishes to be registered for. The client itself is the new seed.
+
+	mrap := proto.MessageRequestAddPeer{}
+	err := msg.Decode(&mrap)
 
-	peerFor := string(msg.Content)
+	if err != nil {
+		msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoNo})
+		return err
+	}
 
-	log.Info("Handling add peer request for ", peerFor)
+	log.Info("Handling add peer request for ", mrap.Address)
 
 	// First up, we need the address in binary form
-	address := dht.DecodeAddress(peerFor)
+	address := dht.DecodeAddress(mrap.Address)
 
 	if len(address.Raw) != dht.AddressBinarySize {
 		msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoNo})
 		return errors.New("Invalid binary address size")
 	}
 
+	seed := Seed{
+		Address:    *msg.From,
+		Registered: mrap.Registered,
+		PublicKey:  mrap.PublicKey,
+		Signature:  mrap.Signature,
+	}
+
+	// Keep the attestation if it is valid and recent, otherwise just register
+	// the seed as of now.
+	skew := time.Since(time.Unix(seed.Registered, 0))
+	if skew < -SeedClockSkew || skew > SeedClockSkew || seed.Verify(address) != nil {
+		seed = Seed{Address: *msg.From, Registered: time.Now().Unix()}
+	}
+
 	if address.Equals(lp.Address()) {
-		log.WithField("peer", address.String()).Info("New seed peer")
+		log.WithField("peer", msg.From.String()).Info("New seed peer")
 
-		add := true
+		lp.seedMutex.Lock()
+		lp.Entry.AddSeed(seed)
+		lp.Entry.CullSeeds(time.Now())
+		lp.seedMutex.Unlock()
 
-		for _, i := range lp.Entry.Seeds {
-			if address.Equals(&dht.Address{i}) {
-				add = false
-			}
-		}
+		err = lp.SaveEntry()
 
-		if add {
-			lp.Entry.Seeds = append(lp.Entry.Seeds, address.Bytes())
+		if err != nil {
+			log.Error(err.Error())
 		}
 
 	} else {
@@ -428,23 +637,27 @@ func (lp *LocalPeer) HandleAddPeer(msg *proto.Message) error {
 		kv, err := lp.DHT.Query(address)
 
 		if err != nil {
+			msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoNo})
 			return err
 		}
 
 		decoded, err := JsonToEntry(kv.Value)
 
 		if err != nil {
+			msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoNo})
 			return err
 		}
 
 		// if the routing table contains the address we are looking for,
 		// register a new seed.
 		if decoded.Address.Equals(&address) {
-			decoded.Seeds = append(decoded.Seeds, address.Bytes())
+			decoded.AddSeed(seed)
+			decoded.CullSeeds(time.Now())
 		}
 
 		json, err := decoded.Json()
 		if err != nil {
+			msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoNo})
 			return err
 		}
 
@@ -476,6 +689,7 @@ func (lp *LocalPeer) HandleHandshake(header proto.ConnHeader) (proto.NetworkPeer
 	}
 
 	lp.Peers.Set(peer.Address().String(), peer)
+	lp.DHT.Touch(*peer.Address())
 
 	return peer, nil
 }
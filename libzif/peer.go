@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"time"
 
@@ -20,7 +21,6 @@ import (
 	data "github.com/wjh/zif/libzif/data"
 	"github.com/wjh/zif/libzif/dht"
 	"github.com/wjh/zif/libzif/proto"
-	"github.com/wjh/zif/libzif/util"
 )
 
 type Peer struct {
@@ -29,8 +29,6 @@ type Peer struct {
 	publicKey ed25519.PublicKey
 	streams   proto.StreamManager
 
-	limiter *util.PeerLimiter
-
 	entry *Entry
 
 	// If this peer is acting as a seed for another
@@ -69,7 +67,7 @@ func (p *Peer) Announce(lp *LocalPeer) error {
 
 	defer stream.Close()
 
-	err = stream.Announce(lp.Entry)
+	err = stream.Announce(lp.copyEntry())
 
 	return err
 }
@@ -85,9 +83,6 @@ func (p *Peer) Connect(addr string, lp *LocalPeer) error {
 	p.publicKey = pair.PublicKey
 	p.address = dht.NewAddress(pair.PublicKey)
 
-	p.limiter = &util.PeerLimiter{}
-	p.limiter.Setup()
-
 	return nil
 }
 
@@ -96,9 +91,6 @@ func (p *Peer) SetTCP(header proto.ConnHeader) {
 
 	p.publicKey = header.PublicKey
 	p.address = dht.NewAddress(header.PublicKey)
-
-	p.limiter = &util.PeerLimiter{}
-	p.limiter.Setup()
 }
 
 func (p *Peer) ConnectServer() (*yamux.Session, error) {
@@ -247,6 +239,8 @@ func (p *Peer) Search(search string, page int) (*data.SearchResult, *proto.Clien
 		return nil, nil, err
 	}
 
+	res.Verify()
+
 	return res, &stream, nil
 }
 
@@ -259,7 +253,7 @@ func (p *Peer) Recent(page int) ([]*data.Post, *proto.Client, error) {
 
 	posts, err := stream.Recent(page)
 
-	return posts, &stream, err
+	return data.FilterForged(posts), &stream, err
 
 }
 
@@ -272,15 +266,52 @@ func (p *Peer) Popular(page int) ([]*data.Post, *proto.Client, error) {
 
 	posts, err := stream.Popular(page)
 
-	return posts, &stream, err
+	return data.FilterForged(posts), &stream, err
+
+}
+
+// Fetch one post from the collection this peer serves, with proof that the
+// collection's owner published it. As the proof is checked against the owner's
+// key, a seed can be trusted as much as the owner.
+func (p *Peer) PostProof(infohash string) (*proto.MessagePostProof, *proto.Client, error) {
+	var entry *Entry
+	var err error
+
+	if p.seed {
+		entry = p.seedFor
+	} else {
+		entry, err = p.Entry()
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stream, err := p.OpenStream()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	proof, err := stream.PostProof(entry.Address, infohash, entry.PublicKey)
 
+	return proof, &stream, err
 }
 
-func (p *Peer) Mirror(db *data.Database) (*proto.Client, error) {
+func (p *Peer) Mirror(db data.PostStore, lp *LocalPeer) (*proto.Client, error) {
 	pieces := make(chan *data.Piece, data.PieceSize)
-	defer close(pieces)
+	inserted := make(chan error, 1)
+	closed := false
+
+	defer func() {
+		if !closed {
+			close(pieces)
+		}
+	}()
 
-	go db.InsertPieces(pieces, true)
+	go func() {
+		inserted <- db.InsertPieces(pieces)
+	}()
 
 	log.WithField("peer", p.Address().String()).Info("Mirroring")
 
@@ -303,11 +334,38 @@ func (p *Peer) Mirror(db *data.Database) (*proto.Client, error) {
 
 	mcol, err := stream.Collection(entry.Address, entry.PublicKey)
 
+	if err != nil {
+		return nil, err
+	}
+
+	// The signature is kept so that we can prove posts to others as a seed.
 	collection := data.Collection{HashList: mcol.HashList}
 	collection.Save(fmt.Sprintf("./data/%s/collection.dat", entry.Address.String()))
+	ioutil.WriteFile(fmt.Sprintf("./data/%s/collection.sig", entry.Address.String()), mcol.Signature, 0644)
+
+	// Kept with the collection, so that snapshots of the mirror can be made.
+	if dat, err := entry.Json(); err == nil {
+		ioutil.WriteFile(fmt.Sprintf("./data/%s/entry.json", entry.Address.String()), dat, 0644)
+	}
+
+	// Applied before any pieces, so that posts deleted or edited since the
+	// last mirror do not come back.
+	tombstones, err := stream.Tombstones(entry.Address)
 
 	if err != nil {
-		return nil, err
+		log.Warn("Failed to fetch tombstones: ", err.Error())
+	}
+
+	// Only the owner of the collection can delete or replace its posts.
+	for _, i := range tombstones {
+		if !bytes.Equal(i.Author, entry.PublicKey) {
+			log.WithField("infohash", i.InfoHash).Warn("Skipping tombstone not signed by the owner")
+			continue
+		}
+
+		if _, err := db.ApplyTombstone(*i, entry.PublicKey); err != nil {
+			log.WithField("infohash", i.InfoHash).Warn("Skipping tombstone: ", err.Error())
+		}
 	}
 
 	log.Info("Downloading collection, size ", mcol.Size)
@@ -327,25 +385,77 @@ func (p *Peer) Mirror(db *data.Database) (*proto.Client, error) {
 		if len(pieces) == 100 {
 			log.Info("Piece buffer full, io is blocking")
 		}
-		pieces <- piece
+
+		// InsertPieces only returns early if it fails.
+		select {
+		case pieces <- piece:
+		case err := <-inserted:
+			return nil, err
+		}
 
 		i++
 	}
 
 	bar.Finish()
+
+	if i != mcol.Size {
+		return nil, errors.New("Peer sent too few pieces")
+	}
+
+	// Wait for the last pieces to be stored, so the mirror is searchable as
+	// soon as this returns.
+	close(pieces)
+	closed = true
+
+	if err := <-inserted; err != nil {
+		return nil, err
+	}
+
 	log.Info("Mirror complete")
 
-	p.RequestAddPeer(p.Address().String())
+	// The origin may have posts we would not store, or that merged into one,
+	// and then our pieces would fail hash checks if we served them.
+	mirrored, err := data.CreateCollection(db, 0, data.PieceSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(mirrored.HashList, mcol.HashList) {
+		log.WithField("peer", entry.Address.String()).Warn("Mirror differs from the collection, not registering as a seed")
+		return &stream, nil
+	}
+
+	// The mirror is usable whether or not the peer takes us as a seed.
+	client, seedErr := p.RequestAddPeer(lp, entry.Address.String())
 
-	return &stream, err
+	if client != nil {
+		client.Close()
+	}
+
+	if seedErr != nil {
+		log.Warn("Failed to register as seed: ", seedErr.Error())
+	}
+
+	return &stream, nil
 }
 
-func (p *Peer) RequestAddPeer(addr string) (*proto.Client, error) {
+// Ask this peer to register us as a seed for the entry at addr.
+func (p *Peer) RequestAddPeer(lp *LocalPeer, addr string) (*proto.Client, error) {
 	stream, err := p.OpenStream()
 
 	if err != nil {
 		return nil, err
 	}
 
-	return &stream, stream.RequestAddPeer(addr)
+	seed := lp.SignSeed(dht.DecodeAddress(addr))
+
+	mrap := proto.MessageRequestAddPeer{
+		Address:    addr,
+		Registered: seed.Registered,
+		PublicKey:  seed.PublicKey,
+		Signature:  seed.Signature,
+	}
+
+	return &stream, stream.RequestAddPeer(mrap)
 }
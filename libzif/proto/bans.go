@@ -0,0 +1,177 @@
+// Keeps track of misbehaving peers. Peers that break the rules build up a score,
+// and once that gets too high they are banned for a while. Bans are saved to
+// disk, so restarting does not let anyone off.
+
+package proto
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Added to a peers score for every request over its rate limit.
+	ViolationScore = 10
+	// Added for messages we do not understand.
+	UnknownMessageScore = 25
+	// Once a peer reaches this score it is banned.
+	BanThreshold = 100
+	BanDuration  = time.Hour * 24
+)
+
+type Ban struct {
+	Address string    `json:"address"`
+	Reason  string    `json:"reason"`
+	Expires time.Time `json:"expires"`
+}
+
+type BanList struct {
+	path string
+
+	mutex  sync.Mutex
+	bans   map[string]Ban
+	scores map[string]int
+}
+
+func NewBanList(path string) *BanList {
+	return &BanList{
+		path:   path,
+		bans:   make(map[string]Ban),
+		scores: make(map[string]int),
+	}
+}
+
+// Load a ban list from the given path. If the file does not exist then an
+// empty list is returned, along with the error.
+func LoadBanList(path string) (*BanList, error) {
+	bl := NewBanList(path)
+
+	dat, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return bl, err
+	}
+
+	bans := make([]Ban, 0)
+	err = json.Unmarshal(dat, &bans)
+
+	if err != nil {
+		return bl, err
+	}
+
+	for _, i := range bans {
+		bl.bans[i.Address] = i
+	}
+
+	return bl, nil
+}
+
+// Writes all bans that have not yet expired to disk. Callers must hold the lock.
+func (bl *BanList) save() error {
+	dat, err := json.Marshal(bl.list())
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(bl.path, dat, 0644)
+}
+
+func (bl *BanList) list() []Ban {
+	ret := make([]Ban, 0, len(bl.bans))
+	now := time.Now()
+
+	for k, v := range bl.bans {
+		if now.After(v.Expires) {
+			delete(bl.bans, k)
+			continue
+		}
+
+		ret = append(ret, v)
+	}
+
+	return ret
+}
+
+// Returns all currently active bans.
+func (bl *BanList) List() []Ban {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	return bl.list()
+}
+
+// Ban a peer for the given duration.
+func (bl *BanList) Ban(address string, duration time.Duration, reason string) error {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	log.WithFields(log.Fields{
+		"peer":   address,
+		"reason": reason,
+	}).Warn("Banning peer")
+
+	bl.bans[address] = Ban{address, reason, time.Now().Add(duration)}
+	delete(bl.scores, address)
+
+	return bl.save()
+}
+
+func (bl *BanList) Unban(address string) error {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	delete(bl.bans, address)
+	delete(bl.scores, address)
+
+	return bl.save()
+}
+
+func (bl *BanList) IsBanned(address string) bool {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	ban, ok := bl.bans[address]
+
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(ban.Expires) {
+		delete(bl.bans, address)
+		return false
+	}
+
+	return true
+}
+
+// Add to a peers misbehaviour score, banning it if it passes BanThreshold.
+// Returns true if the peer is now banned.
+func (bl *BanList) Misbehave(address string, score int, reason string) bool {
+	bl.mutex.Lock()
+	bl.scores[address] += score
+	total := bl.scores[address]
+	bl.mutex.Unlock()
+
+	log.WithFields(log.Fields{
+		"peer":   address,
+		"score":  total,
+		"reason": reason,
+	}).Warn("Peer misbehaving")
+
+	if total < BanThreshold {
+		return false
+	}
+
+	err := bl.Ban(address, BanDuration, reason)
+
+	if err != nil {
+		log.Error(err.Error())
+	}
+
+	return true
+}
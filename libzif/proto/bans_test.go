@@ -0,0 +1,47 @@
+package proto_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wjh/zif/libzif/proto"
+)
+
+func TestBanList(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "zif")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "bans.json")
+	bl := proto.NewBanList(path)
+
+	for i := 0; i < proto.BanThreshold/proto.ViolationScore-1; i++ {
+		if bl.Misbehave("Zpeer", proto.ViolationScore, "test") {
+			t.Fatal("Banned before reaching the threshold")
+		}
+	}
+
+	if !bl.Misbehave("Zpeer", proto.ViolationScore, "test") || !bl.IsBanned("Zpeer") {
+		t.Fatal("Not banned after reaching the threshold")
+	}
+
+	bl.Ban("Zexpired", -time.Second, "test")
+
+	loaded, err := proto.LoadBanList(path)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !loaded.IsBanned("Zpeer") || loaded.IsBanned("Zexpired") {
+		t.Error("Bans not persisted correctly")
+	}
+
+	loaded.Unban("Zpeer")
+
+	if loaded.IsBanned("Zpeer") || len(loaded.List()) != 0 {
+		t.Error("Unban failed")
+	}
+}
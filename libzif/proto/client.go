@@ -2,6 +2,7 @@ package proto
 
 import (
 	"compress/gzip"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"net"
@@ -304,6 +305,10 @@ func (c *Client) Search(search string, page int) ([]*data.Post, error) {
 		return nil, err
 	}
 
+	if recv.Header == ProtoNo {
+		return nil, errors.New("Search failed: " + string(recv.Content))
+	}
+
 	err = recv.Decode(&posts)
 
 	if err != nil {
@@ -409,6 +414,98 @@ func (c *Client) Collection(address dht.Address, pk ed25519.PublicKey) (*Message
 	return &mhl, nil
 }
 
+// Download the tombstones for a peer's deleted and edited posts. Each is
+// signed by the author of its post, and is checked when it is applied.
+func (c *Client) Tombstones(address dht.Address) ([]*data.Tombstone, error) {
+	log.WithField("for", address.String()).Info("Sending request for tombstones")
+
+	msg := &Message{
+		Header:  ProtoRequestTombstones,
+		Content: address.Bytes(),
+	}
+
+	if err := c.WriteMessage(msg); err != nil {
+		return nil, err
+	}
+
+	recv, err := c.ReadMessage()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if recv.Header == ProtoNo {
+		return nil, errors.New("Tombstones refused: " + string(recv.Content))
+	}
+
+	var tombstones []*data.Tombstone
+	err = recv.Decode(&tombstones)
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("Recieved ", len(tombstones), " tombstones")
+
+	return tombstones, nil
+}
+
+// Fetch a single post from a peer's collection, along with the proof that it
+// is in it. The proof is checked against pk, the key of the peer the
+// collection belongs to, so it can come from any seed.
+func (c *Client) PostProof(address dht.Address, infohash string, pk ed25519.PublicKey) (*MessagePostProof, error) {
+	log.WithFields(log.Fields{
+		"for":      address.String(),
+		"infohash": infohash,
+	}).Info("Sending request for a post proof")
+
+	mrpp := MessageRequestPostProof{address.String(), infohash}
+	dat, err := mrpp.Encode()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.WriteMessage(&Message{Header: ProtoRequestPostProof, Content: dat}); err != nil {
+		return nil, err
+	}
+
+	recv, err := c.ReadMessage()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if recv.Header == ProtoNo {
+		return nil, errors.New("Proof refused: " + string(recv.Content))
+	}
+
+	mpp := MessagePostProof{}
+
+	if err := recv.Decode(&mpp); err != nil {
+		return nil, err
+	}
+
+	if err := mpp.Verify(pk); err != nil {
+		return nil, err
+	}
+
+	// A valid proof, but for some other post.
+	want, err := data.NormaliseInfoHash(infohash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if got, _ := data.NormaliseInfoHash(mpp.Post.InfoHash); got != want {
+		return nil, errors.New("Proof is for the wrong post")
+	}
+
+	log.Info("Recieved valid post proof")
+
+	return &mpp, nil
+}
+
 // Download a piece from a peer, given the address and id of the piece we want.
 func (c *Client) Pieces(address dht.Address, id, length int) chan *data.Piece {
 	log.WithFields(log.Fields{
@@ -482,12 +579,20 @@ func (c *Client) Pieces(address dht.Address, id, length int) chan *data.Piece {
 				uploaddate := convert(errReader.ReadString('|'))
 				tags := errReader.ReadString('|')
 				meta := errReader.ReadString('|')
+				author, authorErr := hex.DecodeString(errReader.ReadString('|'))
+				signature, signatureErr := hex.DecodeString(errReader.ReadString('|'))
 
 				if errReader.Err != nil {
 					log.Error("Failed to read post: ", errReader.Err.Error())
 					break
 				}
 
+				// The post is still usable unsigned.
+				if authorErr != nil || signatureErr != nil {
+					log.Error("Failed to read post signature")
+					author, signature = nil, nil
+				}
+
 				if err != nil {
 					log.Error(err.Error())
 				}
@@ -502,7 +607,9 @@ func (c *Client) Pieces(address dht.Address, id, length int) chan *data.Piece {
 					Leechers:   leechers,
 					UploadDate: uploaddate,
 					Tags:       tags,
-					Meta:       meta,
+					Meta:       data.ParseMeta(meta),
+					Author:     author,
+					Signature:  signature,
 				}
 
 				piece.Add(post, true)
@@ -515,10 +622,16 @@ func (c *Client) Pieces(address dht.Address, id, length int) chan *data.Piece {
 	return ret
 }
 
-func (c *Client) RequestAddPeer(addr string) error {
+func (c *Client) RequestAddPeer(mrap MessageRequestAddPeer) error {
+	dat, err := mrap.Encode()
+
+	if err != nil {
+		return err
+	}
+
 	msg := &Message{
 		Header:  ProtoRequestAddPeer,
-		Content: []byte(addr),
+		Content: dat,
 	}
 
 	c.WriteMessage(msg)
@@ -7,7 +7,6 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	"github.com/wjh/zif/libzif/data"
-	"github.com/wjh/zif/libzif/dht"
 	"github.com/wjh/zif/libzif/util"
 )
 
@@ -49,23 +48,6 @@ func handshake_recieve(cl Client) (ed25519.PublicKey, error) {
 
 	log.Debug("Receiving handshake")
 
-	/*var short int16 = 0x0000
-	binary.Read(cl.conn, binary.BigEndian, &short)
-
-	if short != ProtoZif {
-		return nil, errors.New("This is not a Zif connection")
-	}
-
-	log.Debug("Zif connection")
-
-	binary.Read(cl.conn, binary.BigEndian, &short)
-
-	if short != ProtoVersion {
-		return nil, errors.New("Incorrect protocol version")
-	}
-
-	log.Debug("Correct version")*/
-
 	header, err := cl.ReadMessage()
 	log.Debug("Read header")
 
@@ -76,14 +58,22 @@ func handshake_recieve(cl Client) (ed25519.PublicKey, error) {
 
 	log.Debug("Header recieved")
 
+	ph, err := ReadProtocolHeader(header.Content)
+
+	if err != nil {
+		// Sent so that the peer knows why, rather than just being refused.
+		cl.WriteMessage(Message{Header: ProtoNo, Content: []byte(err.Error())})
+		check(err)
+		return nil, err
+	}
+
 	err = cl.WriteMessage(Message{Header: ProtoOk})
 
 	if check(err) {
 		return nil, err
 	}
 
-	address := dht.Address{}
-	address.Generate(header.Content)
+	address := ph.Address()
 
 	log.WithFields(log.Fields{"peer": address.String()}).Info("Incoming connection")
 
@@ -108,7 +98,7 @@ func handshake_recieve(cl Client) (ed25519.PublicKey, error) {
 		return nil, err
 	}
 
-	verified := ed25519.Verify(header.Content, cookie, sig.Content)
+	verified := ed25519.Verify(ph.PublicKey[:], cookie, sig.Content)
 
 	if !verified {
 		log.Error("Failed to verify peer ", address.String())
@@ -121,19 +111,16 @@ func handshake_recieve(cl Client) (ed25519.PublicKey, error) {
 
 	log.WithFields(log.Fields{"peer": address.String()}).Info("Verified")
 
-	return header.Content, nil
+	return ph.PublicKey[:], nil
 }
 
 // Sends a handshake to a peer.
 func handshake_send(cl Client, lp data.Signer) error {
 	log.Debug("Handshaking with ", cl.conn.RemoteAddr().String())
 
-	/*binary.Write(cl.conn, binary.BigEndian, ProtoZif)
-	binary.Write(cl.conn, binary.BigEndian, ProtoVersion)*/
-
 	header := Message{
 		Header:  ProtoHeader,
-		Content: lp.PublicKey(),
+		Content: NewProtocolHeader(lp.PublicKey()).Bytes(),
 	}
 
 	err := cl.WriteMessage(header)
@@ -149,6 +136,10 @@ func handshake_send(cl Client, lp data.Signer) error {
 	}
 
 	if !msg.Ok() {
+		if len(msg.Content) > 0 {
+			return errors.New("Peer refused header: " + string(msg.Content))
+		}
+
 		return errors.New("Peer refused header")
 	}
 
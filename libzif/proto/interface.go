@@ -20,6 +20,8 @@ type ProtocolHandler interface {
 	HandleHashList(*Message) error
 	HandlePiece(*Message) error
 	HandleAddPeer(*Message) error
+	HandleTombstones(*Message) error
+	HandlePostProof(*Message) error
 	HandlePing(*Message) error
 
 	HandleHandshake(ConnHeader) (NetworkPeer, error)
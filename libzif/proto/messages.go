@@ -6,6 +6,7 @@ import (
 	"errors"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/wjh/zif/libzif/data"
 	"golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/sha3"
 )
@@ -20,6 +21,18 @@ type MessageCollection struct {
 	Signature []byte
 }
 
+type MessageRequestPostProof struct {
+	Address  string
+	InfoHash string
+}
+
+// A post, with proof that it is in a collection, and the signature of the
+// collection's root.
+type MessagePostProof struct {
+	data.PostProof
+	Signature []byte
+}
+
 type MessageSearchQuery struct {
 	Query string
 	Page  int
@@ -31,6 +44,15 @@ type MessageRequestPiece struct {
 	Length  int
 }
 
+// Sent by a peer that wants to be registered as a seed for Address. The
+// signature is optional, see libzif.SeedAttestation.
+type MessageRequestAddPeer struct {
+	Address    string
+	Registered int64
+	PublicKey  []byte
+	Signature  []byte
+}
+
 // Allows us to decode a pieces without also decoding all of the posts within it.
 type MessagePiece struct {
 	Posts interface{}
@@ -49,21 +71,37 @@ func (mp *MessagePiece) Hash() ([]byte, error) {
 	return hash.Sum(nil), nil
 }
 
+// The root hash is signed, rather than the whole hash list, so that proofs
+// for single posts can be checked against the same signature.
 func (mhl *MessageCollection) Verify(pk ed25519.PublicKey) error {
-	verified := ed25519.Verify(pk, mhl.HashList, mhl.Signature)
+	if len(mhl.HashList) != mhl.Size*32 {
+		return errors.New("Invalid hash list size")
+	}
+
+	col := data.Collection{HashList: mhl.HashList}
+
+	if !bytes.Equal(col.Hash(), mhl.Hash) {
+		return errors.New("Invalid hash list")
+	}
+
+	verified := ed25519.Verify(pk, mhl.Hash, mhl.Signature)
 
 	if !verified {
 		return errors.New("Invalid signature")
 	}
 
-	hash := sha3.New256()
+	return nil
+}
 
-	for i := 0; i < mhl.Size; i++ {
-		hash.Write(mhl.HashList[32*i : (32*i)+32])
+// Checks both that the post is in the collection, and that the collection was
+// signed by pk.
+func (mpp *MessagePostProof) Verify(pk ed25519.PublicKey) error {
+	if err := mpp.PostProof.Verify(); err != nil {
+		return err
 	}
 
-	if !bytes.Equal(hash.Sum(nil), mhl.Hash) {
-		return errors.New("Invalid hash list")
+	if !ed25519.Verify(pk, mpp.Root, mpp.Signature) {
+		return errors.New("Invalid signature")
 	}
 
 	return nil
@@ -83,3 +121,13 @@ func (mrp *MessageRequestPiece) Encode() ([]byte, error) {
 	data, err := json.Marshal(mrp)
 	return data, err
 }
+
+func (mrpp *MessageRequestPostProof) Encode() ([]byte, error) {
+	data, err := json.Marshal(mrpp)
+	return data, err
+}
+
+func (mrap *MessageRequestAddPeer) Encode() ([]byte, error) {
+	data, err := json.Marshal(mrap)
+	return data, err
+}
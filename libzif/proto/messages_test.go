@@ -0,0 +1,68 @@
+package proto_test
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/wjh/zif/libzif/data"
+	"github.com/wjh/zif/libzif/proto"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestMessagePostProof(t *testing.T) {
+	pk, sk, _ := ed25519.GenerateKey(rand.Reader)
+
+	piece := &data.Piece{}
+	piece.Setup()
+	post := data.Post{InfoHash: "9f9165d9a281a9b8e782cd5176bbcc8256fd1871", Title: "Ubuntu"}
+
+	piece.Add(data.Post{Title: "Before"}, true)
+	piece.Add(post, true)
+	piece.Add(data.Post{Title: "After"}, true)
+
+	col := data.NewCollection()
+	col.Add(&data.Piece{})
+	col.Add(piece)
+
+	mhl := proto.MessageCollection{col.Hash(), col.HashList, 2, ed25519.Sign(sk, col.Hash())}
+
+	if err := mhl.Verify(pk); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	mhl.Size = 3
+
+	if mhl.Verify(pk) == nil {
+		t.Error("Collection with the wrong size verified")
+	}
+
+	mpp := proto.MessagePostProof{
+		PostProof: data.PostProof{
+			Post:      post,
+			Piece:     1,
+			Index:     1,
+			PieceSize: piece.Len(),
+			PostPath:  piece.Proof(1),
+			Pieces:    2,
+			PiecePath: data.MerkleProof(col.PieceHashes(), 1),
+			Root:      col.Hash(),
+		},
+		Signature: mhl.Signature,
+	}
+
+	if err := mpp.Verify(pk); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	if mpp.Verify(other) == nil {
+		t.Error("Proof verified with the wrong key")
+	}
+
+	mpp.Post.Seeders = 100
+
+	if mpp.Verify(pk) == nil {
+		t.Error("Changed post verified")
+	}
+}
@@ -1,6 +1,10 @@
 package proto
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
 	"github.com/wjh/zif/libzif/dht"
 	"golang.org/x/crypto/ed25519"
 )
@@ -22,3 +26,61 @@ type ProtocolHeader struct {
 
 	address dht.Address
 }
+
+// The header we send, for the protocol version we speak.
+func NewProtocolHeader(publicKey ed25519.PublicKey) *ProtocolHeader {
+	ph := &ProtocolHeader{}
+
+	binary.BigEndian.PutUint16(ph.Zif[:], uint16(ProtoZif))
+	binary.BigEndian.PutUint16(ph.Version[:], uint16(ProtoVersion))
+	copy(ph.PublicKey[:], publicKey)
+	ph.address.Generate(publicKey)
+
+	return ph
+}
+
+// Reads a header a peer sent, returning an error if it is not Zif or speaks a
+// different version of the protocol.
+func ReadProtocolHeader(b []byte) (*ProtocolHeader, error) {
+	// Before there were versions only the public key was sent.
+	if len(b) == ed25519.PublicKeySize {
+		return nil, errors.New(fmt.Sprintf(
+			"Peer speaks protocol version 0, we speak version %d", ProtoVersion))
+	}
+
+	if len(b) != ProtocolHeaderSize {
+		return nil, errors.New("This is not a Zif connection")
+	}
+
+	ph := &ProtocolHeader{}
+	copy(ph.Zif[:], b[0:2])
+	copy(ph.Version[:], b[2:4])
+	copy(ph.PublicKey[:], b[4:])
+
+	if int16(binary.BigEndian.Uint16(ph.Zif[:])) != ProtoZif {
+		return nil, errors.New("This is not a Zif connection")
+	}
+
+	if version := int16(binary.BigEndian.Uint16(ph.Version[:])); version != ProtoVersion {
+		return nil, errors.New(fmt.Sprintf(
+			"Peer speaks protocol version %d, we speak version %d", version, ProtoVersion))
+	}
+
+	ph.address.Generate(ph.PublicKey[:])
+
+	return ph, nil
+}
+
+func (ph *ProtocolHeader) Bytes() []byte {
+	ret := make([]byte, 0, ProtocolHeaderSize)
+
+	ret = append(ret, ph.Zif[:]...)
+	ret = append(ret, ph.Version[:]...)
+	ret = append(ret, ph.PublicKey[:]...)
+
+	return ret
+}
+
+func (ph *ProtocolHeader) Address() *dht.Address {
+	return &ph.address
+}
@@ -0,0 +1,41 @@
+package proto_test
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/wjh/zif/libzif/proto"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestProtocolHeader(t *testing.T) {
+	pk, _, _ := ed25519.GenerateKey(rand.Reader)
+	header := proto.NewProtocolHeader(pk).Bytes()
+
+	ph, err := proto.ReadProtocolHeader(header)
+
+	if err != nil || string(ph.PublicKey[:]) != string(pk) {
+		t.Fatalf("Header read back as %+v, %v", ph, err)
+	}
+
+	// Peers from before versions sent only their key.
+	if _, err := proto.ReadProtocolHeader(pk); err == nil || !strings.Contains(err.Error(), "version 0") {
+		t.Errorf("Unversioned header gave %v", err)
+	}
+
+	newer := append([]byte{}, header...)
+	binary.BigEndian.PutUint16(newer[2:4], uint16(proto.ProtoVersion+1))
+
+	if _, err := proto.ReadProtocolHeader(newer); err == nil || !strings.Contains(err.Error(), "protocol version") {
+		t.Errorf("Header of another version gave %v", err)
+	}
+
+	other := append([]byte{}, header...)
+	other[0] = 0
+
+	if _, err := proto.ReadProtocolHeader(other); err == nil {
+		t.Error("Read a header that is not Zif")
+	}
+}
@@ -4,9 +4,11 @@ package proto
 
 var (
 	// Protocol header, so we know this is a zif client.
-	// Version should follow.
+	// Version should follow, peers that speak another version are refused.
+	// 1: collections are Merkle trees, and posts carry signatures and
+	// key/value meta, which piece hashes cover.
 	ProtoZif     int16 = 0x7a66
-	ProtoVersion int16 = 0x0000
+	ProtoVersion int16 = 0x0001
 
 	ProtoHeader = 0x0000
 
@@ -29,17 +31,25 @@ var (
 	// This is the peer we are requesting a hash list for.
 	ProtoRequestHashList = 0x0104
 	ProtoRequestPiece    = 0x0105
-	// Requests that this peer be added to the remotes Peers slice for a given
+	// Requests that this peer be added to the remotes Seeds list for a given
 	// entry. This must be called at least once every hour to ensure that the peer
 	// stays registered as a seed, otherwise it is culled.
-	// TODO: Look into how Bittorrent trackers keep peer lists up to date properly.
+	// The content is a MessageRequestAddPeer.
 	ProtoRequestAddPeer = 0x0106
-
-	ProtoEntry    = 0x0200 // An individual DHT entry in Content
-	ProtoPosts    = 0x0201 // A list of posts in Content
-	ProtoHashList = 0x0202
-	ProtoPiece    = 0x0203
-	ProtoPost     = 0x0204
+	// Request the tombstones of deleted and edited posts, for the address in
+	// the content.
+	ProtoRequestTombstones = 0x0107
+	// Request a post and the proof that it is in a collection, the content is
+	// a MessageRequestPostProof.
+	ProtoRequestPostProof = 0x0108
+
+	ProtoEntry      = 0x0200 // An individual DHT entry in Content
+	ProtoPosts      = 0x0201 // A list of posts in Content
+	ProtoHashList   = 0x0202
+	ProtoPiece      = 0x0203
+	ProtoPost       = 0x0204
+	ProtoTombstones = 0x0205
+	ProtoPostProof  = 0x0206
 
 	ProtoDhtQuery       = 0x0300
 	ProtoDhtAnnounce    = 0x0301
@@ -5,6 +5,7 @@ package proto
 import (
 	"io"
 	"net"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -12,8 +13,95 @@ import (
 	"github.com/wjh/zif/libzif/util"
 )
 
+// Limiters that have not been used for this long are dropped. Every bucket has
+// refilled by then, so a new limiter is no more lenient than the old one.
+const LimiterIdle = time.Hour
+
 type Server struct {
 	listener net.Listener
+
+	// If this is nil then nobody is ever banned.
+	Bans *BanList
+
+	// Keyed by peer address, so that a peer cannot reconnect to refill its
+	// buckets.
+	limiters     map[string]*peerLimiter
+	limiterMutex sync.Mutex
+}
+
+type peerLimiter struct {
+	limiter  *util.PeerLimiter
+	lastUsed time.Time
+}
+
+type messageLimit struct {
+	rate  time.Duration
+	burst int
+}
+
+// How often a single peer may send each type of message, and how far it may
+// burst above that. Anything not in here is not limited.
+var messageLimits = map[int]messageLimit{
+	ProtoDhtQuery:       {time.Second / 4, 20},
+	ProtoDhtFindClosest: {time.Second / 4, 20},
+	// Announces are forwarded, so a peer may well pass on many in a row.
+	ProtoDhtAnnounce:       {time.Second * 10, 10},
+	ProtoSearch:            {time.Second, 5},
+	ProtoRecent:            {time.Second, 5},
+	ProtoPopular:           {time.Second, 5},
+	ProtoRequestHashList:   {time.Minute, 5},
+	ProtoRequestPiece:      {time.Second * 5, 10},
+	ProtoRequestAddPeer:    {time.Minute * 10, 3},
+	ProtoRequestTombstones: {time.Minute, 5},
+	ProtoRequestPostProof:  {time.Second, 5},
+	ProtoPing:              {time.Second, 5},
+}
+
+// Create a limiter with a token bucket for each type of message.
+func NewPeerLimiter() *util.PeerLimiter {
+	pl := &util.PeerLimiter{}
+	pl.Setup()
+
+	for k, v := range messageLimits {
+		pl.Add(k, v.rate, v.burst)
+	}
+
+	return pl
+}
+
+// The limiter for the peer at address, made if it does not have one. Idle
+// limiters are evicted whenever a new one is made.
+func (s *Server) Limiter(address string) *util.PeerLimiter {
+	s.limiterMutex.Lock()
+	defer s.limiterMutex.Unlock()
+
+	now := time.Now()
+
+	if s.limiters == nil {
+		s.limiters = make(map[string]*peerLimiter)
+	}
+
+	pl, ok := s.limiters[address]
+
+	if !ok {
+		s.evictLimiters(now)
+
+		pl = &peerLimiter{limiter: NewPeerLimiter()}
+		s.limiters[address] = pl
+	}
+
+	pl.lastUsed = now
+
+	return pl.limiter
+}
+
+func (s *Server) evictLimiters(now time.Time) {
+	for k, v := range s.limiters {
+		if now.Sub(v.lastUsed) > LimiterIdle {
+			v.limiter.Stop()
+			delete(s.limiters, k)
+		}
+	}
 }
 
 func (s *Server) Listen(addr string, handler ProtocolHandler) {
@@ -85,13 +173,33 @@ func (s *Server) HandleStream(peer NetworkPeer, handler ProtocolHandler, stream
 		msg.Client = &cl
 		msg.From = peer.Address()
 
-		s.RouteMessage(msg, handler)
+		s.RouteMessage(peer, msg, handler)
 	}
 }
 
-func (s *Server) RouteMessage(msg *Message, handler ProtocolHandler) {
+// Add to the misbehaviour score of a peer, closing the connection if this gets
+// it banned.
+func (s *Server) misbehave(peer NetworkPeer, score int, reason string) {
+	if s.Bans == nil {
+		return
+	}
+
+	if s.Bans.Misbehave(peer.Address().String(), score, reason) {
+		if session := peer.Session(); session != nil {
+			session.Close()
+		}
+	}
+}
+
+func (s *Server) RouteMessage(peer NetworkPeer, msg *Message, handler ProtocolHandler) {
 	var err error
 
+	if !s.Limiter(peer.Address().String()).Allow(msg.Header) {
+		msg.Client.WriteMessage(&Message{Header: ProtoNo, Content: []byte("Rate limited")})
+		s.misbehave(peer, ViolationScore, "Rate limit exceeded")
+		return
+	}
+
 	switch msg.Header {
 
 	case ProtoDhtAnnounce:
@@ -112,11 +220,16 @@ func (s *Server) RouteMessage(msg *Message, handler ProtocolHandler) {
 		err = handler.HandlePiece(msg)
 	case ProtoRequestAddPeer:
 		err = handler.HandleAddPeer(msg)
+	case ProtoRequestTombstones:
+		err = handler.HandleTombstones(msg)
+	case ProtoRequestPostProof:
+		err = handler.HandlePostProof(msg)
 	case ProtoPing:
 		err = handler.HandlePing(msg)
 
 	default:
 		log.Error("Unknown message type")
+		s.misbehave(peer, UnknownMessageScore, "Unknown message type")
 
 	}
 
@@ -144,6 +257,12 @@ func (s *Server) Handshake(conn net.Conn, lp ProtocolHandler) {
 		return
 	}
 
+	if s.Bans != nil && s.Bans.IsBanned(addr.String()) {
+		log.WithField("peer", addr.String()).Info("Refusing banned peer")
+		cl.Close()
+		return
+	}
+
 	peer, err := lp.HandleHandshake(ConnHeader{cl, header})
 
 	if err != nil {
@@ -158,4 +277,13 @@ func (s *Server) Close() {
 	if s.listener != nil {
 		s.listener.Close()
 	}
+
+	s.limiterMutex.Lock()
+	defer s.limiterMutex.Unlock()
+
+	for _, i := range s.limiters {
+		i.limiter.Stop()
+	}
+
+	s.limiters = nil
 }
@@ -0,0 +1,26 @@
+package proto_test
+
+import (
+	"testing"
+
+	"github.com/wjh/zif/libzif/proto"
+)
+
+func TestServerLimiter(t *testing.T) {
+	var s proto.Server
+	defer s.Close()
+
+	limiter := s.Limiter("Zpeer")
+
+	for limiter.Allow(proto.ProtoRequestAddPeer) {
+	}
+
+	// Reconnecting does not refill the buckets.
+	if again := s.Limiter("Zpeer"); again != limiter || again.Allow(proto.ProtoRequestAddPeer) {
+		t.Error("Peer given a fresh limiter")
+	}
+
+	if !s.Limiter("Zother").Allow(proto.ProtoRequestAddPeer) {
+		t.Error("Peers share a limiter")
+	}
+}
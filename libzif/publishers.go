@@ -0,0 +1,51 @@
+package libzif
+
+import (
+	data "github.com/wjh/zif/libzif/data"
+)
+
+// A peer that has published an infohash, along with its post for it.
+type Publisher struct {
+	Address string     `json:"address"`
+	Post    *data.Post `json:"post"`
+}
+
+// Look through our own database and those of every peer we have mirrored, and
+// return each that has a post for the given infohash.
+func (lp *LocalPeer) Publishers(infohash string) ([]Publisher, error) {
+	hash, err := data.NormaliseInfoHash(infohash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]Publisher, 0)
+
+	check := func(address string, db data.PostStore) error {
+		post, err := db.QueryInfoHash(hash)
+
+		if err != nil {
+			return err
+		}
+
+		if post != nil {
+			ret = append(ret, Publisher{address, post})
+		}
+
+		return nil
+	}
+
+	if lp.Database != nil {
+		if err := check(lp.Address().String(), lp.Database); err != nil {
+			return nil, err
+		}
+	}
+
+	for k, v := range lp.Databases.Items() {
+		if err := check(k, v.(data.PostStore)); err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
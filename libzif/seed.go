@@ -0,0 +1,209 @@
+// Seeds are peers that have mirrored another peers collection, and so can serve
+// it if the origin is offline. They must re-register at least every
+// SeedLifetime, otherwise they are culled from the entry.
+
+package libzif
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/wjh/zif/libzif/dht"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	SeedLifetime = time.Hour
+	// Re-register well within the lifetime, so that one missed attempt does
+	// not get us culled.
+	SeedRegisterInterval = SeedLifetime / 3
+	// How far the registration time in an attestation may be from our clock.
+	SeedClockSkew = time.Minute * 10
+)
+
+type Seed struct {
+	Address dht.Address `json:"address"`
+	// Unix time of the last registration.
+	Registered int64 `json:"registered"`
+
+	// Optional. If present the seed has signed that it seeds this entry as of
+	// Registered, so anyone can verify the record rather than trusting whoever
+	// relayed the entry.
+	PublicKey []byte `json:"publicKey,omitempty"`
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// The bytes a seed signs to attest that it seeds the given entry.
+func SeedAttestation(entry, seed dht.Address, registered int64) []byte {
+	buf := bytes.Buffer{}
+
+	buf.WriteString("seed")
+	buf.Write(entry.Raw)
+	buf.Write(seed.Raw)
+	buf.WriteString(strconv.FormatInt(registered, 10))
+
+	return buf.Bytes()
+}
+
+// Entries used to store seeds as a plain list of addresses. Accept those too,
+// with no registration time they are culled on the next pass.
+func (s *Seed) UnmarshalJSON(dat []byte) error {
+	var legacy []byte
+
+	if err := json.Unmarshal(dat, &legacy); err == nil {
+		s.Address = dht.Address{Raw: legacy}
+		return nil
+	}
+
+	type seed Seed
+	return json.Unmarshal(dat, (*seed)(s))
+}
+
+func (s *Seed) Signed() bool {
+	return len(s.Signature) > 0
+}
+
+// Check the attestation of a seed for the given entry address.
+func (s *Seed) Verify(entry dht.Address) error {
+	if len(s.PublicKey) != ed25519.PublicKeySize {
+		return errors.New("Seed public key invalid")
+	}
+
+	address := dht.NewAddress(s.PublicKey)
+
+	if !address.Equals(&s.Address) {
+		return errors.New("Seed address does not match public key")
+	}
+
+	if !ed25519.Verify(s.PublicKey, SeedAttestation(entry, s.Address, s.Registered), s.Signature) {
+		return errors.New("Failed to verify seed signature")
+	}
+
+	return nil
+}
+
+func (s *Seed) Expired(now time.Time) bool {
+	return now.Sub(time.Unix(s.Registered, 0)) > SeedLifetime
+}
+
+// Add or refresh a seed, returning true if it was not previously in the list.
+func (e *Entry) AddSeed(seed Seed) bool {
+	for n, i := range e.Seeds {
+		if i.Address.Equals(&seed.Address) {
+			if seed.Registered > i.Registered {
+				e.Seeds[n] = seed
+			}
+
+			return false
+		}
+	}
+
+	e.Seeds = append(e.Seeds, seed)
+
+	return true
+}
+
+// Remove all seeds that have not re-registered within SeedLifetime. Returns the
+// number removed.
+func (e *Entry) CullSeeds(now time.Time) int {
+	kept := make([]Seed, 0, len(e.Seeds))
+
+	for _, i := range e.Seeds {
+		if !i.Expired(now) {
+			kept = append(kept, i)
+		}
+	}
+
+	culled := len(e.Seeds) - len(kept)
+	e.Seeds = kept
+
+	return culled
+}
+
+// Create a signed seed record, saying that we seed the given entry.
+func (lp *LocalPeer) SignSeed(entry dht.Address) Seed {
+	registered := time.Now().Unix()
+
+	return Seed{
+		Address:    *lp.Address(),
+		Registered: registered,
+		PublicKey:  lp.PublicKey(),
+		Signature:  lp.Sign(SeedAttestation(entry, *lp.Address(), registered)),
+	}
+}
+
+// Periodically cull our own seed list, and re-register as a seed with every
+// peer we have mirrored. This blocks, so should be run in a goroutine.
+func (lp *LocalPeer) MaintainSeeds() {
+	ticker := time.NewTicker(SeedRegisterInterval)
+	defer ticker.Stop()
+
+	for {
+		lp.cullSeeds()
+		lp.registerSeeds()
+
+		<-ticker.C
+	}
+}
+
+func (lp *LocalPeer) cullSeeds() {
+	lp.seedMutex.Lock()
+	culled := lp.Entry.CullSeeds(time.Now())
+	lp.seedMutex.Unlock()
+
+	if culled == 0 {
+		return
+	}
+
+	log.WithField("count", culled).Info("Culled expired seeds")
+
+	err := lp.SaveEntry()
+
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
+
+func (lp *LocalPeer) registerSeeds() {
+	for addr := range lp.Databases.Items() {
+		peer := lp.GetPeer(addr)
+
+		if peer == nil {
+			var err error
+			peer, err = lp.ConnectPeer(addr)
+
+			if err != nil {
+				log.WithField("peer", addr).Info("Failed to re-register as seed")
+				continue
+			}
+		}
+
+		// The peer may have moved to a new key, in which case we follow it,
+		// but only if the old key says so.
+		if current := peer.Address().String(); current != addr {
+			if err := lp.followSuccession(addr, current); err != nil {
+				log.WithFields(log.Fields{
+					"peer":    addr,
+					"current": current,
+				}).Warn("Peer has a different address, not following: ", err.Error())
+				continue
+			}
+
+			addr = current
+		}
+
+		stream, err := peer.RequestAddPeer(lp, addr)
+
+		if stream != nil {
+			stream.Close()
+		}
+
+		if err != nil {
+			log.WithField("peer", addr).Info("Failed to re-register as seed")
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package libzif
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/wjh/zif/libzif/dht"
+)
+
+func TestSeedLegacyJson(t *testing.T) {
+	raw := make([]byte, dht.AddressBinarySize)
+	raw[0] = 1
+
+	dat, _ := json.Marshal(struct {
+		Seeds [][]byte `json:"seeds"`
+	}{[][]byte{raw}})
+
+	entry, err := JsonToEntry(dat)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(entry.Seeds) != 1 || !entry.Seeds[0].Address.Equals(&dht.Address{Raw: raw}) {
+		t.Fatal("Legacy seed not decoded")
+	}
+
+	if entry.CullSeeds(time.Now()) != 1 || len(entry.Seeds) != 0 {
+		t.Error("Legacy seed not culled")
+	}
+}
+
+func TestSeedAttestation(t *testing.T) {
+	var lp LocalPeer
+	lp.GenerateKey()
+	lp.Address().Generate(lp.PublicKey())
+
+	target := dht.NewAddress(make([]byte, 32))
+	seed := lp.SignSeed(target)
+
+	if err := seed.Verify(target); err != nil {
+		t.Error(err.Error())
+	}
+
+	if err := seed.Verify(*lp.Address()); err == nil {
+		t.Error("Attestation verified for the wrong entry")
+	}
+
+	entry := Entry{}
+	if !entry.AddSeed(seed) || entry.AddSeed(seed) {
+		t.Error("Seed added twice")
+	}
+}
@@ -0,0 +1,633 @@
+// A snapshot is a gzipped tar archive holding everything needed to check a
+// peer's posts without asking anyone: its entry, which carries its public key,
+// the hash list of its collection and its signature over it, its tombstones,
+// and its posts in collection order. Snapshots can be passed around by hand,
+// kept as backups, and imported as mirrors once they have been verified.
+
+package libzif
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	data "github.com/wjh/zif/libzif/data"
+	"github.com/wjh/zif/libzif/dht"
+	"github.com/wjh/zif/libzif/proto"
+)
+
+// Files in a snapshot, in the order they are written. Posts come last so that
+// they can be checked as they are read.
+const (
+	snapshotEntry      = "entry.json"
+	snapshotCollection = "collection.dat"
+	snapshotSignature  = "collection.sig"
+	snapshotTombstones = "tombstones.json"
+	snapshotPosts      = "posts.jsonl"
+)
+
+// Everything but the posts is read into memory, so is kept small.
+const snapshotHeaderMax = 64 * 1024 * 1024
+
+type SnapshotInfo struct {
+	Address    string `json:"address"`
+	Name       string `json:"name"`
+	Posts      int    `json:"posts"`
+	Pieces     int    `json:"pieces"`
+	Tombstones int    `json:"tombstones"`
+}
+
+// Checks posts against a hash list as they come, a piece at a time.
+type pieceChecker struct {
+	hashes [][]byte
+	piece  *data.Piece
+	n      int
+}
+
+func newPieceChecker(col *data.Collection) *pieceChecker {
+	pc := &pieceChecker{hashes: col.PieceHashes()}
+	pc.reset()
+
+	return pc
+}
+
+func (pc *pieceChecker) reset() {
+	pc.piece = &data.Piece{}
+	pc.piece.Setup()
+}
+
+// Returns the piece once it is full and matches the hash list.
+func (pc *pieceChecker) add(post data.Post) (*data.Piece, error) {
+	pc.piece.Add(post, true)
+
+	if pc.piece.Len() < data.PieceSize {
+		return nil, nil
+	}
+
+	return pc.check()
+}
+
+func (pc *pieceChecker) check() (*data.Piece, error) {
+	if pc.n >= len(pc.hashes) || !bytes.Equal(pc.hashes[pc.n], pc.piece.Hash()) {
+		return nil, fmt.Errorf("Piece %d does not match the collection", pc.n)
+	}
+
+	piece := pc.piece
+	pc.n++
+	pc.reset()
+
+	return piece, nil
+}
+
+// Checks the last piece, and that no pieces are missing.
+func (pc *pieceChecker) finish() (*data.Piece, error) {
+	var piece *data.Piece
+	var err error
+
+	if pc.piece.Len() > 0 {
+		if piece, err = pc.check(); err != nil {
+			return nil, err
+		}
+	}
+
+	if pc.n != len(pc.hashes) {
+		return nil, errors.New("Posts are missing from the collection")
+	}
+
+	return piece, nil
+}
+
+// The database, collection, signature and entry for our own posts, or for a
+// peer we have mirrored. Our own collection is built afresh, so that it
+// matches the database exactly.
+func (lp *LocalPeer) snapshotSource(address string) (data.PostStore, *data.Collection, []byte, *Entry, error) {
+	if address == "" || address == lp.Address().String() {
+		col, err := data.CreateCollection(lp.Database, 0, data.PieceSize)
+
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+
+		return lp.Database, col, lp.Sign(col.Hash()), lp.copyEntry(), nil
+	}
+
+	db, ok := lp.Databases.Get(address)
+
+	if !ok {
+		return nil, nil, nil, nil, errors.New("Peer database not loaded.")
+	}
+
+	dir := fmt.Sprintf("./data/%s", address)
+	col, err := data.LoadCollection(filepath.Join(dir, snapshotCollection))
+
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	sig, err := ioutil.ReadFile(filepath.Join(dir, snapshotSignature))
+
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	// Mirrors made before entries were kept need the entry looked up.
+	var entry *Entry
+	dat, err := ioutil.ReadFile(filepath.Join(dir, snapshotEntry))
+
+	if err == nil {
+		entry, err = JsonToEntry(dat)
+	} else {
+		entry, err = lp.Resolve(address)
+	}
+
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	return db.(data.PostStore), col, sig, entry, nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, r)
+
+	return err
+}
+
+// Writes a snapshot of our own posts, or of a peer we have mirrored, if
+// address is not empty. A mirror whose posts have changed since its collection
+// was fetched cannot be snapshotted, and needs mirroring again.
+func (lp *LocalPeer) WriteSnapshot(w io.Writer, address string) (*SnapshotInfo, error) {
+	db, col, sig, entry, err := lp.snapshotSource(address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	info := &SnapshotInfo{Address: entry.Address.String(), Name: entry.Name,
+		Pieces: len(col.PieceHashes())}
+
+	// Tar needs sizes up front, so posts go to a file first. They are checked
+	// against the collection on the way.
+	tmp, err := ioutil.TempFile("", "zif-snapshot")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	bw := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(bw)
+	checker := newPieceChecker(col)
+
+	err = data.EachPost(db, nil, func(p *data.Post) error {
+		info.Posts++
+
+		if _, err := checker.add(*p); err != nil {
+			return err
+		}
+
+		return encoder.Encode(p)
+	})
+
+	if err == nil {
+		_, err = checker.finish()
+	}
+
+	if err == nil {
+		err = bw.Flush()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := db.QueryTombstones()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// A mirror may hold tombstones by others from before they were checked,
+	// and a snapshot with any of them would not verify.
+	tombstones := make([]*data.Tombstone, 0, len(stored))
+
+	for _, i := range stored {
+		if i.CheckOwner(entry.PublicKey) == nil {
+			tombstones = append(tombstones, i)
+		}
+	}
+
+	info.Tombstones = len(tombstones)
+
+	entryJson, err := entry.Json()
+
+	if err != nil {
+		return nil, err
+	}
+
+	tombstonesJson, err := json.Marshal(tombstones)
+
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	gzw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gzw)
+
+	files := []struct {
+		name string
+		dat  []byte
+	}{
+		{snapshotEntry, entryJson},
+		{snapshotCollection, col.HashList},
+		{snapshotSignature, sig},
+		{snapshotTombstones, tombstonesJson},
+	}
+
+	for _, i := range files {
+		if err := writeTarFile(tw, i.name, int64(len(i.dat)), bytes.NewReader(i.dat)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writeTarFile(tw, snapshotPosts, size, tmp); err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	return info, gzw.Close()
+}
+
+// A snapshot that has been read as far as its posts.
+type snapshotReader struct {
+	tr         *tar.Reader
+	entry      *Entry
+	collection *data.Collection
+	signature  []byte
+	tombstones []*data.Tombstone
+}
+
+// Reads and checks everything before the posts. The entry must be validly
+// signed and match its address, and the collection and every tombstone must be
+// signed by it.
+func openSnapshot(r io.Reader) (*snapshotReader, error) {
+	gzr, err := gzip.NewReader(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sr := &snapshotReader{tr: tar.NewReader(gzr)}
+
+	for _, name := range []string{snapshotEntry, snapshotCollection, snapshotSignature, snapshotTombstones} {
+		header, err := sr.tr.Next()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if header.Name != name {
+			return nil, fmt.Errorf("Expected %s in snapshot, found %s", name, header.Name)
+		}
+
+		dat, err := ioutil.ReadAll(io.LimitReader(sr.tr, snapshotHeaderMax))
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch name {
+		case snapshotEntry:
+			sr.entry, err = JsonToEntry(dat)
+		case snapshotCollection:
+			if len(dat)%32 != 0 {
+				err = errors.New("Invalid collection data file")
+			}
+
+			sr.collection = &data.Collection{HashList: dat}
+		case snapshotSignature:
+			sr.signature = dat
+		case snapshotTombstones:
+			err = json.Unmarshal(dat, &sr.tombstones)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := sr.entry.Validate(); err != nil {
+		return nil, err
+	}
+
+	address := dht.NewAddress(sr.entry.PublicKey)
+
+	if !address.Equals(&sr.entry.Address) {
+		return nil, errors.New("Entry address does not match public key")
+	}
+
+	col := proto.MessageCollection{
+		Hash:      sr.collection.Hash(),
+		HashList:  sr.collection.HashList,
+		Size:      len(sr.collection.PieceHashes()),
+		Signature: sr.signature,
+	}
+
+	if err := col.Verify(sr.entry.PublicKey); err != nil {
+		return nil, err
+	}
+
+	for _, i := range sr.tombstones {
+		if err := i.CheckOwner(sr.entry.PublicKey); err != nil {
+			return nil, fmt.Errorf("Tombstone for %s: %s", i.InfoHash, err.Error())
+		}
+	}
+
+	header, err := sr.tr.Next()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Name != snapshotPosts {
+		return nil, fmt.Errorf("Expected %s in snapshot, found %s", snapshotPosts, header.Name)
+	}
+
+	return sr, nil
+}
+
+// Reads posts, checking every piece against the signed collection. Pieces are
+// sent to pieces as they are checked, if it is not nil, and it is closed once
+// every post has been read.
+func (sr *snapshotReader) readPosts(pieces chan<- *data.Piece) (int, error) {
+	if pieces != nil {
+		defer close(pieces)
+	}
+
+	scanner := bufio.NewScanner(sr.tr)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	checker := newPieceChecker(sr.collection)
+	count := 0
+
+	send := func(piece *data.Piece) {
+		if piece != nil && pieces != nil {
+			pieces <- piece
+		}
+	}
+
+	for scanner.Scan() {
+		var post data.Post
+
+		if err := json.Unmarshal(scanner.Bytes(), &post); err != nil {
+			return count, err
+		}
+
+		count++
+
+		piece, err := checker.add(post)
+
+		if err != nil {
+			return count, err
+		}
+
+		send(piece)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return count, err
+	}
+
+	piece, err := checker.finish()
+
+	if err != nil {
+		return count, err
+	}
+
+	send(piece)
+
+	return count, nil
+}
+
+func (sr *snapshotReader) info(posts int) *SnapshotInfo {
+	return &SnapshotInfo{
+		Address:    sr.entry.Address.String(),
+		Name:       sr.entry.Name,
+		Posts:      posts,
+		Pieces:     len(sr.collection.PieceHashes()),
+		Tombstones: len(sr.tombstones),
+	}
+}
+
+// Checks a snapshot without storing anything, see openSnapshot. Needs nothing
+// but the snapshot itself.
+func VerifySnapshot(r io.Reader) (*SnapshotInfo, error) {
+	sr, err := openSnapshot(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	posts, err := sr.readPosts(nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sr.info(posts), nil
+}
+
+// Imports a snapshot as a mirror of the peer it is of. The whole snapshot is
+// verified before anything is stored, so it is read from a file rather than a
+// stream. Snapshots of our own posts are refused, their posts.jsonl can be
+// imported with ImportPosts instead.
+func (lp *LocalPeer) ImportSnapshot(path string) (*SnapshotInfo, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	if _, err := VerifySnapshot(file); err != nil {
+		return nil, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	sr, err := openSnapshot(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	address := sr.entry.Address.String()
+
+	if address == lp.Address().String() {
+		return nil, errors.New("Snapshot is of our own posts, import its posts.jsonl instead")
+	}
+
+	// Imported into a fresh mirror first, so that posts an existing mirror has
+	// but the snapshot does not are gone, and a failed import leaves it as it was.
+	os.MkdirAll("./data", 0777)
+	tmp, err := ioutil.TempDir("./data", address+".import")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.RemoveAll(tmp)
+
+	posts, err := storeSnapshot(sr, tmp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lp.replaceMirror(address, tmp); err != nil {
+		return nil, err
+	}
+
+	log.WithField("address", address).Info("Imported snapshot")
+
+	return sr.info(posts), nil
+}
+
+// Writes a verified snapshot out as a mirror in dir, as it would be kept under
+// ./data. The database is closed again once done.
+func storeSnapshot(sr *snapshotReader, dir string) (int, error) {
+	db := data.NewDatabase(filepath.Join(dir, "posts.db"))
+
+	if err := db.Connect(); err != nil {
+		return 0, err
+	}
+
+	defer db.Close()
+
+	// As when mirroring, tombstones go first so that deleted posts stay gone.
+	// Every one was checked against the entry by openSnapshot.
+	for _, i := range sr.tombstones {
+		if _, err := db.ApplyTombstone(*i, sr.entry.PublicKey); err != nil {
+			log.WithField("infohash", i.InfoHash).Warn("Skipping tombstone: ", err.Error())
+		}
+	}
+
+	pieces := make(chan *data.Piece, 2)
+	inserted := make(chan error, 1)
+
+	go func() {
+		inserted <- db.InsertPieces(pieces)
+
+		// Drained so that reading can finish if storing failed.
+		for range pieces {
+		}
+	}()
+
+	posts, err := sr.readPosts(pieces)
+
+	if ierr := <-inserted; err == nil {
+		err = ierr
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, snapshotCollection), sr.collection.HashList, 0644); err != nil {
+		return 0, err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, snapshotSignature), sr.signature, 0644); err != nil {
+		return 0, err
+	}
+
+	entryJson, err := sr.entry.Json()
+
+	if err != nil {
+		return 0, err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, snapshotEntry), entryJson, 0644); err != nil {
+		return 0, err
+	}
+
+	return posts, nil
+}
+
+// Puts the mirror in dir in place of whatever we hold for address, and loads
+// it. The old mirror is only removed once the new one is in place.
+func (lp *LocalPeer) replaceMirror(address, dir string) error {
+	path := filepath.Join("./data", address)
+	old := path + ".old"
+
+	if existing, ok := lp.Databases.Get(address); ok {
+		if closer, ok := existing.(*data.Database); ok {
+			closer.Close()
+		}
+
+		lp.Databases.Remove(address)
+	}
+
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Rename(dir, path); err != nil {
+		os.Rename(old, path)
+		return err
+	}
+
+	os.RemoveAll(old)
+
+	db := data.NewDatabase(filepath.Join(path, "posts.db"))
+
+	if err := db.Connect(); err != nil {
+		return err
+	}
+
+	lp.Databases.Set(address, db)
+
+	return nil
+}
@@ -0,0 +1,199 @@
+package libzif
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wjh/zif/libzif/data"
+	"golang.org/x/crypto/ed25519"
+)
+
+// A peer with a signed entry and more than a piece of posts.
+func snapshotPeer(t *testing.T) (*LocalPeer, func()) {
+	lp, done := federatedPeer(t)
+
+	lp.Address().Generate(lp.PublicKey())
+	lp.Entry = &Entry{Name: "Snapshot", PublicAddress: "127.0.0.1", Port: DefaultPort,
+		Signature: make([]byte, ed25519.SignatureSize)}
+	lp.Entry.SetLocalPeer(lp)
+	lp.SignEntry()
+	lp.Collection = data.NewCollection()
+
+	for i := 1; i <= data.PieceSize+10; i++ {
+		if _, err := lp.AddPost(data.Post{InfoHash: fmt.Sprintf("a%039x", i),
+			Title: fmt.Sprintf("Post %d", i)}, false); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	return lp, done
+}
+
+// Rewrites a snapshot with one of its files replaced.
+func replaceSnapshotFile(t *testing.T, snapshot []byte, name string, dat []byte) []byte {
+	gzr, err := gzip.NewReader(bytes.NewReader(snapshot))
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tr := tar.NewReader(gzr)
+	tw := tar.NewWriter(gzw)
+
+	for {
+		header, err := tr.Next()
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		content, _ := ioutil.ReadAll(tr)
+
+		if header.Name == name {
+			content = dat
+			header.Size = int64(len(dat))
+		}
+
+		tw.WriteHeader(header)
+		tw.Write(content)
+	}
+
+	tw.Close()
+	gzw.Close()
+
+	return buf.Bytes()
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zif-snapshot")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Posts are added and snapshots imported under ./data.
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+	os.Mkdir("data", 0777)
+
+	lp, done := snapshotPeer(t)
+	defer done()
+
+	var buf bytes.Buffer
+
+	info, err := lp.WriteSnapshot(&buf, "")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if info.Posts != data.PieceSize+10 || info.Pieces != 2 || info.Address != lp.Address().String() {
+		t.Errorf("Snapshot is %+v", info)
+	}
+
+	snapshot := buf.Bytes()
+
+	if _, err := VerifySnapshot(bytes.NewReader(snapshot)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Changing any post breaks the snapshot.
+	gzr, _ := gzip.NewReader(bytes.NewReader(snapshot))
+	raw, _ := ioutil.ReadAll(gzr)
+	forged := bytes.Replace(raw, []byte(`"Post 500"`), []byte(`"Post 501"`), 1)
+
+	var forgedGz bytes.Buffer
+	gzw := gzip.NewWriter(&forgedGz)
+	gzw.Write(forged)
+	gzw.Close()
+
+	if _, err := VerifySnapshot(&forgedGz); err == nil || !strings.Contains(err.Error(), "Piece 0") {
+		t.Errorf("Forged snapshot gave %v", err)
+	}
+
+	// As does a tombstone from anyone but the owner.
+	stranger, strangerDone := federatedPeer(t)
+	defer strangerDone()
+
+	tombstone := data.Tombstone{InfoHash: fmt.Sprintf("a%039x", 1), Timestamp: 1}
+	tombstone.Sign(stranger)
+	tombstones, _ := json.Marshal([]*data.Tombstone{&tombstone})
+
+	forgedTombstone := replaceSnapshotFile(t, snapshot, snapshotTombstones, tombstones)
+
+	if _, err := VerifySnapshot(bytes.NewReader(forgedTombstone)); err == nil || !strings.Contains(err.Error(), "Tombstone") {
+		t.Errorf("Snapshot with a stranger's tombstone gave %v", err)
+	}
+
+	other, done := federatedPeer(t)
+	defer done()
+
+	other.Address().Generate(other.PublicKey())
+
+	path := filepath.Join(dir, "snapshot.tar.gz")
+	ioutil.WriteFile(path, snapshot, 0644)
+
+	if _, err := lp.ImportSnapshot(path); err == nil {
+		t.Error("Imported a snapshot of our own posts")
+	}
+
+	info, err = other.ImportSnapshot(path)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	mirror, ok := other.Databases.Get(lp.Address().String())
+
+	if !ok || mirror.(data.PostStore).PostCount() != uint(info.Posts) {
+		t.Fatalf("Mirror not loaded after import, %+v", info)
+	}
+
+	// Importing again replaces the mirror, rather than merging into it.
+	stale := data.Post{InfoHash: fmt.Sprintf("b%039x", 1), Title: "Stale"}
+
+	if _, err := mirror.(data.PostStore).InsertPost(stale); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err := other.ImportSnapshot(path); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	mirror, _ = other.Databases.Get(lp.Address().String())
+
+	if mirror.(data.PostStore).PostCount() != uint(info.Posts) {
+		t.Errorf("Stale post kept after import, %d posts", mirror.(data.PostStore).PostCount())
+	}
+
+	if leftover, _ := filepath.Glob("data/" + lp.Address().String() + ".*"); len(leftover) > 0 {
+		t.Errorf("Import left %v behind", leftover)
+	}
+
+	// The mirror can be snapshotted in turn, and is the same.
+	buf.Reset()
+
+	if _, err := other.WriteSnapshot(&buf, lp.Address().String()); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if again, err := VerifySnapshot(&buf); err != nil || again.Address != lp.Address().String() {
+		t.Errorf("Snapshot of mirror is %+v, %v", again, err)
+	}
+}
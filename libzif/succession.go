@@ -0,0 +1,396 @@
+// An address is derived from a key, so replacing the key means a new address.
+// To stop everyone following the old address losing track, the old key signs a
+// succession record naming the new key. The record is kept in the old entry,
+// which is published in the DHT, and resolving or mirroring the old address
+// follows it to the new one.
+
+package libzif
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/wjh/zif/libzif/data"
+	"github.com/wjh/zif/libzif/dht"
+	"golang.org/x/crypto/ed25519"
+)
+
+// The most successions followed when resolving an address. Stops a chain of
+// records, or a loop, making us do endless lookups.
+const MaxSuccessionDepth = 8
+
+type Succession struct {
+	Old    dht.Address `json:"old"`
+	New    dht.Address `json:"new"`
+	NewKey []byte      `json:"newKey"`
+	// Unix time the record was made.
+	Issued int64 `json:"issued"`
+	// Made with the old key.
+	Signature []byte `json:"signature"`
+}
+
+// The bytes the old key signs.
+func SuccessionBytes(old, new dht.Address, newKey []byte, issued int64) []byte {
+	buf := bytes.Buffer{}
+
+	buf.WriteString("succession")
+	buf.Write(old.Raw)
+	buf.Write(new.Raw)
+	buf.Write(newKey)
+	buf.WriteString(strconv.FormatInt(issued, 10))
+
+	return buf.Bytes()
+}
+
+// Check the record was signed by the given key, which must be the key of the
+// old address.
+func (s *Succession) Verify(oldKey []byte) error {
+	if len(oldKey) != ed25519.PublicKeySize || len(s.NewKey) != ed25519.PublicKeySize {
+		return errors.New("Succession public key invalid")
+	}
+
+	old := dht.NewAddress(oldKey)
+	new := dht.NewAddress(s.NewKey)
+
+	if !old.Equals(&s.Old) || !new.Equals(&s.New) {
+		return errors.New("Succession address does not match public key")
+	}
+
+	if old.Equals(&new) {
+		return errors.New("Succession does not change address")
+	}
+
+	if !ed25519.Verify(oldKey, SuccessionBytes(s.Old, s.New, s.NewKey, s.Issued), s.Signature) {
+		return errors.New("Failed to verify succession signature")
+	}
+
+	return nil
+}
+
+// Returns an error if the entry has a successor that it did not sign.
+func (e *Entry) CheckSuccessor() error {
+	if e.Successor == nil {
+		return nil
+	}
+
+	if !e.Successor.Old.Equals(&e.Address) {
+		return errors.New("Succession is for a different address")
+	}
+
+	return e.Successor.Verify(e.PublicKey)
+}
+
+// Replace our identity key with a newly generated one. The entry for the old
+// key is kept with a succession record, signed by the old key, and published
+// under the old address from then on. The new key replaces our identity file, and
+// the entry is saved under the new address.
+// This must be called before Setup, as the DHT is keyed on our address.
+func (lp *LocalPeer) RotateKey() error {
+	if len(lp.privateKey) == 0 {
+		return errors.New("LocalPeer does not have a private key, please generate")
+	}
+
+	err := lp.LoadEntry()
+
+	if err != nil {
+		return err
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		return err
+	}
+
+	// Our address is only generated in Setup, so it is taken from the key.
+	succession := &Succession{
+		Old:    dht.NewAddress(lp.PublicKey()),
+		New:    dht.NewAddress(publicKey),
+		NewKey: publicKey,
+		Issued: time.Now().Unix(),
+	}
+	succession.Signature = lp.Sign(SuccessionBytes(succession.Old, succession.New,
+		succession.NewKey, succession.Issued))
+
+	retired := *lp.copyEntry()
+	retired.Address = succession.Old
+	retired.Successor = succession
+
+	data, _ := retired.Bytes()
+	retired.Signature = lp.Sign(data)
+
+	err = lp.retire(&retired)
+
+	if err != nil {
+		return err
+	}
+
+	err = WriteIdentity(lp.identityPath(), privateKey, lp.Passphrase)
+
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"old": succession.Old.String(),
+		"new": succession.New.String(),
+	}).Info("Rotated identity key")
+
+	lp.privateKey = privateKey
+	lp.publicKey = publicKey
+	lp.Address().Generate(lp.PublicKey())
+
+	// The work and seeds were for the old key, they need to be redone.
+	lp.Entry.SetLocalPeer(lp)
+	lp.Entry.Work = 0
+	lp.seedMutex.Lock()
+	lp.Entry.Seeds = nil
+	lp.seedMutex.Unlock()
+	lp.Entry.Successor = nil
+	lp.SignEntry()
+
+	return lp.SaveEntry()
+}
+
+// Add an entry to the list of those we have retired.
+func (lp *LocalPeer) retire(entry *Entry) error {
+	entries, err := LoadRetired()
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	dat, err := json.Marshal(append(entries, entry))
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile("./data/retired.json", dat, 0644)
+}
+
+// Load the entries for all addresses we have rotated away from.
+func LoadRetired() ([]*Entry, error) {
+	entries := make([]*Entry, 0)
+
+	dat, err := ioutil.ReadFile("./data/retired.json")
+
+	if err != nil {
+		return entries, err
+	}
+
+	err = json.Unmarshal(dat, &entries)
+
+	return entries, err
+}
+
+// Put the entries for our old addresses into the DHT, so that the succession
+// records can be found.
+func (lp *LocalPeer) publishRetired() {
+	entries, err := LoadRetired()
+
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error(err.Error())
+		}
+
+		return
+	}
+
+	for _, i := range entries {
+		dat, err := i.Json()
+
+		if err != nil {
+			log.Error(err.Error())
+			continue
+		}
+
+		err = lp.DHT.Insert(&dht.KeyValue{Key: i.Address, Value: dat})
+
+		if err != nil {
+			log.WithField("address", i.Address.String()).Error("Failed to publish retired entry: ", err.Error())
+		}
+	}
+}
+
+// Announce the entries for our old addresses to the peers closest to them, as
+// they are who anyone resolving an old address will ask.
+func (lp *LocalPeer) announceRetired() {
+	entries, err := LoadRetired()
+
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error(err.Error())
+		}
+
+		return
+	}
+
+	for _, i := range entries {
+		closest, err := lp.DHT.FindClosest(i.Address)
+
+		if err != nil {
+			log.Error(err.Error())
+			continue
+		}
+
+		for _, j := range closest {
+			if j.Key.Equals(&i.Address) || j.Key.Equals(lp.Address()) {
+				continue
+			}
+
+			if err := lp.announceTo(j.Key.String(), i); err != nil {
+				log.WithFields(log.Fields{
+					"address": i.Address.String(),
+					"peer":    j.Key.String(),
+				}).Info("Failed to announce retired entry: ", err.Error())
+			}
+		}
+	}
+}
+
+func (lp *LocalPeer) announceTo(addr string, entry *Entry) error {
+	peer := lp.GetPeer(addr)
+
+	if peer == nil {
+		var err error
+		peer, err = lp.ConnectPeer(addr)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	stream, err := peer.OpenStream()
+
+	if err != nil {
+		return err
+	}
+
+	defer stream.Close()
+
+	return stream.Announce(entry)
+}
+
+// Checks that old has handed over to new, through a chain of signed
+// succession records no longer than MaxSuccessionDepth.
+func (lp *LocalPeer) checkSuccession(old, new string) error {
+	addr := old
+
+	for i := 0; i < MaxSuccessionDepth; i++ {
+		entry, err := lp.resolveAddress(addr)
+
+		if err != nil {
+			return err
+		}
+
+		if entry.Address.String() != addr {
+			return errors.New("Resolved the wrong entry for " + addr)
+		}
+
+		if entry.Successor == nil {
+			return errors.New(addr + " has no successor")
+		}
+
+		if err := entry.CheckSuccessor(); err != nil {
+			return err
+		}
+
+		addr = entry.Successor.New.String()
+
+		if addr == new {
+			return nil
+		}
+	}
+
+	return errors.New("No succession from " + old + " to " + new)
+}
+
+// Move anything we hold for a peer that has rotated its key over to its new
+// address. Nothing is moved unless the old address signed over to the new one,
+// whoever now answers at the old host.
+func (lp *LocalPeer) followSuccession(old, new string) error {
+	if old == new {
+		return nil
+	}
+
+	if err := lp.checkSuccession(old, new); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"old": old,
+		"new": new,
+	}).Info("Following succession")
+
+	if err := lp.moveMirror(old, new); err != nil {
+		return err
+	}
+
+	if db, ok := lp.Databases.Get(old); ok {
+		lp.Databases.Remove(old)
+
+		if !lp.Databases.Has(new) {
+			lp.Databases.Set(new, db)
+		}
+	}
+
+	if col, ok := lp.Collections.Get(old); ok {
+		lp.Collections.Remove(old)
+
+		if !lp.Collections.Has(new) {
+			lp.Collections.Set(new, col)
+		}
+	}
+
+	return nil
+}
+
+// Moves a mirror kept in ./data over to the new address, as that is where it is
+// loaded from on startup. The database is reopened from there.
+func (lp *LocalPeer) moveMirror(old, new string) error {
+	from := filepath.Join("./data", old)
+	to := filepath.Join("./data", new)
+
+	if _, err := os.Stat(from); os.IsNotExist(err) {
+		return nil
+	}
+
+	if _, err := os.Stat(to); err == nil {
+		return errors.New("Already have a mirror of " + new)
+	}
+
+	db, open := lp.Databases.Get(old)
+
+	if open {
+		if closer, ok := db.(*data.Database); ok {
+			closer.Close()
+		}
+	}
+
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+
+	if !open {
+		return nil
+	}
+
+	moved := data.NewDatabase(filepath.Join(to, "posts.db"))
+
+	if err := moved.Connect(); err != nil {
+		lp.Databases.Remove(old)
+		return err
+	}
+
+	lp.Databases.Set(old, moved)
+
+	return nil
+}
@@ -0,0 +1,226 @@
+package libzif
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/streamrail/concurrent-map"
+	"github.com/wjh/zif/libzif/data"
+	"github.com/wjh/zif/libzif/dht"
+	"golang.org/x/crypto/ed25519"
+)
+
+func newSuccession(t *testing.T) (*Succession, ed25519.PublicKey) {
+	oldPub, oldPriv, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	newPub, _, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	s := &Succession{
+		Old:    dht.NewAddress(oldPub),
+		New:    dht.NewAddress(newPub),
+		NewKey: newPub,
+		Issued: time.Now().Unix(),
+	}
+	s.Signature = ed25519.Sign(oldPriv, SuccessionBytes(s.Old, s.New, s.NewKey, s.Issued))
+
+	return s, oldPub
+}
+
+func TestSuccessionVerify(t *testing.T) {
+	s, oldKey := newSuccession(t)
+
+	if err := s.Verify(oldKey); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	s.Issued++
+
+	if s.Verify(oldKey) == nil {
+		t.Error("Tampered succession verified")
+	}
+
+	s.Issued--
+	other, _ := newSuccession(t)
+	s.New = other.New
+
+	if s.Verify(oldKey) == nil {
+		t.Error("Succession verified with mismatched new address")
+	}
+}
+
+func TestEntryCheckSuccessor(t *testing.T) {
+	s, oldKey := newSuccession(t)
+
+	entry := &Entry{Address: s.Old, PublicKey: oldKey}
+
+	if entry.CheckSuccessor() != nil {
+		t.Fatal("Entry without successor rejected")
+	}
+
+	entry.Successor = s
+
+	if err := entry.CheckSuccessor(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Someone else's succession record must not be accepted.
+	_, otherKey := newSuccession(t)
+	entry = &Entry{Address: dht.NewAddress(otherKey), PublicKey: otherKey, Successor: s}
+
+	if entry.CheckSuccessor() == nil {
+		t.Error("Succession for a different address accepted")
+	}
+}
+
+func TestFollowSuccession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zif-succession")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mirrors are kept under ./data.
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	lp, done := federatedPeer(t)
+	defer done()
+
+	lp.Address().Generate(lp.PublicKey())
+	lp.DHT = dht.NewDHT(*lp.Address(), dir)
+	lp.Collections = cmap.New()
+
+	s, oldKey := newSuccession(t)
+	oldAddr, newAddr := s.Old.String(), s.New.String()
+
+	os.MkdirAll(filepath.Join("data", oldAddr), 0777)
+	mirror := data.NewDatabase(filepath.Join("data", oldAddr, "posts.db"))
+
+	if err := mirror.Connect(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	insertFederated(t, mirror, data.Post{InfoHash: fmt.Sprintf("a%039x", 1), Title: "Mirrored"})
+	lp.Databases.Set(oldAddr, mirror)
+
+	// Without a record, whoever answers at the old host is not followed.
+	entry := &Entry{Address: s.Old, PublicKey: oldKey}
+	dat, _ := entry.Json()
+	lp.DHT.Insert(dht.NewKeyValue(s.Old, dat))
+
+	if lp.followSuccession(oldAddr, newAddr) == nil || !lp.Databases.Has(oldAddr) {
+		t.Fatal("Followed a peer without a succession record")
+	}
+
+	// Nor is anyone but the successor it names, which has not moved on.
+	entry.Successor = s
+	dat, _ = entry.Json()
+	lp.DHT.Insert(dht.NewKeyValue(s.Old, dat))
+
+	successor := &Entry{Address: s.New, PublicKey: s.NewKey}
+	dat, _ = successor.Json()
+	lp.DHT.Insert(dht.NewKeyValue(s.New, dat))
+	other, _ := newSuccession(t)
+
+	if lp.followSuccession(oldAddr, other.New.String()) == nil || !lp.Databases.Has(oldAddr) {
+		t.Fatal("Followed a peer the succession record does not name")
+	}
+
+	if err := lp.followSuccession(oldAddr, newAddr); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if lp.Databases.Has(oldAddr) || !lp.Databases.Has(newAddr) {
+		t.Error("Mirror not moved to the new address")
+	}
+
+	// And moved on disk, so that it is loaded there on restart.
+	if _, err := os.Stat(filepath.Join("data", newAddr, "posts.db")); err != nil {
+		t.Error("Mirror not moved on disk: ", err.Error())
+	}
+
+	if _, err := os.Stat(filepath.Join("data", oldAddr)); !os.IsNotExist(err) {
+		t.Error("Mirror left under the old address")
+	}
+
+	if moved, _ := lp.Databases.Get(newAddr); moved.(data.PostStore).PostCount() != 1 {
+		t.Error("Moved mirror not reopened")
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zif-rotate")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+	os.Mkdir("data", 0777)
+
+	// As zifd does it, before Setup.
+	lp := &LocalPeer{IdentityPath: filepath.Join(dir, "identity.pem")}
+	lp.GenerateKey()
+	oldKey := lp.PublicKey()
+	oldAddr := dht.NewAddress(oldKey)
+
+	lp.Entry = &Entry{Name: "Rotating", Signature: make([]byte, ed25519.SignatureSize)}
+	lp.Address().Generate(oldKey)
+	lp.Entry.SetLocalPeer(lp)
+	lp.SignEntry()
+
+	if err := lp.SaveEntry(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	*lp.Address() = dht.Address{}
+
+	if err := lp.RotateKey(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	retired, err := LoadRetired()
+
+	if err != nil || len(retired) != 1 {
+		t.Fatalf("Retired entries are %v, %v", retired, err)
+	}
+
+	old := retired[0]
+
+	if !old.Address.Equals(&oldAddr) || old.Successor == nil {
+		t.Fatalf("Retired entry is %+v", old)
+	}
+
+	if err := old.CheckSuccessor(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !old.Successor.New.Equals(lp.Address()) || !old.Successor.New.Equals(&lp.Entry.Address) {
+		t.Errorf("Succession names %s, we are at %s", old.Successor.New.String(), lp.Address().String())
+	}
+
+	signed, _ := old.Bytes()
+
+	if !ed25519.Verify(oldKey, signed, old.Signature) {
+		t.Error("Retired entry not signed by the old key")
+	}
+}
@@ -5,6 +5,8 @@ import "time"
 type Limiter struct {
 	Throttle chan time.Time
 	Ticker   *time.Ticker
+
+	done chan struct{}
 }
 
 // Return a new rate limiter. This is used to make sure that something like a
@@ -16,6 +18,7 @@ type Limiter struct {
 func NewLimiter(rate time.Duration, burst int, fill bool) *Limiter {
 	tick := time.NewTicker(rate)
 	throttle := make(chan time.Time, burst)
+	done := make(chan struct{})
 
 	if fill {
 		for i := 0; i < burst; i++ {
@@ -23,16 +26,24 @@ func NewLimiter(rate time.Duration, burst int, fill bool) *Limiter {
 		}
 	}
 
+	// This is the only sender on throttle, so it is also the one to close it.
 	go func() {
-		for t := range tick.C {
+		defer close(throttle)
+
+		for {
 			select {
-			case throttle <- t:
-			default:
+			case t := <-tick.C:
+				select {
+				case throttle <- t:
+				default:
+				}
+			case <-done:
+				return
 			}
 		}
 	}()
 
-	return &Limiter{throttle, tick}
+	return &Limiter{throttle, tick, done}
 }
 
 // Block until the given time has elapsed. Or just use a token from the bucket.
@@ -40,22 +51,53 @@ func (l *Limiter) Wait() {
 	_, _ = <-l.Throttle
 }
 
+// Use a token from the bucket if there is one, without blocking. Returns false
+// if the bucket is empty.
+func (l *Limiter) Try() bool {
+	select {
+	case <-l.Throttle:
+		return true
+	default:
+		return false
+	}
+}
+
 // Finish running.
 func (l *Limiter) Stop() {
 	l.Ticker.Stop()
-	close(l.Throttle)
+	close(l.done)
 }
 
-// Limits requests from peers
+// Limits requests from peers, with a separate bucket for each kind of request.
+// Kinds are just ints, for instance a message header.
 type PeerLimiter struct {
-	queryLimiter    *Limiter
-	announceLimiter *Limiter
+	limiters map[int]*Limiter
 }
 
 func (pl *PeerLimiter) Setup() {
-	// Allow an announce every 10 minutes, bursting to allow three.
-	// The burst is there as people may make "mistakes" with titles or descriptions
-	pl.announceLimiter = NewLimiter(time.Minute*10, 3, true)
+	pl.limiters = make(map[int]*Limiter)
+}
+
+// Limit a kind of request to one every rate, bursting to burst. This should only
+// be called while setting up, before Allow is used.
+func (pl *PeerLimiter) Add(kind int, rate time.Duration, burst int) {
+	pl.limiters[kind] = NewLimiter(rate, burst, true)
+}
+
+// Returns true if a request of the given kind is allowed right now, using up a
+// token if so. Kinds that have not been added are not limited.
+func (pl *PeerLimiter) Allow(kind int) bool {
+	limiter, ok := pl.limiters[kind]
+
+	if !ok {
+		return true
+	}
 
-	pl.queryLimiter = NewLimiter(time.Second/3, 3, true)
+	return limiter.Try()
+}
+
+func (pl *PeerLimiter) Stop() {
+	for _, i := range pl.limiters {
+		i.Stop()
+	}
 }
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
 	"os"
+	"os/exec"
 	"os/signal"
 	"strconv"
 
@@ -11,27 +14,252 @@ import (
 
 	zif "github.com/wjh/zif/libzif"
 	data "github.com/wjh/zif/libzif/data"
+	"github.com/wjh/zif/libzif/dht"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func SetupLocalPeer(addr string, newAddr bool) *zif.LocalPeer {
+// The passphrase for the identity file is taken from this environment variable
+// if it is set, otherwise it is asked for.
+const PassphraseEnv = "ZIF_PASSPHRASE"
+
+func SetupLocalPeer(addr, identity string, newAddr, rotate bool) *zif.LocalPeer {
 	var lp zif.LocalPeer
 
+	lp.IdentityPath = identity
+	lp.Passphrase = readPassphrase()
+
 	if !newAddr {
-		if lp.ReadKey() != nil {
+		err := lp.ReadKey()
+
+		if os.IsNotExist(err) {
 			lp.GenerateKey()
 			lp.WriteKey()
+		} else if err != nil {
+			log.Fatal(err.Error())
+		} else if info, err := zif.StatIdentity(identity); err == nil &&
+			!info.Encrypted && lp.Passphrase != "" {
+			log.Info("Encrypting identity")
+			lp.WriteKey()
 		}
 	} else {
 		lp.GenerateKey()
 	}
 
+	if rotate {
+		err := lp.RotateKey()
+
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+
 	lp.Setup()
 
 	return &lp
 }
 
+func readPassphrase() string {
+	if passphrase, ok := os.LookupEnv(PassphraseEnv); ok {
+		return passphrase
+	}
+
+	// Only ask if there is someone there to answer.
+	stat, err := os.Stdin.Stat()
+
+	if err != nil || stat.Mode()&os.ModeCharDevice == 0 {
+		return ""
+	}
+
+	fmt.Print("Identity passphrase (empty for none): ")
+
+	// Best effort at hiding the passphrase as it is typed.
+	stty := func(arg string) {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = os.Stdin
+		cmd.Run()
+	}
+
+	stty("-echo")
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	stty("echo")
+	fmt.Println()
+
+	return strings.TrimRight(line, "\r\n")
+}
+
+// Imports a dump of posts into our database, see LocalPeer.ImportPosts. The
+// collection and entry are rewritten, so zifd should not be running at the
+// same time.
+func importCommand(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+
+	var db_path = flags.String("database", "./data/posts.db", "Posts database path")
+	var identity = flags.String("identity", zif.DefaultIdentityPath, "Identity file path, encrypted with the passphrase from $"+PassphraseEnv)
+	var format = flags.String("format", "", "Dump format, jsonl or csv, guessed from the file name if not given")
+	var columns = flags.String("columns", "", "Post fields to the dump columns holding them, as in title=name,infohash=hash")
+
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: zifd import [flags] dump")
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	path := flags.Arg(0)
+	opts := data.ImportOptions{Format: *format}
+
+	if opts.Format == "" {
+		opts.Format = zif.DumpFormat(path)
+	}
+
+	var err error
+	opts.Columns, err = data.ParseImportColumns(*columns)
+
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	defer file.Close()
+
+	lp := SetupLocalPeer("", *identity, false, false)
+
+	// Posts are signed by us, and the entry re-signed, so it must be ours.
+	if err := lp.LoadEntry(); err != nil {
+		log.Fatal("Could not load our entry, run zifd once first: ", err.Error())
+	}
+
+	if !bytes.Equal(lp.Entry.PublicKey, lp.PublicKey()) {
+		log.Fatal("Entry does not belong to this identity")
+	}
+
+	db := data.NewDatabase(*db_path)
+
+	if err := db.Connect(); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	lp.Database = db
+	defer db.Close()
+
+	updates := make(chan data.ImportProgress)
+
+	go func() {
+		for i := range updates {
+			log.WithFields(log.Fields{
+				"read":     i.Read,
+				"imported": i.Imported,
+				"skipped":  i.Skipped,
+			}).Info("Importing")
+		}
+	}()
+
+	progress, err := lp.ImportPosts(file, opts, updates)
+
+	if progress != nil {
+		for _, i := range progress.Errors {
+			log.Warn(i)
+		}
+	}
+
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+}
+
+// Exports a database to JSON lines or CSV, see data.ExportPosts. Mirrors can
+// be exported by giving the path of their database.
+func exportCommand(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+
+	var db_path = flags.String("database", "./data/posts.db", "Posts database path")
+	var format = flags.String("format", "", "Export format, jsonl or csv, guessed from the output file name if not given")
+	var query = flags.String("query", "", "Only export posts matching this search query")
+	var out = flags.String("out", "", "Output file, standard output if not given")
+
+	flags.Parse(args)
+
+	opts := data.ExportOptions{Format: *format, Query: *query}
+
+	if opts.Format == "" {
+		opts.Format = zif.DumpFormat(*out)
+	}
+
+	db := data.NewDatabase(*db_path)
+
+	if err := db.Connect(); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	defer db.Close()
+
+	w := os.Stdout
+
+	if *out != "" {
+		file, err := os.Create(*out)
+
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		defer file.Close()
+		w = file
+	}
+
+	bw := bufio.NewWriter(w)
+	count, err := data.ExportPosts(db, bw, opts)
+
+	if err == nil {
+		err = bw.Flush()
+	}
+
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	log.WithField("posts", count).Info("Exported posts")
+}
+
+// Checks a snapshot, without needing a network or a node.
+func verifyCommand(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: zifd verify snapshot")
+		os.Exit(2)
+	}
+
+	file, err := os.Open(args[0])
+
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	defer file.Close()
+
+	info, err := zif.VerifySnapshot(file)
+
+	if err != nil {
+		log.Fatal("Snapshot is not valid: ", err.Error())
+	}
+
+	log.WithFields(log.Fields{
+		"address":    info.Address,
+		"name":       info.Name,
+		"posts":      info.Posts,
+		"tombstones": info.Tombstones,
+	}).Info("Snapshot is valid")
+}
+
 func main() {
 
 	log.SetLevel(log.DebugLevel)
@@ -42,12 +270,33 @@ func main() {
 
 	os.Mkdir("./data", 0777)
 
-	var addr = flag.String("address", "0.0.0.0:5050", "Bind address")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import":
+			importCommand(os.Args[2:])
+			return
+		case "export":
+			exportCommand(os.Args[2:])
+			return
+		case "verify":
+			verifyCommand(os.Args[2:])
+			return
+		}
+	}
+
+	var addr = flag.String("address", fmt.Sprintf("0.0.0.0:%d", zif.DefaultPort), "Bind address")
 	var db_path = flag.String("database", "./data/posts.db", "Posts database path")
+	var memory = flag.Bool("memory", false, "Keep our posts in memory instead of the database, for nodes that need not keep them between runs")
+	var identity = flag.String("identity", zif.DefaultIdentityPath, "Identity file path, encrypted with the passphrase from $"+PassphraseEnv)
 	var newAddr = flag.Bool("new", false, "Ignore identity file and create a new address")
+	var rotate = flag.Bool("rotate", false, "Replace the identity key, signing a succession record so that followers move to the new address")
 	var tor = flag.Bool("tor", false, "Start hidden service and proxy connections through tor")
 	var torport = flag.Int("torport", 9051, "The port we should connect to the tor deamon")
 	var torpath = flag.String("torpath", "./tor/", "Path to the tor folder")
+	var work = flag.Int("work", dht.DefaultWorkDifficulty, "Proof of work difficulty to generate for our entry")
+	var bootstrap = flag.String("bootstrap", "./data/bootstrap.json", "Bootstrap node list, tried on startup and when the routing table is empty")
+	var discover = flag.Bool("discover", false, "Find peers on the local network using multicast beacons")
+	var minWork = flag.Int("minwork", dht.DefaultWorkDifficulty, "Proof of work difficulty required of other entries, 0 to disable")
 
 	var http = flag.String("http", "127.0.0.1:8080", "HTTP address and port")
 
@@ -55,7 +304,7 @@ func main() {
 
 	port, _ := strconv.Atoi(strings.Split(*addr, ":")[1])
 
-	lp := SetupLocalPeer(fmt.Sprintf("%s:%v", *addr), *newAddr)
+	lp := SetupLocalPeer(fmt.Sprintf("%s:%v", *addr), *identity, *newAddr, *rotate)
 
 	if *tor {
 		_, onion, err := zif.SetupZifTorService(5050, *torport, fmt.Sprintf("%s/cookie", *torpath))
@@ -73,6 +322,8 @@ func main() {
 	lp.SignEntry()
 
 	lp.LoadEntry()
+	lp.GenerateWork(*work)
+	lp.MinWork = *minWork
 
 	err := lp.SaveEntry()
 
@@ -84,15 +335,43 @@ func main() {
 	post.InfoHash = "foo"
 	post.Title = "Foo"
 
-	lp.Database = data.NewDatabase(*db_path)
+	if *memory {
+		lp.Database = data.NewMemoryStore()
+	} else {
+		db := data.NewDatabase(*db_path)
 
-	err = lp.Database.Connect()
+		if err := db.Connect(); err != nil {
+			log.Fatal(err.Error())
+		}
 
-	if err != nil {
-		log.Fatal(err.Error())
+		lp.Database = db
+	}
+
+	if err := lp.CheckCollection(); err != nil {
+		log.Error("Failed to check collection: ", err.Error())
 	}
 
 	lp.Listen(*addr)
+	go lp.MaintainSeeds()
+
+	lp.BootstrapList, err = zif.LoadBootstrapList(*bootstrap)
+
+	if err != nil && !os.IsNotExist(err) {
+		log.Error(err.Error())
+	}
+
+	go lp.MaintainBootstrap()
+
+	// Beacons would give away the address of a hidden service.
+	if *discover && !*tor {
+		go func() {
+			err := lp.Discover(zif.DiscoveryGroup)
+
+			if err != nil {
+				log.Error("Local discovery failed: ", err.Error())
+			}
+		}()
+	}
 
 	log.Info("My name: ", lp.Entry.Name)
 	log.Info("My address: ", lp.Address().String())